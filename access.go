@@ -0,0 +1,33 @@
+package mongo
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// lastAccessField is the field holding the last access time of items when the
+// handler is configured with TrackAccess.
+const lastAccessField = "_lastAccess"
+
+// touch sets the last access time of the items of c with the given ids to the
+// current time. The etag of the items is left untouched so that concurrent
+// updates are not affected, and errors are ignored as the access is recorded
+// on a best effort basis. Like in MultiGet, the ids are sent in $in queries of
+// at most InBatchSize ids.
+func (m OptionsHandler) touch(c *mgo.Collection, ids []interface{}) {
+	now := time.Now().Truncate(time.Millisecond)
+	ids = m.mongoIDs(ids)
+	size := m.inBatchSize()
+	if size == 0 {
+		size = len(ids)
+	}
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		c.UpdateAll(bson.M{"_id": bson.M{"$in": ids[start:end]}}, bson.M{"$set": bson.M{lastAccessField: now}})
+	}
+}
@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"context"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Aggregate runs the aggregation pipeline on the collection managed by m and
+// returns the resulting documents as is, e.g. to compute counts or sums per
+// category for reporting. Unlike Find, stored field names are used and
+// options like DateFields or FlattenSeparator are not applied.
+//
+// The context deadline, if any, bounds the execution time on the server, and
+// the ReadConcern option applies. It fails with ErrEventualMode if the session
+// is in mgo.Eventual mode.
+func (m OptionsHandler) Aggregate(ctx context.Context, pipeline []bson.M) (_ []map[string]interface{}, err error) {
+	defer func() { err = classifyError(err) }()
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	if c.Database.Session.Mode() == mgo.Eventual {
+		return nil, ErrEventualMode
+	}
+
+	// mgo.Pipe can't set maxTimeMS, so the aggregate command is run directly
+	cmd := bson.D{
+		{Name: "aggregate", Value: c.Name},
+		{Name: "pipeline", Value: pipeline},
+		{Name: "cursor", Value: bson.M{}},
+	}
+	if ms, ok := maxTimeMS(ctx); ok {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: ms})
+	}
+	var res cursorResult
+	if err := c.Database.Run(m.withReadConcern(cmd), &res); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	iter := c.NewIter(nil, res.Cursor.FirstBatch, res.Cursor.ID, nil)
+	docs := []map[string]interface{}{}
+	for {
+		doc := map[string]interface{}{}
+		if !iter.Next(&doc) {
+			break
+		}
+		if err = m.err(ctx); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err := iter.Close(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return docs, nil
+}
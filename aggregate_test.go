@@ -0,0 +1,51 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAggregate(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a", "price": 10}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "b", "price": 5}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "a", "price": 7}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "category": "c", "price": 1}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	docs, err := h.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"price": bson.M{"$gt": 1}}},
+		{"$group": bson.M{"_id": "$category", "count": bson.M{"$sum": 1}, "total": bson.M{"$sum": "$price"}}},
+		{"$sort": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{
+		{"_id": "a", "count": 2, "total": 17},
+		{"_id": "b", "count": 1, "total": 5},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got: %v want: %v", docs, want)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.Aggregate(ctx, []bson.M{{"$match": bson.M{}}}); err != context.Canceled {
+		t.Errorf("got: %v want: %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,90 @@
+package mongo
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type allowedIDsKey struct{}
+
+// WithAllowedIDs returns a copy of ctx restricting the items seen by the Find,
+// FindWithProjection, FindInto, Count and MultiGet operations of handlers to
+// those whose id is listed in ids, e.g. the items a user has access to.
+// MultiGet handles the ids which are not allowed like missing ones. The
+// restriction is
+// combined with the query filter as an $in clause on _id, intersected with the
+// $in clause of the filter on the id if any, which Find, Count and Distinct
+// split into batches of at most Options.InBatchSize ids. Other operations send
+// the whole set in a single query, which must fit in a query document (16MB).
+// Results restricted this way are not cached.
+func WithAllowedIDs(ctx context.Context, ids []interface{}) context.Context {
+	return context.WithValue(ctx, allowedIDsKey{}, ids)
+}
+
+func allowedIDsFromContext(ctx context.Context) ([]interface{}, bool) {
+	ids, ok := ctx.Value(allowedIDsKey{}).([]interface{})
+	return ids, ok
+}
+
+// restrictQuery restricts the query document qry to the stored _id of the ids
+// allowed by ctx, if any, and reports whether it did.
+func (m OptionsHandler) restrictQuery(ctx context.Context, qry bson.M) (bson.M, bool) {
+	ids, ok := allowedIDsFromContext(ctx)
+	if !ok {
+		return qry, false
+	}
+	if ids == nil {
+		// Nothing is allowed.
+		ids = []interface{}{}
+	}
+	r := make(bson.M, len(qry)+1)
+	for k, v := range qry {
+		r[k] = v
+	}
+	ops, _ := r["_id"].(bson.M)
+	if in, ok := ops["$in"].([]interface{}); ok {
+		// Keep a single $in condition on _id, so that it can be split into
+		// batches.
+		rops := make(bson.M, len(ops))
+		for op, v := range ops {
+			rops[op] = v
+		}
+		rops["$in"] = intersectIDs(in, m.mongoIDs(ids))
+		r["_id"] = rops
+		return r, true
+	}
+	mergeCondition(r, "_id", bson.M{"$in": m.mongoIDs(ids)})
+	return r, true
+}
+
+// allowedIDSet returns the set of the ids allowed by ctx, keyed by idKey, and
+// whether ctx restricts the ids at all.
+func allowedIDSet(ctx context.Context) (map[interface{}]bool, bool) {
+	ids, ok := allowedIDsFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	return idSet(ids), true
+}
+
+// idSet returns the set of ids, keyed by idKey.
+func idSet(ids []interface{}) map[interface{}]bool {
+	set := make(map[interface{}]bool, len(ids))
+	for _, id := range ids {
+		set[idKey(id)] = true
+	}
+	return set
+}
+
+// intersectIDs returns the stored ids of a also listed in b, in order.
+func intersectIDs(a, b []interface{}) []interface{} {
+	inB := idSet(b)
+	r := []interface{}{}
+	for _, id := range a {
+		if inB[idKey(id)] {
+			r = append(r, id)
+		}
+	}
+	return r
+}
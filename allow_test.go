@@ -0,0 +1,59 @@
+package mongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRestrictQuery(t *testing.T) {
+	m := OptionsHandler{}
+	qry := bson.M{"f": "a", "_id": bson.M{"$gt": "1"}}
+	if got, restricted := m.restrictQuery(context.Background(), qry); restricted || !reflect.DeepEqual(got, qry) {
+		t.Errorf("got: %v, %v want the query as is", got, restricted)
+	}
+
+	ctx := WithAllowedIDs(context.Background(), []interface{}{"1", "2"})
+	got, restricted := m.restrictQuery(ctx, qry)
+	expect := bson.M{"f": "a", "_id": bson.M{"$gt": "1", "$in": []interface{}{"1", "2"}}}
+	if !restricted || !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+	if _, found := qry["_id"].(bson.M)["$in"]; found {
+		t.Error("restrictQuery modified the original query")
+	}
+
+	got, _ = m.restrictQuery(WithAllowedIDs(context.Background(), nil), bson.M{})
+	if expect := (bson.M{"_id": bson.M{"$in": []interface{}{}}}); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+
+	// The allowed ids are intersected with those of the filter, so that the
+	// $in condition can be split.
+	m = OptionsHandler{opts: Options{InBatchSize: 2}}
+	ctx = WithAllowedIDs(context.Background(), []interface{}{"1", "2", "3", "4", "5"})
+	got, _ = m.restrictQuery(ctx, bson.M{"_id": bson.M{"$in": []interface{}{"5", "9", "1", "2"}}})
+	if expect := (bson.M{"_id": bson.M{"$in": []interface{}{"5", "1", "2"}}}); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+	batches := splitIn(got, m.inBatchSize())
+	expectBatches := []bson.M{
+		{"_id": bson.M{"$in": []interface{}{"5", "1"}}},
+		{"_id": bson.M{"$in": []interface{}{"2"}}},
+	}
+	if !reflect.DeepEqual(batches, expectBatches) {
+		t.Errorf("got batches: %v want: %v", batches, expectBatches)
+	}
+	got, _ = OptionsHandler{}.restrictQuery(WithAllowedIDs(context.Background(), []interface{}{int64(1), 2.5}), bson.M{"_id": bson.M{"$in": []interface{}{1.0, 2, 2.5}}})
+	if expect := (bson.M{"_id": bson.M{"$in": []interface{}{1.0, 2.5}}}); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+
+	m = OptionsHandler{opts: Options{IDCodec: decimalCodec{}}}
+	got, _ = m.restrictQuery(WithAllowedIDs(context.Background(), []interface{}{"1", "2"}), bson.M{})
+	if expect := (bson.M{"_id": bson.M{"$in": []interface{}{int64(1), int64(2)}}}); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
@@ -0,0 +1,85 @@
+package mongo
+
+import (
+	"errors"
+
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrCollScan is returned by Find when the handler is configured with
+// FailOnCollScan and the query is answered by a collection scan.
+var ErrCollScan = errors.New("mongo: query requires a collection scan")
+
+// auditScan explains the find pipeline of q and reports whether its winning
+// plan scans the whole collection, calling the OnCollScan option if so.
+// Queries without filter are not audited as they read all items anyway.
+func (m OptionsHandler) auditScan(c *mgo.Collection, q *query.Query, pipeline []bson.M) error {
+	if match, _ := pipeline[0]["$match"].(bson.M); len(match) == 0 {
+		return nil
+	}
+	var res bson.M
+	err := c.Database.Run(bson.D{
+		{Name: "explain", Value: bson.D{
+			{Name: "aggregate", Value: c.Name},
+			{Name: "pipeline", Value: pipeline},
+			{Name: "cursor", Value: bson.M{}},
+		}},
+		{Name: "verbosity", Value: "queryPlanner"},
+	}, &res)
+	if err != nil {
+		return err
+	}
+	if !hasCollScan(res, false) {
+		return nil
+	}
+	if m.opts.OnCollScan != nil {
+		m.opts.OnCollScan(q)
+	}
+	if m.opts.FailOnCollScan {
+		return ErrCollScan
+	}
+	return nil
+}
+
+// hasCollScan reports whether the explain output v holds a stage of a winning
+// plan scanning the whole collection: a COLLSCAN, or an IXSCAN without bounds
+// as chosen to sort on an index when no index covers the filter. The location
+// of plans depends on the MongoDB version, so v is searched recursively.
+func hasCollScan(v interface{}, winning bool) bool {
+	switch t := v.(type) {
+	case bson.M:
+		if winning && (t["stage"] == "COLLSCAN" || t["stage"] == "IXSCAN" && unbounded(t["indexBounds"])) {
+			return true
+		}
+		for k, sv := range t {
+			if hasCollScan(sv, winning || k == "winningPlan") {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, sv := range t {
+			if hasCollScan(sv, winning) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unbounded reports whether the indexBounds of an IXSCAN stage cover all the
+// keys of the index.
+func unbounded(v interface{}) bool {
+	bounds, ok := v.(bson.M)
+	if !ok || len(bounds) == 0 {
+		return false
+	}
+	for _, b := range bounds {
+		l, _ := b.([]interface{})
+		if len(l) != 1 || (l[0] != "[MinKey, MaxKey]" && l[0] != "[MaxKey, MinKey]") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package mongo
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestHasCollScan(t *testing.T) {
+	stage := func(name string, bounds bson.M) bson.M {
+		s := bson.M{"stage": name}
+		if bounds != nil {
+			s["indexBounds"] = bounds
+		}
+		return s
+	}
+	fetch := func(input bson.M) bson.M {
+		return bson.M{"stage": "FETCH", "inputStage": input}
+	}
+	cases := []struct {
+		name string
+		res  bson.M
+		want bool
+	}{
+		{"collection scan", bson.M{"queryPlanner": bson.M{
+			"winningPlan": stage("COLLSCAN", nil),
+		}}, true},
+		{"bounded index scan", bson.M{"queryPlanner": bson.M{
+			"winningPlan":   fetch(stage("IXSCAN", bson.M{"name": []interface{}{`["a", "a"]`}})),
+			"rejectedPlans": []interface{}{stage("COLLSCAN", nil)},
+		}}, false},
+		{"unbounded index scan", bson.M{"queryPlanner": bson.M{
+			"winningPlan": fetch(stage("IXSCAN", bson.M{"_id": []interface{}{"[MaxKey, MinKey]"}})),
+		}}, true},
+		{"aggregation cursor", bson.M{"stages": []interface{}{
+			bson.M{"$cursor": bson.M{"queryPlanner": bson.M{
+				"winningPlan": bson.M{"queryPlan": stage("COLLSCAN", nil)},
+			}}},
+		}}, true},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hasCollScan(tc.res, false); got != tc.want {
+				t.Errorf("hasCollScan: got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+}
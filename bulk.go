@@ -0,0 +1,319 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BulkError is returned when some of the operations of a bulk call failed.
+// The operations not listed in Errors have been performed.
+type BulkError struct {
+	Errors []BulkOpError
+}
+
+// BulkOpError describes a failed operation of a bulk call.
+type BulkOpError struct {
+	// Op is the kind of operation, either "insert", "update" or "delete".
+	Op string
+	// Index is the position of the item in the list given for Op.
+	Index int
+	// ID is the id of the item.
+	ID interface{}
+	// Err is the cause of the failure, resource.ErrConflict for a duplicate
+	// key.
+	Err error
+}
+
+func (e *BulkError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, oe := range e.Errors {
+		msgs[i] = fmt.Sprintf("%s #%d (%v): %v", oe.Op, oe.Index, oe.ID, oe.Err)
+	}
+	return fmt.Sprintf("bulk: %d operation(s) failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// BulkApply applies a changeset using the bulk API: inserts are created,
+// updates are created or replace the item with the same id, and deletes are
+// removed. Like deletes, updates hold the etag of the stored item they apply
+// to, and only replace it if its etag still matches. The replacing items are
+// stored with a new etag, computed from their payload like rest-layer does,
+// which is set back into the updated items. Updates without etag replace the
+// stored item unconditionally, or create it. Updates must have an id, or
+// ErrEmptyID is returned before anything is sent. Each kind of operation is
+// sent in a single round trip, and a failed operation does not prevent the
+// others from being applied. Inserts are prepared like by Insert: items without an id get a new
+// ObjectId, set back into their ID and payload once inserted, and
+// ServerTimestamps applies to inserts and updates.
+//
+// The returned count is the number of items inserted, created or replaced by
+// an update, or deleted. A delete whose etag does not match is not applied
+// and not counted, but is not reported as an error either, while an update
+// whose etag does not match fails with resource.ErrConflict, or
+// resource.ErrNotFound if the item does not exist anymore. As the bulk API
+// does not tell which updates matched, this takes another round trip when
+// some of the updates hold an etag. Failed
+// operations are reported by a *BulkError. A failure which is not specific to
+// operations, e.g. a network failure, stops the call before the next kind of
+// operation is sent, and is returned like by the other operations of the
+// handler, matching ErrTemporary or ErrUnavailable.
+func (m OptionsHandler) BulkApply(ctx context.Context, inserts, updates, deletes []*resource.Item) (applied int, err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("bulk", time.Now(), &err)
+	}
+	defer func() { err = classifyError(err) }()
+	mInserts, _, generated, err := m.insertDocs(inserts)
+	if err != nil {
+		return 0, err
+	}
+	mUpdates := make([]interface{}, 0, 2*len(updates))
+	etags := make([]string, len(updates))
+	for i, item := range updates {
+		if emptyID(item.ID) {
+			return 0, fmt.Errorf("update #%d: %w", i, ErrEmptyID)
+		}
+		mItem, err := m.newMongoItem(item)
+		if err != nil {
+			return 0, err
+		}
+		updated, err := resource.NewItem(item.Payload)
+		if err != nil {
+			return 0, fmt.Errorf("update #%d: %v", i, err)
+		}
+		etags[i], mItem.ETag = updated.ETag, updated.ETag
+		s := bson.M{"_id": mItem.ID}
+		if item.ETag != "" {
+			m.etagCondition(s, item.ETag)
+		}
+		mUpdates = append(mUpdates, s, mItem)
+	}
+	mDeletes := make([]interface{}, len(deletes))
+	for i, item := range deletes {
+		s := bson.M{"_id": m.mongoID(item.ID)}
+		m.etagCondition(s, item.ETag)
+		mDeletes[i] = s
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, nil)
+
+	bulkErr := &BulkError{}
+	run := func(op string, items []*resource.Item, queue func(b *mgo.Bulk)) (map[int]bool, error) {
+		if len(items) == 0 {
+			return nil, nil
+		}
+		b := c.Bulk()
+		b.Unordered()
+		queue(b)
+		res, err := b.Run()
+		if err == nil {
+			// Inserts and upserts always apply unless they fail, while the
+			// matched count of upserts leaves out the created items.
+			if op == "delete" {
+				applied += res.Matched
+			} else {
+				applied += len(items)
+			}
+			return nil, nil
+		}
+		opErrs, err := bulkOpErrors(err, op, items)
+		if err != nil {
+			return nil, err
+		}
+		bulkErr.Errors = append(bulkErr.Errors, opErrs...)
+		// The number of matched deletes is not reported on failure.
+		if op != "delete" {
+			applied += len(items) - len(opErrs)
+		}
+		failed := make(map[int]bool, len(opErrs))
+		for _, oe := range opErrs {
+			failed[oe.Index] = true
+		}
+		return failed, nil
+	}
+	var failedInserts, failedUpdates map[int]bool
+	if failedInserts, err = run("insert", inserts, func(b *mgo.Bulk) { b.Insert(mInserts...) }); err == nil {
+		m.setInserted(inserts, mInserts, generated, failedInserts)
+		queue := func(b *mgo.Bulk) {
+			for i, item := range updates {
+				if item.ETag != "" {
+					// An upsert would re-create an item deleted meanwhile.
+					b.Update(mUpdates[2*i], mUpdates[2*i+1])
+				} else {
+					b.Upsert(mUpdates[2*i], mUpdates[2*i+1])
+				}
+			}
+		}
+		if failedUpdates, err = run("update", updates, queue); err == nil {
+			var opErrs []BulkOpError
+			if opErrs, err = m.unmatchedUpdates(c, updates, etags, failedUpdates); err != nil {
+				return applied, err
+			}
+			bulkErr.Errors = append(bulkErr.Errors, opErrs...)
+			applied -= len(opErrs)
+			if failedUpdates == nil {
+				failedUpdates = make(map[int]bool, len(opErrs))
+			}
+			for _, oe := range opErrs {
+				failedUpdates[oe.Index] = true
+			}
+			for i, item := range updates {
+				if !failedUpdates[i] {
+					item.ETag = etags[i]
+					if m.opts.ServerTimestamps {
+						item.Updated = mUpdates[2*i+1].(*mongoItem).Updated
+					}
+				}
+			}
+			_, err = run("delete", deletes, func(b *mgo.Bulk) { b.Remove(mDeletes...) })
+		}
+	}
+	if err == nil && len(bulkErr.Errors) > 0 {
+		err = bulkErr
+	}
+	if ctx.Err() != nil {
+		return applied, ctx.Err()
+	}
+	return applied, err
+}
+
+// BulkApply applies a changeset of inserts, updates and deletes using the bulk
+// API.
+func (m Handler) BulkApply(ctx context.Context, inserts, updates, deletes []*resource.Item) (int, error) {
+	return m.options().BulkApply(ctx, inserts, updates, deletes)
+}
+
+// unmatchedUpdates returns the failures of the updates holding an etag which
+// matched no item, telling from the stored items whether they do not exist or
+// hold another etag than the one set by the update. Updates in failed are
+// skipped.
+func (m OptionsHandler) unmatchedUpdates(c *mgo.Collection, updates []*resource.Item, etags []string, failed map[int]bool) ([]BulkOpError, error) {
+	ids := []interface{}{}
+	for i, item := range updates {
+		if item.ETag != "" && !failed[i] {
+			ids = append(ids, m.mongoID(item.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	stored := make(map[string]interface{}, len(ids))
+	iter := c.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1, m.etagField(): 1}).Iter()
+	var d bson.M
+	for iter.Next(&d) {
+		stored[fmt.Sprintf("%#v", idKey(d["_id"]))] = d[m.etagField()]
+		d = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	var opErrs []BulkOpError
+	for i, item := range updates {
+		if item.ETag == "" || failed[i] {
+			continue
+		}
+		etag, found := stored[fmt.Sprintf("%#v", idKey(m.mongoID(item.ID)))]
+		switch {
+		case !found:
+			opErrs = append(opErrs, BulkOpError{Op: "update", Index: i, ID: item.ID, Err: resource.ErrNotFound})
+		case etag != etags[i]:
+			opErrs = append(opErrs, BulkOpError{Op: "update", Index: i, ID: item.ID, Err: resource.ErrConflict})
+		}
+	}
+	return opErrs, nil
+}
+
+// bulkOpErrors returns the failed operations described by err, the error of a
+// bulk run of the op operations queued for items. It returns err itself if it
+// does not tell which operations failed, and the cause of the failure if it
+// is not a write error, e.g. a network failure, which mgo reports for all the
+// operations sent.
+func bulkOpErrors(err error, op string, items []*resource.Item) ([]BulkOpError, error) {
+	berr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return nil, err
+	}
+	cases := berr.Cases()
+	if len(cases) > 0 && !hasWriteError(cases) {
+		return nil, cases[0].Err
+	}
+	var opErrs []BulkOpError
+	for _, ec := range cases {
+		if ec.Index < 0 || ec.Index >= len(items) {
+			// The failed operation is unknown
+			return nil, err
+		}
+		opErr := ec.Err
+		if mgo.IsDup(opErr) {
+			opErr = resource.ErrConflict
+		}
+		opErrs = append(opErrs, BulkOpError{Op: op, Index: ec.Index, ID: items[ec.Index].ID, Err: opErr})
+	}
+	return opErrs, nil
+}
+
+// hasWriteError returns true if one of the error cases of a bulk run is a
+// write error reported by the server for an operation.
+func hasWriteError(cases []mgo.BulkErrorCase) bool {
+	for _, ec := range cases {
+		switch ec.Err.(type) {
+		case *mgo.QueryError, *mgo.LastError:
+			return true
+		}
+	}
+	return false
+}
+
+// insertBulk inserts mItems, the documents of items, using unordered bulk
+// operations of at most BulkInsertSize documents, so that a failed insert
+// does not prevent the others. Failed inserts are reported by a *BulkError,
+// or resource.ErrConflict if all the items already exist.
+func (m OptionsHandler) insertBulk(ctx context.Context, c *mgo.Collection, items []*resource.Item, mItems []interface{}) error {
+	bulkErr := &BulkError{}
+	for start := 0; start < len(mItems); start += m.opts.BulkInsertSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + m.opts.BulkInsertSize
+		if end > len(mItems) {
+			end = len(mItems)
+		}
+		b := c.Bulk()
+		b.Unordered()
+		b.Insert(mItems[start:end]...)
+		if _, err := b.Run(); err != nil {
+			opErrs, err := bulkOpErrors(err, "insert", items[start:end])
+			if err != nil {
+				return err
+			}
+			for _, oe := range opErrs {
+				oe.Index += start
+				bulkErr.Errors = append(bulkErr.Errors, oe)
+			}
+		}
+	}
+	if len(bulkErr.Errors) == 0 {
+		return nil
+	}
+	if len(bulkErr.Errors) == len(items) {
+		conflicts := 0
+		for _, oe := range bulkErr.Errors {
+			if oe.Err == resource.ErrConflict {
+				conflicts++
+			}
+		}
+		if conflicts == len(items) {
+			return resource.ErrConflict
+		}
+	}
+	return bulkErr
+}
@@ -0,0 +1,156 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBulkApply(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	item := func(id, etag, foo string) *resource.Item {
+		return &resource.Item{ID: id, ETag: etag, Updated: now, Payload: map[string]interface{}{"id": id, "foo": foo}}
+	}
+	if err := h.Insert(context.Background(), []*resource.Item{item("1", "a", "v1"), item("2", "b", "v1"), item("3", "c", "v1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates hold the etag of the item they replace, and get a new one.
+	// Updates without etag create the missing items.
+	updates := []*resource.Item{item("2", "b", "v2"), item("5", "", "v1"), item("1", "stale", "v3"), item("6", "f", "v1")}
+	applied, err := h.BulkApply(context.Background(),
+		[]*resource.Item{item("4", "d", "v1"), item("1", "a2", "v2")},
+		updates,
+		[]*resource.Item{item("3", "c", ""), item("2", "b", "")},
+	)
+	if applied != 4 {
+		t.Errorf("got applied: %d want: 4", applied)
+	}
+	berr, ok := err.(*mongo.BulkError)
+	if !ok {
+		t.Fatalf("got error: %#v want: *mongo.BulkError", err)
+	}
+	expect := []mongo.BulkOpError{
+		{Op: "insert", Index: 1, ID: "1", Err: resource.ErrConflict},
+		{Op: "update", Index: 2, ID: "1", Err: resource.ErrConflict},
+		{Op: "update", Index: 3, ID: "6", Err: resource.ErrNotFound},
+	}
+	if !reflect.DeepEqual(berr.Errors, expect) {
+		t.Errorf("got errors: %v want: %v", berr.Errors, expect)
+	}
+	b2, _ := resource.NewItem(updates[0].Payload)
+	if updates[0].ETag != b2.ETag || updates[2].ETag != "stale" || updates[3].ETag != "f" {
+		t.Errorf("got update etags: %s, %s, %s want: %s, stale, f", updates[0].ETag, updates[2].ETag, updates[3].ETag, b2.ETag)
+	}
+
+	assertCollectionIDs(t, s.DB("").C("test"), []string{"1", "2", "4", "5"})
+	var docs []struct {
+		ID   string `bson:"_id"`
+		ETag string `bson:"_etag"`
+		Foo  string `bson:"foo"`
+	}
+	if err := s.DB("").C("test").Find(nil).Sort("_id").All(&docs); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		want := map[string]string{"1": "a v1", "2": b2.ETag + " v2", "4": "d v1", "5": updates[1].ETag + " v1"}[d.ID]
+		if got := d.ETag + " " + d.Foo; got != want {
+			t.Errorf("%s: got: %s want: %s", d.ID, got, want)
+		}
+	}
+
+	if applied, err := h.BulkApply(context.Background(), nil, nil, nil); applied != 0 || err != nil {
+		t.Errorf("empty changeset: got: %d, %v want: 0, <nil>", applied, err)
+	}
+}
+
+func TestBulkApplyEmptyIDs(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ServerTimestamps: true})
+	inserts := []*resource.Item{
+		{ETag: "a", Payload: map[string]interface{}{"foo": "v1"}},
+		{ETag: "b", Payload: map[string]interface{}{"foo": "v2"}},
+	}
+	applied, err := h.BulkApply(context.Background(), inserts, nil, nil)
+	if applied != 2 || err != nil {
+		t.Fatalf("got: %d, %v want: 2, <nil>", applied, err)
+	}
+	for i, item := range inserts {
+		id, ok := item.ID.(bson.ObjectId)
+		if !ok || item.Payload["id"] != id {
+			t.Errorf("item #%d: got id: %#v, payload id: %#v want: ObjectId", i, item.ID, item.Payload["id"])
+		}
+		if item.Updated.IsZero() {
+			t.Errorf("item #%d: update time not set", i)
+		}
+	}
+	if n, err := s.DB("").C("test").Find(bson.M{"_created": bson.M{"$exists": true}}).Count(); err != nil || n != 2 {
+		t.Errorf("got: %d, %v items with a creation time want: 2", n, err)
+	}
+
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{EmptyIDs: mongo.RejectEmptyIDs})
+	_, err = h.BulkApply(context.Background(), []*resource.Item{{Payload: map[string]interface{}{}}}, nil, nil)
+	if !errors.Is(err, mongo.ErrEmptyID) {
+		t.Errorf("got error: %v want: %v", err, mongo.ErrEmptyID)
+	}
+
+	// Updates are never given an id.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	applied, err = h.BulkApply(context.Background(), nil, []*resource.Item{{Payload: map[string]interface{}{"foo": "v3"}}}, nil)
+	if applied != 0 || !errors.Is(err, mongo.ErrEmptyID) {
+		t.Errorf("update: got: %d, %v want: 0, %v", applied, err, mongo.ErrEmptyID)
+	}
+}
+
+func TestInsertBulk(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{BulkInsertSize: 2})
+	item := func(id, foo string) *resource.Item {
+		return &resource.Item{ID: id, ETag: "a", Updated: now, Payload: map[string]interface{}{"id": id, "foo": foo}}
+	}
+	if err := h.Insert(context.Background(), []*resource.Item{item("1", "v1"), item("3", "v1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []*resource.Item{item("1", "v2"), item("2", "v1"), item("", "v1"), item("3", "v2"), item("4", "v1")}
+	err := h.Insert(context.Background(), items)
+	berr, ok := err.(*mongo.BulkError)
+	if !ok {
+		t.Fatalf("got error: %#v want: *mongo.BulkError", err)
+	}
+	expect := []mongo.BulkOpError{
+		{Op: "insert", Index: 0, ID: "1", Err: resource.ErrConflict},
+		{Op: "insert", Index: 3, ID: "3", Err: resource.ErrConflict},
+	}
+	if !reflect.DeepEqual(berr.Errors, expect) {
+		t.Errorf("got errors: %v want: %v", berr.Errors, expect)
+	}
+	generated, ok := items[2].ID.(bson.ObjectId)
+	if !ok {
+		t.Fatalf("got id: %#v want: a generated ObjectId", items[2].ID)
+	}
+	n, err := s.DB("").C("test").Find(bson.M{"foo": "v1"}).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("got: %d items v1 want: 5", n)
+	}
+	if n, _ := s.DB("").C("test").FindId(generated).Count(); n != 1 {
+		t.Errorf("item with generated id %v not inserted", generated)
+	}
+
+	// Only duplicates fail like the default insert.
+	if err := h.Insert(context.Background(), []*resource.Item{item("1", "v3"), item("2", "v3")}); err != resource.ErrConflict {
+		t.Errorf("got error: %v want: %v", err, resource.ErrConflict)
+	}
+}
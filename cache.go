@@ -0,0 +1,146 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Cache is a read-through cache consulted by the handler for Find and Count
+// results. Entries are grouped by the full name of the collection they have
+// been read from (i.e.: "db.collection"), and the whole group is invalidated
+// whenever the handler writes to that collection.
+//
+// Values are shared with the handler; a Cache storing them out of process must
+// return copies.
+type Cache interface {
+	// Get returns the value stored for key in the collection group.
+	Get(ctx context.Context, collection, key string) (value interface{}, found bool)
+	// Set stores value for key in the collection group.
+	Set(ctx context.Context, collection, key string, value interface{})
+	// Invalidate removes all the values stored in the collection group.
+	Invalidate(ctx context.Context, collection string)
+}
+
+// cache wraps a Cache to prevent a read performed concurrently with a write
+// from storing stale results once the write invalidated the cache. This
+// guarantee only holds for writes performed through the same handler.
+type cache struct {
+	Cache
+	mu   sync.Mutex
+	gens map[string]uint64
+}
+
+func newCache(c Cache) *cache {
+	if c == nil {
+		return nil
+	}
+	return &cache{Cache: c, gens: map[string]uint64{}}
+}
+
+// get returns the value cached for key, and the generation of the collection
+// group to be passed to set.
+func (c *cache) get(ctx context.Context, collection, key string) (interface{}, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	gen := c.gens[collection]
+	c.mu.Unlock()
+	v, found := c.Cache.Get(ctx, collection, key)
+	return v, gen, found
+}
+
+// set stores value for key unless the collection group has been invalidated
+// since gen has been returned by get.
+func (c *cache) set(ctx context.Context, collection, key string, gen uint64, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gens[collection] == gen {
+		c.Cache.Set(ctx, collection, key, value)
+	}
+}
+
+// invalidate removes all the values cached for the collection group.
+func (c *cache) invalidate(ctx context.Context, collection string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gens[collection]++
+	c.Cache.Invalidate(ctx, collection)
+}
+
+// findCacheKey returns the cache key of a Find for q sorted by srt, returning
+// the fields selected by sel or computed by the aggregation stages.
+func findCacheKey(q *query.Query, srt []string, sel bson.M, stages []bson.M) string {
+	w := "-"
+	if q.Window != nil {
+		w = fmt.Sprintf("%d,%d", q.Window.Offset, q.Window.Limit)
+	}
+	return fmt.Sprintf("find %s %s %s %v %v", q.Predicate, strings.Join(srt, ","), w, sel, stages)
+}
+
+// countCacheKey returns the cache key of a Count for q.
+func countCacheKey(q *query.Query) string {
+	return fmt.Sprintf("count %s", q.Predicate)
+}
+
+// copyItemList returns a copy of l that can be modified without altering l,
+// items included.
+func copyItemList(l *resource.ItemList) *resource.ItemList {
+	items := make([]*resource.Item, len(l.Items))
+	for i, item := range l.Items {
+		items[i] = copyItem(item)
+	}
+	return &resource.ItemList{
+		Total: l.Total,
+		Limit: l.Limit,
+		Items: items,
+	}
+}
+
+// copyItem returns a copy of item that can be modified without altering
+// item, payload included.
+func copyItem(item *resource.Item) *resource.Item {
+	c := *item
+	if item.Payload != nil {
+		c.Payload = copyValue(item.Payload).(map[string]interface{})
+	}
+	return &c
+}
+
+// copyValue returns a copy of the payload value v, whose documents and arrays
+// are copied recursively.
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			c[k] = copyValue(e)
+		}
+		return c
+	case bson.M:
+		c := make(bson.M, len(t))
+		for k, e := range t {
+			c[k] = copyValue(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, e := range t {
+			c[i] = copyValue(e)
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,91 @@
+package mongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+type mapCache map[string]map[string]interface{}
+
+func (c mapCache) Get(ctx context.Context, collection, key string) (interface{}, bool) {
+	v, found := c[collection][key]
+	return v, found
+}
+
+func (c mapCache) Set(ctx context.Context, collection, key string, value interface{}) {
+	if c[collection] == nil {
+		c[collection] = map[string]interface{}{}
+	}
+	c[collection][key] = value
+}
+
+func (c mapCache) Invalidate(ctx context.Context, collection string) {
+	delete(c, collection)
+}
+
+func TestCacheStaleSet(t *testing.T) {
+	ctx := context.Background()
+	c := newCache(mapCache{})
+
+	// A read started before a write must not store its result after the
+	// write invalidated the cache.
+	_, gen, _ := c.get(ctx, "db.c", "key")
+	c.invalidate(ctx, "db.c")
+	c.set(ctx, "db.c", "key", gen, "stale")
+	if v, _, found := c.get(ctx, "db.c", "key"); found {
+		t.Errorf("got cached value %v, expected none", v)
+	}
+
+	_, gen, _ = c.get(ctx, "db.c", "key")
+	c.set(ctx, "db.c", "key", gen, "fresh")
+	if v, _, _ := c.get(ctx, "db.c", "key"); v != "fresh" {
+		t.Errorf("got: %v want: fresh", v)
+	}
+
+	// Other collections are left untouched.
+	c.invalidate(ctx, "db.other")
+	if v, _, _ := c.get(ctx, "db.c", "key"); v != "fresh" {
+		t.Errorf("got: %v want: fresh", v)
+	}
+}
+
+func TestCacheNil(t *testing.T) {
+	var c *cache
+	if c = newCache(nil); c != nil {
+		t.Fatal("expected a nil cache")
+	}
+	c.set(context.Background(), "db.c", "key", 0, "value")
+	c.invalidate(context.Background(), "db.c")
+	if _, _, found := c.get(context.Background(), "db.c", "key"); found {
+		t.Error("expected a nil cache to never find values")
+	}
+}
+
+func TestCopyItemList(t *testing.T) {
+	l := &resource.ItemList{Total: 1, Limit: 10, Items: []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{
+			"id":   "1",
+			"meta": map[string]interface{}{"title": "a"},
+			"tags": []interface{}{"x"},
+		}},
+	}}
+	c := copyItemList(l)
+	if !reflect.DeepEqual(c, l) {
+		t.Fatalf("got: %#v want: %#v", c, l)
+	}
+	c.Items[0].ETag = "b"
+	c.Items[0].Payload["id"] = "2"
+	c.Items[0].Payload["meta"].(map[string]interface{})["title"] = "b"
+	c.Items[0].Payload["tags"].([]interface{})[0] = "y"
+	want := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{
+		"id":   "1",
+		"meta": map[string]interface{}{"title": "a"},
+		"tags": []interface{}{"x"},
+	}}
+	if !reflect.DeepEqual(l.Items[0], want) {
+		t.Errorf("original modified: got: %#v want: %#v", l.Items[0], want)
+	}
+}
@@ -0,0 +1,128 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveBatches(t *testing.T) {
+	const n = 2500
+	read := 0
+	next := func() (interface{}, bool) {
+		if read == n {
+			return nil, false
+		}
+		read++
+		return read, true
+	}
+	var batches []int
+	remove := func(ids []interface{}) (int, error) {
+		// Ids are removed as they are read, one batch at a time.
+		if held := read - len(batches)*clearBatchSize; held != len(ids) {
+			t.Errorf("batch #%d: %d ids read but not removed, want %d", len(batches), held, len(ids))
+		}
+		batches = append(batches, len(ids))
+		return len(ids), nil
+	}
+	removed, err := removeBatches(context.Background(), clearBatchSize, next, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != n {
+		t.Errorf("got: %d removed want: %d", removed, n)
+	}
+	if want := []int{1000, 1000, 500}; !reflect.DeepEqual(batches, want) {
+		t.Errorf("got: batches %v want: %v", batches, want)
+	}
+
+	read, batches = 0, nil
+	failure := errors.New("failure")
+	removed, err = removeBatches(context.Background(), clearBatchSize, next, func(ids []interface{}) (int, error) {
+		batches = append(batches, len(ids))
+		if len(batches) == 2 {
+			return 10, failure
+		}
+		return len(ids), nil
+	})
+	if err != failure || removed != 1010 {
+		t.Errorf("got: %d, %v want: 1010, %v", removed, err, failure)
+	}
+	if read != 2*clearBatchSize {
+		t.Errorf("got: %d ids read want: %d", read, 2*clearBatchSize)
+	}
+
+	read = n
+	removed, err = removeBatches(context.Background(), clearBatchSize, next, func(ids []interface{}) (int, error) {
+		t.Error("remove called without ids")
+		return 0, nil
+	})
+	if err != nil || removed != 0 {
+		t.Errorf("got: %d, %v want: 0, nil", removed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	read = 0
+	removed, err = removeBatches(ctx, clearBatchSize, func() (interface{}, bool) {
+		if read == 5 {
+			cancel()
+		}
+		return next()
+	}, func(ids []interface{}) (int, error) {
+		t.Error("remove called after cancellation")
+		return 0, nil
+	})
+	if err != context.Canceled || removed != 0 || read != 6 {
+		t.Errorf("got: %d, %v after %d ids read want: 0, %v after 6 ids read", removed, err, read, context.Canceled)
+	}
+}
+
+// fakeIDIter reads ids 1 to n, calling onNext before each read.
+type fakeIDIter struct {
+	n      int
+	read   int
+	onNext func(read int)
+	closed bool
+}
+
+func (it *fakeIDIter) Next(result interface{}) bool {
+	if it.read == it.n {
+		return false
+	}
+	it.read++
+	it.onNext(it.read)
+	result.(*struct {
+		ID interface{} `bson:"_id"`
+	}).ID = it.read
+	return true
+}
+
+func (it *fakeIDIter) Close() error {
+	it.closed = true
+	return nil
+}
+
+func TestReadIDsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := &fakeIDIter{n: 1000, onNext: func(read int) {
+		if read == 10 {
+			cancel()
+		}
+	}}
+	ids, err := readIDs(ctx, it)
+	if err != context.Canceled || ids != nil {
+		t.Errorf("got: %v, %v want: nil, %v", ids, err, context.Canceled)
+	}
+	if it.read != 10 || !it.closed {
+		t.Errorf("got: %d ids read, closed %v want: 10 ids read and the iterator closed", it.read, it.closed)
+	}
+
+	it = &fakeIDIter{n: 3, onNext: func(int) {}}
+	ids, err = readIDs(context.Background(), it)
+	if err != nil || !reflect.DeepEqual(ids, []interface{}{1, 2, 3}) {
+		t.Errorf("got: %v, %v want: [1 2 3], nil", ids, err)
+	}
+}
@@ -0,0 +1,30 @@
+package mongo
+
+import "fmt"
+
+// IDCodec converts item ids into the _id they are stored as, and back, e.g. to
+// expose integer keys as base62 strings. Encode is also applied to the ids
+// compared with the id field in queries.
+type IDCodec interface {
+	// Encode returns the _id stored for the item id.
+	Encode(id interface{}) (interface{}, error)
+	// Decode returns the item id stored as the _id v.
+	Decode(v interface{}) (interface{}, error)
+}
+
+// customIDs reports whether item ids differ from the _id they are stored as.
+func (m OptionsHandler) customIDs() bool {
+	return len(m.opts.IDFields) > 0 || m.opts.IDCodec != nil
+}
+
+// encodeID returns the _id stored for the item id.
+func (m OptionsHandler) encodeID(id interface{}) (interface{}, error) {
+	if m.opts.IDCodec == nil {
+		return id, nil
+	}
+	v, err := m.opts.IDCodec.Encode(id)
+	if err != nil {
+		return nil, fmt.Errorf("id: %w", err)
+	}
+	return v, nil
+}
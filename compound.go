@@ -0,0 +1,122 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// compoundID returns the _id of the payload p of a collection keyed by the
+// IDFields option: a sub-document holding the values of these fields, in
+// order. Values must be strings or numbers.
+func (m OptionsHandler) compoundID(p map[string]interface{}) (bson.D, error) {
+	id := make(bson.D, 0, len(m.opts.IDFields))
+	for _, f := range m.opts.IDFields {
+		v := p[f]
+		if v == nil {
+			return nil, fmt.Errorf("%s: id field is missing", f)
+		}
+		switch v.(type) {
+		case string, int, int32, int64, float64, json.Number:
+		default:
+			return nil, fmt.Errorf("%s: id field must be a string or a number", f)
+		}
+		id = append(id, bson.DocElem{Name: f, Value: v})
+	}
+	return id, nil
+}
+
+// itemID returns the id of the item stored with the _id v, decoded by the
+// IDCodec option if any. For collections keyed by the IDFields option, it is
+// the JSON array of the values of the id fields of the compound _id v, e.g.
+// `["acme",42]`. Being a string, it can be used in URLs and compared, unlike
+// v. Ids which can't be decoded are returned as is.
+func (m OptionsHandler) itemID(v interface{}) interface{} {
+	if len(m.opts.IDFields) == 0 {
+		if m.opts.IDCodec != nil {
+			if id, err := m.opts.IDCodec.Decode(v); err == nil {
+				return id
+			}
+		}
+		return v
+	}
+	var doc map[string]interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		doc = t
+	case bson.M:
+		doc = t
+	case bson.D:
+		doc = t.Map()
+	default:
+		return v
+	}
+	values := make([]interface{}, len(m.opts.IDFields))
+	for i, f := range m.opts.IDFields {
+		values[i] = doc[f]
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return v
+	}
+	return string(b)
+}
+
+// mongoID returns the _id stored for the item id, which differs from id for
+// collections keyed by the IDFields option or with an IDCodec. Ids which are
+// not valid compound ids or can't be encoded are returned as is, so they match
+// no item.
+func (m OptionsHandler) mongoID(id interface{}) interface{} {
+	if len(m.opts.IDFields) == 0 {
+		if v, err := m.encodeID(id); err == nil {
+			return v
+		}
+		return id
+	}
+	s, ok := id.(string)
+	if !ok {
+		return id
+	}
+	d := json.NewDecoder(bytes.NewReader([]byte(s)))
+	d.UseNumber()
+	var values []interface{}
+	if err := d.Decode(&values); err != nil || len(values) != len(m.opts.IDFields) {
+		return id
+	}
+	doc := make(bson.D, len(values))
+	for i, v := range values {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else if f, err := n.Float64(); err == nil {
+				v = f
+			}
+		}
+		doc[i] = bson.DocElem{Name: m.opts.IDFields[i], Value: v}
+	}
+	return doc
+}
+
+// mongoIDs returns the _id stored for each of the item ids.
+func (m OptionsHandler) mongoIDs(ids []interface{}) []interface{} {
+	if !m.customIDs() {
+		return ids
+	}
+	r := make([]interface{}, len(ids))
+	for i, id := range ids {
+		r[i] = m.mongoID(id)
+	}
+	return r
+}
+
+// idValue converts query values compared with the id into the _id they are
+// stored as.
+func (m OptionsHandler) idValue(field string, v query.Value) (query.Value, error) {
+	if field != "id" {
+		return v, nil
+	}
+	return m.mongoID(v), nil
+}
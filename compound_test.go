@@ -0,0 +1,112 @@
+package mongo
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompoundID(t *testing.T) {
+	m := OptionsHandler{opts: Options{IDFields: []string{"tenant", "num"}}}
+	p := map[string]interface{}{"tenant": "acme", "num": 42}
+	id, err := m.compoundID(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.D{{Name: "tenant", Value: "acme"}, {Name: "num", Value: 42}}); !reflect.DeepEqual(id, want) {
+		t.Errorf("compoundID: got: %#v want: %#v", id, want)
+	}
+
+	itemID := m.itemID(bson.M{"tenant": "acme", "num": 42})
+	if itemID != `["acme",42]` {
+		t.Errorf("itemID: got: %#v want: %#v", itemID, `["acme",42]`)
+	}
+	if want := (bson.D{{Name: "tenant", Value: "acme"}, {Name: "num", Value: int64(42)}}); !reflect.DeepEqual(m.mongoID(itemID), want) {
+		t.Errorf("mongoID: got: %#v want: %#v", m.mongoID(itemID), want)
+	}
+	for _, id := range []interface{}{"acme", `["acme"]`, 42} {
+		if got := m.mongoID(id); !reflect.DeepEqual(got, id) {
+			t.Errorf("mongoID(%#v): got: %#v want: the id as is", id, got)
+		}
+	}
+
+	for _, p := range []map[string]interface{}{
+		{"tenant": "acme"},
+		{"tenant": "acme", "num": []interface{}{42}},
+	} {
+		if _, err := m.compoundID(p); err == nil {
+			t.Errorf("compoundID(%v): expected error, got nil", p)
+		}
+	}
+
+	b, err := m.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{id:{$in:["[\"acme\",42]"]},tenant:"acme"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"_id":    bson.M{"$in": []interface{}{bson.D{{Name: "tenant", Value: "acme"}, {Name: "num", Value: int64(42)}}}},
+		"tenant": "acme",
+	}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("getQuery:\ngot:  %#v\nwant: %#v", b, want)
+	}
+}
+
+// decimalCodec stores decimal string ids as integers.
+type decimalCodec struct{}
+
+func (decimalCodec) Encode(id interface{}) (interface{}, error) {
+	s, _ := id.(string)
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (decimalCodec) Decode(v interface{}) (interface{}, error) {
+	n, ok := v.(int64)
+	if !ok {
+		return nil, errors.New("not an integer")
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func TestIDCodec(t *testing.T) {
+	m := OptionsHandler{opts: Options{IDCodec: decimalCodec{}}}
+	mItem, err := m.newMongoItem(&resource.Item{ID: "123", Payload: map[string]interface{}{"id": "123", "foo": "bar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mItem.ID != int64(123) {
+		t.Errorf("newMongoItem: got: _id %#v want: %#v", mItem.ID, int64(123))
+	}
+	if _, err := m.newMongoItem(&resource.Item{ID: "x", Payload: map[string]interface{}{}}); err == nil || !strings.HasPrefix(err.Error(), "id: ") {
+		t.Errorf("newMongoItem: got: error %v want: an id error", err)
+	}
+
+	item := m.newItem(&mongoItem{ID: int64(123), Payload: map[string]interface{}{"foo": "bar"}})
+	if item.ID != "123" || item.Payload["id"] != "123" {
+		t.Errorf("newItem: got: id %#v want: %#v", item.ID, "123")
+	}
+	if item.ETag != "p-123" {
+		t.Errorf("newItem: got: etag %q want: %q", item.ETag, "p-123")
+	}
+	// Ids which can't be decoded are returned as stored.
+	if item := m.newItem(&mongoItem{ID: "raw", Payload: map[string]interface{}{}}); item.ID != "raw" {
+		t.Errorf("newItem: got: id %#v want: %#v", item.ID, "raw")
+	}
+
+	if got := m.mongoIDs([]interface{}{"123", "x"}); !reflect.DeepEqual(got, []interface{}{int64(123), "x"}) {
+		t.Errorf("mongoIDs: got: %#v", got)
+	}
+	b, err := m.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{id:{$in:["123","62"]}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"_id": bson.M{"$in": []interface{}{int64(123), int64(62)}}}); !reflect.DeepEqual(b, want) {
+		t.Errorf("getQuery:\ngot:  %#v\nwant: %#v", b, want)
+	}
+}
@@ -0,0 +1,69 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FindDuplicates returns the ids of the items sharing the same values for all
+// the given fields (using dotted notation for sub-fields), e.g. to find items
+// stored twice with different ids. Each group holds at least two ids, sorted,
+// and groups are sorted by their first id. Items missing a field are grouped
+// with the items missing it as well.
+//
+// Items are grouped by the server on a key made of the values of the fields,
+// which is compared by value like a content hash but without collisions.
+// Large collections are grouped using temporary files on the server.
+func (m OptionsHandler) FindDuplicates(ctx context.Context, fields ...string) (_ [][]interface{}, err error) {
+	defer func() { err = classifyError(err) }()
+	if len(fields) == 0 {
+		return nil, errors.New("duplicates: at least one field is required")
+	}
+	// Keys of the group key can't hold dots, so values are keyed by position.
+	key := make(bson.D, len(fields))
+	for i, f := range fields {
+		key[i] = bson.DocElem{Name: "f" + strconv.Itoa(i), Value: "$" + getField(m.flatField(f))}
+	}
+	pipeline := []bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{"_id": key, "ids": bson.M{"$push": "$_id"}}},
+		{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+		{"$project": bson.M{"_id": 0, "ids": 1, "first": bson.M{"$arrayElemAt": []interface{}{"$ids", 0}}}},
+		{"$sort": bson.M{"first": 1}},
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+
+	iter := c.Pipe(pipeline).AllowDiskUse().Iter()
+	groups := [][]interface{}{}
+	var group struct {
+		IDs []interface{} `bson:"ids"`
+	}
+	for iter.Next(&group) {
+		if err = m.err(ctx); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if m.customIDs() {
+			for i, id := range group.IDs {
+				group.IDs[i] = m.itemID(id)
+			}
+		}
+		groups = append(groups, group.IDs)
+		group.IDs = nil
+	}
+	if err := iter.Close(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return groups, nil
+}
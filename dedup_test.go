@@ -0,0 +1,48 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "meta": map[string]interface{}{"size": 1}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b", "meta": map[string]interface{}{"size": 1}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "a", "meta": map[string]interface{}{"size": 1}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "name": "a", "meta": map[string]interface{}{"size": 2}}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "name": "b", "meta": map[string]interface{}{"size": 1}}},
+		{ID: "6", Payload: map[string]interface{}{"id": "6", "name": "a", "meta": map[string]interface{}{"size": 1}}},
+		{ID: "7", Payload: map[string]interface{}{"id": "7"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := h.FindDuplicates(context.Background(), "name", "meta.size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]interface{}{{"1", "3", "6"}, {"2", "5"}}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got: %v want: %v", groups, want)
+	}
+
+	groups, err = h.FindDuplicates(context.Background(), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 0 {
+		t.Errorf("got: %v want: no duplicates", groups)
+	}
+
+	if _, err := h.FindDuplicates(context.Background()); err == nil {
+		t.Error("expected an error without fields, got nil")
+	}
+}
@@ -0,0 +1,69 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Distinct returns the distinct values of field (using dotted notation for
+// sub-fields) among the items matching q, e.g. to list the tags in use
+// without reading all the items. Values of array fields are returned
+// individually. Values are returned as stored, in no particular order, and
+// must fit in a 16MiB document. Queries holding a long $in condition are
+// split like by Find (see Options.InBatchSize).
+func (m OptionsHandler) Distinct(ctx context.Context, field string, q *query.Query) (_ []interface{}, err error) {
+	defer func() { err = classifyError(err) }()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	qry, _ = m.restrictQuery(ctx, qry)
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+
+	batches := splitIn(qry, m.inBatchSize())
+	if batches == nil {
+		batches = []bson.M{qry}
+	}
+	result := []interface{}{}
+	for _, b := range batches {
+		var values []interface{}
+		if values, err = m.distinct(ctx, c, field, b); err != nil {
+			break
+		}
+		result = append(result, values...)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(batches) > 1 {
+		result = uniqueValues(result)
+	}
+	return result, nil
+}
+
+// distinct returns the distinct values of field among the items of c matching
+// the query document qry.
+func (m OptionsHandler) distinct(ctx context.Context, c *mgo.Collection, field string, qry bson.M) ([]interface{}, error) {
+	mq := c.Find(qry)
+	if dl, ok := ctx.Deadline(); ok {
+		dur := time.Until(dl)
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	result := []interface{}{}
+	err := mq.Distinct(getField(m.flatField(field)), &result)
+	return result, err
+}
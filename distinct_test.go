@@ -0,0 +1,61 @@
+package mongo_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestDistinct(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tag": "a", "tags": []interface{}{"x", "y"}, "public": true}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tag": "b", "tags": []interface{}{"y"}, "public": true}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tag": "a", "tags": []interface{}{"z"}, "public": false}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "tag": "c", "public": true}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "public": true}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		field     string
+		predicate string
+		want      []string
+	}{
+		{"tag", "", []string{"a", "b", "c"}},
+		{"tag", "{public:true}", []string{"a", "b", "c"}},
+		{"tag", "{public:false}", []string{"a"}},
+		{"tags", "{public:true}", []string{"x", "y"}},
+		{"tag", "{public:false,tag:\"z\"}", []string{}},
+	}
+	for _, tc := range cases {
+		values, err := h.Distinct(context.Background(), tc.field, &query.Query{Predicate: query.MustParsePredicate(tc.predicate)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(values))
+		for i, v := range values {
+			got[i] = fmt.Sprint(v)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Distinct(%s, %s): got: %v want: %v", tc.field, tc.predicate, got, tc.want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.Distinct(ctx, "tag", &query.Query{}); err != context.Canceled {
+		t.Errorf("got: %v want: %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,257 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2"
+)
+
+// DuplicateKeyError is returned when a write is rejected because it would
+// duplicate the key of a unique index other than the primary key. It matches
+// resource.ErrConflict with errors.Is.
+type DuplicateKeyError struct {
+	// Index is the name of the violated unique index.
+	Index string
+	// Fields lists the fields covered by the index, when known.
+	Fields []string
+
+	err error
+}
+
+func (e *DuplicateKeyError) Error() string {
+	if len(e.Fields) == 0 {
+		return fmt.Sprintf("duplicate key on unique index %s", e.Index)
+	}
+	return fmt.Sprintf("duplicate key on unique index %s (%s)", e.Index, strings.Join(e.Fields, ", "))
+}
+
+// Is reports whether target is resource.ErrConflict.
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == resource.ErrConflict
+}
+
+// Unwrap returns the mgo error.
+func (e *DuplicateKeyError) Unwrap() error {
+	return e.err
+}
+
+// WriteConcernError is returned when a write could not be confirmed to satisfy
+// the write concern of the session, e.g. on a timeout waiting for the majority
+// of a degraded replica set. Unlike other errors, the write may have been
+// applied, so retrying it may not be safe.
+type WriteConcernError struct {
+	// Code is the MongoDB error code.
+	Code int
+	// Timeout is true if the write concern timed out.
+	Timeout bool
+
+	err error
+}
+
+func (e *WriteConcernError) Error() string {
+	return fmt.Sprintf("write concern not satisfied, the write may have been applied: %v", e.err)
+}
+
+// Unwrap returns the mgo error.
+func (e *WriteConcernError) Unwrap() error {
+	return e.err
+}
+
+// writeConcernError returns err as a *WriteConcernError if it reports a write
+// concern failure, or err as is.
+func writeConcernError(err error) error {
+	lerr, ok := err.(*mgo.LastError)
+	if !ok {
+		return err
+	}
+	switch {
+	case lerr.WTimeout:
+	case lerr.Code == 64 || lerr.Code == 79 || lerr.Code == 100:
+		// WriteConcernFailed, UnknownReplWriteConcern and
+		// UnsatisfiableWriteConcern
+	default:
+		return err
+	}
+	return &WriteConcernError{Code: lerr.Code, Timeout: lerr.WTimeout || lerr.Code == 64, err: err}
+}
+
+var dupIndexRe = regexp.MustCompile(`index: (\S+) dup key`)
+
+// dupIndex returns the name of the index reported in the message of a
+// duplicate key error.
+func dupIndex(msg string) (string, bool) {
+	m := dupIndexRe.FindStringSubmatch(msg)
+	if m == nil {
+		return "", false
+	}
+	// Collection names may be prefixed, e.g.: "index: db.test.$email_1".
+	name := m[1]
+	if i := strings.LastIndex(name, ".$"); i >= 0 {
+		name = name[i+2:]
+	}
+	return name, true
+}
+
+// duplicateKeyError converts the duplicate key error err returned by a write
+// on c into a *DuplicateKeyError, or resource.ErrConflict if the violated
+// index is the primary key or can't be determined.
+func duplicateKeyError(c *mgo.Collection, err error) error {
+	var msg string
+	switch e := err.(type) {
+	case *mgo.LastError:
+		msg = e.Err
+	case *mgo.QueryError:
+		msg = e.Message
+	}
+	name, ok := dupIndex(msg)
+	if !ok || name == "_id_" {
+		return resource.ErrConflict
+	}
+	dup := &DuplicateKeyError{Index: name, err: err}
+	// Fields are informative only, so failing to list indexes is ignored.
+	indexes, _ := collectionIndexes(c)
+	for _, idx := range indexes {
+		if idx.Name != name {
+			continue
+		}
+		for _, k := range idx.Key {
+			k = strings.TrimPrefix(k, "-")
+			if i := strings.Index(k, ":"); i >= 0 {
+				// Special index kinds, e.g.: "$2dsphere:loc".
+				k = k[i+1:]
+			}
+			if k == "_id" {
+				k = "id"
+			}
+			dup.Fields = append(dup.Fields, k)
+		}
+	}
+	return dup
+}
+
+// SortMemoryError is returned by Find when the configuration is
+// StrictLargeSorts and MongoDB fails to sort the items in memory, because no
+// index provides the requested order and too many items match.
+type SortMemoryError struct {
+	// Sort lists the sorted fields, prefixed by "-" when reversed, using
+	// stored names.
+	Sort []string
+
+	err error
+}
+
+func (e *SortMemoryError) Error() string {
+	return fmt.Sprintf("sort on %s exceeds the memory limit of MongoDB: index these fields, filter more items, or allow sorts using the disk (DiskLargeSorts)", strings.Join(e.Sort, ", "))
+}
+
+// Unwrap returns the mgo error.
+func (e *SortMemoryError) Unwrap() error {
+	return e.err
+}
+
+// isSortMemoryError returns true if err reports a sort exceeding the memory
+// limit of MongoDB.
+func isSortMemoryError(err error) bool {
+	qerr, ok := err.(*mgo.QueryError)
+	if !ok {
+		return false
+	}
+	switch qerr.Code {
+	case 292, 16819:
+		// QueryExceededMemoryLimitNoDiskUseAllowed and the $sort stage
+		// error of MongoDB before 4.4
+		return true
+	case 96:
+		// OperationFailed, returned by find before MongoDB 4.4
+		return strings.Contains(qerr.Message, "Sort operation used more than the maximum")
+	}
+	return false
+}
+
+var (
+	// ErrTemporary is matched with errors.Is by the errors of operations
+	// interrupted by a network failure, e.g. a socket timeout or a reset
+	// connection, or by a change of the replica set primary. The operation
+	// may be retried, but writes may have been applied.
+	ErrTemporary = errors.New("mongo: temporary failure")
+	// ErrUnavailable is matched with errors.Is by the errors of operations
+	// for which no server could be reached. The operation may be retried
+	// once the servers are back.
+	ErrUnavailable = errors.New("mongo: servers unavailable")
+)
+
+// classifiedError wraps an mgo error to match ErrTemporary or ErrUnavailable.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return fmt.Sprintf("%v: %v", e.class, e.err)
+}
+
+// Is reports whether target is the class of the error.
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// Unwrap returns the mgo error.
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classifyError maps the errors returned by mgo to the errors of rest-layer
+// or to errors matching ErrTemporary or ErrUnavailable. Other errors are
+// returned as is.
+func classifyError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// Context errors are net.Errors, but are not temporary.
+		return err
+	case err == mgo.ErrNotFound:
+		return resource.ErrNotFound
+	case mgo.IsDup(err):
+		return resource.ErrConflict
+	case err.Error() == "no reachable servers":
+		return &classifiedError{class: ErrUnavailable, err: err}
+	case isTemporary(err):
+		return &classifiedError{class: ErrTemporary, err: err}
+	}
+	return err
+}
+
+// isTemporary returns true if err reports a network failure or a change of the
+// replica set primary.
+func isTemporary(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var code int
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		code = e.Code
+	case *mgo.LastError:
+		code = e.Code
+	default:
+		// Sockets closed while in use, e.g. by a server failover.
+		return err.Error() == "Closed explicitly"
+	}
+	switch code {
+	case 91, 189, 10107, 11600, 11602, 13435, 13436:
+		// ShutdownInProgress, PrimarySteppedDown, NotWritablePrimary,
+		// InterruptedAtShutdown, InterruptedDueToReplStateChange,
+		// NotPrimaryNoSecondaryOk and NotPrimaryOrSecondary
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2"
+)
+
+func TestDupIndex(t *testing.T) {
+	cases := []struct {
+		msg  string
+		want string
+		ok   bool
+	}{
+		{`E11000 duplicate key error collection: test.users index: email_1 dup key: { email: "a@b.c" }`, "email_1", true},
+		{`E11000 duplicate key error index: test.users.$email_1 dup key: { : "a@b.c" }`, "email_1", true},
+		{`E11000 duplicate key error collection: test.users index: _id_ dup key: { _id: "1" }`, "_id_", true},
+		{`not a duplicate key error`, "", false},
+	}
+	for _, tc := range cases {
+		got, ok := dupIndex(tc.msg)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("dupIndex(%q): got: %q, %v want: %q, %v", tc.msg, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestWriteConcernError(t *testing.T) {
+	cases := []struct {
+		err     error
+		ok      bool
+		timeout bool
+	}{
+		{&mgo.LastError{Code: 64, Err: "waiting for replication timed out"}, true, true},
+		{&mgo.LastError{WTimeout: true, Err: "timeout"}, true, true},
+		{&mgo.LastError{Code: 100, Err: "Not enough data-bearing nodes"}, true, false},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}, false, false},
+		{errors.New("connection reset"), false, false},
+	}
+	for _, tc := range cases {
+		err := writeConcernError(tc.err)
+		wcErr, ok := err.(*WriteConcernError)
+		if ok != tc.ok {
+			t.Errorf("writeConcernError(%v): got: %T want a *WriteConcernError: %v", tc.err, err, tc.ok)
+			continue
+		}
+		if !ok {
+			if err != tc.err {
+				t.Errorf("writeConcernError(%v): got: %v want the error as is", tc.err, err)
+			}
+			continue
+		}
+		if wcErr.Timeout != tc.timeout {
+			t.Errorf("writeConcernError(%v): got timeout: %v want: %v", tc.err, wcErr.Timeout, tc.timeout)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("writeConcernError(%v) does not wrap the mgo error", tc.err)
+		}
+	}
+}
+
+func TestIsSortMemoryError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&mgo.QueryError{Code: 292, Message: "Executor error during find command :: caused by :: Sort exceeded memory limit of 104857600 bytes"}, true},
+		{&mgo.QueryError{Code: 16819, Message: "Sort exceeded memory limit of 104857600 bytes"}, true},
+		{&mgo.QueryError{Code: 96, Message: "Executor error during find command: OperationFailed: Sort operation used more than the maximum 33554432 bytes of RAM"}, true},
+		{&mgo.QueryError{Code: 96, Message: "operation failed"}, false},
+		{&mgo.QueryError{Code: 2, Message: "bad sort"}, false},
+		{errors.New("Sort operation used more than the maximum 33554432 bytes of RAM"), false},
+	}
+	for _, tc := range cases {
+		if got := isSortMemoryError(tc.err); got != tc.want {
+			t.Errorf("isSortMemoryError(%v): got: %v want: %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	dup := &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+	wc := &WriteConcernError{err: &mgo.LastError{Code: 64}}
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{mgo.ErrNotFound, resource.ErrNotFound},
+		{dup, resource.ErrConflict},
+		{errors.New("no reachable servers"), ErrUnavailable},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, ErrTemporary},
+		{io.EOF, ErrTemporary},
+		{errors.New("Closed explicitly"), ErrTemporary},
+		{&mgo.QueryError{Code: 10107, Message: "not master"}, ErrTemporary},
+		{&mgo.LastError{Code: 189, Err: "primary stepped down"}, ErrTemporary},
+		{&mgo.QueryError{Code: 2, Message: "bad value"}, nil},
+		{context.DeadlineExceeded, nil},
+		{wc, nil},
+	}
+	for _, tc := range cases {
+		err := classifyError(tc.err)
+		if tc.want == nil {
+			// Not classified
+			if err != tc.err {
+				t.Errorf("classifyError(%v): got: %v want the error as is", tc.err, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("classifyError(%v): got: %v want: %v", tc.err, err, tc.want)
+		}
+		if (tc.want == ErrTemporary || tc.want == ErrUnavailable) && errors.Unwrap(err) != tc.err {
+			t.Errorf("classifyError(%v) does not wrap the mgo error", tc.err)
+		}
+	}
+}
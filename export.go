@@ -0,0 +1,67 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// ExportNDJSON writes the payloads of the items matching q to w as
+// newline-delimited JSON, one item per line, as they are read from the
+// cursor. It returns the number of items written, which are all the items
+// written before an error if any, e.g. when ctx is done. The errors of w are
+// returned as is.
+func (m OptionsHandler) ExportNDJSON(ctx context.Context, q *query.Query, w io.Writer) (int, error) {
+	if q.Window != nil && q.Window.Limit == 0 {
+		return 0, nil
+	}
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	qry, _ = m.restrictQuery(ctx, qry)
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	defer m.close(c)
+
+	mq := c.Find(qry).Sort(m.getSort(q)...)
+	if q.Window != nil {
+		mq = applyWindow(mq, *q.Window)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		dur := time.Until(dl)
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	iter := mq.Iter()
+	n := 0
+	var mItem mongoItem
+	for iter.Next(&mItem) {
+		if err = m.err(ctx); err != nil {
+			iter.Close()
+			return n, err
+		}
+		b, err := json.Marshal(m.newItem(&mItem).Payload)
+		if err == nil {
+			_, err = w.Write(append(b, '\n'))
+		}
+		if err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+	return n, classifyError(iter.Close())
+}
+
+// ExportNDJSON writes the items matching q to w as newline-delimited JSON.
+func (m Handler) ExportNDJSON(ctx context.Context, q *query.Query, w io.Writer) (int, error) {
+	return m.options().ExportNDJSON(ctx, q, w)
+}
@@ -0,0 +1,690 @@
+package mongo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Prefix matches string values of Field starting with Value. It is translated
+// into an anchored regular expression, which MongoDB can answer using an
+// index on Field.
+type Prefix struct {
+	Field string
+	Value string
+}
+
+// Match implements query.Expression interface.
+func (e Prefix) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, e.Value)
+}
+
+// Prepare implements query.Expression interface.
+func (e *Prefix) Prepare(validator schema.Validator) error {
+	r := &query.Regex{Field: e.Field, Value: regexp.MustCompile(e.pattern())}
+	return r.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e Prefix) String() string {
+	return fmt.Sprintf("%s: {$prefix: %q}", e.Field, e.Value)
+}
+
+// pattern returns the anchored regular expression matching e.
+func (e Prefix) pattern() string {
+	return "^" + regexp.QuoteMeta(e.Value)
+}
+
+// ElemMatchCount matches documents whose Field array holds at least Min
+// elements matching all the Exps sub-expressions, e.g. the documents with at
+// least 2 comments by a given user. Like query.ElemMatch, sub-expressions
+// apply to the fields of array elements.
+//
+// It is translated into a $expr counting matching elements with $filter,
+// which requires MongoDB 3.6 and can't use indexes. Comparisons then follow
+// the aggregation semantics, where a missing field is lower than any value.
+type ElemMatchCount struct {
+	Field string
+	Exps  []query.Expression
+	Min   int
+}
+
+// Match implements query.Expression interface.
+func (e ElemMatchCount) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	arr, ok := v.([]interface{})
+	if !ok {
+		return e.Min <= 0
+	}
+	p := query.Predicate(e.Exps)
+	n := 0
+	for _, val := range arr {
+		if v, ok := val.(map[string]interface{}); ok && p.Match(v) {
+			n++
+		}
+	}
+	return n >= e.Min
+}
+
+// Prepare implements query.Expression interface.
+func (e *ElemMatchCount) Prepare(validator schema.Validator) error {
+	em := &query.ElemMatch{Field: e.Field, Exps: e.Exps}
+	return em.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e ElemMatchCount) String() string {
+	s := make([]string, 0, len(e.Exps))
+	for _, v := range e.Exps {
+		s = append(s, v.String())
+	}
+	return fmt.Sprintf("%s: {$elemMatchCount: {%s}, $min: %d}", e.Field, strings.Join(s, ", "), e.Min)
+}
+
+// All matches documents whose Field array holds all the Values, in any order,
+// e.g. the documents having all of a set of tags. Like query.In, a Field
+// holding a single value matches if it is the only element of Values.
+//
+// It is translated into an $all condition, which can use an index on Field.
+type All struct {
+	Field  string
+	Values []query.Value
+}
+
+// Match implements query.Expression interface.
+func (e All) Match(payload map[string]interface{}) bool {
+	if len(e.Values) == 0 {
+		return false
+	}
+	for _, v := range e.Values {
+		if !(query.In{Field: e.Field, Values: []query.Value{v}}).Match(payload) {
+			return false
+		}
+	}
+	return true
+}
+
+// Prepare implements query.Expression interface.
+func (e *All) Prepare(validator schema.Validator) error {
+	if len(e.Values) == 0 {
+		return fmt.Errorf("%s: $all requires at least one value", e.Field)
+	}
+	in := &query.In{Field: e.Field, Values: e.Values}
+	if err := in.Prepare(validator); err != nil {
+		return err
+	}
+	e.Values = in.Values
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e All) String() string {
+	s := make([]string, 0, len(e.Values))
+	for _, v := range e.Values {
+		b, _ := json.Marshal(v)
+		s = append(s, string(b))
+	}
+	return fmt.Sprintf("%s: {$all: [%s]}", e.Field, strings.Join(s, ", "))
+}
+
+// Not matches documents not matching Exp, e.g. the items whose title does not
+// match a regular expression or whose price is not greater than a value.
+// Like MongoDB, documents missing the field of Exp match.
+//
+// It is translated into a $not wrapping the operators of Exp, which must bear
+// on a single field: expressions translated into a plain equality, a $not, a
+// $expr or a condition on several fields can't be negated and fail with
+// resource.ErrNotImplemented.
+type Not struct {
+	Exp query.Expression
+}
+
+// Match implements query.Expression interface.
+func (e Not) Match(payload map[string]interface{}) bool {
+	return e.Exp != nil && !e.Exp.Match(payload)
+}
+
+// Prepare implements query.Expression interface.
+func (e *Not) Prepare(validator schema.Validator) error {
+	if e.Exp == nil {
+		return errors.New("$not: expression is required")
+	}
+	return e.Exp.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e Not) String() string {
+	return fmt.Sprintf("{$not: %s}", e.Exp)
+}
+
+// AllElemMatch matches documents whose Field array holds, for each element of
+// Exps, an element matching all its sub-expressions, e.g. the orders with an
+// item of product a and another item of quantity 2. Like query.ElemMatch,
+// sub-expressions apply to the fields of array elements, and a single array
+// element may match several of them.
+//
+// It is translated into an $all condition holding an $elemMatch per element
+// of Exps.
+type AllElemMatch struct {
+	Field string
+	Exps  [][]query.Expression
+}
+
+// Match implements query.Expression interface.
+func (e AllElemMatch) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	arr, ok := v.([]interface{})
+	if !ok || len(e.Exps) == 0 {
+		return false
+	}
+next:
+	for _, exps := range e.Exps {
+		p := query.Predicate(exps)
+		for _, val := range arr {
+			if v, ok := val.(map[string]interface{}); ok && p.Match(v) {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Prepare implements query.Expression interface.
+func (e *AllElemMatch) Prepare(validator schema.Validator) error {
+	if len(e.Exps) == 0 {
+		return fmt.Errorf("%s: $all requires at least one $elemMatch", e.Field)
+	}
+	for _, exps := range e.Exps {
+		em := &query.ElemMatch{Field: e.Field, Exps: exps}
+		if err := em.Prepare(validator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e AllElemMatch) String() string {
+	all := make([]string, 0, len(e.Exps))
+	for _, exps := range e.Exps {
+		s := make([]string, 0, len(exps))
+		for _, v := range exps {
+			s = append(s, v.String())
+		}
+		all = append(all, fmt.Sprintf("{$elemMatch: {%s}}", strings.Join(s, ", ")))
+	}
+	return fmt.Sprintf("%s: {$all: [%s]}", e.Field, strings.Join(all, ", "))
+}
+
+// NumberRegex matches numeric values of Field whose decimal representation
+// matches Value, e.g. phone numbers stored as integers. String values are
+// matched as is.
+//
+// It is translated into a $expr applying $regexMatch to the $toString
+// conversion of the field, which requires MongoDB 4.2 and can't use indexes:
+// it should be combined with other, indexed, conditions on large collections.
+type NumberRegex struct {
+	Field string
+	Value *regexp.Regexp
+}
+
+// Match implements query.Expression interface.
+func (e NumberRegex) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case float64:
+		s = strconv.FormatFloat(t, 'f', -1, 64)
+	case float32:
+		s = strconv.FormatFloat(float64(t), 'f', -1, 32)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s = fmt.Sprint(t)
+	default:
+		return false
+	}
+	return e.Value.MatchString(s)
+}
+
+// Prepare implements query.Expression interface.
+func (e *NumberRegex) Prepare(validator schema.Validator) error {
+	// The value is not validated as the field is not expected to be a string.
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e NumberRegex) String() string {
+	return fmt.Sprintf("%s: {$numberRegex: %q}", e.Field, e.Value.String())
+}
+
+// Mod matches numeric values of Field whose remainder of the division by
+// Divisor is Remainder, e.g. the items of a shard. Like MongoDB, decimal values
+// are truncated towards zero before division, and the remainder has the sign
+// of the value.
+//
+// It is translated into a $mod condition, which can use an index on Field.
+type Mod struct {
+	Field     string
+	Divisor   int64
+	Remainder int64
+}
+
+// Match implements query.Expression interface.
+func (e Mod) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	f, ok := toFloat(v)
+	if !ok || e.Divisor == 0 {
+		return false
+	}
+	return int64(math.Trunc(f))%e.Divisor == e.Remainder
+}
+
+// Prepare implements query.Expression interface.
+func (e *Mod) Prepare(validator schema.Validator) error {
+	if e.Divisor == 0 {
+		return fmt.Errorf("%s: $mod divisor must not be zero", e.Field)
+	}
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e Mod) String() string {
+	return fmt.Sprintf("%s: {$mod: [%d, %d]}", e.Field, e.Divisor, e.Remainder)
+}
+
+// DateBetween matches documents whose Field is a date between Start and End,
+// both included, e.g. the orders of a given month. Dates given as strings in
+// payloads are parsed as RFC 3339 or "2006-01-02" dates by Match.
+//
+// It is translated into a single {$gte: Start, $lte: End} condition, merged
+// with the other conditions on Field, which can use an index on Field. Field
+// must be stored as a date (see Options.DateFields).
+type DateBetween struct {
+	Field string
+	Start time.Time
+	End   time.Time
+}
+
+// Match implements query.Expression interface.
+func (e DateBetween) Match(payload map[string]interface{}) bool {
+	v, found := getPath(payload, e.Field)
+	if !found || v == nil {
+		return false
+	}
+	t, err := parseTime(v)
+	if err != nil {
+		return false
+	}
+	return !t.Before(e.Start) && !t.After(e.End)
+}
+
+// Prepare implements query.Expression interface.
+func (e *DateBetween) Prepare(validator schema.Validator) error {
+	if e.End.Before(e.Start) {
+		return fmt.Errorf("%s: $between end must not be before start", e.Field)
+	}
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e DateBetween) String() string {
+	return fmt.Sprintf("%s: {$between: [%s, %s]}", e.Field, e.Start.Format(time.RFC3339Nano), e.End.Format(time.RFC3339Nano))
+}
+
+// DateDiff matches documents whose To date is more than Min after their From
+// date, e.g. the tickets resolved more than 24 hours after their creation.
+// Documents missing one of the dates never match.
+//
+// It is translated into a $expr comparing the $subtract of both fields, which
+// can't use indexes. Both fields must be stored as dates (see
+// Options.DateFields).
+type DateDiff struct {
+	From string
+	To   string
+	Min  time.Duration
+}
+
+// Match implements query.Expression interface.
+func (e DateDiff) Match(payload map[string]interface{}) bool {
+	from, found := getPath(payload, e.From)
+	if !found || from == nil {
+		return false
+	}
+	to, found := getPath(payload, e.To)
+	if !found || to == nil {
+		return false
+	}
+	f, err := parseTime(from)
+	if err != nil {
+		return false
+	}
+	t, err := parseTime(to)
+	if err != nil {
+		return false
+	}
+	return t.Sub(f) > e.Min
+}
+
+// Prepare implements query.Expression interface.
+func (e *DateDiff) Prepare(validator schema.Validator) error {
+	for _, f := range []string{e.From, e.To} {
+		if f == updatedField {
+			continue
+		}
+		ex := &query.Exist{Field: f}
+		if err := ex.Prepare(validator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e DateDiff) String() string {
+	return fmt.Sprintf("%s: {$dateDiff: {$from: %q, $gt: %q}}", e.To, e.From, e.Min)
+}
+
+// Unsorted matches documents whose Field is an array of numbers not sorted in
+// ascending order. Empty and single-element arrays are always sorted, and
+// documents where Field is missing or not an array never match.
+//
+// It is translated into a $expr comparing the array with its $sortArray
+// version, which requires MongoDB 5.2 (see OptionsHandler.UnsortedArray) and
+// can't use indexes.
+type Unsorted struct {
+	Field string
+}
+
+// Match implements query.Expression interface.
+func (e Unsorted) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	a, ok := v.([]interface{})
+	if !ok {
+		return false
+	}
+	for i := 1; i < len(a); i++ {
+		prev, ok1 := toFloat(a[i-1])
+		cur, ok2 := toFloat(a[i])
+		if ok1 && ok2 && cur < prev {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepare implements query.Expression interface.
+func (e *Unsorted) Prepare(validator schema.Validator) error {
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e Unsorted) String() string {
+	return fmt.Sprintf("%s: {$unsorted: true}", e.Field)
+}
+
+// SizeMismatch matches documents whose Field and Other arrays have different
+// lengths, e.g. the orders with a quantity missing for some of their items.
+// Missing or null arrays count as empty, as do values which are not arrays.
+//
+// It is translated into a $expr comparing the $size of both fields, which
+// can't use indexes.
+type SizeMismatch struct {
+	Field string
+	Other string
+}
+
+// Match implements query.Expression interface.
+func (e SizeMismatch) Match(payload map[string]interface{}) bool {
+	return arrayLen(payload, e.Field) != arrayLen(payload, e.Other)
+}
+
+// Prepare implements query.Expression interface.
+func (e *SizeMismatch) Prepare(validator schema.Validator) error {
+	for _, f := range []string{e.Field, e.Other} {
+		ex := &query.Exist{Field: f}
+		if err := ex.Prepare(validator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e SizeMismatch) String() string {
+	return fmt.Sprintf("%s: {$sizeNe: %q}", e.Field, e.Other)
+}
+
+// FieldRegex matches documents whose string Field matches the regular
+// expression stored in their Pattern field, e.g. the inputs matching the
+// format of their own rule. Documents where either field is not a string
+// don't match.
+//
+// It is translated into a $expr applying $regexMatch to both fields, which
+// requires MongoDB 4.2 and can't use indexes. Patterns are compiled by the
+// server for each document: a query fails as soon as it meets an invalid
+// pattern, while Match considers such documents as not matching.
+type FieldRegex struct {
+	Field   string
+	Pattern string
+}
+
+// Match implements query.Expression interface.
+func (e FieldRegex) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	p, _ := getPath(payload, e.Pattern)
+	s, ok1 := v.(string)
+	pattern, ok2 := p.(string)
+	if !ok1 || !ok2 {
+		return false
+	}
+	re, err := regexp.Compile(pattern)
+	return err == nil && re.MatchString(s)
+}
+
+// Prepare implements query.Expression interface.
+func (e *FieldRegex) Prepare(validator schema.Validator) error {
+	for _, f := range []string{e.Field, e.Pattern} {
+		ex := &query.Exist{Field: f}
+		if err := ex.Prepare(validator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e FieldRegex) String() string {
+	return fmt.Sprintf("%s: {$regexField: %q}", e.Field, e.Pattern)
+}
+
+// arrayLen returns the length of the array at path in payload, zero if it is
+// not an array.
+func arrayLen(payload map[string]interface{}, path string) int {
+	v, _ := getPath(payload, path)
+	a, _ := v.([]interface{})
+	return len(a)
+}
+
+// toFloat converts a numeric value into a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+// FieldCount matches documents holding more than Min payload fields at their
+// top-level, e.g. to find documents with unexpected extra fields. The id and
+// the meta fields (etag, update, creation and expiration times) are not
+// counted. Use OptionsHandler.MoreFieldsThan to build the expression for a
+// handler storing meta fields under custom names (see Options.FieldMapping).
+// As stored fields are counted, sub-fields count individually with
+// Options.FlattenSeparator.
+//
+// It is translated into a $expr counting the fields with $objectToArray,
+// which requires MongoDB 3.6 and can't use indexes.
+type FieldCount struct {
+	Min int
+
+	// meta lists the stored meta fields, defaultMetaFields if nil.
+	meta []string
+}
+
+// defaultMetaFields are the stored fields not counted by FieldCount by
+// default.
+var defaultMetaFields = []string{"_id", "_etag", updatedField, createdField, seqField, lastAccessField, expireAtField}
+
+// Match implements query.Expression interface.
+func (e FieldCount) Match(payload map[string]interface{}) bool {
+	n := len(payload)
+	if _, found := payload["id"]; found {
+		n--
+	}
+	return n > e.Min
+}
+
+// Prepare implements query.Expression interface.
+func (e *FieldCount) Prepare(validator schema.Validator) error {
+	if e.Min < 0 {
+		return errors.New("$fieldCount: minimum must not be negative")
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e FieldCount) String() string {
+	return fmt.Sprintf("{$fieldCount: {$gt: %d}}", e.Min)
+}
+
+// metaFields returns the stored fields not counted by e.
+func (e FieldCount) metaFields() []string {
+	if e.meta == nil {
+		return defaultMetaFields
+	}
+	return e.meta
+}
+
+// updatedField is the field holding the last update time of items.
+const updatedField = "_updated"
+
+// createdField is the field holding the creation time of items when the
+// handler is configured with ServerTimestamps.
+const createdField = "_created"
+
+// UpdatedAfter returns an expression matching the items updated more than d
+// after the date held by field, e.g. the items modified long after their last
+// check. Items missing the field never match. It is a DateDiff from field to
+// the update time of items, so field must be stored as a date (see
+// Options.DateFields).
+//
+// The update time is not part of payloads: the expression can't be matched
+// against payloads in memory. Handlers compare field with the field mapped by
+// Options.FieldMapping, if any.
+func UpdatedAfter(field string, d time.Duration) query.Expression {
+	return &DateDiff{From: field, To: updatedField, Min: d}
+}
+
+// Text matches documents whose fields covered by the text index of the
+// collection (see EnsureTextIndex) hold words of Search, using the $text
+// operator. Language overrides the default language of the index, defining
+// stop words and stemming rules, and CaseSensitive disables the case
+// insensitive matching of words.
+//
+// MongoDB only allows $text at the root of a query, so a predicate can hold a
+// single Text expression, outside of $or and $elemMatch. As text indexes are
+// not available in memory, Match approximates the search by looking for any
+// word of Search in the string values of the payload.
+type Text struct {
+	Search        string
+	Language      string
+	CaseSensitive bool
+}
+
+// Match implements query.Expression interface.
+func (e Text) Match(payload map[string]interface{}) bool {
+	words := strings.Fields(e.Search)
+	if !e.CaseSensitive {
+		for i, w := range words {
+			words[i] = strings.ToLower(w)
+		}
+	}
+	return e.matchValue(payload, words)
+}
+
+func (e Text) matchValue(v interface{}, words []string) bool {
+	switch t := v.(type) {
+	case string:
+		if !e.CaseSensitive {
+			t = strings.ToLower(t)
+		}
+		for _, w := range words {
+			if strings.Contains(t, w) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, sv := range t {
+			if e.matchValue(sv, words) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, sv := range t {
+			if e.matchValue(sv, words) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Prepare implements query.Expression interface.
+func (e *Text) Prepare(validator schema.Validator) error {
+	if strings.TrimSpace(e.Search) == "" {
+		return errors.New("$text: search must not be empty")
+	}
+	return nil
+}
+
+// String implements query.Expression interface.
+func (e Text) String() string {
+	return fmt.Sprintf("{$text: {$search: %q, $language: %q, $caseSensitive: %t}}", e.Search, e.Language, e.CaseSensitive)
+}
+
+// doc returns the $text operator document of e.
+func (e Text) doc() bson.M {
+	d := bson.M{"$search": e.Search}
+	if e.Language != "" {
+		d["$language"] = e.Language
+	}
+	if e.CaseSensitive {
+		d["$caseSensitive"] = true
+	}
+	return d
+}
@@ -0,0 +1,384 @@
+package mongo
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestPrefixMatch(t *testing.T) {
+	e := Prefix{Field: "a.b", Value: "f.o"}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"a": map[string]interface{}{"b": "f.oo"}}, true},
+		{map[string]interface{}{"a": map[string]interface{}{"b": "fxoo"}}, false},
+		{map[string]interface{}{"a": map[string]interface{}{"b": 1}}, false},
+		{map[string]interface{}{}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestElemMatchCountMatch(t *testing.T) {
+	e := ElemMatchCount{Field: "c", Exps: []query.Expression{&query.Equal{Field: "u", Value: "x"}}, Min: 2}
+	comments := func(users ...string) map[string]interface{} {
+		c := []interface{}{}
+		for _, u := range users {
+			c = append(c, map[string]interface{}{"u": u})
+		}
+		return map[string]interface{}{"c": c}
+	}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{comments("x", "y", "x"), true},
+		{comments("x", "y"), false},
+		{map[string]interface{}{"c": []interface{}{"x", "x"}}, false},
+		{map[string]interface{}{}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestAllElemMatchMatch(t *testing.T) {
+	e := AllElemMatch{Field: "items", Exps: [][]query.Expression{
+		{&query.Equal{Field: "a", Value: 1}},
+		{&query.Equal{Field: "b", Value: 2}},
+	}}
+	items := func(elems ...map[string]interface{}) map[string]interface{} {
+		arr := []interface{}{}
+		for _, el := range elems {
+			arr = append(arr, el)
+		}
+		return map[string]interface{}{"items": arr}
+	}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{items(map[string]interface{}{"a": 1}, map[string]interface{}{"b": 2}), true},
+		{items(map[string]interface{}{"a": 1, "b": 2}), true},
+		{items(map[string]interface{}{"a": 1}, map[string]interface{}{"b": 3}), false},
+		{map[string]interface{}{"items": []interface{}{1, 2}}, false},
+		{map[string]interface{}{}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestNumberRegexMatch(t *testing.T) {
+	e := NumberRegex{Field: "n", Value: regexp.MustCompile(`^55\d$`)}
+	cases := []struct {
+		value interface{}
+		want  bool
+	}{
+		{551, true},
+		{int64(552), true},
+		{float64(553), true},
+		{"554", true},
+		{5.5, false},
+		{5551, false},
+		{nil, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(map[string]interface{}{"n": tc.value}); got != tc.want {
+			t.Errorf("Match(%#v): got: %v want: %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestDateDiffMatch(t *testing.T) {
+	e := DateDiff{From: "created", To: "meta.resolved", Min: time.Hour}
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"created": created, "meta": map[string]interface{}{"resolved": created.Add(2 * time.Hour)}}, true},
+		{map[string]interface{}{"created": "2023-01-01T00:00:00Z", "meta": map[string]interface{}{"resolved": "2023-01-01T03:00:00Z"}}, true},
+		{map[string]interface{}{"created": created, "meta": map[string]interface{}{"resolved": created.Add(time.Hour)}}, false},
+		{map[string]interface{}{"created": created}, false},
+		{map[string]interface{}{"meta": map[string]interface{}{"resolved": created}}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestUnsortedMatch(t *testing.T) {
+	e := Unsorted{Field: "scores"}
+	cases := []struct {
+		value interface{}
+		want  bool
+	}{
+		{[]interface{}{1, 3, 2}, true},
+		{[]interface{}{1.5, int64(1)}, true},
+		{[]interface{}{1, 1, 2.5}, false},
+		{[]interface{}{4}, false},
+		{[]interface{}{}, false},
+		{3, false},
+		{nil, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(map[string]interface{}{"scores": tc.value}); got != tc.want {
+			t.Errorf("Match(%#v): got: %v want: %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestSizeMismatchMatch(t *testing.T) {
+	e := SizeMismatch{Field: "items", Other: "meta.quantities"}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"items": []interface{}{"a", "b"}, "meta": map[string]interface{}{"quantities": []interface{}{1}}}, true},
+		{map[string]interface{}{"items": []interface{}{"a"}, "meta": map[string]interface{}{"quantities": []interface{}{1}}}, false},
+		{map[string]interface{}{"items": []interface{}{"a"}}, true},
+		{map[string]interface{}{"items": []interface{}{}}, false},
+		{map[string]interface{}{"items": "a", "meta": map[string]interface{}{"quantities": []interface{}{1}}}, true},
+		{map[string]interface{}{}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestFieldRegexMatch(t *testing.T) {
+	e := FieldRegex{Field: "text", Pattern: "rule.pattern"}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"text": "abc", "rule": map[string]interface{}{"pattern": "^a"}}, true},
+		{map[string]interface{}{"text": "abc", "rule": map[string]interface{}{"pattern": "^b"}}, false},
+		{map[string]interface{}{"text": "abc", "rule": map[string]interface{}{"pattern": "("}}, false},
+		{map[string]interface{}{"text": 1, "rule": map[string]interface{}{"pattern": "1"}}, false},
+		{map[string]interface{}{"text": "abc"}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestNotMatch(t *testing.T) {
+	e := Not{Exp: &query.GreaterThan{Field: "price", Value: 10.0}}
+	s := schema.Schema{Fields: schema.Fields{"price": {Filterable: true, Validator: &schema.Float{}}}}
+	if err := e.Prepare(s); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"price": 5.0}, true},
+		{map[string]interface{}{"price": 10.0}, true},
+		{map[string]interface{}{"price": 15.0}, false},
+		{map[string]interface{}{}, true},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		version string
+		want    bool
+	}{
+		{"5.2.0", true},
+		{"5.2", true},
+		{"6.0.3", true},
+		{"5.10.1", true},
+		{"5.3.0-rc1", true},
+		{"5.1.9", false},
+		{"4.4.6", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := versionAtLeast(tc.version, 5, 2); got != tc.want {
+			t.Errorf("versionAtLeast(%q, 5, 2): got: %v want: %v", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestTextMatch(t *testing.T) {
+	payload := map[string]interface{}{
+		"title": "Red Shoes",
+		"tags":  []interface{}{"summer"},
+		"meta":  map[string]interface{}{"brand": "Acme"},
+	}
+	cases := []struct {
+		e    Text
+		want bool
+	}{
+		{Text{Search: "shoes boots"}, true},
+		{Text{Search: "acme"}, true},
+		{Text{Search: "summer"}, true},
+		{Text{Search: "boots"}, false},
+		{Text{Search: "shoes", CaseSensitive: true}, false},
+	}
+	for _, tc := range cases {
+		if got := tc.e.Match(payload); got != tc.want {
+			t.Errorf("%v.Match: got: %v want: %v", tc.e, got, tc.want)
+		}
+	}
+}
+
+func TestAllMatch(t *testing.T) {
+	e := All{Field: "tags", Values: []query.Value{"a", "b"}}
+	cases := []struct {
+		value interface{}
+		want  bool
+	}{
+		{[]interface{}{"b", "c", "a"}, true},
+		{[]interface{}{"a", "b"}, true},
+		{[]interface{}{"a", "c"}, false},
+		{[]interface{}{}, false},
+		{"a", false},
+		{nil, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(map[string]interface{}{"tags": tc.value}); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.value, got, tc.want)
+		}
+	}
+	if got := (All{Field: "tags", Values: []query.Value{"a"}}).Match(map[string]interface{}{"tags": "a"}); !got {
+		t.Error("Match(a): got: false want: true")
+	}
+	if err := (&All{Field: "tags"}).Prepare(nil); err == nil {
+		t.Error("Prepare: expected error for an empty $all, got nil")
+	}
+}
+
+func TestDateBetweenMatch(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := DateBetween{Field: "d", Start: start, End: start.Add(24 * time.Hour)}
+	cases := []struct {
+		value interface{}
+		want  bool
+	}{
+		{start, true},
+		{start.Add(24 * time.Hour), true},
+		{"2023-01-01T12:00:00Z", true},
+		{"2023-01-02", true},
+		{start.Add(-time.Second), false},
+		{"2023-01-03", false},
+		{"yesterday", false},
+		{nil, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(map[string]interface{}{"d": tc.value}); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.value, got, tc.want)
+		}
+	}
+	if err := (&DateBetween{Field: "d", Start: start, End: start.Add(-time.Hour)}).Prepare(nil); err == nil {
+		t.Error("Prepare: expected error for an end before start, got nil")
+	}
+}
+
+func TestModMatch(t *testing.T) {
+	e := Mod{Field: "n", Divisor: 16, Remainder: 3}
+	cases := []struct {
+		value interface{}
+		want  bool
+	}{
+		{19, true},
+		{int64(35), true},
+		{3.9, true},
+		{20, false},
+		{-13, false},
+		{"19", false},
+		{nil, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(map[string]interface{}{"n": tc.value}); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.value, got, tc.want)
+		}
+	}
+	if got := (Mod{Field: "n", Divisor: 16, Remainder: -3}).Match(map[string]interface{}{"n": -19}); !got {
+		t.Error("Match(-19): got: false want: true")
+	}
+	if err := (&Mod{Field: "n"}).Prepare(nil); err == nil {
+		t.Error("Prepare: expected an error for a zero divisor, got nil")
+	}
+}
+
+func TestGeoMatch(t *testing.T) {
+	point := func(lng, lat float64) map[string]interface{} {
+		return map[string]interface{}{"loc": map[string]interface{}{"type": "Point", "coordinates": []interface{}{lng, lat}}}
+	}
+	near := Near{Field: "loc", Point: []float64{2.35, 48.85}, MinDistance: 100, MaxDistance: 5000}
+	within := GeoWithin{Field: "loc", Polygon: [][]float64{{2, 48}, {3, 48}, {3, 49}, {2, 49}}}
+	cases := []struct {
+		payload      map[string]interface{}
+		near, within bool
+	}{
+		{point(2.35, 48.86), true, true},  // ~1.1km
+		{point(2.35, 48.85), false, true}, // closer than min distance
+		{point(2.5, 48.9), false, true},   // ~12km
+		{point(-0.12, 51.5), false, false},
+		{map[string]interface{}{"loc": []interface{}{2.35, 48.86}}, false, false},
+		{map[string]interface{}{}, false, false},
+	}
+	for _, tc := range cases {
+		if got := near.Match(tc.payload); got != tc.near {
+			t.Errorf("Near.Match(%v): got: %v want: %v", tc.payload, got, tc.near)
+		}
+		if got := within.Match(tc.payload); got != tc.within {
+			t.Errorf("GeoWithin.Match(%v): got: %v want: %v", tc.payload, got, tc.within)
+		}
+	}
+	if err := (&Near{Field: "loc", Point: []float64{1}}).Prepare(nil); err == nil {
+		t.Error("Near.Prepare: expected an error for an invalid point, got nil")
+	}
+	if err := (&GeoWithin{Field: "loc", Polygon: [][]float64{{0, 0}, {1, 1}}}).Prepare(nil); err == nil {
+		t.Error("GeoWithin.Prepare: expected an error for a polygon of 2 points, got nil")
+	}
+}
+
+func TestFieldCountMatch(t *testing.T) {
+	e := FieldCount{Min: 1}
+	cases := []struct {
+		payload map[string]interface{}
+		want    bool
+	}{
+		{map[string]interface{}{"id": "1", "a": 1}, false},
+		{map[string]interface{}{"id": "1", "a": 1, "b": map[string]interface{}{"c": 1, "d": 2}}, true},
+		{map[string]interface{}{"a": 1, "b": 2}, true},
+		{map[string]interface{}{}, false},
+	}
+	for _, tc := range cases {
+		if got := e.Match(tc.payload); got != tc.want {
+			t.Errorf("Match(%v): got: %v want: %v", tc.payload, got, tc.want)
+		}
+	}
+	m := OptionsHandler{opts: Options{FieldMapping: FieldMapping{ETag: "version"}}}
+	if got, want := m.MoreFieldsThan(2).(*FieldCount).metaFields(), []string{"_id", "version", "_updated", "_created", "_seq", "_lastAccess", "_expireAt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MoreFieldsThan meta fields: got: %v want: %v", got, want)
+	}
+}
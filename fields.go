@@ -0,0 +1,105 @@
+package mongo
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FieldMapping defines the names of the fields storing the etag and update
+// time of items, e.g. to use a legacy collection storing etags in a "version"
+// field. Ids are always stored in _id, as required by MongoDB.
+type FieldMapping struct {
+	// ETag is the field storing etags, "_etag" by default.
+	ETag string
+	// Updated is the field storing update times, "_updated" by default.
+	Updated string
+}
+
+// etagField returns the name of the field storing etags.
+func (m OptionsHandler) etagField() string {
+	if m.opts.FieldMapping.ETag != "" {
+		return m.opts.FieldMapping.ETag
+	}
+	return "_etag"
+}
+
+// updatedField returns the name of the field storing update times.
+func (m OptionsHandler) updatedField() string {
+	if m.opts.FieldMapping.Updated != "" {
+		return m.opts.FieldMapping.Updated
+	}
+	return updatedField
+}
+
+// mappedFields reports whether the etag or update time are stored under
+// custom names.
+func (m OptionsHandler) mappedFields() bool {
+	return m.etagField() != "_etag" || m.updatedField() != updatedField
+}
+
+// metaField reports whether f is one of the fields managed by the handler,
+// which can't be changed directly.
+func (m OptionsHandler) metaField(f string) bool {
+	return f == "id" || f == "_id" || f == "_etag" || f == "_updated" || f == m.etagField() || f == m.updatedField() || f == createdField || f == seqField || f == lastAccessField
+}
+
+// etagCondition adds to the selector s the condition for a write to only apply
+// to the item with etag.
+func (m OptionsHandler) etagCondition(s bson.M, etag string) {
+	if strings.HasPrefix(etag, "p-") {
+		// If the original ETag is in "p-[id]" format,
+		// then _etag field must be absent from the resource in DB
+		s[m.etagField()] = bson.M{"$exists": false}
+	} else {
+		s[m.etagField()] = etag
+	}
+}
+
+// renameMeta renames the default etag and update time keys of the document d
+// to their mapped names.
+func (m OptionsHandler) renameMeta(d bson.M) bson.M {
+	if !m.mappedFields() || d == nil {
+		return d
+	}
+	for from, to := range map[string]string{"_etag": m.etagField(), "_updated": m.updatedField()} {
+		if v, found := d[from]; found && from != to {
+			delete(d, from)
+			d[to] = v
+		}
+	}
+	return d
+}
+
+// storedItem is a mongoItem stored with the default field names.
+type storedItem mongoItem
+
+// GetBSON implements bson.Getter, storing the etag and update time under
+// their mapped names.
+func (i *mongoItem) GetBSON() (interface{}, error) {
+	if i.etagField == "" {
+		return (*storedItem)(i), nil
+	}
+	d := make(bson.M, len(i.Payload)+3)
+	for k, v := range i.Payload {
+		d[k] = v
+	}
+	d["_id"] = i.ID
+	d[i.etagField] = i.ETag
+	d[i.updatedField] = i.Updated
+	return d, nil
+}
+
+// readMeta moves the etag and update time stored under their mapped names
+// from the payload of i into its fields.
+func (m OptionsHandler) readMeta(i *mongoItem) {
+	if etag, found := i.Payload[m.etagField()]; found {
+		i.ETag, _ = etag.(string)
+		delete(i.Payload, m.etagField())
+	}
+	if updated, found := i.Payload[m.updatedField()]; found {
+		i.Updated, _ = updated.(time.Time)
+		delete(i.Payload, m.updatedField())
+	}
+}
@@ -0,0 +1,64 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFieldMapping(t *testing.T) {
+	updated := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		mapping FieldMapping
+		etag    string
+		updated string
+	}{
+		{"default", FieldMapping{}, "_etag", "_updated"},
+		{"mapped", FieldMapping{ETag: "version", Updated: "modifiedAt"}, "version", "modifiedAt"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := OptionsHandler{opts: Options{FieldMapping: tc.mapping}}
+			mItem, err := m.newMongoItem(&resource.Item{ID: "1", ETag: "a", Updated: updated, Payload: map[string]interface{}{"id": "1", "foo": "bar"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := bson.Marshal(mItem)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc bson.M
+			if err := bson.Unmarshal(b, &doc); err != nil {
+				t.Fatal(err)
+			}
+			want := bson.M{"_id": "1", tc.etag: "a", tc.updated: updated.Local(), "foo": "bar"}
+			if !reflect.DeepEqual(doc, want) {
+				t.Errorf("stored:\ngot:  %#v\nwant: %#v", doc, want)
+			}
+
+			var read mongoItem
+			if err := bson.Unmarshal(b, &read); err != nil {
+				t.Fatal(err)
+			}
+			item := m.newItem(&read)
+			if item.ETag != "a" || !item.Updated.Equal(updated) || !reflect.DeepEqual(item.Payload, map[string]interface{}{"id": "1", "foo": "bar"}) {
+				t.Errorf("read: got: %#v", item)
+			}
+
+			s := bson.M{}
+			m.etagCondition(s, "p-1")
+			if want := (bson.M{tc.etag: bson.M{"$exists": false}}); !reflect.DeepEqual(s, want) {
+				t.Errorf("etagCondition: got: %#v want: %#v", s, want)
+			}
+			if got, want := m.renameMeta(bson.M{"foo": 1, "_etag": 1, "_updated": 1}), (bson.M{"foo": 1, tc.etag: 1, tc.updated: 1}); !reflect.DeepEqual(got, want) {
+				t.Errorf("renameMeta: got: %#v want: %#v", got, want)
+			}
+			if !m.metaField(tc.etag) || !m.metaField(tc.updated) || m.metaField("foo") {
+				t.Error("metaField: mapped fields should be managed by the handler")
+			}
+		})
+	}
+}
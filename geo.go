@@ -0,0 +1,270 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DistanceField is the payload field set by FindNear to the distance in meters
+// between each returned item and the searched point.
+const DistanceField = "_distance"
+
+// FindNear returns the items whose GeoJSON field is the nearest to point, a
+// [longitude, latitude] pair, ordered nearest-first. The distance in meters is
+// injected in the payload of each item as DistanceField. Items further than
+// maxDist meters are ignored unless maxDist is zero, and at most limit items
+// are returned unless limit is zero.
+//
+// The field must be covered by a 2dsphere index (see EnsureGeoIndex).
+func (m OptionsHandler) FindNear(ctx context.Context, field string, point []float64, maxDist float64, limit int) (_ *resource.ItemList, err error) {
+	defer func() { err = classifyError(err) }()
+	if len(point) != 2 {
+		return nil, errors.New("near: point must be a [longitude, latitude] pair")
+	}
+	if maxDist < 0 || limit < 0 {
+		return nil, errors.New("near: max distance and limit must not be negative")
+	}
+	geoNear := bson.M{
+		"near":          bson.M{"type": "Point", "coordinates": point},
+		"distanceField": DistanceField,
+		"spherical":     true,
+		"key":           getField(m.flatField(field)),
+	}
+	if maxDist > 0 {
+		geoNear["maxDistance"] = maxDist
+	}
+	pipeline := []bson.M{{"$geoNear": geoNear}}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+
+	iter := c.Pipe(pipeline).Iter()
+	list := &resource.ItemList{
+		Total: -1,
+		Limit: -1,
+		Items: []*resource.Item{},
+	}
+	if limit > 0 {
+		list.Limit = limit
+	}
+	var mItem mongoItem
+	for iter.Next(&mItem) {
+		if err = m.err(ctx); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		list.Items = append(list.Items, m.newItem(&mItem))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if limit == 0 || len(list.Items) < limit {
+		list.Total = len(list.Items)
+	}
+	return list, nil
+}
+
+// FindNear returns the items nearest to point, nearest first, with their
+// distance.
+func (m Handler) FindNear(ctx context.Context, field string, point []float64, maxDist float64, limit int) (*resource.ItemList, error) {
+	return m.options().FindNear(ctx, field, point, maxDist, limit)
+}
+
+// Near matches documents whose GeoJSON point Field is between MinDistance and
+// MaxDistance meters from Point, a [longitude, latitude] pair. Distances are
+// not bounded when zero. Unless the query is sorted, documents are returned
+// nearest-first.
+//
+// It is translated into a $near condition, which requires a 2dsphere index on
+// Field (see EnsureGeoIndex). MongoDB allows a single $near per query, which
+// can't be nested in $or or $elemMatch.
+type Near struct {
+	Field       string
+	Point       []float64
+	MinDistance float64
+	MaxDistance float64
+}
+
+// Match implements query.Expression interface.
+func (e Near) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	p, ok := geoPoint(v)
+	if !ok || len(e.Point) != 2 {
+		return false
+	}
+	d := earthDistance(e.Point, p)
+	return d >= e.MinDistance && (e.MaxDistance == 0 || d <= e.MaxDistance)
+}
+
+// Prepare implements query.Expression interface.
+func (e *Near) Prepare(validator schema.Validator) error {
+	if len(e.Point) != 2 {
+		return fmt.Errorf("%s: $near point must be a [longitude, latitude] pair", e.Field)
+	}
+	if e.MinDistance < 0 || e.MaxDistance < 0 {
+		return fmt.Errorf("%s: $near distances must not be negative", e.Field)
+	}
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e Near) String() string {
+	return fmt.Sprintf("%s: {$near: %v, $minDistance: %v, $maxDistance: %v}", e.Field, e.Point, e.MinDistance, e.MaxDistance)
+}
+
+func (e Near) doc() bson.M {
+	near := bson.M{"$geometry": bson.M{"type": "Point", "coordinates": e.Point}}
+	if e.MinDistance > 0 {
+		near["$minDistance"] = e.MinDistance
+	}
+	if e.MaxDistance > 0 {
+		near["$maxDistance"] = e.MaxDistance
+	}
+	return near
+}
+
+// NearSphere matches documents whose GeoJSON point Field is between
+// MinDistance and MaxDistance meters from Point, a [longitude, latitude] pair,
+// computed on a sphere. Distances are not bounded when zero. Unless the query
+// is sorted, documents are returned nearest-first.
+//
+// It is translated into a $nearSphere condition, which requires a 2dsphere
+// index on Field (see EnsureGeoIndex). Like $near, MongoDB allows a single
+// $nearSphere per query, which can't be nested in $or or $elemMatch.
+type NearSphere struct {
+	Field       string
+	Point       []float64
+	MinDistance float64
+	MaxDistance float64
+}
+
+// Match implements query.Expression interface.
+func (e NearSphere) Match(payload map[string]interface{}) bool {
+	return Near(e).Match(payload)
+}
+
+// Prepare implements query.Expression interface.
+func (e *NearSphere) Prepare(validator schema.Validator) error {
+	if len(e.Point) != 2 {
+		return fmt.Errorf("%s: $nearSphere point must be a [longitude, latitude] pair", e.Field)
+	}
+	if e.MinDistance < 0 || e.MaxDistance < 0 {
+		return fmt.Errorf("%s: $nearSphere distances must not be negative", e.Field)
+	}
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e NearSphere) String() string {
+	return fmt.Sprintf("%s: {$nearSphere: %v, $minDistance: %v, $maxDistance: %v}", e.Field, e.Point, e.MinDistance, e.MaxDistance)
+}
+
+// GeoWithin matches documents whose GeoJSON point Field lies within Polygon,
+// a ring of at least 3 [longitude, latitude] pairs, closed automatically if
+// its last point differs from the first one.
+//
+// It is translated into a $geoWithin condition, which can use a 2dsphere index
+// on Field (see EnsureGeoIndex). MongoDB uses spherical geometry, while Match
+// considers coordinates as planar, so both only agree for small polygons.
+type GeoWithin struct {
+	Field   string
+	Polygon [][]float64
+}
+
+// Match implements query.Expression interface.
+func (e GeoWithin) Match(payload map[string]interface{}) bool {
+	v, _ := getPath(payload, e.Field)
+	p, ok := geoPoint(v)
+	if !ok {
+		return false
+	}
+	// Ray casting: count the edges crossed by a ray going east from p.
+	in := false
+	ring := e.Polygon
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if len(a) != 2 || len(b) != 2 {
+			return false
+		}
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// Prepare implements query.Expression interface.
+func (e *GeoWithin) Prepare(validator schema.Validator) error {
+	if len(e.Polygon) < 3 {
+		return fmt.Errorf("%s: $geoWithin polygon must have at least 3 points", e.Field)
+	}
+	for _, p := range e.Polygon {
+		if len(p) != 2 {
+			return fmt.Errorf("%s: $geoWithin points must be [longitude, latitude] pairs", e.Field)
+		}
+	}
+	ex := &query.Exist{Field: e.Field}
+	return ex.Prepare(validator)
+}
+
+// String implements query.Expression interface.
+func (e GeoWithin) String() string {
+	return fmt.Sprintf("%s: {$geoWithin: %v}", e.Field, e.Polygon)
+}
+
+func (e GeoWithin) doc() bson.M {
+	ring := e.Polygon
+	if first, last := ring[0], ring[len(ring)-1]; first[0] != last[0] || first[1] != last[1] {
+		ring = append(append([][]float64{}, ring...), first)
+	}
+	return bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": [][][]float64{ring}}}
+}
+
+// geoPoint returns the [longitude, latitude] pair of the GeoJSON point v.
+func geoPoint(v interface{}) ([]float64, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || m["type"] != "Point" {
+		return nil, false
+	}
+	switch c := m["coordinates"].(type) {
+	case []float64:
+		if len(c) == 2 {
+			return c, true
+		}
+	case []interface{}:
+		if len(c) == 2 {
+			lng, ok1 := toFloat(c[0])
+			lat, ok2 := toFloat(c[1])
+			return []float64{lng, lat}, ok1 && ok2
+		}
+	}
+	return nil, false
+}
+
+// earthRadius is the radius of the Earth in meters used by MongoDB.
+const earthRadius = 6378100
+
+// earthDistance returns the distance in meters between the [longitude,
+// latitude] pairs a and b, using the haversine formula.
+func earthDistance(a, b []float64) float64 {
+	rad := math.Pi / 180
+	dLat := (b[1] - a[1]) * rad
+	dLng := (b[0] - a[0]) * rad
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(a[1]*rad)*math.Cos(b[1]*rad)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
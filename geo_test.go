@@ -0,0 +1,129 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestFindNear(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	if err := s.DB("").C("test").EnsureIndex(mgo.Index{Key: []string{"$2dsphere:loc"}}); err != nil {
+		t.Fatal(err)
+	}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	point := func(lng, lat float64) map[string]interface{} {
+		return map[string]interface{}{"type": "Point", "coordinates": []float64{lng, lat}}
+	}
+	items := []*resource.Item{
+		{ID: "far", Payload: map[string]interface{}{"id": "far", "loc": point(2.5, 48.9)}},
+		{ID: "near", Payload: map[string]interface{}{"id": "near", "loc": point(2.35, 48.86)}},
+		{ID: "mid", Payload: map[string]interface{}{"id": "mid", "loc": point(2.4, 48.87)}},
+		{ID: "away", Payload: map[string]interface{}{"id": "away", "loc": point(-0.12, 51.5)}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.FindNear(context.Background(), "loc", []float64{2.35, 48.85}, 50000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"near", "mid", "far"}
+	if len(l.Items) != len(want) || l.Total != len(want) {
+		t.Fatalf("got: %v want: %v", l.Items, want)
+	}
+	prev := -1.0
+	for i, item := range l.Items {
+		if item.ID != want[i] {
+			t.Errorf("item %d: got: %v want: %v", i, item.ID, want[i])
+		}
+		d, ok := item.Payload[mongo.DistanceField].(float64)
+		if !ok || d < prev {
+			t.Errorf("item %d: got distance: %#v, want > %v", i, item.Payload[mongo.DistanceField], prev)
+		}
+		prev = d
+	}
+
+	l, err = h.FindNear(context.Background(), "loc", []float64{2.35, 48.85}, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 2 || l.Items[0].ID != "near" || l.Items[1].ID != "mid" || l.Total != -1 {
+		t.Errorf("got: %v (total %d) want: [near mid] (total -1)", l.Items, l.Total)
+	}
+
+	if _, err := h.FindNear(context.Background(), "loc", []float64{2.35}, 0, 0); err == nil {
+		t.Error("expected error for invalid point")
+	}
+}
+
+func TestFindNearExpression(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	if err := mongo.EnsureGeoIndex(context.Background(), h, "loc"); err != nil {
+		t.Fatal(err)
+	}
+	point := func(lng, lat float64) map[string]interface{} {
+		return map[string]interface{}{"type": "Point", "coordinates": []float64{lng, lat}}
+	}
+	items := []*resource.Item{
+		{ID: "far", Payload: map[string]interface{}{"id": "far", "loc": point(2.5, 48.9)}},
+		{ID: "near", Payload: map[string]interface{}{"id": "near", "loc": point(2.35, 48.86)}},
+		{ID: "mid", Payload: map[string]interface{}{"id": "mid", "loc": point(2.4, 48.87)}},
+		{ID: "away", Payload: map[string]interface{}{"id": "away", "loc": point(-0.12, 51.5)}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		exp  query.Expression
+		want []string
+	}{
+		{"near", &mongo.Near{Field: "loc", Point: []float64{2.35, 48.85}, MaxDistance: 50000}, []string{"near", "mid", "far"}},
+		{"near with min distance", &mongo.Near{Field: "loc", Point: []float64{2.35, 48.85}, MinDistance: 2000, MaxDistance: 50000}, []string{"mid", "far"}},
+		{"near sphere", &mongo.NearSphere{Field: "loc", Point: []float64{2.35, 48.85}, MinDistance: 2000, MaxDistance: 15000}, []string{"mid", "far"}},
+		{"within", &mongo.GeoWithin{Field: "loc", Polygon: [][]float64{{2.3, 48.8}, {2.45, 48.8}, {2.45, 48.9}, {2.3, 48.9}}}, []string{"mid", "near"}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			// Near results are sorted by distance, unless a sort is given.
+			sort := query.Sort{}
+			if _, ok := tc.exp.(*mongo.GeoWithin); ok {
+				sort = query.Sort{{Name: "id"}}
+			}
+			l, err := h.Find(context.Background(), &query.Query{Predicate: query.Predicate{tc.exp}, Sort: sort})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, item := range l.Items {
+				got = append(got, item.ID.(string))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+
+	// Near queries are not aggregated for ConsistentTotal.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ConsistentTotal: true})
+	q := &query.Query{Predicate: query.Predicate{cases[0].exp}, Window: &query.Window{Limit: 2}}
+	l, err := h.Find(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 2 || l.Items[0].ID != "near" || l.Items[1].ID != "mid" {
+		t.Errorf("ConsistentTotal: got: %v want: [near mid]", l.Items)
+	}
+}
@@ -0,0 +1,143 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FindWithGroupCounts is like Find, but also returns the number of items per
+// value of groupField among all the items matching q, not only those in the
+// window of q, e.g. to display facet counts next to a page of results. Values
+// are formatted with fmt.Sprint, and items missing groupField are counted
+// under the empty string. As the total is then known, it is always set.
+//
+// Both are computed by a single $facet aggregation, whose result must fit in
+// a 16MiB document: large windows of big items should be avoided.
+func (m OptionsHandler) FindWithGroupCounts(ctx context.Context, q *query.Query, groupField string) (_ *resource.ItemList, _ map[string]int, err error) {
+	defer func() { err = classifyError(err) }()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	qry, _ = m.restrictQuery(ctx, qry)
+	limit := -1
+	if q.Window != nil {
+		limit = q.Window.Limit
+	}
+	facet := bson.M{
+		"counts": []bson.M{{"$group": bson.M{
+			"_id": "$" + getField(m.flatField(groupField)),
+			"n":   bson.M{"$sum": 1},
+		}}},
+	}
+	if limit != 0 {
+		// $limit must be positive: the items are not read for an empty window.
+		facet["items"] = findPipeline(qry, m.getSort(q), q.Window, nil)[1:]
+	}
+	pipeline := []bson.M{{"$match": qry}, {"$facet": facet}}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer m.close(c)
+
+	var res struct {
+		Items  []mongoItem `bson:"items"`
+		Counts []struct {
+			Value interface{} `bson:"_id"`
+			N     int         `bson:"n"`
+		} `bson:"counts"`
+	}
+	err = m.pipeOne(ctx, c, pipeline, &res)
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list := &resource.ItemList{
+		Limit: limit,
+		Items: make([]*resource.Item, 0, len(res.Items)),
+	}
+	for i := range res.Items {
+		list.Items = append(list.Items, m.newItem(&res.Items[i]))
+	}
+	counts := make(map[string]int, len(res.Counts))
+	for _, g := range res.Counts {
+		key := ""
+		if g.Value != nil {
+			key = fmt.Sprint(g.Value)
+		}
+		counts[key] += g.N
+		list.Total += g.N
+	}
+	return list, counts, nil
+}
+
+// FindWithGroupCounts is like Find, and also counts the matching items by
+// value of groupField.
+func (m Handler) FindWithGroupCounts(ctx context.Context, q *query.Query, groupField string) (*resource.ItemList, map[string]int, error) {
+	return m.options().FindWithGroupCounts(ctx, q, groupField)
+}
+
+// findWithTotal returns the items matching qry sorted by srt in the window w,
+// followed by stages, along with the total number of items matching qry, both
+// read by a single $facet aggregation.
+func (m OptionsHandler) findWithTotal(ctx context.Context, c *mgo.Collection, qry bson.M, srt []string, w *query.Window, stages []bson.M) (*resource.ItemList, error) {
+	pipeline := []bson.M{{"$match": qry}, {"$facet": bson.M{
+		"total": []bson.M{{"$count": "n"}},
+		"items": findPipeline(qry, srt, w, stages)[1:],
+	}}}
+	var res struct {
+		Items []mongoItem `bson:"items"`
+		Total []struct {
+			N int `bson:"n"`
+		} `bson:"total"`
+	}
+	err := m.pipeOne(ctx, c, pipeline, &res)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := &resource.ItemList{
+		Limit: -1,
+		Items: make([]*resource.Item, 0, len(res.Items)),
+	}
+	if w != nil {
+		list.Limit = w.Limit
+	}
+	if len(res.Total) > 0 {
+		// No document is output by $count when no item matches.
+		list.Total = res.Total[0].N
+	}
+	for i := range res.Items {
+		list.Items = append(list.Items, m.newItem(&res.Items[i]))
+	}
+	return list, nil
+}
+
+// pipeOne unmarshals into result the first document returned by the
+// aggregation pipeline run on c, like mgo.Pipe.One, but with the read concern
+// of the handler.
+func (m OptionsHandler) pipeOne(ctx context.Context, c *mgo.Collection, pipeline []bson.M, result interface{}) error {
+	iter, err := m.pipeIter(ctx, c, pipeline)
+	if err != nil {
+		return err
+	}
+	if iter.Next(result) {
+		return iter.Close()
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return mgo.ErrNotFound
+}
@@ -0,0 +1,136 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestFindWithGroupCounts(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "status": "open", "age": 1}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "status": "closed", "age": 2}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "status": "open", "age": 3}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "age": 4}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "status": "open", "age": 5}},
+		{ID: "6", Payload: map[string]interface{}{"id": "6", "status": "closed", "age": 0}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, counts, err := h.FindWithGroupCounts(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{age:{$gt:0}}`),
+		Window:    &query.Window{Offset: 1, Limit: 2},
+	}, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []interface{}
+	for _, item := range l.Items {
+		ids = append(ids, item.ID)
+	}
+	if want := []interface{}{"2", "3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got: items %v want: %v", ids, want)
+	}
+	if l.Total != 5 || l.Limit != 2 {
+		t.Errorf("got: total %d, limit %d want: 5, 2", l.Total, l.Limit)
+	}
+	if want := map[string]int{"open": 3, "closed": 1, "": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got: counts %v want: %v", counts, want)
+	}
+
+	l, counts, err = h.FindWithGroupCounts(context.Background(), &query.Query{
+		Window: &query.Window{Limit: 0},
+	}, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 0 || l.Total != 6 {
+		t.Errorf("got: %d items, total %d want: 0, 6", len(l.Items), l.Total)
+	}
+	if want := map[string]int{"open": 3, "closed": 2, "": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got: counts %v want: %v", counts, want)
+	}
+}
+
+func TestFindConsistentTotal(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ConsistentTotal: true})
+	items := make([]*resource.Item, 10)
+	for i := range items {
+		id := strconv.Itoa(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}}
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &query.Query{
+		Predicate: query.MustParsePredicate(`{n:{$gte:2}}`),
+		Sort:      query.Sort{{Name: "n"}},
+		Window:    &query.Window{Offset: 1, Limit: 3},
+	}
+	l, err := h.Find(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []interface{}
+	for _, item := range l.Items {
+		ids = append(ids, item.ID)
+	}
+	if want := []interface{}{"3", "4", "5"}; !reflect.DeepEqual(ids, want) || l.Total != 8 || l.Limit != 3 {
+		t.Errorf("got: %v (total %d, limit %d) want: %v (total 8, limit 3)", ids, l.Total, l.Limit, want)
+	}
+
+	// Items are written while reading: the total always matches the items
+	// of a page holding all of them.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 10; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			id := strconv.Itoa(i)
+			item := &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}}
+			if err := h.Insert(context.Background(), []*resource.Item{item}); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%2 == 0 {
+				if err := h.Delete(context.Background(), item); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	q = &query.Query{Window: &query.Window{Limit: 100000}}
+	for i := 0; i < 50; i++ {
+		l, err := h.Find(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Total != len(l.Items) {
+			t.Errorf("got: total %d for %d items", l.Total, len(l.Items))
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
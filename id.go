@@ -2,8 +2,11 @@ package mongo
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/rs/rest-layer/schema"
 	"gopkg.in/mgo.v2/bson"
@@ -12,24 +15,49 @@ import (
 var (
 	// NewObjectID is a field hook handler that generates a new Mongo ObjectID hex if
 	// value is nil to be used in schema with OnInit.
-	NewObjectID = func(ctx context.Context, value interface{}) interface{} {
+	NewObjectID = NewIDHook(func() string {
+		return bson.NewObjectId().Hex()
+	})
+
+	// ObjectIDField is a common schema field configuration that generate an Object ID
+	// for new item id.
+	ObjectIDField = IDField(NewObjectID, &ObjectID{})
+
+	// NewUUID is a field hook handler that generates a new random (version 4)
+	// UUID if value is nil to be used in schema with OnInit.
+	NewUUID = NewIDHook(newUUID)
+
+	// UUIDField is a common schema field configuration that generate a UUID
+	// for new item id.
+	UUIDField = IDField(NewUUID, &UUID{})
+)
+
+// NewIDHook returns a field hook handler that generates a new id using gen if
+// value is nil to be used in schema with OnInit. It allows ids to be generated
+// with another strategy than ObjectID, e.g. ULID or KSUID for lexicographic
+// sortability.
+func NewIDHook(gen func() string) func(ctx context.Context, value interface{}) interface{} {
+	return func(ctx context.Context, value interface{}) interface{} {
 		if value == nil {
-			value = bson.NewObjectId().Hex()
+			value = gen()
 		}
 		return value
 	}
+}
 
-	// ObjectIDField is a common schema field configuration that generate an Object ID
-	// for new item id.
-	ObjectIDField = schema.Field{
+// IDField returns a schema field configuration, similar to ObjectIDField,
+// generating new item ids with the onInit hook (see NewIDHook) and validating
+// them with validator.
+func IDField(onInit func(ctx context.Context, value interface{}) interface{}, validator schema.FieldValidator) schema.Field {
+	return schema.Field{
 		Required:   true,
 		ReadOnly:   true,
-		OnInit:     NewObjectID,
+		OnInit:     onInit,
 		Filterable: true,
 		Sortable:   true,
-		Validator:  &ObjectID{},
+		Validator:  validator,
 	}
-)
+}
 
 // ObjectID validates and serialize unique id
 type ObjectID struct{}
@@ -69,3 +97,58 @@ func (v ObjectID) BuildJSONSchema() (map[string]interface{}, error) {
 		"pattern": "^[0-9a-fA-F]{24}$",
 	}, nil
 }
+
+// UUID validates and serialize ids formatted as UUID strings, e.g.
+// "123e4567-e89b-12d3-a456-426614174000". They are stored as strings,
+// normalized to lower case.
+type UUID struct{}
+
+// Validate implements FieldValidator interface
+func (v UUID) Validate(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, errors.New("invalid uuid")
+	}
+	if len(s) != 36 {
+		return nil, errors.New("invalid uuid length")
+	}
+	for i, r := range s {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if r != '-' {
+				return nil, errors.New("invalid uuid")
+			}
+		} else if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return nil, errors.New("invalid uuid")
+		}
+	}
+	return strings.ToLower(s), nil
+}
+
+// Serialize implements FieldSerializer interface
+func (v UUID) Serialize(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, errors.New("not a UUID")
+	}
+	return s, nil
+}
+
+// BuildJSONSchema implements the jsonschema.Builder interface.
+func (v UUID) BuildJSONSchema() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"type":    "string",
+		"format":  "uuid",
+		"pattern": "^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$",
+	}, nil
+}
+
+// newUUID returns a new random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(fmt.Errorf("cannot generate uuid: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -1,9 +1,14 @@
 package mongo_test
 
 import (
+	"context"
+	"fmt"
 	"regexp"
 	"testing"
 
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
 	"gopkg.in/mgo.v2/bson"
 
 	mongo "github.com/rs/rest-layer-mongo"
@@ -68,3 +73,144 @@ func TestObjectIDJSONSchmea(t *testing.T) {
 		}
 	})
 }
+
+func TestIDField(t *testing.T) {
+	var n int
+	// A ULID-like generator producing lexicographically sortable ids.
+	gen := func() string {
+		n++
+		return fmt.Sprintf("01%024d", n)
+	}
+	v := &schema.String{Regexp: "^[0-9A-Z]{26}$"}
+	if err := v.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+	f := mongo.IDField(mongo.NewIDHook(gen), v)
+
+	id1 := f.OnInit(context.Background(), nil)
+	id2 := f.OnInit(context.Background(), nil)
+	if id1.(string) >= id2.(string) {
+		t.Errorf("ids are not sortable: %v >= %v", id1, id2)
+	}
+	if _, err := f.Validator.Validate(id1); err != nil {
+		t.Errorf("generated id %v is invalid: %v", id1, err)
+	}
+	if id := f.OnInit(context.Background(), "given"); id != "given" {
+		t.Errorf("got: %v want: given", id)
+	}
+	if _, err := f.Validator.Validate(validObjectID); err == nil {
+		t.Error("expected an error for an ObjectID, got nil")
+	}
+
+	// Items without etag get a provisional one built from the custom id.
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	if err := s.DB("").C("test").Insert(bson.M{"_id": id1, "foo": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(context.Background(), &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ETag != "p-"+id1.(string) {
+		t.Fatalf("got: %v want: an item with etag p-%v", l.Items, id1)
+	}
+	item := &resource.Item{ID: id1, ETag: "new", Payload: map[string]interface{}{"id": id1, "foo": "baz"}}
+	if err := h.Update(context.Background(), item, l.Items[0]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUUIDValidate(t *testing.T) {
+	v := &mongo.UUID{}
+	valid := map[string]string{
+		"123e4567-e89b-12d3-a456-426614174000": "123e4567-e89b-12d3-a456-426614174000",
+		"123E4567-E89B-12D3-A456-426614174000": "123e4567-e89b-12d3-a456-426614174000",
+	}
+	for value, want := range valid {
+		id, err := v.Validate(value)
+		if err != nil || id != want {
+			t.Errorf("v.Validate(%q): got: %v, %v want: %v", value, id, err, want)
+		}
+	}
+	for _, value := range []interface{}{
+		"123e4567-e89b-12d3-a456-42661417400",
+		"123e4567e89b-12d3-a456-4266141740000",
+		"123e4567-e89b-12d3-a456-42661417400g",
+		validObjectID,
+		42,
+	} {
+		if id, err := v.Validate(value); err == nil {
+			t.Errorf("v.Validate(%#v): got: %v want: an error", value, id)
+		}
+	}
+
+	m, err := v.BuildJSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(m["pattern"].(string))
+	for value := range valid {
+		if !re.MatchString(value) {
+			t.Errorf("pattern %s does not match %s", re, value)
+		}
+	}
+}
+
+func TestUUIDField(t *testing.T) {
+	id1 := mongo.UUIDField.OnInit(context.Background(), nil)
+	id2 := mongo.UUIDField.OnInit(context.Background(), nil)
+	if id1 == id2 {
+		t.Errorf("got: the same uuid %v twice", id1)
+	}
+	id, err := mongo.UUIDField.Validator.Validate(id1)
+	if err != nil || id != id1 {
+		t.Errorf("generated uuid %v is invalid: %v", id1, err)
+	}
+	if v := id1.(string)[14]; v != '4' {
+		t.Errorf("got: version %c want: 4", v)
+	}
+}
+
+func TestNonStringIDs(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ItemCacheSize: 10})
+	ctx := context.Background()
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	items := []*resource.Item{
+		{ID: int64(1) << 40, ETag: "a", Payload: map[string]interface{}{"id": int64(1) << 40, "foo": "big"}},
+		{ID: 5, ETag: "a", Payload: map[string]interface{}{"id": 5, "foo": "small"}},
+		{ID: uuid, ETag: "a", Payload: map[string]interface{}{"id": uuid, "foo": "uuid"}},
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// The second call is served by the item cache.
+		got, err := h.MultiGet(ctx, []interface{}{1 << 40, int64(5), uuid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 || got[0].ID != int64(1)<<40 || got[1].ID != 5 || got[2].ID != uuid {
+			t.Fatalf("got: %v want: the items with ids as inserted", got)
+		}
+	}
+
+	// Items without etag get a provisional one built from the id.
+	if err := s.DB("").C("test").Insert(bson.M{"_id": int64(6), "foo": "raw"}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(ctx, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "id", Value: 6}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != int64(6) || l.Items[0].ETag != "p-6" {
+		t.Fatalf("got: %v want: an item with id 6 and etag p-6", l.Items)
+	}
+	item := &resource.Item{ID: int64(6), ETag: "b", Payload: map[string]interface{}{"id": int64(6), "foo": "updated"}}
+	if err := h.Update(ctx, item, l.Items[0]); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,410 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultInBatchSize is the maximum number of values of an $in condition sent
+// by Find in a single query when Options.InBatchSize is zero.
+const defaultInBatchSize = 1000
+
+// inBatchSize returns the maximum number of values of an $in condition sent
+// in a single query, zero if $in conditions are never split.
+func (m OptionsHandler) inBatchSize() int {
+	switch {
+	case m.opts.InBatchSize < 0:
+		return 0
+	case m.opts.InBatchSize == 0:
+		return defaultInBatchSize
+	}
+	return m.opts.InBatchSize
+}
+
+// splitIn returns copies of the query document qry where the longest $in
+// condition at its root is split into conditions of at most size values, or
+// nil if qry holds no $in condition with more than size values.
+func splitIn(qry bson.M, size int) []bson.M {
+	if size <= 0 {
+		return nil
+	}
+	var field string
+	var longest int
+	for f, cond := range qry {
+		ops, ok := cond.(bson.M)
+		if !ok || strings.HasPrefix(f, "$") {
+			continue
+		}
+		if in, ok := ops["$in"].([]interface{}); ok && len(in) > longest {
+			field, longest = f, len(in)
+		}
+	}
+	return splitInField(qry, field, size)
+}
+
+// splitInField returns copies of the query document qry where the $in
+// condition on field is split into conditions of at most size values, or nil
+// if qry holds no $in condition on field with more than size values.
+func splitInField(qry bson.M, field string, size int) []bson.M {
+	ops, _ := qry[field].(bson.M)
+	values, _ := ops["$in"].([]interface{})
+	if size <= 0 || len(values) <= size {
+		return nil
+	}
+	var batches []bson.M
+	for start := 0; start < len(values); start += size {
+		end := start + size
+		if end > len(values) {
+			end = len(values)
+		}
+		bops := make(bson.M, len(ops))
+		for op, v := range ops {
+			bops[op] = v
+		}
+		bops["$in"] = values[start:end]
+		b := make(bson.M, len(qry))
+		for f, cond := range qry {
+			b[f] = cond
+		}
+		b[field] = bops
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+// uniqueValues returns values without duplicates, in order.
+func uniqueValues(values []interface{}) []interface{} {
+	seen := make(map[string]bool, len(values))
+	r := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if key := fmt.Sprintf("%#v", v); !seen[key] {
+			seen[key] = true
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// countBatches returns the number of items of c matching the query document
+// qry by counting the ids of its $in condition on _id in batches of at most
+// InBatchSize ids, or false if the condition is short enough to be sent at
+// once.
+func (m OptionsHandler) countBatches(ctx context.Context, c *mgo.Collection, qry bson.M) (int, bool, error) {
+	ops, _ := qry["_id"].(bson.M)
+	ids, _ := ops["$in"].([]interface{})
+	size := m.inBatchSize()
+	if size <= 0 || len(ids) <= size {
+		return 0, false, nil
+	}
+	// Documents have a single _id, so batches of distinct ids never match the
+	// same document.
+	uops := make(bson.M, len(ops))
+	for op, v := range ops {
+		uops[op] = v
+	}
+	uops["$in"] = uniqueValues(ids)
+	uqry := make(bson.M, len(qry))
+	for f, cond := range qry {
+		uqry[f] = cond
+	}
+	uqry["_id"] = uops
+	batches := splitInField(uqry, "_id", size)
+	if batches == nil {
+		batches = []bson.M{uqry}
+	}
+	total := 0
+	for _, b := range batches {
+		n, err := m.count(ctx, c, b)
+		if err != nil {
+			return 0, true, err
+		}
+		total += n
+	}
+	return total, true, nil
+}
+
+// mergeableSort tells if the items of the queries split by splitIn can be
+// merged in memory in the order of s. MongoDB sorts arrays by their lowest or
+// highest element and compares numbers of any type, so only the fields known
+// to hold a single value compareValues orders like MongoDB are merged: the
+// id, the meta fields, and the scalar fields of the Schema option, except
+// DecimalFields.
+func (m OptionsHandler) mergeableSort(s query.Sort) bool {
+	// Compound or encoded ids may not be scalars.
+	scalarIDs := len(m.opts.IDFields) == 0 && m.opts.IDCodec == nil
+	if len(s) == 0 {
+		return scalarIDs
+	}
+	for _, f := range s {
+		switch f.Name {
+		case "id":
+			if !scalarIDs {
+				return false
+			}
+		case m.etagField(), m.updatedField(), seqField:
+		default:
+			if m.opts.Schema == nil || inStrings(f.Name, m.opts.DecimalFields) {
+				return false
+			}
+			sf := m.opts.Schema.GetField(f.Name)
+			if sf == nil || sf.Schema != nil {
+				return false
+			}
+			switch sf.Validator.(type) {
+			case *schema.String, *schema.Integer, *schema.Float, *schema.Bool,
+				*schema.Time, *schema.Reference, *schema.IP, *schema.URL:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// findBatches returns the items matching any of the query documents batches,
+// without duplicates, sorted by srt and windowed by w. Each batch is queried
+// for the first items of the window only, and the results are merged in
+// memory. The fields selected by sel are completed with the sorted fields
+// while merging.
+func (m OptionsHandler) findBatches(ctx context.Context, c *mgo.Collection, batches []bson.M, srt []string, sel bson.M, w *query.Window) ([]*resource.Item, error) {
+	sel, extra := sortSelect(sel, srt)
+	seen := map[string]bool{}
+	var mItems []*mongoItem
+	var bw *query.Window
+	if w != nil && w.Limit > -1 {
+		bw = &query.Window{Limit: w.Offset + w.Limit}
+	}
+	for _, qry := range batches {
+		iter, err := m.batchIter(ctx, c, qry, srt, sel, bw)
+		if err != nil {
+			return nil, err
+		}
+		err = m.readDocs(ctx, c, iter, func(mItem *mongoItem) {
+			// A document may match several batches when the field is an
+			// array.
+			if key := fmt.Sprintf("%#v", mItem.ID); !seen[key] {
+				seen[key] = true
+				mItems = append(mItems, mItem)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(mItems, func(i, j int) bool {
+		for _, f := range srt {
+			desc := strings.HasPrefix(f, "-")
+			f = strings.TrimPrefix(f, "-")
+			r := compareValues(m.sortValue(mItems[i], f), m.sortValue(mItems[j], f))
+			if desc {
+				r = -r
+			}
+			if r != 0 {
+				return r < 0
+			}
+		}
+		return false
+	})
+	if w != nil {
+		if w.Offset >= len(mItems) {
+			mItems = nil
+		} else {
+			mItems = mItems[w.Offset:]
+		}
+		if w.Limit > -1 && w.Limit < len(mItems) {
+			mItems = mItems[:w.Limit]
+		}
+	}
+	items := make([]*resource.Item, len(mItems))
+	for i, mItem := range mItems {
+		for _, f := range extra {
+			deletePath(mItem.Payload, f)
+		}
+		items[i] = m.newItem(mItem)
+	}
+	return items, nil
+}
+
+// batchIter returns an iterator over the items of c matching the batch query
+// qry, sorted by srt, restricted to the fields selected by sel if not nil, and
+// windowed by w.
+func (m OptionsHandler) batchIter(ctx context.Context, c *mgo.Collection, qry bson.M, srt []string, sel bson.M, w *query.Window) (*mgo.Iter, error) {
+	if m.opts.ReadConcern != "" {
+		return m.findCommand(ctx, c, qry, srt, sel, w)
+	}
+	mq := c.Find(qry).Sort(srt...)
+	if sel != nil {
+		mq = mq.Select(sel)
+	}
+	if w != nil {
+		mq = mq.Limit(w.Limit)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		dur := time.Until(dl)
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	return mq.Iter(), nil
+}
+
+// sortSelect returns the field selection sel completed with the sorted fields
+// of srt it does not include, and these fields.
+func sortSelect(sel bson.M, srt []string) (bson.M, []string) {
+	inclusion := false
+	for _, v := range sel {
+		if v == 1 {
+			inclusion = true
+			break
+		}
+	}
+	if !inclusion {
+		return sel, nil
+	}
+	var extra []string
+	r := make(bson.M, len(sel)+len(srt))
+	for f, v := range sel {
+		r[f] = v
+	}
+	for _, f := range srt {
+		f = strings.TrimPrefix(f, "-")
+		if _, found := r[f]; !found && f != "_id" {
+			r[f] = 1
+			extra = append(extra, f)
+		}
+	}
+	return r, extra
+}
+
+// sortValue returns the value of the stored field f of i, nil if missing.
+// The etag and update time are read from the payload of i when stored under
+// the names of FieldMapping.
+func (m OptionsHandler) sortValue(i *mongoItem, f string) interface{} {
+	switch {
+	case f == "_id":
+		return i.ID
+	case f == "_etag" && m.etagField() == "_etag":
+		if i.ETag != "" {
+			return i.ETag
+		}
+		return nil
+	case f == updatedField && m.updatedField() == updatedField:
+		if !i.Updated.IsZero() {
+			return i.Updated
+		}
+		return nil
+	}
+	var v interface{} = i.Payload
+	for _, k := range strings.Split(f, ".") {
+		switch doc := v.(type) {
+		case map[string]interface{}:
+			v = doc[k]
+		case bson.M:
+			v = doc[k]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// compareValues returns -1, 0 or 1 whether a sorts before, with or after b in
+// the BSON comparison order of MongoDB: missing and null values, numbers,
+// strings, documents, arrays, binary data, ObjectIds, booleans then dates.
+// Strings are compared without collation, arrays element by element, and
+// documents or binary data are considered equal.
+func compareValues(a, b interface{}) int {
+	ra, rb := bsonRank(a), bsonRank(b)
+	if ra != rb {
+		return compareInts(ra, rb)
+	}
+	switch x := a.(type) {
+	case string:
+		return strings.Compare(x, b.(string))
+	case bson.ObjectId:
+		return strings.Compare(string(x), string(b.(bson.ObjectId)))
+	case bool:
+		return compareInts(boolInt(x), boolInt(b.(bool)))
+	case time.Time:
+		y := b.(time.Time)
+		if x.Before(y) {
+			return -1
+		} else if x.After(y) {
+			return 1
+		}
+		return 0
+	case []interface{}:
+		y := b.([]interface{})
+		for k := 0; k < len(x) && k < len(y); k++ {
+			if r := compareValues(x[k], y[k]); r != 0 {
+				return r
+			}
+		}
+		return compareInts(len(x), len(y))
+	}
+	if ra == 2 {
+		x, _ := sortNumber(a)
+		y, _ := sortNumber(b)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// bsonRank returns the rank of the type of v in the BSON comparison order.
+func bsonRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float32, float64, bson.Decimal128:
+		return 2
+	case string:
+		return 3
+	case map[string]interface{}, bson.M, bson.D:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte, bson.Binary:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+	return 10
+}
+
+// sortNumber returns the number v as a float64, Decimal128 included.
+func sortNumber(v interface{}) (float64, bool) {
+	if d, ok := v.(bson.Decimal128); ok {
+		f, err := strconv.ParseFloat(d.String(), 64)
+		return f, err == nil
+	}
+	return toFloat(v)
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
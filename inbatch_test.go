@@ -0,0 +1,147 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSplitIn(t *testing.T) {
+	qry := bson.M{
+		"a": bson.M{"$in": []interface{}{1, 2, 3}, "$ne": 2},
+		"b": bson.M{"$in": []interface{}{1, 2, 3, 4, 5}},
+		"c": "x",
+	}
+	got := splitIn(qry, 2)
+	want := []bson.M{
+		{"a": qry["a"], "b": bson.M{"$in": []interface{}{1, 2}}, "c": "x"},
+		{"a": qry["a"], "b": bson.M{"$in": []interface{}{3, 4}}, "c": "x"},
+		{"a": qry["a"], "b": bson.M{"$in": []interface{}{5}}, "c": "x"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitIn:\ngot:  %#v\nwant: %#v", got, want)
+	}
+	if got := splitIn(qry, 5); got != nil {
+		t.Errorf("splitIn: got: %#v want: nil", got)
+	}
+	if got := splitIn(bson.M{"$or": []bson.M{{"a": bson.M{"$in": []interface{}{1, 2, 3}}}}}, 1); got != nil {
+		t.Errorf("splitIn: got: %#v want: nil", got)
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	now := time.Now()
+	ordered := []interface{}{
+		nil,
+		-1.5,
+		2,
+		int64(3),
+		"a",
+		"b",
+		bson.M{"a": 1},
+		[]interface{}{1},
+		[]interface{}{1, 2},
+		bson.ObjectIdHex("59a40602952dbd0001c3ffc9"),
+		false,
+		true,
+		now,
+		now.Add(time.Second),
+	}
+	for i := 1; i < len(ordered); i++ {
+		a, b := ordered[i-1], ordered[i]
+		if got := compareValues(a, b); got != -1 {
+			t.Errorf("compareValues(%#v, %#v): got: %d want: -1", a, b, got)
+		}
+		if got := compareValues(b, a); got != 1 {
+			t.Errorf("compareValues(%#v, %#v): got: %d want: 1", b, a, got)
+		}
+	}
+	if got := compareValues(2, 2.0); got != 0 {
+		t.Errorf("compareValues(2, 2.0): got: %d want: 0", got)
+	}
+	d, _ := bson.ParseDecimal128("2.5")
+	if got := compareValues(2, d); got != -1 {
+		t.Errorf("compareValues(2, 2.5 decimal): got: %d want: -1", got)
+	}
+}
+
+func TestMergeableSort(t *testing.T) {
+	sch := &schema.Schema{Fields: schema.Fields{
+		"id":    schema.IDField,
+		"name":  {Validator: &schema.String{}},
+		"rank":  {Validator: &schema.Integer{}},
+		"price": {Validator: &schema.Float{}},
+		"tags":  {Validator: &schema.Array{}},
+		"meta":  {Schema: &schema.Schema{}},
+		"raw":   {},
+	}}
+	m := OptionsHandler{opts: Options{Schema: sch, DecimalFields: []string{"price"}, FieldMapping: FieldMapping{Updated: "modifiedAt"}}}
+	cases := []struct {
+		sort string
+		want bool
+	}{
+		{"", true},
+		{"-rank,name,id", true},
+		{"modifiedAt", true},
+		{"_etag", true},
+		{"tags", false},
+		{"meta", false},
+		{"raw", false},
+		{"price", false},
+		{"unknown", false},
+	}
+	for _, tc := range cases {
+		s := query.Sort{}
+		if tc.sort != "" {
+			s = query.MustParseSort(tc.sort)
+		}
+		if got := m.mergeableSort(s); got != tc.want {
+			t.Errorf("mergeableSort(%q): got: %v want: %v", tc.sort, got, tc.want)
+		}
+	}
+	if (OptionsHandler{}).mergeableSort(query.MustParseSort("rank")) {
+		t.Error("mergeableSort without schema: got: true want: false")
+	}
+	if (OptionsHandler{opts: Options{IDFields: []string{"a"}}}).mergeableSort(query.Sort{}) {
+		t.Error("mergeableSort with compound ids: got: true want: false")
+	}
+}
+
+func TestSortValue(t *testing.T) {
+	now := time.Now()
+	i := &mongoItem{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"modifiedAt": now, "meta": map[string]interface{}{"a": 1}}}
+	m := OptionsHandler{}
+	if got := m.sortValue(i, "_updated"); got != now {
+		t.Errorf("sortValue(_updated): got: %v want: %v", got, now)
+	}
+	if got := m.sortValue(i, "meta.a"); got != 1 {
+		t.Errorf("sortValue(meta.a): got: %v want: 1", got)
+	}
+	// The update time is stored under its mapped name.
+	m = OptionsHandler{opts: Options{FieldMapping: FieldMapping{Updated: "modifiedAt"}}}
+	i.Updated = time.Time{}
+	if got := m.sortValue(i, "modifiedAt"); got != now {
+		t.Errorf("sortValue(modifiedAt): got: %v want: %v", got, now)
+	}
+	if got := m.sortValue(i, "_updated"); got != nil {
+		t.Errorf("sortValue(_updated): got: %v want: nil", got)
+	}
+}
+
+func TestSortSelect(t *testing.T) {
+	sel, extra := sortSelect(bson.M{"name": 1, "_etag": 1}, []string{"-age", "name", "_id"})
+	if want := (bson.M{"name": 1, "_etag": 1, "age": 1}); !reflect.DeepEqual(sel, want) {
+		t.Errorf("sortSelect: got: %#v want: %#v", sel, want)
+	}
+	if want := []string{"age"}; !reflect.DeepEqual(extra, want) {
+		t.Errorf("sortSelect: got: extra %v want: %v", extra, want)
+	}
+	sel, extra = sortSelect(bson.M{"raw": 0}, []string{"age"})
+	if !reflect.DeepEqual(sel, bson.M{"raw": 0}) || extra != nil {
+		t.Errorf("sortSelect: got: %#v, %v want: the exclusion as is", sel, extra)
+	}
+}
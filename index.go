@@ -0,0 +1,234 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/schema"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// expireAtField is the field holding the expiration time of items when the
+// handler is configured with an ExpireField.
+const expireAtField = "_expireAt"
+
+// EnsureIndexes creates the given indexes on the collection managed by h, along
+// with the indexes required by the options of h:
+//
+//   - a TTL index on the expiration time of items when ExpireField is set. As
+//     mgo can't create TTL indexes without delay, items are removed a second
+//     after they expire at the earliest (MongoDB checks for expired items every
+//     minute).
+//
+// Indexes already existing are left untouched. An index may have a Collation,
+// e.g. CaseInsensitive for unique fields like emails, in which case its Name
+// should be set to not collide with an index on the same keys without
+// collation. All indexes are built in the background when BackgroundIndexes is
+// set.
+func EnsureIndexes(ctx context.Context, h OptionsHandler, indexes ...mgo.Index) error {
+	for _, index := range indexes {
+		if index.Collation != nil && index.Collation.Locale == "" {
+			return fmt.Errorf("index %v: collation locale is required", index.Key)
+		}
+	}
+	indexes = append([]mgo.Index{}, indexes...)
+	if h.opts.ExpireField != "" {
+		indexes = append(indexes, mgo.Index{Key: []string{expireAtField}, ExpireAfter: time.Second})
+	}
+	c, err := h.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer h.close(c)
+	for _, index := range indexes {
+		if h.opts.BackgroundIndexes {
+			index.Background = true
+		}
+		if err := c.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureSchemaIndexes is like EnsureIndexes, but also creates the indexes
+// derived from the schema s:
+//
+//   - the primary key index on _id, which MongoDB always makes unique. It is
+//     created along with the collection if it does not exist yet.
+//   - a single-field index on each filterable or sortable field of s,
+//     including the fields of sub-schemas using dotted notation. The id
+//     field is covered by the _id index.
+func EnsureSchemaIndexes(ctx context.Context, h OptionsHandler, s schema.Schema, indexes ...mgo.Index) error {
+	return EnsureIndexes(ctx, h, append(h.schemaIndexes(s), indexes...)...)
+}
+
+// schemaIndexes returns the _id index followed by the single-field indexes on
+// the filterable or sortable fields of s, sorted by field.
+func (m OptionsHandler) schemaIndexes(s schema.Schema) []mgo.Index {
+	fields := indexedFields("", s.Fields, nil)
+	sort.Strings(fields)
+	indexes := []mgo.Index{{Key: []string{"_id"}}}
+	for _, f := range fields {
+		if f == "id" {
+			continue
+		}
+		indexes = append(indexes, mgo.Index{Key: []string{m.flatField(getField(f))}})
+	}
+	return indexes
+}
+
+// indexedFields appends to fields the dotted paths of the filterable or
+// sortable fields of fs, whose parent path is prefix.
+func indexedFields(prefix string, fs schema.Fields, fields []string) []string {
+	for name, f := range fs {
+		path := prefix + name
+		if f.Schema != nil {
+			fields = indexedFields(path+".", f.Schema.Fields, fields)
+			continue
+		}
+		if f.Filterable || f.Sortable {
+			fields = append(fields, path)
+		}
+	}
+	return fields
+}
+
+// EnsureGeoIndex creates a 2dsphere index on the GeoJSON field of the
+// collection managed by h, as required by FindNear and Near expressions.
+func EnsureGeoIndex(ctx context.Context, h OptionsHandler, field string) error {
+	c, err := h.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer h.close(c)
+	return c.EnsureIndex(mgo.Index{
+		Key:        []string{"$2dsphere:" + getField(h.flatField(field))},
+		Background: h.opts.BackgroundIndexes,
+	})
+}
+
+// EnsureTTLIndex creates a TTL index on the date field of the collection
+// managed by h, so that MongoDB removes items expireAfter their field time
+// (MongoDB checks for expired items every minute). The updated field maps to
+// the update time of items, e.g. to expire sessions a day after their last
+// update. The field must hold BSON dates, which the update time always does:
+// items without a date in field never expire.
+//
+// Running it again with the same field is a no-op, and an existing TTL index
+// on field is changed to the new expireAfter delay.
+func EnsureTTLIndex(ctx context.Context, h OptionsHandler, field string, expireAfter time.Duration) error {
+	if expireAfter < time.Second {
+		return errors.New("ttl index: expiration delay must be at least a second")
+	}
+	key := getField(h.flatField(field))
+	if field == "updated" {
+		key = h.updatedField()
+	}
+
+	c, err := h.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer h.close(c)
+	indexes, err := collectionIndexes(c)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if len(idx.Key) != 1 || idx.Key[0] != key || idx.ExpireAfter == 0 || idx.ExpireAfter == expireAfter {
+			continue
+		}
+		// The delay of a TTL index can't be changed by EnsureIndex.
+		return c.Database.Run(bson.D{
+			{Name: "collMod", Value: c.Name},
+			{Name: "index", Value: bson.M{"keyPattern": bson.M{key: 1}, "expireAfterSeconds": int(expireAfter / time.Second)}},
+		}, nil)
+	}
+	return c.EnsureIndex(mgo.Index{
+		Key:         []string{key},
+		ExpireAfter: expireAfter,
+		Background:  h.opts.BackgroundIndexes,
+	})
+}
+
+// CaseInsensitive returns a collation comparing strings case-insensitively
+// using the rules of locale (e.g. "en"). Accents remain significant.
+func CaseInsensitive(locale string) *mgo.Collation {
+	return &mgo.Collation{Locale: locale, Strength: 2}
+}
+
+// EnsureTextIndex creates a text index on the collection managed by h over the
+// fields listed in weights, using their associated weight to score matches.
+// The language defines the stop words and stemming rules, "english" being the
+// default if empty.
+//
+// MongoDB allows only one text index per collection, so an error is returned
+// if the collection already has a text index with different fields or
+// options.
+func EnsureTextIndex(ctx context.Context, h OptionsHandler, weights map[string]int, language string) error {
+	if len(weights) == 0 {
+		return errors.New("text index: at least one field is required")
+	}
+	fields := make([]string, 0, len(weights))
+	for f := range weights {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	index := mgo.Index{
+		Key:             make([]string, len(fields)),
+		Weights:         make(map[string]int, len(fields)),
+		DefaultLanguage: language,
+	}
+	for i, f := range fields {
+		index.Key[i] = "$text:" + getField(f)
+		index.Weights[getField(f)] = weights[f]
+	}
+
+	c, err := h.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer h.close(c)
+	indexes, err := collectionIndexes(c)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if !isTextIndex(idx) {
+			continue
+		}
+		if !reflect.DeepEqual(idx.Weights, index.Weights) || textLanguage(idx) != textLanguage(index) {
+			return fmt.Errorf("text index: collection %s already has text index %s", c.FullName, idx.Name)
+		}
+	}
+	return c.EnsureIndex(index)
+}
+
+// collectionIndexes returns the indexes of c, which are none if the collection
+// does not exist yet.
+func collectionIndexes(c *mgo.Collection) ([]mgo.Index, error) {
+	indexes, err := c.Indexes()
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 26 {
+		// NamespaceNotFound
+		return nil, nil
+	}
+	return indexes, err
+}
+
+func isTextIndex(idx mgo.Index) bool {
+	return len(idx.Key) > 0 && strings.HasPrefix(idx.Key[0], "$text:")
+}
+
+func textLanguage(idx mgo.Index) string {
+	if idx.DefaultLanguage == "" {
+		return "english"
+	}
+	return idx.DefaultLanguage
+}
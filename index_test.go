@@ -0,0 +1,240 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestEnsureTextIndex(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	weights := map[string]int{"title": 10, "body": 2}
+
+	if err := mongo.EnsureTextIndex(context.Background(), h, weights, "french"); err != nil {
+		t.Fatal(err)
+	}
+	// Creating the same index again is a no-op.
+	if err := mongo.EnsureTextIndex(context.Background(), h, weights, "french"); err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, err := s.DB("").C("test").Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, idx := range indexes {
+		if len(idx.Key) == 0 || !strings.HasPrefix(idx.Key[0], "$text:") {
+			continue
+		}
+		found = true
+		if !reflect.DeepEqual(idx.Weights, weights) {
+			t.Errorf("got weights: %v want: %v", idx.Weights, weights)
+		}
+		if idx.DefaultLanguage != "french" {
+			t.Errorf("got language: %v want: french", idx.DefaultLanguage)
+		}
+	}
+	if !found {
+		t.Fatalf("text index not found in %v", indexes)
+	}
+
+	// Only one text index is allowed per collection.
+	err = mongo.EnsureTextIndex(context.Background(), h, map[string]int{"title": 1}, "")
+	if err == nil {
+		t.Error("expected an error when creating a second text index, got nil")
+	}
+}
+
+func TestEnsureTTLIndex(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	ctx := context.Background()
+
+	if err := mongo.EnsureTTLIndex(ctx, h, "updated", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Creating the same index again is a no-op.
+	if err := mongo.EnsureTTLIndex(ctx, h, "updated", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ttl := func() time.Duration {
+		indexes, err := s.DB("").C("test").Indexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range indexes {
+			if strings.Join(idx.Key, ",") == "_updated" {
+				return idx.ExpireAfter
+			}
+		}
+		t.Fatalf("TTL index not found in %v", indexes)
+		return 0
+	}
+	if got := ttl(); got != 24*time.Hour {
+		t.Errorf("got expire after: %v want: %v", got, 24*time.Hour)
+	}
+
+	// Changing the delay updates the existing index.
+	if err := mongo.EnsureTTLIndex(ctx, h, "updated", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := ttl(); got != time.Hour {
+		t.Errorf("got expire after: %v want: %v", got, time.Hour)
+	}
+
+	if err := mongo.EnsureTTLIndex(ctx, h, "updated", time.Millisecond); err == nil {
+		t.Error("expected an error for a sub-second delay, got nil")
+	}
+}
+
+func TestEnsureIndexesExpireField(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ExpireField: "expiresAt"})
+	if err := mongo.EnsureIndexes(context.Background(), h, mgo.Index{Key: []string{"name"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, err := s.DB("").C("test").Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]mgo.Index{}
+	for _, idx := range indexes {
+		keys[strings.Join(idx.Key, ",")] = idx
+	}
+	if _, found := keys["name"]; !found {
+		t.Errorf("name index not created: %v", indexes)
+	}
+	if idx, found := keys["_expireAt"]; !found || idx.ExpireAfter != time.Second {
+		t.Errorf("TTL index not created: %v", indexes)
+	}
+
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "expiresAt": "2030-01-02T03:04:05Z"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		ExpireAt *time.Time `bson:"_expireAt"`
+	}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.ExpireAt == nil || !doc.ExpireAt.Equal(expiresAt) {
+		t.Errorf("got: %v want: %v", doc.ExpireAt, expiresAt)
+	}
+	doc.ExpireAt = nil
+	if err := s.DB("").C("test").FindId("2").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.ExpireAt != nil {
+		t.Errorf("got: %v want: no expiration", doc.ExpireAt)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || !reflect.DeepEqual(l.Items[0].Payload, items[0].Payload) {
+		t.Errorf("got: %v want: %v", l.Items, items[0].Payload)
+	}
+}
+
+func TestEnsureSchemaIndexes(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{BackgroundIndexes: true})
+	sch := schema.Schema{Fields: schema.Fields{
+		"id":    {Sortable: true, Filterable: true},
+		"name":  {Filterable: true},
+		"rank":  {Sortable: true},
+		"notes": {},
+		"meta": {Schema: &schema.Schema{Fields: schema.Fields{
+			"author": {Filterable: true},
+			"raw":    {},
+		}}},
+	}}
+	if err := mongo.EnsureSchemaIndexes(context.Background(), h, sch); err != nil {
+		t.Fatal(err)
+	}
+	// Creating the indexes again is a no-op.
+	if err := mongo.EnsureSchemaIndexes(context.Background(), h, sch); err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, err := s.DB("").C("test").Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, idx := range indexes {
+		keys = append(keys, strings.Join(idx.Key, ","))
+		if idx.Name != "_id_" && !idx.Background {
+			t.Errorf("index %s not built in background", idx.Name)
+		}
+	}
+	sort.Strings(keys)
+	if want := []string{"_id", "meta.author", "name", "rank"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got: %v want: %v", keys, want)
+	}
+}
+
+func TestEnsureIndexesCaseInsensitive(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	index := mgo.Index{Key: []string{"email"}, Unique: true, Name: "email_ci", Collation: mongo.CaseInsensitive("en")}
+	if err := mongo.EnsureIndexes(context.Background(), h, index); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "email": "A@x.com"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "email": "b@x.com"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	assertDup := func(err error) {
+		t.Helper()
+		dup, ok := err.(*mongo.DuplicateKeyError)
+		if !ok {
+			t.Fatalf("got error: %v want: *DuplicateKeyError", err)
+		}
+		if dup.Index != "email_ci" || !reflect.DeepEqual(dup.Fields, []string{"email"}) {
+			t.Errorf("got: %v want: index email_ci on email", dup)
+		}
+		if !errors.Is(err, resource.ErrConflict) {
+			t.Errorf("%v does not match resource.ErrConflict", err)
+		}
+	}
+	assertDup(h.Insert(context.Background(), []*resource.Item{
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "email": "a@X.COM"}},
+	}))
+	assertDup(h.Update(context.Background(), &resource.Item{
+		ID: "2", ETag: "c", Payload: map[string]interface{}{"id": "2", "email": "a@x.com"},
+	}, items[1]))
+
+	index.Collation = &mgo.Collation{}
+	if err := mongo.EnsureIndexes(context.Background(), h, index); err == nil {
+		t.Error("expected an error for a collation without locale, got nil")
+	}
+}
@@ -0,0 +1,120 @@
+package mongo
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+// itemCache is a size-bounded LRU cache of the items returned by MultiGet,
+// keyed by collection and id. Writes performed through the handler remove the
+// items they touch, and a generation number prevents a read performed
+// concurrently with a write from storing items older than the write. Items are
+// copied in and out of the cache, so callers may modify them.
+type itemCache struct {
+	mu    sync.Mutex
+	size  int
+	gen   uint64
+	ll    *list.List
+	items map[itemKey]*list.Element
+}
+
+type itemKey struct {
+	collection string
+	id         interface{}
+}
+
+type itemEntry struct {
+	key  itemKey
+	item *resource.Item
+}
+
+func newItemCache(size int) *itemCache {
+	if size <= 0 {
+		return nil
+	}
+	return &itemCache{size: size, ll: list.New(), items: map[itemKey]*list.Element{}}
+}
+
+// generation returns the generation to be passed to add for the items read
+// from now on.
+func (c *itemCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns the item with id cached for collection.
+func (c *itemCache) get(collection string, id interface{}) (*resource.Item, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.items[itemKey{collection, idKey(id)}]
+	if !found {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return copyItem(e.Value.(*itemEntry).item), true
+}
+
+// add caches items for collection unless a write happened since gen has been
+// returned by generation, evicting the least recently used items if needed.
+func (c *itemCache) add(collection string, gen uint64, items []*resource.Item) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	for _, item := range items {
+		item = copyItem(item)
+		key := itemKey{collection, idKey(item.ID)}
+		if e, found := c.items[key]; found {
+			e.Value.(*itemEntry).item = item
+			c.ll.MoveToFront(e)
+			continue
+		}
+		c.items[key] = c.ll.PushFront(&itemEntry{key, item})
+		if c.ll.Len() > c.size {
+			e := c.ll.Back()
+			c.ll.Remove(e)
+			delete(c.items, e.Value.(*itemEntry).key)
+		}
+	}
+}
+
+// invalidate removes the items with ids cached for collection, or all the
+// items of collection if ids is nil.
+func (c *itemCache) invalidate(collection string, ids []interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if ids != nil {
+		for _, id := range ids {
+			if e, found := c.items[itemKey{collection, idKey(id)}]; found {
+				c.ll.Remove(e)
+				delete(c.items, e.Value.(*itemEntry).key)
+			}
+		}
+		return
+	}
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if key := e.Value.(*itemEntry).key; key.collection == collection {
+			c.ll.Remove(e)
+			delete(c.items, key)
+		}
+		e = next
+	}
+}
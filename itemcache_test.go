@@ -0,0 +1,76 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestItemCache(t *testing.T) {
+	c := newItemCache(2)
+	item := func(id string) *resource.Item {
+		return &resource.Item{ID: id, ETag: "e" + id}
+	}
+
+	c.add("db.c", c.generation(), []*resource.Item{item("1"), item("2")})
+	if i, found := c.get("db.c", "1"); !found || i.ETag != "e1" {
+		t.Errorf("got: %v, %v want: item 1", i, found)
+	}
+	if _, found := c.get("db.other", "1"); found {
+		t.Error("got an item cached for another collection")
+	}
+
+	// 2 is the least recently used item.
+	c.add("db.c", c.generation(), []*resource.Item{item("3")})
+	if _, found := c.get("db.c", "2"); found {
+		t.Error("item 2 not evicted")
+	}
+	if _, found := c.get("db.c", "1"); !found {
+		t.Error("item 1 evicted")
+	}
+
+	// A read started before a write must not store its result after the
+	// write.
+	gen := c.generation()
+	c.invalidate("db.c", []interface{}{"1"})
+	if _, found := c.get("db.c", "1"); found {
+		t.Error("item 1 not invalidated")
+	}
+	c.add("db.c", gen, []*resource.Item{item("1")})
+	if _, found := c.get("db.c", "1"); found {
+		t.Error("stale item 1 cached")
+	}
+	if _, found := c.get("db.c", "3"); !found {
+		t.Error("item 3 invalidated")
+	}
+
+	c.invalidate("db.c", nil)
+	if _, found := c.get("db.c", "3"); found {
+		t.Error("item 3 not invalidated")
+	}
+
+	// A nil cache is disabled.
+	var nc *itemCache
+	nc.add("db.c", nc.generation(), []*resource.Item{item("1")})
+	if _, found := nc.get("db.c", "1"); found {
+		t.Error("got an item from a nil cache")
+	}
+}
+
+func TestItemCacheCopies(t *testing.T) {
+	c := newItemCache(2)
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	c.add("db.c", c.generation(), []*resource.Item{item})
+
+	// Neither the added item nor the returned ones alter the cache.
+	item.Payload["foo"] = "baz"
+	got, _ := c.get("db.c", "1")
+	if got.Payload["foo"] != "bar" {
+		t.Errorf("got: %v want: bar", got.Payload["foo"])
+	}
+	got.ETag = "b"
+	got.Payload["foo"] = "qux"
+	if got, _ := c.get("db.c", "1"); got.ETag != "a" || got.Payload["foo"] != "bar" {
+		t.Errorf("got: %s, %v want: a, bar", got.ETag, got.Payload["foo"])
+	}
+}
@@ -0,0 +1,80 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultMergeRetries is the number of times UpdateWithMerge retries when
+// the MergeRetries option is not set.
+const defaultMergeRetries = 10
+
+// UpdateWithMerge reads the item with id, passes it to merge and replaces it
+// by the returned item if it has not been modified in the meantime. Otherwise,
+// the item is read again and merge called with its new version, up to
+// MergeRetries times before failing with resource.ErrConflict, so concurrent
+// merges are never lost. It fails with resource.ErrNotFound if the item does
+// not exist or is removed while merging.
+//
+// merge may be called several times and must not modify current. The
+// returned item gets a new random etag and its update time set to the current
+// time if they are left unchanged.
+func (m OptionsHandler) UpdateWithMerge(ctx context.Context, id interface{}, merge func(current *resource.Item) (*resource.Item, error)) (err error) {
+	defer func() { err = classifyError(err) }()
+	retries := m.opts.MergeRetries
+	if retries <= 0 {
+		retries = defaultMergeRetries
+	}
+	for attempt := 0; ; attempt++ {
+		current, err := m.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		item, err := merge(current)
+		if err != nil {
+			return err
+		}
+		if item.ETag == "" || item.ETag == current.ETag {
+			item.ETag = bson.NewObjectId().Hex()
+		}
+		if item.Updated.IsZero() || item.Updated.Equal(current.Updated) {
+			item.Updated = time.Now()
+		}
+		err = m.Update(ctx, item, current)
+		// A *DuplicateKeyError also matches resource.ErrConflict, but
+		// retrying would fail the same way.
+		if err != resource.ErrConflict || attempt == retries {
+			return err
+		}
+	}
+}
+
+// UpdateWithMerge updates the item with id with merge, retrying on conflicts.
+func (m Handler) UpdateWithMerge(ctx context.Context, id interface{}, merge func(current *resource.Item) (*resource.Item, error)) error {
+	return m.options().UpdateWithMerge(ctx, id, merge)
+}
+
+// get reads the item with id from the collection, bypassing the item cache.
+func (m OptionsHandler) get(ctx context.Context, id interface{}) (*resource.Item, error) {
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	var mItem mongoItem
+	err = c.FindId(m.mongoID(id)).One(&mItem)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err == mgo.ErrNotFound {
+		return nil, resource.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.newItem(&mItem), nil
+}
@@ -0,0 +1,24 @@
+package mongo
+
+import "time"
+
+// Metrics receives the outcome of the operations of a handler, e.g. to export
+// their latency and error rate. Operations are reported under the names
+// "insert", "update", "delete", "clear", "find", "count" and "bulk" for
+// BulkApply. As an operation does not tell its collection, a handler should be
+// given its own Metrics to label them by collection.
+//
+// ObserveOp is called synchronously once the operation returns, and must be
+// safe for concurrent use.
+type Metrics interface {
+	// ObserveOp reports that the op operation took duration and returned
+	// err, nil on success.
+	ObserveOp(op string, duration time.Duration, err error)
+}
+
+// observe reports to the Metrics option the op operation started at start,
+// returning *err. It is meant to be deferred by operations with a named error
+// result, before any other defer so that it observes the final error.
+func (m OptionsHandler) observe(op string, start time.Time, err *error) {
+	m.opts.Metrics.ObserveOp(op, time.Since(start), *err)
+}
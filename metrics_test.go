@@ -0,0 +1,83 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+
+	mongo "github.com/rs/rest-layer-mongo"
+)
+
+type observation struct {
+	op  string
+	err error
+}
+
+type fakeMetrics struct {
+	mu  sync.Mutex
+	obs []observation
+}
+
+func (f *fakeMetrics) ObserveOp(op string, duration time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.obs = append(f.obs, observation{op, err})
+}
+
+// runOps runs each observed operation of h once.
+func runOps(h mongo.OptionsHandler) {
+	ctx := context.Background()
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	update := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	h.Insert(ctx, []*resource.Item{item})
+	h.Update(ctx, update, item)
+	h.Find(ctx, &query.Query{})
+	h.Count(ctx, &query.Query{})
+	h.Delete(ctx, update)
+	h.Clear(ctx, &query.Query{})
+}
+
+func TestMetricsErrors(t *testing.T) {
+	metrics := &fakeMetrics{}
+	h := mongo.NewHandlerFunc(nil, mongo.Options{Metrics: metrics})
+	h.Close()
+	runOps(h)
+	want := []observation{
+		{"insert", mongo.ErrHandlerClosed},
+		{"update", mongo.ErrHandlerClosed},
+		{"find", mongo.ErrHandlerClosed},
+		{"count", mongo.ErrHandlerClosed},
+		{"delete", mongo.ErrHandlerClosed},
+		{"clear", mongo.ErrHandlerClosed},
+	}
+	if !reflect.DeepEqual(metrics.obs, want) {
+		t.Errorf("got: %v want: %v", metrics.obs, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	metrics := &fakeMetrics{}
+	runOps(mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{Metrics: metrics}))
+	want := []observation{{"insert", nil}, {"update", nil}, {"find", nil}, {"count", nil}, {"delete", nil}, {"clear", nil}}
+	if !reflect.DeepEqual(metrics.obs, want) {
+		t.Errorf("got: %v want: %v", metrics.obs, want)
+	}
+}
+
+func TestMetricsEmptyWindow(t *testing.T) {
+	metrics := &fakeMetrics{}
+	h := mongo.NewHandlerFunc(nil, mongo.Options{Metrics: metrics})
+	h.Close()
+	// Items are counted, but a single find is observed.
+	h.Find(context.Background(), &query.Query{Window: &query.Window{Limit: 0}})
+	if want := []observation{{"find", mongo.ErrHandlerClosed}}; !reflect.DeepEqual(metrics.obs, want) {
+		t.Errorf("got: %v want: %v", metrics.obs, want)
+	}
+}
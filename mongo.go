@@ -3,11 +3,17 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
 	"github.com/rs/rest-layer/schema/query"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -19,10 +25,19 @@ type mongoItem struct {
 	ETag    string                 `bson:"_etag"`
 	Updated time.Time              `bson:"_updated"`
 	Payload map[string]interface{} `bson:",inline"`
+
+	// etagField and updatedField, when set, are the mapped names of the
+	// fields storing the etag and update time (see FieldMapping).
+	etagField    string
+	updatedField string
+
+	// transformed holds the values given in the item for the transformed
+	// fields, before they were transformed (see keepMeta).
+	transformed map[string]interface{}
 }
 
 // newMongoItem converts a resource.Item into a mongoItem.
-func newMongoItem(i *resource.Item) *mongoItem {
+func (m OptionsHandler) newMongoItem(i *resource.Item) (*mongoItem, error) {
 	// Filter out id from the payload so we don't store it twice
 	p := map[string]interface{}{}
 	for k, v := range i.Payload {
@@ -30,21 +45,116 @@ func newMongoItem(i *resource.Item) *mongoItem {
 			p[k] = v
 		}
 	}
-	return &mongoItem{
-		ID:      i.ID,
+	if m.opts.MaxDepth > 0 {
+		if err := checkDepth(p, m.opts.MaxDepth); err != nil {
+			return nil, err
+		}
+	}
+	transformed := m.transformedValues(p)
+	if err := m.writeTransforms(p); err != nil {
+		return nil, err
+	}
+	if m.opts.NonFinite != KeepNonFinite {
+		if err := replaceNonFinite(p, m.opts.NonFinite == RejectNonFinite); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.opts.DateFields {
+		if err := coerceDate(p, f); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.opts.DecimalFields {
+		if err := coerceDecimal(p, f); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.opts.BoolFields {
+		coerceBool(p, f)
+	}
+	if f := m.opts.ExpireField; f != "" {
+		if v, found := getPath(p, f); found && v != nil {
+			t, err := parseTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f, err)
+			}
+			p[expireAtField] = t
+		}
+	}
+	id := i.ID
+	if len(m.opts.IDFields) > 0 {
+		var err error
+		if id, err = m.compoundID(p); err != nil {
+			return nil, err
+		}
+	} else if !emptyID(id) {
+		var err error
+		if id, err = m.encodeID(id); err != nil {
+			return nil, err
+		}
+	}
+	if m.opts.FlattenSeparator != "" {
+		p = flatten(p, m.opts.FlattenSeparator)
+	}
+	mItem := &mongoItem{
+		ID:      id,
 		ETag:    i.ETag,
 		Updated: i.Updated,
 		Payload: p,
+
+		transformed: transformed,
+	}
+	if m.opts.ServerTimestamps {
+		// MongoDB stores dates with a millisecond precision.
+		mItem.Updated = time.Now().Truncate(time.Millisecond)
+	}
+	if m.opts.InsertionOrder {
+		mItem.Payload[seqField] = nextSeq()
+	}
+	if m.opts.TrackAccess {
+		mItem.Payload[lastAccessField] = time.Now().Truncate(time.Millisecond)
 	}
+	if m.mappedFields() {
+		mItem.etagField, mItem.updatedField = m.etagField(), m.updatedField()
+	}
+	return mItem, nil
 }
 
 // newItem converts a back mongoItem into a resource.Item.
-func newItem(i *mongoItem) *resource.Item {
+func (m OptionsHandler) newItem(i *mongoItem) *resource.Item {
 	// If there is no field except those defined in mongoItem, Payload could be nil
 	// when just fetched from the database.
 	if i.Payload == nil {
 		i.Payload = make(map[string]interface{})
 	}
+	if m.mappedFields() {
+		m.readMeta(i)
+	}
+	if m.opts.FlattenSeparator != "" {
+		i.Payload = unflatten(i.Payload, m.opts.FlattenSeparator)
+	}
+	for _, f := range m.opts.DecimalFields {
+		decodeDecimal(i.Payload, f)
+	}
+	for _, f := range m.opts.BoolFields {
+		decodeBool(i.Payload, f)
+	}
+	if m.opts.ExpireField != "" {
+		delete(i.Payload, expireAtField)
+	}
+	if m.opts.ServerTimestamps {
+		delete(i.Payload, createdField)
+	}
+	if m.opts.InsertionOrder {
+		delete(i.Payload, seqField)
+	}
+	if m.opts.TrackAccess {
+		delete(i.Payload, lastAccessField)
+	}
+	m.readTransforms(i.Payload)
+	if m.customIDs() {
+		i.ID = m.itemID(i.ID)
+	}
 	// Add the id back (we use the same map hoping the mongoItem won't be stored back)
 	i.Payload["id"] = i.ID
 	item := &resource.Item{
@@ -64,9 +174,520 @@ func newItem(i *mongoItem) *resource.Item {
 	return item
 }
 
+// CollectionFunc returns the mongo collection to use for a given context.
+type CollectionFunc func(ctx context.Context) (*mgo.Collection, error)
+
+// Options defines optional behaviors of an OptionsHandler. The zero value gives
+// the default behavior.
+type Options struct {
+	// CreatedField, when set, names a virtual field holding the creation time
+	// embedded in ObjectId ids. Comparisons on this field are translated into
+	// range queries on _id so they use the primary key index. It must only be
+	// used on collections keyed by ObjectIDField.
+	CreatedField string
+
+	// Schema, when set, is used to validate the fields referenced by query
+	// predicates. A query referencing a field unknown to the schema is then
+	// rejected with an error instead of silently matching nothing.
+	Schema schema.FieldGetter
+
+	// DateFields lists payload fields (using dotted notation for sub-fields)
+	// holding dates. ISO 8601 string values of these fields are stored as BSON
+	// dates, and query values compared with them are converted the same way so
+	// range queries are correct.
+	DateFields []string
+
+	// DecimalFields lists numeric payload fields (using dotted notation for
+	// sub-fields) stored as BSON Decimal128 to preserve the precision of
+	// numbers not representable as float64, e.g. big integer ids. Numbers,
+	// json.Number and numeric strings are accepted. When read, integer values
+	// are returned as int64 and other values as json.Number.
+	DecimalFields []string
+
+	// BoolFields lists boolean payload fields (using dotted notation for
+	// sub-fields) stored as 0 or 1 integers, for consumers reading the
+	// collection directly without support for BSON booleans. They are read
+	// back as booleans, and boolean query values compared with them are
+	// converted the same way.
+	BoolFields []string
+
+	// FlattenSeparator, when set, makes payloads stored flattened: nested
+	// objects are replaced by keys joining the path of their fields with the
+	// separator, e.g. {"a":{"b":1}} is stored as {"a__b":1} with "__". Arrays
+	// are stored as is. The dotted paths used by queries, sorts and
+	// projections are translated the same way, so paths reaching into arrays
+	// of objects are not supported. As MongoDB interprets dots in queries as
+	// paths, the separator must not be a dot, nor appear in payload keys.
+	FlattenSeparator string
+
+	// MissingIDs defines how MultiGet handles the requested ids for which no
+	// item is found. Missing items are omitted from the result by default.
+	MissingIDs MissingIDs
+
+	// EmptyIDs defines how Insert handles items with an empty id. They get a
+	// new ObjectId by default.
+	EmptyIDs EmptyIDs
+
+	// ExpireField, when set, names a payload field (using dotted notation for
+	// sub-fields) holding the time at which each item expires, either as a
+	// time.Time or an ISO 8601 string. The time is copied into the _expireAt
+	// field, covered by a TTL index created by EnsureIndexes, so MongoDB
+	// removes items once expired. Items without the field never expire.
+	ExpireField string
+
+	// BackgroundIndexes makes EnsureIndexes and EnsureSchemaIndexes build
+	// indexes in the background, which does not block other operations on the
+	// collection while the existing documents are indexed, at the cost of a
+	// slower build.
+	BackgroundIndexes bool
+
+	// MaxDepth, when positive, is the maximum nesting depth of stored
+	// payloads: writes of items nested deeper fail. Top-level fields are at
+	// depth 1, and each sub-document or array adds a level, so the fields of
+	// sub-documents held by an array are at depth 3. The changes of partial
+	// updates are checked too, dotted fields at the depth of their last
+	// segment.
+	MaxDepth int
+
+	// NonFinite defines how NaN and infinite float values found in payloads
+	// are stored. They are stored as is by default.
+	NonFinite NonFinite
+
+	// OnCollScan, when set, is called with the query of each Find answered by
+	// a scan of the whole collection, which usually reveals a missing index.
+	// Queries are explained beforehand, doubling the requests: it is meant
+	// to audit index usage in tests or development only.
+	OnCollScan func(q *query.Query)
+
+	// FailOnCollScan makes Find fail with ErrCollScan instead of performing
+	// queries answered by a scan of the whole collection. Like OnCollScan,
+	// it is meant for tests or development only.
+	FailOnCollScan bool
+
+	// MaxResults, when positive, caps the number of items returned by Find
+	// for queries without limit, i.e. without window or with a limit of -1,
+	// so that a query can't read a whole large collection in memory. The
+	// first MaxResults items are returned, with the list Limit set to
+	// MaxResults, unless FailOnMaxResults is set. Explicit limits are
+	// honored, even above MaxResults.
+	MaxResults int
+
+	// FailOnMaxResults makes Find fail with ErrTooManyResults instead of
+	// truncating the results of queries without limit matching more than
+	// MaxResults items.
+	FailOnMaxResults bool
+
+	// AlwaysCountTotal makes Find count the items matching the query with a
+	// second request when their total can't be deduced from the returned
+	// items, e.g. for pages other than the last one, instead of setting the
+	// Total of the list to -1.
+	AlwaysCountTotal bool
+
+	// ConsistentTotal makes Find compute the items and their total with a
+	// single aggregation, so that writes performed in between can't make the
+	// total disagree with the returned items, as they could with a Count
+	// performed after the Find. It costs a count of the matching items on each
+	// Find, and the items of a page must fit in a 16MiB document. It doesn't
+	// apply to FindWithProjection without $size computed fields, nor to
+	// queries holding Near or NearSphere expressions, which can't be
+	// aggregated and are read by a regular find.
+	//
+	// Snapshot read concern, which would allow separate Find and Count calls
+	// to read the same data, requires sessions unsupported by mgo.
+	ConsistentTotal bool
+
+	// ItemCacheSize, when positive, is the number of items kept in an
+	// in-memory LRU cache by MultiGet, which is used to resolve references.
+	// Cached items are removed when written through the handler, but writes
+	// performed by other processes are not seen until the items are evicted.
+	// Items are copied in and out of the cache, so callers may modify them.
+	ItemCacheSize int
+
+	// ProjectionPushdown makes Find only read the fields selected by the
+	// projection of the query instead of whole documents, which saves
+	// bandwidth when items hold large fields. Fields with children, e.g.
+	// references, are read as a whole, unless Schema is set and defines them
+	// as objects, whose sub-fields are then selected individually.
+	ProjectionPushdown bool
+
+	// Cache, when set, is used to cache the results of Find and Count. The
+	// cached results of a collection are invalidated on each write performed
+	// by the handler.
+	Cache Cache
+
+	// Metrics, when set, is called with the duration and error of each
+	// Insert, Update, Delete, Clear, Find, Count and BulkApply.
+	Metrics Metrics
+
+	// UpsertOnInsert makes Insert create or update items by id instead of
+	// failing with resource.ErrConflict when an item already exists. Existing
+	// documents get the fields of the inserted item set, while fields absent
+	// from the item are left untouched. It is equivalent to a
+	// ConflictStrategy of MergeOnConflict.
+	UpsertOnInsert bool
+
+	// ConflictStrategy defines how Insert handles items whose id already
+	// exists. It fails with resource.ErrConflict by default.
+	ConflictStrategy ConflictStrategy
+
+	// InsertDefaults maps payload fields to values only set when a document
+	// is created by an Insert with the MergeOnConflict or IgnoreOnConflict
+	// strategy (see ConflictStrategy), e.g. a version starting at 1.
+	// Re-inserting an item never resets them. A default is ignored when the
+	// inserted item holds the field or its top-level parent.
+	InsertDefaults map[string]interface{}
+
+	// Transforms maps payload fields (using dotted notation for sub-fields)
+	// to transformations applied to their values when stored and read, e.g.
+	// to hash a password and redact it from read payloads. Query values
+	// compared with these fields are transformed like stored values, so
+	// filters only match for deterministic transformations. Update and
+	// Upsert keep the stored value of transformed fields absent from the new
+	// item, so updating an item read without a redacted field does not
+	// remove it: set the field to null to clear it. A value equal to the
+	// stored one, e.g. a hash read back, is not transformed again.
+	Transforms map[string]FieldTransform
+
+	// IDFields, when set, makes items keyed by the values of these top-level
+	// payload fields, which must be strings or numbers, instead of their id.
+	// The _id is stored as a sub-document holding the values, in order. Item
+	// ids are then the JSON array of the values, e.g. `["acme",42]`, so they
+	// can be used in URLs: rest-layer id fields of such collections must not
+	// be generated.
+	IDFields []string
+
+	// IDCodec, when set, converts item ids into the _id they are stored as,
+	// and back. The provisional etags of items stored without etag are
+	// derived from their decoded id. It is ignored when IDFields is set, and
+	// generated ids are ObjectIds given to Encode.
+	IDCodec IDCodec
+
+	// InBatchSize is the maximum number of values of an $in condition sent by
+	// Find, Distinct or MultiGet in a single query, or by Count for $in
+	// conditions on the id. A Find whose query holds, outside of $or and
+	// $and, an $in with more values is split into queries of at most
+	// InBatchSize values, whose results are merged in memory without
+	// duplicates, in the requested order. Strings are then compared without
+	// collation. Each query reads the items of the whole window. It defaults
+	// to 1000, and a negative value disables splitting. Finds performed by
+	// aggregation ($size projections, ConsistentTotal), $near queries without
+	// sort, and Finds sorted on fields which may hold arrays or documents are
+	// not split: only sorts on the id, the meta fields and the scalar fields
+	// of the Schema option, except DecimalFields, are merged.
+	InBatchSize int
+
+	// ServerTimestamps, when set, makes the handler set the update time of
+	// items to the current time on every write, ignoring the one given by
+	// the client, which is updated once the write succeeds. Insert and Upsert
+	// also store the creation time of new items under "_created", which
+	// Update and Upsert keep by reading it back before replacing the item.
+	// Other writes replacing whole items, such as BulkApply updates, drop
+	// it. The creation time is not returned in payloads.
+	ServerTimestamps bool
+
+	// InsertionOrder, when set, makes the handler stamp written items with
+	// an increasing sequence number stored under "_seq", and sort items in
+	// insertion order instead of by id when a query has no sort, e.g. for
+	// collections keyed by strings, whose ids carry no creation time.
+	// Sequence numbers are derived from the time of the write, so items
+	// written by different processes are ordered at the precision of their
+	// clocks. Update and Upsert keep the sequence number of the item they
+	// replace, while other writes replacing whole items renew it. Items
+	// stored without one come first. The sequence number is not returned in
+	// payloads.
+	InsertionOrder bool
+
+	// TrackAccess, when set, makes the handler record the time items are
+	// last accessed under "_lastAccess", e.g. to expire inactive items with
+	// EnsureTTLIndex(ctx, h, "_lastAccess", d). Items are stamped when
+	// written, and when read by id with MultiGet, including from the item
+	// cache, using a single update per call. Reads from Find are not
+	// recorded, as stamping lists would be too expensive. Failing to record
+	// an access does not fail the read. The access time is not returned in
+	// payloads.
+	TrackAccess bool
+
+	// BulkInsertSize, when positive, makes Insert send the items using
+	// unordered bulk operations of at most BulkInsertSize items, instead of
+	// a single insert aborted by the first failure. Failed inserts do not
+	// prevent the others and are reported by a *BulkError listing their
+	// indexes, duplicate keys failing with resource.ErrConflict. When all the
+	// items fail as duplicates, Insert fails with resource.ErrConflict like
+	// the default insert. It is ignored unless ConflictStrategy is
+	// ErrorOnConflict.
+	BulkInsertSize int
+
+	// ReadConcern, when set, is the read concern level of Find,
+	// FindWithGroupCounts, Count and Aggregate, e.g. ReadConcernMajority to
+	// only read data acknowledged by a majority of the replica set, which
+	// can't be rolled back. As mgo can't set read concerns, these operations
+	// then run the find, count and aggregate commands directly, which
+	// requires MongoDB 3.2. Except for Count, they fail with ErrEventualMode
+	// if the session is in mgo.Eventual mode. Other reads use the default
+	// read concern of the server.
+	ReadConcern string
+
+	// EstimatedCount, when set, makes Count answer queries without filter
+	// from the metadata of the collection instead of counting its items,
+	// which is much faster on large collections but may be inaccurate, e.g.
+	// after an unclean shutdown or with orphaned documents on sharded
+	// clusters. Queries with a filter are always counted exactly.
+	EstimatedCount bool
+
+	// LargeSorts defines how Find handles sorts exceeding the memory limit
+	// of MongoDB, FailLargeSorts by default.
+	LargeSorts LargeSorts
+
+	// FieldMapping, when set, defines custom names for the fields storing the
+	// etag and update time of items.
+	FieldMapping FieldMapping
+
+	// MergeRetries is the number of times UpdateWithMerge reads the item
+	// again and retries when the item is modified concurrently. It defaults
+	// to 10.
+	MergeRetries int
+
+	// Safe defines the write concern of the handler, e.g. &mgo.Safe{WMode:
+	// "majority"}. Writes are acknowledged by default. The safety settings
+	// of the session are kept when more conservative.
+	Safe *mgo.Safe
+
+	// ReadMode, when set, defines the read preference of the handler, e.g.
+	// mgo.SecondaryPreferred. It is not applied to sessions pinned with
+	// WithSession. As its zero value, mgo.Eventual can't be selected.
+	ReadMode mgo.Mode
+
+	// SessionPoolSize, when positive, is the number of long-lived copies of
+	// the mgo session kept by the handler, each used by one operation at a
+	// time, instead of copying the session for each operation. It saves
+	// allocations under high load, as long as SessionPoolSize exceeds the
+	// number of concurrent operations, the others copying the session. The
+	// collections returned by the CollectionFunc of the handler must then
+	// share the same session. Pooled sessions have timeouts of a minute, as
+	// with mgo.Dial, unless shortened by the options below or the context.
+	SessionPoolSize int
+
+	// SocketTimeout and SyncTimeout, when set, override the corresponding
+	// timeouts of the session. A shorter context deadline still takes
+	// precedence.
+	SocketTimeout time.Duration
+	SyncTimeout   time.Duration
+}
+
+// ConflictStrategy defines how Insert handles items whose id already exists.
+// With a strategy other than ErrorOnConflict, items are written one by one,
+// each of them created or resolved independently.
+type ConflictStrategy int
+
+const (
+	// ErrorOnConflict fails with resource.ErrConflict.
+	ErrorOnConflict ConflictStrategy = iota
+	// OverwriteOnConflict replaces the existing document by the item.
+	OverwriteOnConflict
+	// IgnoreOnConflict leaves the existing document untouched.
+	IgnoreOnConflict
+	// MergeOnConflict sets the fields of the item in the existing document,
+	// leaving the fields absent from the item untouched.
+	MergeOnConflict
+)
+
+// MissingIDs defines how MultiGet handles the requested ids for which no item
+// is found.
+type MissingIDs int
+
+const (
+	// OmitMissing omits missing items from the result, as expected by REST
+	// Layer.
+	OmitMissing MissingIDs = iota
+	// NilMissing returns a nil item in place of each missing item.
+	NilMissing
+	// ErrorMissing fails with a *MissingIDsError listing the missing ids.
+	ErrorMissing
+)
+
+// NonFinite defines how NaN and infinite float values found in payloads are
+// stored.
+type NonFinite int
+
+const (
+	// KeepNonFinite stores non-finite values as is.
+	KeepNonFinite NonFinite = iota
+	// RejectNonFinite fails writes holding non-finite values with an error
+	// naming the offending field.
+	RejectNonFinite
+	// NullNonFinite stores non-finite values as null.
+	NullNonFinite
+)
+
+// EmptyIDs defines how Insert handles items with an empty id: nil, an empty
+// string or an empty ObjectId.
+type EmptyIDs int
+
+const (
+	// GenerateEmptyIDs gives items with an empty id a new ObjectId.
+	GenerateEmptyIDs EmptyIDs = iota
+	// RejectEmptyIDs fails inserts of items with an empty id with
+	// ErrEmptyID.
+	RejectEmptyIDs
+)
+
+// LargeSorts defines how Find handles the sorts MongoDB can't perform in
+// memory, because no index provides the requested order and the matching
+// items exceed the memory limit of sorts (100MB, or 32MB before MongoDB 4.4).
+type LargeSorts int
+
+const (
+	// FailLargeSorts returns the error of MongoDB.
+	FailLargeSorts LargeSorts = iota
+	// DiskLargeSorts runs the query again as an aggregation allowed to sort
+	// using temporary files, which is slower but succeeds. Finds already
+	// performed by aggregation are always allowed to use the disk.
+	DiskLargeSorts
+	// StrictLargeSorts fails with a *SortMemoryError naming the sorted
+	// fields.
+	StrictLargeSorts
+)
+
+// ErrTooManyResults is returned by Find for queries without limit matching more
+// than MaxResults items when the handler is configured with FailOnMaxResults.
+var ErrTooManyResults = errors.New("mongo: query matches more items than allowed without limit")
+
+// ErrEmptyID is returned by Insert for items with an empty id when the handler
+// is configured with RejectEmptyIDs.
+var ErrEmptyID = errors.New("mongo: item id must not be empty")
+
+// MissingIDsError is returned by MultiGet when some of the requested items are
+// not found and the handler is configured with ErrorMissing. It matches
+// resource.ErrNotFound with errors.Is.
+type MissingIDsError struct {
+	// IDs lists the missing ids, once each, in the requested order.
+	IDs []interface{}
+}
+
+func (e *MissingIDsError) Error() string {
+	return fmt.Sprintf("ids not found: %v", e.IDs)
+}
+
+// Is reports whether target is resource.ErrNotFound.
+func (e *MissingIDsError) Is(target error) bool {
+	return target == resource.ErrNotFound
+}
+
 // Handler handles resource storage in a MongoDB collection.
 type Handler func(ctx context.Context) (*mgo.Collection, error)
 
+// options returns the handler with default options performing the operations
+// of m.
+func (m Handler) options() OptionsHandler {
+	return OptionsHandler{collection: CollectionFunc(m)}
+}
+
+// Insert inserts new items in the mongo collection.
+func (m Handler) Insert(ctx context.Context, items []*resource.Item) error {
+	return m.options().Insert(ctx, items)
+}
+
+// Update replace an item by a new one in the mongo collection.
+func (m Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
+	return m.options().Update(ctx, item, original)
+}
+
+// Delete deletes an item from the mongo collection.
+func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
+	return m.options().Delete(ctx, item)
+}
+
+// Clear clears all items from the mongo collection matching the query.
+func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
+	return m.options().Clear(ctx, q)
+}
+
+// Find items from the mongo collection matching the provided query.
+func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+	return m.options().Find(ctx, q)
+}
+
+// Count counts the number items matching the lookup filter.
+func (m Handler) Count(ctx context.Context, q *query.Query) (int, error) {
+	return m.options().Count(ctx, q)
+}
+
+// OptionsHandler handles resource storage in a MongoDB collection like
+// Handler, with the optional behaviors defined by its Options and the
+// operations they enable. It is created by NewHandlerWithOptions or
+// NewHandlerFunc.
+type OptionsHandler struct {
+	collection CollectionFunc
+	opts       Options
+	cache      *cache
+	items      *itemCache
+	pool       *sessionPool
+	closed     *closed
+}
+
+// ErrHandlerClosed is returned by the operations of a closed handler.
+var ErrHandlerClosed = errors.New("mongo: handler closed")
+
+// closed is shared by the copies of a handler to signal they are closed. It
+// also tracks the reads in flight, so Close can interrupt them.
+type closed struct {
+	once sync.Once
+	ch   chan struct{}
+
+	mu    sync.Mutex
+	done  bool
+	reads map[*mgo.Iter]*mgo.Session
+}
+
+// track registers the read performed with iter on the session s, which Close
+// interrupts by closing both. It returns false if the handler is closed.
+func (cl *closed) track(iter *mgo.Iter, s *mgo.Session) bool {
+	if cl == nil {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.done {
+		return false
+	}
+	if cl.reads == nil {
+		cl.reads = map[*mgo.Iter]*mgo.Session{}
+	}
+	cl.reads[iter] = s
+	return true
+}
+
+// untrack unregisters the read performed with iter. It returns false if Close
+// interrupted the read, in which case iter and its session are closed and
+// must not be used anymore.
+func (cl *closed) untrack(iter *mgo.Iter) bool {
+	if cl == nil {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, found := cl.reads[iter]; !found {
+		return false
+	}
+	delete(cl.reads, iter)
+	return true
+}
+
+// interrupt closes the iterators of the reads in flight, which kills their
+// server cursors, and then their sessions, so the sockets they wait on are
+// closed with the base session.
+func (cl *closed) interrupt() {
+	cl.mu.Lock()
+	cl.done = true
+	reads := cl.reads
+	cl.reads = nil
+	cl.mu.Unlock()
+	for iter, s := range reads {
+		iter.Close()
+		s.Close()
+	}
+}
+
 // NewHandler creates an new mongo handler
 func NewHandler(s *mgo.Session, db, collection string) Handler {
 	c := func() *mgo.Collection {
@@ -77,81 +698,855 @@ func NewHandler(s *mgo.Session, db, collection string) Handler {
 	}
 }
 
+// NewHandlerWithOptions creates a new mongo handler with the given options.
+func NewHandlerWithOptions(s *mgo.Session, db, collection string, opts Options) OptionsHandler {
+	c := func() *mgo.Collection {
+		return s.DB(db).C(collection)
+	}
+	return NewHandlerFunc(func(ctx context.Context) (*mgo.Collection, error) {
+		return c(), nil
+	}, opts)
+}
+
+// NewHandlerFunc creates a new mongo handler using f to select the collection
+// for each operation, e.g. to store each tenant in its own database.
+func NewHandlerFunc(f CollectionFunc, opts Options) OptionsHandler {
+	return OptionsHandler{
+		collection: f,
+		opts:       opts,
+		cache:      newCache(opts.Cache),
+		items:      newItemCache(opts.ItemCacheSize),
+		pool:       newSessionPool(opts.SessionPoolSize),
+		closed:     &closed{ch: make(chan struct{})},
+	}
+}
+
+// Close stops the handler: new operations fail with ErrHandlerClosed, and
+// in-flight Finds return the same error. The iterators of these Finds are
+// closed, which kills their server cursors, along with their session copies.
+// Close should be called before closing the base mgo session on shutdown:
+// once no copy of the base session is left, mgo closes its sockets, which
+// interrupts the Finds still waiting on a server reply instead of leaving them
+// waiting on a socket timeout. Other in-flight operations complete. The
+// sessions of the pool of the handler, if any, are closed once their
+// operation is over. Close is shared by all the copies of the handler, and
+// may be called several times.
+func (m OptionsHandler) Close() {
+	// Close the pool first so the interrupted sessions are not reused.
+	m.pool.close()
+	if m.closed != nil {
+		m.closed.once.Do(func() { close(m.closed.ch) })
+		m.closed.interrupt()
+	}
+}
+
+// err returns the error to interrupt an operation with, either because ctx is
+// done or because the handler has been closed.
+func (m OptionsHandler) err(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.closed != nil {
+		select {
+		case <-m.closed.ch:
+			return ErrHandlerClosed
+		default:
+		}
+	}
+	return nil
+}
+
 // C returns the mongo collection managed by this storage handler
 // from a Copy() of the mgo session.
-func (m Handler) c(ctx context.Context) (*mgo.Collection, error) {
-	if err := ctx.Err(); err != nil {
+func (m OptionsHandler) c(ctx context.Context) (*mgo.Collection, error) {
+	if err := m.err(ctx); err != nil {
 		return nil, err
 	}
-	c, err := m(ctx)
+	c, err := m.collection(ctx)
 	if err != nil {
 		return nil, err
 	}
-	// With mgo, session.Copy() pulls a connection from the connection pool
-	s := c.Database.Session.Copy()
+	var s *mgo.Session
+	pooled := false
+	if ps := sessionFromContext(ctx); ps != nil {
+		// Reuse the socket reserved by the session pinned to the context
+		s = ps.Clone()
+	} else if s = m.pool.get(c.Database.Session, m.opts.ReadMode); s != nil {
+		pooled = true
+	} else {
+		// With mgo, session.Copy() pulls a connection from the connection pool
+		s = c.Database.Session.Copy()
+		if m.opts.ReadMode != mgo.Eventual {
+			s.SetMode(m.opts.ReadMode, true)
+		}
+	}
 	// Ensure safe mode is enabled in order to get errors
-	s.EnsureSafe(&mgo.Safe{})
-	// Set a timeout to match the context deadline if any
+	safe := m.opts.Safe
+	if safe == nil {
+		safe = &mgo.Safe{}
+	}
+	s.EnsureSafe(safe)
+	// Set a timeout to match the context deadline if any, unless the
+	// configured one is shorter
 	if deadline, ok := ctx.Deadline(); ok {
 		timeout := time.Until(deadline)
 		if timeout <= 0 {
 			timeout = 0
 		}
-		s.SetSocketTimeout(timeout)
-		s.SetSyncTimeout(timeout)
+		s.SetSocketTimeout(shorterTimeout(m.opts.SocketTimeout, timeout))
+		s.SetSyncTimeout(shorterTimeout(m.opts.SyncTimeout, timeout))
+	} else {
+		socketTimeout, syncTimeout := m.opts.SocketTimeout, m.opts.SyncTimeout
+		if pooled {
+			// Reset the timeouts set for the previous operation
+			if socketTimeout <= 0 {
+				socketTimeout = defaultPoolTimeout
+			}
+			if syncTimeout <= 0 {
+				syncTimeout = defaultPoolTimeout
+			}
+		}
+		if socketTimeout > 0 {
+			s.SetSocketTimeout(socketTimeout)
+		}
+		if syncTimeout > 0 {
+			s.SetSyncTimeout(syncTimeout)
+		}
 	}
 	c.Database.Session = s
 	return c, nil
 }
 
-// close returns a mgo.Collection's session to the connection pool.
-func (m Handler) close(c *mgo.Collection) {
-	c.Database.Session.Close()
+// shorterTimeout returns the configured timeout if set and shorter than the
+// timeout derived from the context deadline.
+func shorterTimeout(configured, deadline time.Duration) time.Duration {
+	if configured > 0 && configured < deadline {
+		return configured
+	}
+	return deadline
 }
 
-// Insert inserts new items in the mongo collection.
-func (m Handler) Insert(ctx context.Context, items []*resource.Item) error {
-	mItems := make([]interface{}, len(items))
+// close returns a mgo.Collection's session to the session pool of the
+// handler, or to the connection pool.
+func (m OptionsHandler) close(c *mgo.Collection) {
+	if !m.pool.put(c.Database.Session) {
+		c.Database.Session.Close()
+	}
+}
+
+// invalidate removes the cached values made stale by a write to c touching the
+// items with ids, or any item if ids is nil.
+func (m OptionsHandler) invalidate(ctx context.Context, c *mgo.Collection, ids []interface{}) {
+	m.cache.invalidate(ctx, c.FullName)
+	m.items.invalidate(c.FullName, ids)
+}
+
+// ServerVersion returns the version of the MongoDB server, e.g. "4.4.6", so
+// features requiring a minimum version can be gated.
+func (m OptionsHandler) ServerVersion(ctx context.Context) (_ string, err error) {
+	defer func() { err = classifyError(err) }()
+	c, err := m.c(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer m.close(c)
+	info, err := c.Database.Session.BuildInfo()
+	if err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
+
+// ServerVersion returns the version of the MongoDB server.
+func (m Handler) ServerVersion(ctx context.Context) (string, error) {
+	return m.options().ServerVersion(ctx)
+}
+
+// MoreFieldsThan returns a FieldCount expression matching the documents
+// holding more than n payload fields at their top-level, not counting the id
+// and the meta fields under the names used by m.
+func (m OptionsHandler) MoreFieldsThan(n int) query.Expression {
+	return &FieldCount{Min: n, meta: []string{"_id", m.etagField(), m.updatedField(), createdField, seqField, lastAccessField, expireAtField}}
+}
+
+// UnsortedArray returns an Unsorted expression matching the documents whose
+// numeric array field is not sorted in ascending order. It fails if the
+// server is older than MongoDB 5.2, which introduced $sortArray.
+func (m OptionsHandler) UnsortedArray(ctx context.Context, field string) (query.Expression, error) {
+	v, err := m.ServerVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !versionAtLeast(v, 5, 2) {
+		return nil, fmt.Errorf("%s: unsorted array query requires MongoDB 5.2, server is %s", field, v)
+	}
+	return &Unsorted{Field: field}, nil
+}
+
+// versionAtLeast tells if the server version v, e.g. "4.4.6", is at least
+// min, given as major, minor, ... numbers.
+func versionAtLeast(v string, min ...int) bool {
+	parts := strings.Split(v, ".")
+	for i, n := range min {
+		p := 0
+		if i < len(parts) {
+			// Ignore suffixes like in "5.3.0-rc1".
+			digits := parts[i]
+			if end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+				digits = digits[:end]
+			}
+			var err error
+			if p, err = strconv.Atoi(digits); err != nil {
+				return false
+			}
+		}
+		if p != n {
+			return p > n
+		}
+	}
+	return true
+}
+
+// Insert inserts new items in the mongo collection. Items without an id get a
+// new ObjectId, set back into their ID and payload once inserted, unless the
+// EmptyIDs option rejects them. Violating a unique index other than the
+// primary key fails with a *DuplicateKeyError, and a write concern failure,
+// after which the items may have been inserted, with a *WriteConcernError:
+// their generated ids are set back anyway, so they can be looked up before
+// retrying.
+// With the BulkInsertSize option, the items not listed by a *BulkError are
+// inserted.
+//
+// Like the other operations of the handler, network failures return errors
+// matching ErrTemporary or ErrUnavailable.
+func (m OptionsHandler) Insert(ctx context.Context, items []*resource.Item) (err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("insert", time.Now(), &err)
+	}
+	defer func() { err = classifyError(err) }()
+	mItems, ids, generated, err := m.insertDocs(items)
+	if err != nil {
+		return err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, ids)
+	strategy := m.opts.ConflictStrategy
+	if m.opts.UpsertOnInsert && strategy == ErrorOnConflict {
+		strategy = MergeOnConflict
+	}
+	if strategy != ErrorOnConflict {
+		err = m.upsertItems(c, mItems, strategy)
+	} else if m.opts.BulkInsertSize > 0 {
+		err = m.insertBulk(ctx, c, items, mItems)
+	} else {
+		err = c.Insert(mItems...)
+	}
+	if mgo.IsDup(err) {
+		err = duplicateKeyError(c, err)
+	} else {
+		err = writeConcernError(err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var bulkErr *BulkError
+	var wcErr *WriteConcernError
+	// After a write concern failure, the items may have been inserted, so
+	// their generated ids are returned for the caller to check them.
+	if err == nil || errors.As(err, &bulkErr) || errors.As(err, &wcErr) {
+		failed := map[int]bool{}
+		if bulkErr != nil {
+			for _, oe := range bulkErr.Errors {
+				failed[oe.Index] = true
+			}
+		}
+		m.setInserted(items, mItems, generated, failed)
+	}
+	return err
+}
+
+// insertDocs returns the documents inserting items, along with the ids of
+// items and the ids generated for them by index. Items without an id get a
+// new ObjectId, unless the EmptyIDs option rejects them.
+func (m OptionsHandler) insertDocs(items []*resource.Item) (mItems, ids []interface{}, generated map[int]interface{}, err error) {
+	mItems = make([]interface{}, len(items))
+	ids = make([]interface{}, len(items))
+	generated = map[int]interface{}{}
 	for i, item := range items {
-		mItems[i] = newMongoItem(item)
+		mItem, err := m.newMongoItem(item)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ids[i] = mItem.ID
+		if len(m.opts.IDFields) > 0 {
+			// The id is derived from the payload
+			ids[i] = m.itemID(mItem.ID)
+			generated[i] = ids[i]
+		} else if emptyID(item.ID) {
+			if m.opts.EmptyIDs == RejectEmptyIDs {
+				return nil, nil, nil, fmt.Errorf("item #%d: %w", i, ErrEmptyID)
+			}
+			// Generate the id like MongoDB drivers do, so it can be returned
+			id := bson.NewObjectId()
+			if mItem.ID, err = m.encodeID(id); err != nil {
+				return nil, nil, nil, err
+			}
+			generated[i] = id
+			ids[i] = id
+		} else if m.opts.IDCodec != nil {
+			ids[i] = item.ID
+		}
+		if m.opts.ServerTimestamps {
+			mItem.Payload[createdField] = mItem.Updated
+		}
+		mItems[i] = mItem
+	}
+	return mItems, ids, generated, nil
+}
+
+// setInserted sets back into the inserted items the ids generated for them
+// and, with ServerTimestamps, their update time, except for the failed ones.
+func (m OptionsHandler) setInserted(items []*resource.Item, mItems []interface{}, generated map[int]interface{}, failed map[int]bool) {
+	for i, id := range generated {
+		if failed[i] {
+			continue
+		}
+		items[i].ID = id
+		if items[i].Payload != nil {
+			items[i].Payload["id"] = id
+		}
+	}
+	if m.opts.ServerTimestamps {
+		for i, mItem := range mItems {
+			if !failed[i] {
+				items[i].Updated = mItem.(*mongoItem).Updated
+			}
+		}
+	}
+}
+
+// emptyID reports whether id is unset, in which case Insert generates one.
+func emptyID(id interface{}) bool {
+	switch t := id.(type) {
+	case nil:
+		return true
+	case string:
+		return t == ""
+	case bson.ObjectId:
+		return t == ""
+	}
+	return false
+}
+
+// idKey returns the key of id in maps of items by id. Integer ids are read
+// back as int or int64 depending on their size, and given as int by rest-layer
+// integer validators, so they are keyed as int64. Integral float64 ids, e.g.
+// those of a parsed predicate, match the same documents and are keyed as
+// int64 too.
+func idKey(id interface{}) interface{} {
+	switch t := id.(type) {
+	case int:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case float64:
+		if t == math.Trunc(t) && t >= -(1<<63) && t < 1<<63 {
+			return int64(t)
+		}
+	}
+	return id
+}
+
+// upsertItems creates mItems by id, resolving the conflicts with existing
+// documents according to strategy, and applying the insert defaults to the
+// created documents only.
+func (m OptionsHandler) upsertItems(c *mgo.Collection, mItems []interface{}, strategy ConflictStrategy) error {
+	for _, mi := range mItems {
+		mItem := mi.(*mongoItem)
+		if strategy == OverwriteOnConflict {
+			if _, err := c.UpsertId(mItem.ID, mItem); err != nil {
+				return err
+			}
+			continue
+		}
+		// The etag and update time are always set so the stored document
+		// matches the item returned to the client.
+		set := bson.M{m.etagField(): mItem.ETag, m.updatedField(): mItem.Updated}
+		for k, v := range mItem.Payload {
+			set[k] = v
+		}
+		var u bson.M
+		if strategy == IgnoreOnConflict {
+			for k, v := range insertDefaults(m.flatDoc(m.opts.InsertDefaults), set) {
+				set[k] = v
+			}
+			u = bson.M{"$setOnInsert": set}
+		} else {
+			u = bson.M{"$set": set}
+			if d := insertDefaults(m.flatDoc(m.opts.InsertDefaults), set); len(d) > 0 {
+				u["$setOnInsert"] = d
+			}
+		}
+		if _, err := c.UpsertId(mItem.ID, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertDefaults returns the defaults not conflicting with the fields of the
+// $set document set, as MongoDB rejects updates touching the same path twice.
+func insertDefaults(defaults map[string]interface{}, set bson.M) bson.M {
+	d := bson.M{}
+	for f, v := range defaults {
+		if _, found := set[strings.SplitN(f, ".", 2)[0]]; found {
+			continue
+		}
+		d[f] = v
+	}
+	return d
+}
+
+// FindOrCreate returns the first item matching q, or atomically inserts item
+// if none does. The returned boolean is true if item has been inserted, in
+// which case, like with Insert, item gets its generated id if it had none.
+//
+// Concurrent calls with the same query may both try to create the item: a
+// unique index covering the queried fields is required to guarantee only one
+// of them succeeds, the other then returning the created item.
+func (m OptionsHandler) FindOrCreate(ctx context.Context, q *query.Query, item *resource.Item) (_ *resource.Item, _ bool, err error) {
+	defer func() { err = classifyError(err) }()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, false, err
+	}
+	// The item is prepared like by Insert, so that it gets an id if missing.
+	items := []*resource.Item{item}
+	mItems, ids, generated, err := m.insertDocs(items)
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, ids)
+	change := mgo.Change{
+		Update:    bson.M{"$setOnInsert": mItems[0]},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var result mongoItem
+	info, err := c.Find(qry).Sort(m.getSort(q)...).Apply(change, &result)
+	if mgo.IsDup(err) {
+		// A concurrent call created a matching item first, which is now
+		// returned unless the duplicate is on another unique key.
+		result = mongoItem{}
+		info, err = c.Find(qry).Sort(m.getSort(q)...).Apply(change, &result)
+		if mgo.IsDup(err) {
+			err = resource.ErrConflict
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	created := info.UpsertedId != nil
+	if created {
+		m.setInserted(items, mItems, generated, nil)
+	}
+	return m.newItem(&result), created, nil
+}
+
+// FindOrCreate returns the item matching q, creating item if none does.
+func (m Handler) FindOrCreate(ctx context.Context, q *query.Query, item *resource.Item) (*resource.Item, bool, error) {
+	return m.options().FindOrCreate(ctx, q, item)
+}
+
+// Update replace an item by a new one in the mongo collection.
+func (m OptionsHandler) Update(ctx context.Context, item *resource.Item, original *resource.Item) (err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("update", time.Now(), &err)
+	}
+	_, err = m.UpdateWithInfo(ctx, item, original)
+	return err
+}
+
+// UpdateWithInfo is like Update, but also returns the outcome reported by
+// MongoDB, e.g. for audit logs: Matched is 1, and Updated is 0 if the stored
+// document was identical to the new one. The info is nil if the session is
+// not in safe mode (see mgo.Session.SetSafe), as MongoDB then reports
+// nothing.
+func (m OptionsHandler) UpdateWithInfo(ctx context.Context, item *resource.Item, original *resource.Item) (_ *mgo.ChangeInfo, err error) {
+	defer func() { err = classifyError(err) }()
+	mItem, err := m.newMongoItem(item)
+	if err != nil {
+		return nil, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, []interface{}{original.ID})
+	s := bson.M{"_id": m.mongoID(original.ID)}
+	m.etagCondition(s, original.ETag)
+	if err = m.keepMeta(c, s["_id"], mItem); err != nil {
+		return nil, err
+	}
+	info, err := updateOne(c, s, mItem)
+	if err == nil && m.opts.ServerTimestamps {
+		item.Updated = mItem.Updated
+	}
+	if mgo.IsDup(err) {
+		// The new version of the item collides with another one on a
+		// unique index
+		return nil, duplicateKeyError(c, err)
+	}
+	if err == mgo.ErrNotFound {
+		// Determine if the item is not found or if the item is found but etag missmatch
+		var count int
+		count, err = c.FindId(m.mongoID(original.ID)).Count()
+		if err != nil {
+			// The find returned an unexpected err, just forward it with no mapping
+		} else if count == 0 {
+			err = resource.ErrNotFound
+		} else if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			// If the item were found, it means that its etag didn't match
+			err = resource.ErrConflict
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// updateOne replaces the document of c matching the selector s by doc, like
+// c.Update, but also returns the number of matched and modified documents,
+// which mgo only reports for bulk operations.
+func updateOne(c *mgo.Collection, s bson.M, doc interface{}) (*mgo.ChangeInfo, error) {
+	b := c.Bulk()
+	b.Update(s, doc)
+	res, err := b.Run()
+	if berr, ok := err.(*mgo.BulkError); ok {
+		if cases := berr.Cases(); len(cases) == 1 {
+			err = cases[0].Err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Database.Session.Safe() == nil {
+		return nil, nil
+	}
+	if res.Matched == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return &mgo.ChangeInfo{Matched: res.Matched, Updated: res.Modified}, nil
+}
+
+// Upsert replaces the item with the id of item, or atomically inserts item if
+// no item has this id. When original is not nil, an existing item is only
+// replaced if its etag still matches the original one; otherwise it fails
+// with resource.ErrConflict, like Update. A nil original replaces any stored
+// item. The returned boolean is true if item has been inserted.
+func (m OptionsHandler) Upsert(ctx context.Context, item *resource.Item, original *resource.Item) (_ bool, err error) {
+	defer func() { err = classifyError(err) }()
+	mItem, err := m.newMongoItem(item)
+	if err != nil {
+		return false, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, []interface{}{item.ID})
+	s := bson.M{"_id": m.mongoID(item.ID)}
+	if original != nil {
+		m.etagCondition(s, original.ETag)
+	}
+	if err = m.keepMeta(c, s["_id"], mItem); err != nil {
+		return false, err
+	}
+	if m.opts.ServerTimestamps {
+		if _, found := mItem.Payload[createdField]; !found {
+			mItem.Payload[createdField] = mItem.Updated
+		}
+	}
+	info, err := c.Upsert(s, mItem)
+	if mgo.IsDup(err) {
+		// Either the stored item's etag didn't match, making MongoDB try to
+		// insert a new item with the same id, a concurrent call inserted the
+		// item first, or the item collides with another one on a unique index
+		err = duplicateKeyError(c, err)
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		return false, err
+	}
+	if m.opts.ServerTimestamps {
+		item.Updated = mItem.Updated
+	}
+	return info.UpsertedId != nil, nil
+}
+
+// keepMeta copies the creation time and sequence number of the item stored
+// with the _id id, if any and enabled by the options, into the replacement
+// document mItem, so that replacing the item does not change them. The
+// stored values of transformed fields are kept as well when mItem omits them
+// or gives them the stored value, which must not be transformed again.
+func (m OptionsHandler) keepMeta(c *mgo.Collection, id interface{}, mItem *mongoItem) error {
+	sel := bson.M{}
+	if m.opts.ServerTimestamps {
+		sel[createdField] = 1
+	}
+	if m.opts.InsertionOrder {
+		sel[seqField] = 1
+	}
+	for f := range m.opts.Transforms {
+		sel[m.storedPath(f)] = 1
+	}
+	if len(sel) == 0 {
+		return nil
+	}
+	var stored map[string]interface{}
+	err := c.FindId(id).Select(sel).One(&stored)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{createdField, seqField} {
+		if _, selected := sel[f]; !selected {
+			continue
+		}
+		if v, found := stored[f]; found {
+			mItem.Payload[f] = v
+		}
+	}
+	for f := range m.opts.Transforms {
+		path := m.storedPath(f)
+		sv, found := m.storedValue(stored, path)
+		if !found {
+			continue
+		}
+		if v, given := mItem.transformed[f]; !given || reflect.DeepEqual(v, sv) {
+			m.setStoredValue(mItem.Payload, path, sv)
+		}
+	}
+	return nil
+}
+
+// CompareAndSwap atomically sets the changes fields of the item identified by
+// id if all its conditions fields hold the given values. It returns false if
+// the item does not exist or does not match the conditions. Both maps use
+// dotted notation for sub-fields. Condition values are converted like query
+// values, e.g. for DateFields and BoolFields.
+//
+// On success, the item gets a new random _etag and its _updated set to the
+// current time, so concurrent Updates based on the previous version fail with
+// resource.ErrConflict.
+func (m OptionsHandler) CompareAndSwap(ctx context.Context, id interface{}, conditions, changes map[string]interface{}) (_ bool, err error) {
+	defer func() { err = classifyError(err) }()
+	set, err := m.changesDoc(changes)
+	if err != nil {
+		return false, fmt.Errorf("compare and swap: %v", err)
+	}
+	p := make(query.Predicate, 0, len(conditions))
+	for f, v := range conditions {
+		if f != "id" {
+			p = append(p, &query.Equal{Field: f, Value: v})
+		}
+	}
+	if p, err = m.storedValues(p); err != nil {
+		return false, fmt.Errorf("compare and swap: %v", err)
+	}
+	s := bson.M{"_id": m.mongoID(id)}
+	for _, exp := range p {
+		eq := exp.(*query.Equal)
+		s[m.flatField(eq.Field)] = eq.Value
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, []interface{}{id})
+	err = c.Update(s, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return false, ctx.Err()
+	}
+	if mgo.IsDup(err) {
+		err = resource.ErrConflict
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareAndSwap applies changes to the item with id if it matches conditions.
+func (m Handler) CompareAndSwap(ctx context.Context, id interface{}, conditions, changes map[string]interface{}) (bool, error) {
+	return m.options().CompareAndSwap(ctx, id, conditions, changes)
+}
+
+// changesDoc returns the $set document applying changes, a map of dotted
+// field paths to their new value, to an item. The item gets a new random
+// _etag and its _updated set to the current time.
+func (m OptionsHandler) changesDoc(changes map[string]interface{}) (bson.M, error) {
+	if len(changes) == 0 {
+		return nil, errors.New("no changes")
+	}
+	set := bson.M{}
+	for f, v := range changes {
+		if m.metaField(f) {
+			return nil, fmt.Errorf("%s: field cannot be changed", f)
+		}
+		set[f] = v
+	}
+	if m.opts.MaxDepth > 0 {
+		if err := checkDepth(set, m.opts.MaxDepth); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.writeTransforms(set); err != nil {
+		return nil, err
+	}
+	if m.opts.NonFinite != KeepNonFinite {
+		if err := replaceNonFinite(set, m.opts.NonFinite == RejectNonFinite); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.opts.DateFields {
+		if err := coerceDate(set, f); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.opts.DecimalFields {
+		if err := coerceDecimal(set, f); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.opts.BoolFields {
+		coerceBool(set, f)
+	}
+	if f := m.opts.ExpireField; f != "" {
+		if v, found := set[f]; found && v != nil {
+			t, err := parseTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f, err)
+			}
+			set[expireAtField] = t
+		}
+	}
+	set = m.flatDoc(set)
+	set[m.etagField()] = bson.NewObjectId().Hex()
+	set[m.updatedField()] = time.Now()
+	return set, nil
+}
+
+// PartialUpdate sets the changes fields, using dotted notation for
+// sub-fields, of the original item and returns the resulting item in a single
+// round trip. Like Update, it fails with resource.ErrConflict if the stored
+// item's etag no longer matches the original one.
+//
+// The updated item gets a new random etag and its update time set to the
+// current time, both reflected in the returned item.
+func (m OptionsHandler) PartialUpdate(ctx context.Context, original *resource.Item, changes map[string]interface{}) (*resource.Item, error) {
+	set, err := m.changesDoc(changes)
+	if err != nil {
+		return nil, fmt.Errorf("partial update: %v", err)
+	}
+	return m.modify(ctx, original, bson.M{"$set": set}, nil)
+}
+
+// PartialUpdateChanged is like PartialUpdate, but also removes the unset
+// fields and only returns the changed fields of the updated item, along with
+// its id, etag and update time, to save bandwidth. Removed fields are returned
+// with a nil value.
+func (m OptionsHandler) PartialUpdateChanged(ctx context.Context, original *resource.Item, changes map[string]interface{}, unset []string) (*resource.Item, error) {
+	if len(changes) == 0 && len(unset) == 0 {
+		return nil, errors.New("partial update: no changes")
 	}
-	c, err := m.c(ctx)
-	if err != nil {
-		return err
+	set := bson.M{m.etagField(): bson.NewObjectId().Hex(), m.updatedField(): time.Now()}
+	if len(changes) > 0 {
+		var err error
+		if set, err = m.changesDoc(changes); err != nil {
+			return nil, fmt.Errorf("partial update: %v", err)
+		}
 	}
-	defer m.close(c)
-	err = c.Insert(mItems...)
-	if mgo.IsDup(err) {
-		// Duplicate ID key
-		err = resource.ErrConflict
+	update := bson.M{"$set": set}
+	sel := bson.M{}
+	for f := range set {
+		sel[f] = 1
 	}
-	if ctx.Err() != nil {
-		return ctx.Err()
+	if len(unset) > 0 {
+		u := bson.M{}
+		for _, f := range unset {
+			if m.metaField(f) {
+				return nil, fmt.Errorf("partial update: %s: field cannot be changed", f)
+			}
+			if _, found := changes[f]; found {
+				return nil, fmt.Errorf("partial update: %s: field both changed and unset", f)
+			}
+			u[m.flatField(f)] = ""
+			if f == m.opts.ExpireField {
+				u[expireAtField] = ""
+			}
+		}
+		update["$unset"] = u
 	}
-	return err
+	item, err := m.modify(ctx, original, update, sel)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range unset {
+		setPath(item.Payload, f, nil)
+	}
+	return item, nil
 }
 
-// Update replace an item by a new one in the mongo collection.
-func (m Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
-	mItem := newMongoItem(item)
+// modify applies update to the original item if its etag still matches the
+// stored one, and returns the updated item with the fields selected by sel,
+// or all of them if sel is nil.
+func (m OptionsHandler) modify(ctx context.Context, original *resource.Item, update, sel bson.M) (_ *resource.Item, err error) {
+	defer func() { err = classifyError(err) }()
 	c, err := m.c(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer m.close(c)
-	s := bson.M{"_id": original.ID}
-	if strings.HasPrefix(original.ETag, "p-") {
-		// If the original ETag is in "p-[id]" format,
-		// then _etag field must be absent from the resource in DB
-		s["_etag"] = bson.M{"$exists": false}
-	} else {
-		s["_etag"] = original.ETag
+	defer m.invalidate(ctx, c, []interface{}{original.ID})
+	s := bson.M{"_id": m.mongoID(original.ID)}
+	m.etagCondition(s, original.ETag)
+	mq := c.Find(s)
+	if sel != nil {
+		mq = mq.Select(sel)
+	}
+	var mItem mongoItem
+	_, err = mq.Apply(mgo.Change{Update: update, ReturnNew: true}, &mItem)
+	if mgo.IsDup(err) {
+		return nil, duplicateKeyError(c, err)
 	}
-	err = c.Update(s, mItem)
 	if err == mgo.ErrNotFound {
 		// Determine if the item is not found or if the item is found but etag missmatch
 		var count int
-		count, err = c.FindId(original.ID).Count()
+		count, err = c.FindId(m.mongoID(original.ID)).Count()
 		if err != nil {
 			// The find returned an unexpected err, just forward it with no mapping
 		} else if count == 0 {
@@ -163,29 +1558,31 @@ func (m Handler) Update(ctx context.Context, item *resource.Item, original *reso
 			err = resource.ErrConflict
 		}
 	}
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return m.newItem(&mItem), nil
 }
 
 // Delete deletes an item from the mongo collection.
-func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
+func (m OptionsHandler) Delete(ctx context.Context, item *resource.Item) (err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("delete", time.Now(), &err)
+	}
+	defer func() { err = classifyError(err) }()
 	c, err := m.c(ctx)
 	if err != nil {
 		return err
 	}
 	defer m.close(c)
-	s := bson.M{"_id": item.ID}
-	if strings.HasPrefix(item.ETag, "p-") {
-		// If the item ETag is in "p-[id]" format,
-		// then _etag field must be absent from the resource in DB
-		s["_etag"] = bson.M{"$exists": false}
-	} else {
-		s["_etag"] = item.ETag
-	}
+	defer m.invalidate(ctx, c, []interface{}{item.ID})
+	s := bson.M{"_id": m.mongoID(item.ID)}
+	m.etagCondition(s, item.ETag)
 	err = c.Remove(s)
 	if err == mgo.ErrNotFound {
 		// Determine if the item is not found or if the item is found but etag missmatch
 		var count int
-		count, err = c.FindId(item.ID).Count()
+		count, err = c.FindId(m.mongoID(item.ID)).Count()
 		if err != nil {
 			// The find returned an unexpected err, just forward it with no mapping
 		} else if count == 0 {
@@ -200,14 +1597,17 @@ func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
 	return err
 }
 
-// Clear clears all items from the mongo collection matching the query. Note
-// that when q.Window != nil, the current implementation may error if the BSON
-// encoding of all matching IDs according to the q.Window length gets close to
-// the maximum document size in MongDB (usually 16MiB):
+// Clear clears all items from the mongo collection matching the query. When
+// q.Window != nil, the ids of the matching items are streamed and removed in
+// batches of clearBatchSize ids as they are read, to stay under the maximum
+// document size in MongoDB (usually 16MiB):
 // https://docs.mongodb.com/manual/reference/limits/#bson-documents
-func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
-	// When not applying windowing, qry will be passed directly to RemoveAll.
-	qry, err := getQuery(q)
+func (m OptionsHandler) Clear(ctx context.Context, q *query.Query) (_ int, err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("clear", time.Now(), &err)
+	}
+	defer func() { err = classifyError(err) }()
+	qry, err := m.getQuery(q)
 	if err != nil {
 		return 0, err
 	}
@@ -217,23 +1617,10 @@ func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 		return 0, err
 	}
 	defer m.close(c)
+	defer m.invalidate(ctx, c, nil)
 
 	if q.Window != nil {
-		// RemoveAll does not allow skip and limit to be set. To workaround
-		// this we do an additional pre-query to retrieve a sorted and sliced
-		// list of the IDs for all items to be deleted.
-		//
-		// This solution does not handle the case where a query containg all
-		// IDs is larger than the maximum BSON document size in MongoDB:
-		// https://docs.mongodb.com/manual/reference/limits/#bson-documents
-		srt := getSort(q)
-		mq := applyWindow(c.Find(qry).Sort(srt...), *q.Window)
-
-		if ids, err := selectIDs(c, mq); err == nil {
-			qry = bson.M{"_id": bson.M{"$in": ids}}
-		} else {
-			return 0, err
-		}
+		return m.removeWindow(ctx, c, qry, q, clearBatchSize, nil)
 	}
 
 	// We handle the potential of partial failure by returning both the number
@@ -248,12 +1635,356 @@ func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 	return info.Removed, err
 }
 
-// Find items from the mongo collection matching the provided query.
-func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+// clearBatchSize is the maximum number of ids removed by a single RemoveAll
+// when clearing a window of items.
+const clearBatchSize = 1000
+
+// removeWindow removes the items matching qry in the window of q. Their ids
+// are streamed and removed in batches of size ids as they are read, so large
+// windows don't require to hold all their ids in memory. If progress is not
+// nil, it is called with the number of items removed so far after each
+// batch. On failure,
+// the number of items removed by the previous batches is returned along with
+// the error.
+func (m OptionsHandler) removeWindow(ctx context.Context, c *mgo.Collection, qry bson.M, q *query.Query, size int, progress func(int)) (int, error) {
+	it := m.windowQuery(c, qry, q).Select(bson.M{"_id": 1}).Iter()
+	var tmp struct {
+		ID interface{} `bson:"_id"`
+	}
+	next := func() (interface{}, bool) {
+		tmp.ID = nil
+		if !it.Next(&tmp) {
+			return nil, false
+		}
+		return tmp.ID, true
+	}
+	total := 0
+	remove := func(ids []interface{}) (int, error) {
+		info, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		if info == nil {
+			return 0, err
+		}
+		total += info.Removed
+		if err == nil && progress != nil {
+			progress(total)
+		}
+		return info.Removed, err
+	}
+	removed, err := removeBatches(ctx, size, next, remove)
+	if cerr := it.Close(); err == nil {
+		err = cerr
+	}
+	return removed, err
+}
+
+// removeBatches reads ids with next until it returns false, and passes them
+// to remove in batches of at most size ids, holding a single batch
+// at a time. It returns the number of items removed, which on failure counts
+// the previous batches only, and stops with the context error as soon as ctx
+// is done.
+func removeBatches(ctx context.Context, size int, next func() (interface{}, bool), remove func(ids []interface{}) (int, error)) (int, error) {
+	removed := 0
+	ids := make([]interface{}, 0, size)
+	for {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		id, ok := next()
+		if ok {
+			ids = append(ids, id)
+		}
+		if len(ids) == size || !ok && len(ids) > 0 {
+			n, err := remove(ids)
+			removed += n
+			if err == nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				return removed, err
+			}
+			ids = ids[:0]
+		}
+		if !ok {
+			return removed, nil
+		}
+	}
+}
+
+// ClearWithProgress is like Clear, but removes the matching items in batches
+// of batchSize items, calling progress with the number of items removed so far
+// after each batch. Like Clear, the ids of a window of items are streamed, so
+// large windows don't require to hold all their ids. When ctx is done, it
+// stops after the current batch and returns the number of items removed along
+// with the context error.
+func (m OptionsHandler) ClearWithProgress(ctx context.Context, q *query.Query, batchSize int, progress func(deletedSoFar int)) (_ int, err error) {
+	defer func() { err = classifyError(err) }()
+	if batchSize <= 0 {
+		return 0, errors.New("clear: batch size must be positive")
+	}
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+	defer m.invalidate(ctx, c, nil)
+
+	if q.Window != nil {
+		return m.removeWindow(ctx, c, qry, q, batchSize, progress)
+	}
+	total := 0
+	for {
+		if err := m.err(ctx); err != nil {
+			return total, err
+		}
+		ids, err := selectIDs(ctx, c.Find(qry).Sort("_id").Limit(batchSize))
+		if err != nil || len(ids) == 0 {
+			return total, err
+		}
+		// The query is applied again in case the items changed since their
+		// selection.
+		info, err := c.RemoveAll(bson.M{"$and": []bson.M{qry, {"_id": bson.M{"$in": ids}}}})
+		if info != nil {
+			total += info.Removed
+		}
+		if err != nil {
+			return total, err
+		}
+		if progress != nil {
+			progress(total)
+		}
+	}
+}
+
+// ClearWithProgress is like Clear, but removes the items in batches and
+// reports the progress.
+func (m Handler) ClearWithProgress(ctx context.Context, q *query.Query, batchSize int, progress func(deletedSoFar int)) (int, error) {
+	return m.options().ClearWithProgress(ctx, q, batchSize, progress)
+}
+
+// ClearDryRun returns the number of items Clear would remove for the given
+// query, without removing them. Windows of items are counted by the server,
+// without reading their ids.
+func (m OptionsHandler) ClearDryRun(ctx context.Context, q *query.Query) (_ int, err error) {
+	defer func() { err = classifyError(err) }()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+
+	mq := c.Find(qry)
+	if q.Window != nil {
+		// The count of mgo applies the skip and limit of the query.
+		mq = m.windowQuery(c, qry, q)
+	}
+	n, err := mq.Count()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return n, err
+}
+
+// ClearDryRun returns the number of items Clear would remove, without removing
+// them.
+func (m Handler) ClearDryRun(ctx context.Context, q *query.Query) (int, error) {
+	return m.options().ClearDryRun(ctx, q)
+}
+
+// windowQuery returns the query reading the items matching qry in the window
+// of q.
+func (m OptionsHandler) windowQuery(c *mgo.Collection, qry bson.M, q *query.Query) *mgo.Query {
+	return applyWindow(c.Find(qry).Sort(m.getSort(q)...), *q.Window)
+}
+
+// ETag returns the etag of the item with id, without reading its payload, e.g.
+// to answer conditional requests. Items stored without an etag get the same
+// provisional etag as when they are read. It returns resource.ErrNotFound if
+// the item does not exist.
+func (m OptionsHandler) ETag(ctx context.Context, id interface{}) (_ string, err error) {
+	defer func() { err = classifyError(err) }()
+	c, err := m.c(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer m.close(c)
+
+	mq := c.FindId(m.mongoID(id)).Select(bson.M{"_id": 1, m.etagField(): 1})
+	if dl, ok := ctx.Deadline(); ok {
+		dur := time.Until(dl)
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	var mItem mongoItem
+	err = mq.One(&mItem)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return "", err
+	}
+	return m.newItem(&mItem).ETag, nil
+}
+
+// ETag returns the etag of the item with id, without reading its payload.
+func (m Handler) ETag(ctx context.Context, id interface{}) (string, error) {
+	return m.options().ETag(ctx, id)
+}
+
+// MultiGet retrieves the items with the given ids, in the requested order. A
+// requested id may be repeated, in which case its item is repeated too. Items
+// not found are handled according to the MissingIDs option. Items are served
+// from memory when the ItemCacheSize option is set. Others are read with $in
+// queries of at most InBatchSize distinct ids. Only the ids allowed by
+// WithAllowedIDs, if any, are retrieved.
+func (m OptionsHandler) MultiGet(ctx context.Context, ids []interface{}) (_ []*resource.Item, err error) {
+	defer func() { err = classifyError(err) }()
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	found := make(map[interface{}]*resource.Item, len(ids))
+	fetch := make([]interface{}, 0, len(ids))
+	queued := map[interface{}]bool{}
+	allowed, restricted := allowedIDSet(ctx)
+	for _, id := range ids {
+		if restricted && !allowed[idKey(id)] {
+			// Left out of found, like missing items.
+			continue
+		}
+		if item, ok := m.items.get(c.FullName, id); ok {
+			found[idKey(id)] = item
+		} else if !queued[idKey(id)] {
+			queued[idKey(id)] = true
+			fetch = append(fetch, id)
+		}
+	}
+	if len(fetch) > 0 {
+		gen := m.items.generation()
+		fetched := make([]*resource.Item, 0, len(fetch))
+		size := m.inBatchSize()
+		if size == 0 {
+			size = len(fetch)
+		}
+		for start := 0; start < len(fetch); start += size {
+			end := start + size
+			if end > len(fetch) {
+				end = len(fetch)
+			}
+			iter := c.Find(bson.M{"_id": bson.M{"$in": m.mongoIDs(fetch[start:end])}}).Iter()
+			var mItem mongoItem
+			for iter.Next(&mItem) {
+				if err = m.err(ctx); err != nil {
+					iter.Close()
+					return nil, err
+				}
+				item := m.newItem(&mItem)
+				found[idKey(item.ID)] = item
+				fetched = append(fetched, item)
+			}
+			if err := iter.Close(); err != nil {
+				return nil, err
+			}
+		}
+		m.items.add(c.FullName, gen, fetched)
+	}
+
+	if m.opts.TrackAccess && len(found) > 0 {
+		accessed := make([]interface{}, 0, len(found))
+		for _, item := range found {
+			accessed = append(accessed, item.ID)
+		}
+		m.touch(c, accessed)
+	}
+
+	items := make([]*resource.Item, 0, len(ids))
+	var missing []interface{}
+	seen := map[interface{}]bool{}
+	for _, id := range ids {
+		item, ok := found[idKey(id)]
+		if !ok {
+			if !seen[idKey(id)] {
+				seen[idKey(id)] = true
+				missing = append(missing, id)
+			}
+			if m.opts.MissingIDs == NilMissing {
+				items = append(items, nil)
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(missing) > 0 && m.opts.MissingIDs == ErrorMissing {
+		return nil, &MissingIDsError{IDs: missing}
+	}
+	return items, nil
+}
+
+// Find items from the mongo collection matching the provided query. When
+// ProjectionPushdown is set, only the fields selected by the projection of q
+// are read.
+func (m OptionsHandler) Find(ctx context.Context, q *query.Query) (_ *resource.ItemList, err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("find", time.Now(), &err)
+	}
+	if m.opts.ProjectionPushdown && len(q.Projection) > 0 {
+		if p := pushdownProjection(q.Projection, m.opts.Schema); len(p.Include) > 0 {
+			return m.FindWithProjection(ctx, q, p)
+		}
+	}
+	return m.find(ctx, q, nil, nil)
+}
+
+// FindWithProjection is like Find, but only returns the fields selected by p.
+// The returned items thus hold partial payloads and must not be used as is
+// for a later Update.
+//
+// When p holds $size computed fields, the query is performed using the
+// aggregation framework.
+func (m OptionsHandler) FindWithProjection(ctx context.Context, q *query.Query, p Projection) (*resource.ItemList, error) {
+	if m.opts.FlattenSeparator != "" {
+		p = m.flatProjection(p)
+	}
+	if len(p.Size) > 0 {
+		stages, err := getProjectStages(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range stages {
+			if project, ok := stage["$project"].(bson.M); ok {
+				m.renameMeta(project)
+			}
+		}
+		return m.find(ctx, q, nil, stages)
+	}
+	sel, err := getSelect(p)
+	if err != nil {
+		return nil, err
+	}
+	return m.find(ctx, q, m.renameMeta(sel), nil)
+}
+
+// find performs a Find, restricting the returned fields to sel if not nil. If
+// stages is not nil, the query is performed by an aggregation pipeline ending
+// with these stages instead.
+func (m OptionsHandler) find(ctx context.Context, q *query.Query, sel bson.M, stages []bson.M) (_ *resource.ItemList, err error) {
+	defer func() { err = classifyError(err) }()
 	// MongoDB will return all records on Limit=0. Workaround that behavior.
 	// https://docs.mongodb.com/manual/reference/method/cursor.limit/#zero-value
 	if q.Window != nil && q.Window.Limit == 0 {
-		n, err := m.Count(ctx, q)
+		n, err := m.countQuery(ctx, q)
 		if err != nil {
 			return nil, err
 		}
@@ -264,12 +1995,20 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		}
 		return list, err
 	}
+	if m.opts.MaxResults > 0 && (q.Window == nil || q.Window.Limit < 0) {
+		return m.findCapped(ctx, q, sel, stages)
+	}
 
-	qry, err := getQuery(q)
+	qry, err := m.getQuery(q)
 	if err != nil {
 		return nil, err
 	}
-	srt := getSort(q)
+	srt := m.getSort(q)
+	cache := m.cache
+	var restricted bool
+	if qry, restricted = m.restrictQuery(ctx, qry); restricted {
+		cache = nil
+	}
 
 	c, err := m.c(ctx)
 	if err != nil {
@@ -277,24 +2016,36 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 	}
 	defer m.close(c)
 
-	mq := c.Find(qry).Sort(srt...)
+	var key string
+	var gen uint64
+	if cache != nil {
+		key = findCacheKey(q, srt, sel, stages)
+		var v interface{}
+		var found bool
+		if v, gen, found = cache.get(ctx, c.FullName, key); found {
+			return copyItemList(v.(*resource.ItemList)), nil
+		}
+	}
+
 	limit := -1
 	if q.Window != nil {
-		mq = applyWindow(mq, *q.Window)
 		limit = q.Window.Limit
 	}
-
-	// Apply context deadline if any
-	if dl, ok := ctx.Deadline(); ok {
-		dur := time.Until(dl)
-		if dur < 0 {
-			dur = 0
+	if m.opts.OnCollScan != nil || m.opts.FailOnCollScan {
+		if err := m.auditScan(c, q, findPipeline(qry, srt, q.Window, stages)); err != nil {
+			return nil, err
 		}
-		mq.SetMaxTime(dur)
 	}
-
-	// Perform request
-	iter := mq.Iter()
+	if m.opts.ConsistentTotal && sel == nil && !hasNear(q.Predicate) {
+		list, err := m.findWithTotal(ctx, c, qry, srt, q.Window, stages)
+		if err != nil {
+			return nil, err
+		}
+		if cache != nil {
+			cache.set(ctx, c.FullName, key, gen, copyItemList(list))
+		}
+		return list, nil
+	}
 	// Total is set to -1 because we have no easy way with MongoDB to to compute
 	// this value without performing two requests.
 	list := &resource.ItemList{
@@ -302,18 +2053,13 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		Limit: limit,
 		Items: []*resource.Item{},
 	}
-
-	var mItem mongoItem
-	for iter.Next(&mItem) {
-		// Check if context is still ok before to continue
-		if err = ctx.Err(); err != nil {
-			// TODO bench this as net/context is using mutex under the hood
-			iter.Close()
+	// Queries without sort keep the nearest-first order of $near, which
+	// can't be merged.
+	if batches := splitIn(qry, m.inBatchSize()); batches != nil && stages == nil && len(srt) > 0 && m.mergeableSort(q.Sort) {
+		if list.Items, err = m.findBatches(ctx, c, batches, srt, sel, q.Window); err != nil {
 			return nil, err
 		}
-		list.Items = append(list.Items, newItem(&mItem))
-	}
-	if err := iter.Close(); err != nil {
+	} else if list.Items, err = m.findItems(ctx, c, qry, srt, sel, q.Window, stages); err != nil {
 		return nil, err
 	}
 	// If the number of returned elements is lower than requested limit, or no
@@ -329,21 +2075,226 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 			list.Total = len(list.Items)
 		}
 	}
+	if list.Total == -1 && m.opts.AlwaysCountTotal {
+		if list.Total, err = m.count(ctx, c, qry); err != nil {
+			return nil, err
+		}
+	}
+	if cache != nil {
+		cache.set(ctx, c.FullName, key, gen, copyItemList(list))
+	}
 	return list, err
 }
 
+// findCapped is find for the query q without limit, returning at most
+// MaxResults items.
+func (m OptionsHandler) findCapped(ctx context.Context, q *query.Query, sel bson.M, stages []bson.M) (*resource.ItemList, error) {
+	w := query.Window{Limit: m.opts.MaxResults}
+	if q.Window != nil {
+		w.Offset = q.Window.Offset
+	}
+	if m.opts.FailOnMaxResults {
+		// Read one more item to tell whether there are too many.
+		w.Limit++
+	}
+	capped := *q
+	capped.Window = &w
+	list, err := m.find(ctx, &capped, sel, stages)
+	if err != nil || !m.opts.FailOnMaxResults {
+		return list, err
+	}
+	if len(list.Items) > m.opts.MaxResults {
+		return nil, ErrTooManyResults
+	}
+	list.Limit = -1
+	return list, nil
+}
+
+// findItems returns the items of c matching the Mongo query qry, sorted by srt
+// and windowed by w. Only the fields selected by sel are returned if not nil.
+// If stages is not nil, the query is performed by an aggregation pipeline
+// ending with these stages instead.
+func (m OptionsHandler) findItems(ctx context.Context, c *mgo.Collection, qry bson.M, srt []string, sel bson.M, w *query.Window, stages []bson.M) ([]*resource.Item, error) {
+	var iter *mgo.Iter
+	var err error
+	if stages != nil {
+		iter, err = m.pipeIter(ctx, c, findPipeline(qry, srt, w, stages))
+	} else if m.opts.ReadConcern != "" {
+		iter, err = m.findCommand(ctx, c, qry, srt, sel, w)
+	} else {
+		mq := c.Find(qry).Sort(srt...)
+		if sel != nil {
+			mq = mq.Select(sel)
+		}
+		if w != nil {
+			mq = applyWindow(mq, *w)
+		}
+
+		// Apply context deadline if any
+		if dl, ok := ctx.Deadline(); ok {
+			dur := time.Until(dl)
+			if dur < 0 {
+				dur = 0
+			}
+			mq.SetMaxTime(dur)
+		}
+
+		// Perform request
+		iter = mq.Iter()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	items, err := m.readItems(ctx, c, iter)
+	if err == nil || !isSortMemoryError(err) {
+		return items, err
+	}
+	switch m.opts.LargeSorts {
+	case DiskLargeSorts:
+		if stages != nil {
+			break
+		}
+		// Unlike find, aggregations can sort using temporary files.
+		stages = []bson.M{}
+		if sel != nil {
+			stages = append(stages, bson.M{"$project": sel})
+		}
+		if iter, err = m.pipeIter(ctx, c, findPipeline(qry, srt, w, stages)); err != nil {
+			return nil, err
+		}
+		return m.readItems(ctx, c, iter)
+	case StrictLargeSorts:
+		return nil, &SortMemoryError{Sort: srt, err: err}
+	}
+	return nil, err
+}
+
+// pipeIter returns an iterator over the documents returned by the aggregation
+// pipeline run on c, allowed to use the disk with DiskLargeSorts.
+func (m OptionsHandler) pipeIter(ctx context.Context, c *mgo.Collection, pipeline []bson.M) (*mgo.Iter, error) {
+	if m.opts.ReadConcern != "" {
+		return m.aggregateCommand(ctx, c, pipeline)
+	}
+	p := c.Pipe(pipeline)
+	if m.opts.LargeSorts == DiskLargeSorts {
+		p = p.AllowDiskUse()
+	}
+	return p.Iter(), nil
+}
+
+// readItems returns the items read with iter, an iterator over the documents
+// of c. The read is interrupted if the handler is closed.
+func (m OptionsHandler) readItems(ctx context.Context, c *mgo.Collection, iter *mgo.Iter) ([]*resource.Item, error) {
+	items := []*resource.Item{}
+	err := m.readDocs(ctx, c, iter, func(mItem *mongoItem) {
+		items = append(items, m.newItem(mItem))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// readDocs calls fn with each document read with iter, an iterator over the
+// documents of c, and closes iter. The read is interrupted if the handler is
+// closed.
+func (m OptionsHandler) readDocs(ctx context.Context, c *mgo.Collection, iter *mgo.Iter, fn func(mItem *mongoItem)) error {
+	if !m.closed.track(iter, c.Database.Session) {
+		iter.Close()
+		return ErrHandlerClosed
+	}
+	mItem := &mongoItem{}
+	for iter.Next(mItem) {
+		// Check if context is still ok and the handler not closed before to
+		// continue
+		if err := m.err(ctx); err != nil {
+			// TODO bench this as net/context is using mutex under the hood
+			if m.closed.untrack(iter) {
+				iter.Close()
+			}
+			return err
+		}
+		fn(mItem)
+		mItem = &mongoItem{}
+	}
+	if !m.closed.untrack(iter) {
+		// The iterator was closed by Close while waiting for documents.
+		return ErrHandlerClosed
+	}
+	return iter.Close()
+}
+
 // Count counts the number items matching the lookup filter
-func (m Handler) Count(ctx context.Context, query *query.Query) (int, error) {
-	q, err := getQuery(query)
+func (m OptionsHandler) Count(ctx context.Context, query *query.Query) (_ int, err error) {
+	if m.opts.Metrics != nil {
+		defer m.observe("count", time.Now(), &err)
+	}
+	defer func() { err = classifyError(err) }()
+	return m.countQuery(ctx, query)
+}
+
+// countQuery returns the number of items matching query, like Count but
+// without observing the operation, for the operations counting items.
+func (m OptionsHandler) countQuery(ctx context.Context, query *query.Query) (int, error) {
+	q, err := m.getQuery(query)
 	if err != nil {
 		return -1, err
 	}
+	cache := m.cache
+	var restricted bool
+	if q, restricted = m.restrictQuery(ctx, q); restricted {
+		cache = nil
+	}
 	c, err := m.c(ctx)
 	if err != nil {
 		return -1, err
 	}
 	defer m.close(c)
-	mq := c.Find(q)
+	var key string
+	var gen uint64
+	if cache != nil {
+		key = countCacheKey(query)
+		var v interface{}
+		var found bool
+		if v, gen, found = cache.get(ctx, c.FullName, key); found {
+			return v.(int), nil
+		}
+	}
+	var n int
+	var batched bool
+	if m.opts.EstimatedCount && len(q) == 0 {
+		n, err = m.estimatedCount(ctx, c)
+	} else if n, batched, err = m.countBatches(ctx, c, q); !batched {
+		n, err = m.count(ctx, c, q)
+	}
+	if err == nil {
+		cache.set(ctx, c.FullName, key, gen, n)
+	}
+	return n, err
+}
+
+// estimatedCount returns the number of items of c according to the metadata
+// of the collection, like the estimatedDocumentCount of MongoDB drivers.
+func (m OptionsHandler) estimatedCount(ctx context.Context, c *mgo.Collection) (int, error) {
+	// Without query, the count command reads the metadata of the collection.
+	cmd := bson.D{{Name: "count", Value: c.Name}}
+	if ms, ok := maxTimeMS(ctx); ok {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: ms})
+	}
+	var res struct {
+		N int `bson:"n"`
+	}
+	err := c.Database.Run(m.withReadConcern(cmd), &res)
+	return res.N, err
+}
+
+// count returns the number of items of c matching the Mongo query qry.
+func (m OptionsHandler) count(ctx context.Context, c *mgo.Collection, qry bson.M) (int, error) {
+	if m.opts.ReadConcern != "" {
+		return m.countCommand(ctx, c, qry)
+	}
+	mq := c.Find(qry)
 	// Apply context deadline if any
 	if dl, ok := ctx.Deadline(); ok {
 		dur := time.Until(dl)
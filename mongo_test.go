@@ -2,15 +2,27 @@ package mongo_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"net"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	mongo "github.com/rs/rest-layer-mongo"
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
 	"github.com/rs/rest-layer/schema/query"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // Mongo doesn't support nanoseconds
@@ -30,7 +42,7 @@ func randomName(n int) string {
 	return string(b)
 }
 
-func setupDBTest(t *testing.T) (*mgo.Session, func()) {
+func setupDBTest(t testing.TB) (*mgo.Session, func()) {
 	dbName := randomName(16)
 	if testing.Short() {
 		t.Skip("skipping DB test in short mode.")
@@ -101,6 +113,81 @@ func TestInsert(t *testing.T) {
 
 }
 
+func TestFindWithProjectionSize(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", ETag: "e1", Updated: now, Payload: map[string]interface{}{"id": "1", "title": "a", "comments": []interface{}{"c1", "c2"}}},
+		{ID: "2", ETag: "e2", Updated: now, Payload: map[string]interface{}{"id": "2", "title": "b", "comments": []interface{}{"c1", "c2", "c3"}}},
+		{ID: "3", ETag: "e3", Updated: now, Payload: map[string]interface{}{"id": "3", "title": "b"}},
+		{ID: "4", ETag: "e4", Updated: now, Payload: map[string]interface{}{"id": "4", "title": "c", "comments": []interface{}{}}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.FindWithProjection(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{title:{$in:["b","c"]}}`),
+		Sort:      query.Sort{{Name: "id", Reversed: true}},
+		Window:    &query.Window{Offset: 1, Limit: 5},
+	}, mongo.Projection{
+		Size: map[string]string{"commentCount": "comments"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []*resource.Item{
+		{ID: "3", ETag: "e3", Updated: now, Payload: map[string]interface{}{"id": "3", "title": "b", "commentCount": 0}},
+		{ID: "2", ETag: "e2", Updated: now, Payload: map[string]interface{}{"id": "2", "title": "b", "commentCount": 3}},
+	}
+	if !reflect.DeepEqual(l.Items, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", l.Items, expect)
+	}
+	if l.Total != 3 {
+		t.Errorf("got total: %d want: 3", l.Total)
+	}
+
+	l, err = h.FindWithProjection(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{id:"1"}`),
+	}, mongo.Projection{
+		Include: []string{"comments"},
+		Size:    map[string]string{"commentCount": "comments"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []*resource.Item{
+		{ID: "1", ETag: "e1", Updated: now, Payload: map[string]interface{}{"id": "1", "comments": []interface{}{"c1", "c2"}, "commentCount": 2}},
+	}
+	if !reflect.DeepEqual(l.Items, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", l.Items, expect)
+	}
+}
+
+func TestInsertNilPayload(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1234", ETag: "etag", Updated: now},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{id:"1234"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []*resource.Item{
+		{ID: "1234", ETag: "etag", Updated: now, Payload: map[string]interface{}{"id": "1234"}},
+	}
+	if !reflect.DeepEqual(l.Items, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", l.Items, expect)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	now := time.Now().Truncate(time.Millisecond)
 
@@ -352,6 +439,42 @@ func TestClear(t *testing.T) {
 	}
 	assertCollectionIDs(t, s.DB("").C(cName), []string{"1"})
 }
+func TestClearLimitBatches(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	const n = 2500
+	items := make([]*resource.Item, n)
+	for i := range items {
+		id := fmt.Sprintf("%04d", i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id}}
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	// The window spans three batches of removal.
+	q, err := query.New("", "", "", &query.Window{Offset: 100, Limit: 2300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := h.Clear(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := 2300; deleted != expect {
+		t.Errorf("Unexpected result:\nexpect: %#v\ngot: %#v", expect, deleted)
+	}
+	var remaining []string
+	for i := 0; i < 100; i++ {
+		remaining = append(remaining, fmt.Sprintf("%04d", i))
+	}
+	for i := 2400; i < n; i++ {
+		remaining = append(remaining, fmt.Sprintf("%04d", i))
+	}
+	assertCollectionIDs(t, s.DB("").C("test"), remaining)
+}
+
 func TestClearLimit(t *testing.T) {
 	const (
 		dbName = "testclearlimit"
@@ -418,6 +541,42 @@ func TestClearOffset(t *testing.T) {
 	assertCollectionIDs(t, s.DB("").C(cName), []string{"1", "2", "4"})
 }
 
+func TestClearDryRun(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "c"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "name": "c"}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "name": "c"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	queries := []*query.Query{
+		{Predicate: query.MustParsePredicate(`{name:"a"}`)},
+		{Predicate: query.MustParsePredicate(`{name:"c"}`), Window: &query.Window{Offset: 1, Limit: 1}},
+		{Predicate: query.MustParsePredicate(`{name:"c"}`), Window: &query.Window{Offset: 1, Limit: 5}},
+	}
+	for _, q := range queries {
+		count, err := h.ClearDryRun(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := h.Clear(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != deleted {
+			t.Errorf("ClearDryRun(%v) = %d, Clear removed %d", q.Predicate, count, deleted)
+		}
+	}
+	assertCollectionIDs(t, s.DB("").C("test"), []string{"2", "3"})
+}
+
 func TestFind(t *testing.T) {
 	allItems := []*resource.Item{
 		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1}},
@@ -708,3 +867,3145 @@ func TestFind(t *testing.T) {
 		}
 	})
 }
+
+func TestNewHandlerWithOptions(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1}},
+		{ID: "2", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "2", "name": "b", "age": 2}},
+		{ID: "3", ETag: "c", Updated: now, Payload: map[string]interface{}{"id": "3", "name": "c", "age": 2}},
+	}
+	if err := mongo.NewHandler(s, "", "test").Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	// With zero options, the handler behaves like the one of NewHandler.
+	q := &query.Query{
+		Predicate: query.MustParsePredicate(`{age:2}`),
+		Sort:      query.MustParseSort("-name"),
+		Window:    &query.Window{Limit: 1},
+	}
+	expect, err := mongo.NewHandler(s, "", "test").Find(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	l, err := h.Find(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l, expect) {
+		t.Errorf("got: %v want: %v", l, expect)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "3" {
+		t.Errorf("got: %v want: item 3", l.Items)
+	}
+
+	// Options apply to the items it reads and writes.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{BoolFields: []string{"public"}})
+	item := &resource.Item{ID: "4", ETag: "d", Updated: now, Payload: map[string]interface{}{"id": "4", "public": true}}
+	if err := h.Insert(context.Background(), []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	l, err = h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{public:true}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].Payload["public"] != true {
+		t.Errorf("got: %v want: item 4", l.Items)
+	}
+}
+
+func TestFindWithProjection(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", ETag: "e1", Updated: now, Payload: map[string]interface{}{
+			"id":       "1",
+			"title":    "a",
+			"raw":      "large",
+			"comments": []interface{}{"c1", "c2", "c3", "c4"},
+		}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.FindWithProjection(context.Background(), &query.Query{}, mongo.Projection{
+		Exclude: []string{"raw"},
+		Slice:   map[string]mongo.Slice{"comments": {Limit: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []*resource.Item{
+		{ID: "1", ETag: "e1", Updated: now, Payload: map[string]interface{}{
+			"id":       "1",
+			"title":    "a",
+			"comments": []interface{}{"c1", "c2", "c3"},
+		}},
+	}
+	if !reflect.DeepEqual(l.Items, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", l.Items, expect)
+	}
+
+	_, err = h.FindWithProjection(context.Background(), &query.Query{}, mongo.Projection{
+		Include: []string{"title"},
+		Exclude: []string{"raw"},
+	})
+	if err == nil {
+		t.Error("expected an error for an illegal projection, got nil")
+	}
+}
+
+func TestFindCreated(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{CreatedField: "created"})
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := []bson.ObjectId{
+		bson.NewObjectIdWithTime(day.Add(-time.Hour)),
+		bson.NewObjectIdWithTime(day),
+		bson.NewObjectIdWithTime(day.Add(time.Hour)),
+		bson.NewObjectIdWithTime(day.Add(48 * time.Hour)),
+	}
+	items := make([]*resource.Item, len(ids))
+	for i, id := range ids {
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id}}
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{created:{$gte:"2023-01-01"},created:{$lt:"2023-01-02"}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{ids[1], ids[2]}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
+
+func TestFindUnknownField(t *testing.T) {
+	s := schema.Schema{Fields: schema.Fields{"id": schema.IDField, "name": {Filterable: true}}}
+	h := mongo.NewHandlerWithOptions(nil, "", "test", mongo.Options{Schema: s})
+	_, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{nmae:"foo"}`)})
+	if err == nil || err.Error() != "nmae: unknown query field" {
+		t.Errorf("got: %v want: nmae: unknown query field", err)
+	}
+}
+
+func TestDateFields(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{DateFields: []string{"at"}})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "at": "2023-01-01T23:00:00-02:00"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "at": "2023-01-02T00:30:00Z"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "at": "2023-01-02T03:00:00+01:00"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		At interface{} `bson:"at"`
+	}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if at, ok := doc.At.(time.Time); !ok || !at.Equal(time.Date(2023, 1, 2, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("got: %#v want: 2023-01-02T01:00:00Z", doc.At)
+	}
+
+	// A string comparison would not match 1.
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{$and:[{at:{$gte:"2023-01-02T00:45:00Z"}},{at:{$lt:"2023-01-02T02:00:00Z"}}]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{"1"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
+
+func TestBoolFields(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{BoolFields: []string{"public"}})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "public": true}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "public": false}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "public": true}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["public"] != 1 {
+		t.Errorf("got stored: %#v want: 1", doc["public"])
+	}
+
+	for p, expect := range map[string][]interface{}{
+		`{public:true}`:          {"1", "3"},
+		`{public:false}`:         {"2"},
+		`{public:{$in:[false]}}`: {"2"},
+	} {
+		l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(p)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.ID)
+			if public := item.Payload["public"]; public != (item.ID != "2") {
+				t.Errorf("%v: got public: %#v", item.ID, public)
+			}
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: got: %v want: %v", p, got, expect)
+		}
+	}
+}
+
+func TestMultiGetItemCache(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ItemCacheSize: 10})
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "title": "a"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "title": "a"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	titles := func() []interface{} {
+		t.Helper()
+		l, err := h.MultiGet(context.Background(), []interface{}{"1", "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l {
+			got = append(got, item.Payload["title"])
+		}
+		return got
+	}
+	titles()
+
+	// Changes made behind the handler are not seen while items are cached.
+	if err := s.DB("").C("test").UpdateId("1", bson.M{"$set": bson.M{"title": "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := titles(), []interface{}{"a", "a"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v (cache hit)", got, expect)
+	}
+
+	// Writes through the handler invalidate the written items.
+	updated := &resource.Item{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "title": "c"}}
+	if err := h.Update(context.Background(), updated, items[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := titles(), []interface{}{"a", "c"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+	if err := h.Delete(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.MultiGet(context.Background(), []interface{}{"2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 0 {
+		t.Errorf("got deleted item: %v", l)
+	}
+}
+
+func TestFindAllowedIDs(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{Cache: &fakeCache{values: map[string]interface{}{}}})
+	var items []*resource.Item
+	for i := 1; i <= 5; i++ {
+		id := strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "public": i%2 == 1}})
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &query.Query{Predicate: query.MustParsePredicate(`{public:true}`)}
+	ctx := mongo.WithAllowedIDs(context.Background(), []interface{}{"1", "2", "3"})
+	for _, c := range []struct {
+		ctx    context.Context
+		expect []interface{}
+	}{
+		{ctx, []interface{}{"1", "3"}},
+		// Restricted results are not cached.
+		{context.Background(), []interface{}{"1", "3", "5"}},
+		{mongo.WithAllowedIDs(context.Background(), nil), nil},
+	} {
+		l, err := h.Find(c.ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.ID)
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("got: %v want: %v", got, c.expect)
+		}
+	}
+	if n, err := h.Count(ctx, q); err != nil || n != 2 {
+		t.Errorf("got count: %v, %v want: 2", n, err)
+	}
+
+	// Large sets are counted in batches of distinct ids.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{InBatchSize: 2})
+	ctx = mongo.WithAllowedIDs(context.Background(), []interface{}{"1", "2", "3", "3", "5"})
+	if n, err := h.Count(ctx, q); err != nil || n != 3 {
+		t.Errorf("got count: %v, %v want: 3", n, err)
+	}
+	values, err := h.Distinct(ctx, "public", &query.Query{})
+	if err != nil || len(values) != 2 {
+		t.Errorf("got distinct: %v, %v want: [true false]", values, err)
+	}
+	// The allowed ids are intersected with those of the filter.
+	q = &query.Query{Predicate: query.MustParsePredicate(`{id:{$in:["1","2","4","5"]}}`)}
+	l, err := h.Find(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{"1", "2", "5"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+	if n, err := h.Count(ctx, q); err != nil || n != 3 {
+		t.Errorf("got count: %v, %v want: 3", n, err)
+	}
+
+	// MultiGet handles the ids which are not allowed like missing ones.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{MissingIDs: mongo.NilMissing, ItemCacheSize: 10})
+	if _, err := h.MultiGet(context.Background(), []interface{}{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	mget, err := h.MultiGet(ctx, []interface{}{"5", "4", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mget) != 3 || mget[0] == nil || mget[0].ID != "5" || mget[1] != nil || mget[2] == nil || mget[2].ID != "1" {
+		t.Errorf("got: %v want: [5 <nil> 1]", mget)
+	}
+}
+
+func TestFindProjectionPushdown(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	sch := schema.Schema{Fields: schema.Fields{
+		"name": {},
+		"body": {},
+		"meta": {Schema: &schema.Schema{Fields: schema.Fields{"title": {}, "raw": {}}}},
+	}}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ProjectionPushdown: true, Schema: sch})
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{
+			"id": "1", "name": "a", "body": "large",
+			"meta": map[string]interface{}{"title": "t", "raw": "large"},
+		}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Projection: query.MustParseProjection("id,name,meta{title}"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": "1", "name": "a", "meta": map[string]interface{}{"title": "t"}}
+	if len(l.Items) != 1 || l.Items[0].ETag != "a" || !reflect.DeepEqual(l.Items[0].Payload, want) {
+		t.Errorf("got: %v want: %v", l.Items, want)
+	}
+
+	l, err = h.Find(context.Background(), &query.Query{
+		Projection: query.MustParseProjection("*"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || !reflect.DeepEqual(l.Items[0].Payload, items[0].Payload) {
+		t.Errorf("got: %v want: %v", l.Items, items[0].Payload)
+	}
+
+	// Without schema, fields with children may be references, which are read
+	// as a whole.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ProjectionPushdown: true})
+	l, err = h.Find(context.Background(), &query.Query{
+		Projection: query.MustParseProjection("id,meta{title}"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{"id": "1", "meta": map[string]interface{}{"title": "t", "raw": "large"}}
+	if len(l.Items) != 1 || !reflect.DeepEqual(l.Items[0].Payload, want) {
+		t.Errorf("without schema: got: %v want: %v", l.Items, want)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "meta": map[string]interface{}{"n": 1}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b\nc"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "d"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	n, err := h.ExportNDJSON(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{name:{$ne:"d"}}`),
+	}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got: %d items want: 2", n)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 3 || lines[2] != "" {
+		t.Fatalf("got: %q want: 2 lines", buf.String())
+	}
+	for i, line := range lines[:2] {
+		var p map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if p["id"] != items[i].ID || p["name"] != items[i].Payload["name"] {
+			t.Errorf("line %d: got: %v want: %v", i, p, items[i].Payload)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.ExportNDJSON(ctx, &query.Query{}, &buf); err != context.Canceled {
+		t.Errorf("got: %v want: %v", err, context.Canceled)
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(id string, updated time.Time) *resource.Item {
+		return &resource.Item{ID: id, Updated: updated, Payload: map[string]interface{}{"id": id}}
+	}
+	// 2, 3 and 4 are updated during the same millisecond.
+	items := []*resource.Item{
+		item("1", t0),
+		item("3", t0.Add(time.Second)),
+		item("2", t0.Add(time.Second)),
+		item("4", t0.Add(time.Second+500*time.Microsecond)),
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	ids := func(l *resource.ItemList) []interface{} {
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.ID)
+		}
+		return got
+	}
+
+	l, cursor, err := h.ChangedSince(context.Background(), mongo.ChangeCursor{Updated: t0.Add(time.Millisecond)}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := ids(l), []interface{}{"2", "3"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("first pass: got: %v want: %v", got, expect)
+	}
+	if cursor.ID != "3" || !cursor.Updated.Equal(t0.Add(time.Second)) {
+		t.Errorf("got cursor: %v", cursor)
+	}
+
+	// 4 is not skipped although updated during the same millisecond as 3.
+	items = []*resource.Item{item("5", t0.Add(2*time.Second))}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	l, cursor, err = h.ChangedSince(context.Background(), cursor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expect := ids(l), []interface{}{"4", "5"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("second pass: got: %v want: %v", got, expect)
+	}
+
+	l, next, err := h.ChangedSince(context.Background(), cursor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 0 || next != cursor {
+		t.Errorf("got: %v, %v want no item and the same cursor", ids(l), next)
+	}
+}
+
+type fakeCache struct {
+	values map[string]interface{}
+	hits   int
+}
+
+func (c *fakeCache) Get(ctx context.Context, collection, key string) (interface{}, bool) {
+	v, found := c.values[collection+" "+key]
+	if found {
+		c.hits++
+	}
+	return v, found
+}
+
+func (c *fakeCache) Set(ctx context.Context, collection, key string, value interface{}) {
+	c.values[collection+" "+key] = value
+}
+
+func (c *fakeCache) Invalidate(ctx context.Context, collection string) {
+	for k := range c.values {
+		if strings.HasPrefix(k, collection+" ") {
+			delete(c.values, k)
+		}
+	}
+}
+
+func TestFindCache(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	fc := &fakeCache{values: map[string]interface{}{}}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{Cache: fc})
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	q := &query.Query{Predicate: query.MustParsePredicate(`{name:"a"}`)}
+
+	for i := 0; i < 2; i++ {
+		l, err := h.Find(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Items) != 1 {
+			t.Fatalf("got %d items, want 1", len(l.Items))
+		}
+	}
+	if fc.hits != 1 {
+		t.Errorf("got %d cache hits, want 1", fc.hits)
+	}
+
+	updated := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "name": "b"}}
+	if err := h.Update(context.Background(), updated, items[0]); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 0 {
+		t.Errorf("got %d items after update, want 0", len(l.Items))
+	}
+	if fc.hits != 1 {
+		t.Errorf("got %d cache hits after update, want 1", fc.hits)
+	}
+}
+
+func TestFindElemMatchOperators(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		// Has a click and a recent event, but not a recent click.
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "events": []interface{}{
+			map[string]interface{}{"type": "click", "ts": 1},
+			map[string]interface{}{"type": "view", "ts": 10},
+		}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "events": []interface{}{
+			map[string]interface{}{"type": "view", "ts": 1},
+			map[string]interface{}{"type": "click", "ts": 10},
+		}}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{events:{$elemMatch:{type:"click",ts:{$gt:5},ts:{$lt:20}}}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "2" {
+		t.Errorf("got: %v want: [2]", l.Items)
+	}
+}
+
+func TestFindAllElemMatch(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "items": []interface{}{
+			map[string]interface{}{"a": 1, "b": 1},
+			map[string]interface{}{"a": 2, "b": 2},
+		}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "items": []interface{}{
+			map[string]interface{}{"a": 1, "b": 1},
+		}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "items": []interface{}{
+			map[string]interface{}{"a": 1, "b": 2},
+		}}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{&mongo.AllElemMatch{Field: "items", Exps: [][]query.Expression{
+			{&query.Equal{Field: "a", Value: 1}},
+			{&query.Equal{Field: "b", Value: 2}},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 2 || l.Items[0].ID != "1" || l.Items[1].ID != "3" {
+		t.Errorf("got: %v want: [1 3]", l.Items)
+	}
+}
+
+func TestFindMoreFieldsThan(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{FieldMapping: mongo.FieldMapping{ETag: "version"}})
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "a": 1}},
+		{ID: "2", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "2", "a": 1, "b": 2}},
+		{ID: "3", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "3", "a": 1, "b": map[string]interface{}{"c": 1, "d": 2}}},
+		{ID: "4", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "4", "a": 1, "b": 2, "c": 3}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	for n, want := range map[int][]interface{}{0: {"1", "2", "3", "4"}, 1: {"2", "3", "4"}, 2: {"4"}, 3: nil} {
+		l, err := h.Find(context.Background(), &query.Query{Predicate: query.Predicate{h.MoreFieldsThan(n)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("more than %d fields: got: %v want: %v", n, got, want)
+		}
+	}
+}
+
+func TestFindInt64(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	// 2^53 and 2^53+1 can't be distinguished once converted to float64.
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "n": int64(9007199254740992)}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "n": int64(9007199254740993)}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{&query.In{Field: "n", Values: []query.Value{json.Number("9007199254740993"), "foo"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "2" {
+		t.Fatalf("got: %v want: [2]", l.Items)
+	}
+	if n := l.Items[0].Payload["n"]; n != int64(9007199254740993) {
+		t.Errorf("got: %#v want: int64(9007199254740993)", n)
+	}
+}
+
+func TestInsertDefaults(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{
+		UpsertOnInsert: true,
+		InsertDefaults: map[string]interface{}{"version": 1, "meta.owner": "system"},
+	})
+	c := s.DB("").C("test")
+	insert := func(item *resource.Item) {
+		t.Helper()
+		if err := h.Insert(context.Background(), []*resource.Item{item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var doc map[string]interface{}
+	get := func() {
+		t.Helper()
+		doc = nil
+		if err := c.FindId("1").One(&doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(&resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}})
+	get()
+	if doc["version"] != 1 || doc["foo"] != "bar" || doc["_etag"] != "a" {
+		t.Fatalf("got: %v want: version=1 foo=bar _etag=a", doc)
+	}
+	if meta, _ := doc["meta"].(map[string]interface{}); meta["owner"] != "system" {
+		t.Errorf("got: %v want: meta.owner=system", doc["meta"])
+	}
+
+	if err := c.UpdateId("1", bson.M{"$inc": bson.M{"version": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	insert(&resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "baz", "meta": map[string]interface{}{"owner": "me"}}})
+	get()
+	if doc["version"] != 2 || doc["foo"] != "baz" || doc["_etag"] != "b" {
+		t.Errorf("got: %v want: version=2 foo=baz _etag=b", doc)
+	}
+	if meta, _ := doc["meta"].(map[string]interface{}); meta["owner"] != "me" {
+		t.Errorf("got: %v want: meta.owner=me", doc["meta"])
+	}
+
+	// The stored etag must match the one of the last inserted item.
+	item := &resource.Item{ID: "1", ETag: "c", Payload: map[string]interface{}{"id": "1", "foo": "qux"}}
+	if err := h.Update(context.Background(), item, &resource.Item{ID: "1", ETag: "b"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertConflictStrategy(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	c := s.DB("").C("test")
+	cases := []struct {
+		strategy mongo.ConflictStrategy
+		err      error
+		expect   map[string]interface{}
+	}{
+		{mongo.ErrorOnConflict, resource.ErrConflict, map[string]interface{}{"_etag": "a", "foo": "a", "bar": "a"}},
+		{mongo.OverwriteOnConflict, nil, map[string]interface{}{"_etag": "b", "foo": "b"}},
+		{mongo.IgnoreOnConflict, nil, map[string]interface{}{"_etag": "a", "foo": "a", "bar": "a"}},
+		{mongo.MergeOnConflict, nil, map[string]interface{}{"_etag": "b", "foo": "b", "bar": "a"}},
+	}
+	for _, tc := range cases {
+		if _, err := c.RemoveAll(nil); err != nil {
+			t.Fatal(err)
+		}
+		existing := &resource.Item{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "a", "bar": "a"}}
+		h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ConflictStrategy: tc.strategy})
+		if err := h.Insert(context.Background(), []*resource.Item{existing}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A batch mixing new and existing items.
+		err := h.Insert(context.Background(), []*resource.Item{
+			{ID: "2", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "2", "foo": "b"}},
+			{ID: "1", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "b"}},
+			{ID: "3", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "3", "foo": "b"}},
+		})
+		if err != tc.err {
+			t.Errorf("strategy %d: got: %v want: %v", tc.strategy, err, tc.err)
+		}
+		var doc map[string]interface{}
+		if err := c.FindId("1").Select(bson.M{"_id": 0, "_updated": 0}).One(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(doc, tc.expect) {
+			t.Errorf("strategy %d: got: %v want: %v", tc.strategy, doc, tc.expect)
+		}
+		if tc.err == nil {
+			assertCollectionIDs(t, c, []string{"1", "2", "3"})
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	ctx := context.Background()
+
+	t.Run("when the item does not exist, then it should be inserted", func(t *testing.T) {
+		item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+		inserted, err := h.Upsert(ctx, item, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inserted {
+			t.Error("got: inserted false want: true")
+		}
+		l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Items) != 1 || l.Items[0].ETag != "a" || l.Items[0].Payload["foo"] != "bar" {
+			t.Errorf("got: %v want: the inserted item", l.Items)
+		}
+	})
+	t.Run("when the item exists with the original etag, then it should be replaced", func(t *testing.T) {
+		item := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+		inserted, err := h.Upsert(ctx, item, &resource.Item{ID: "1", ETag: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted {
+			t.Error("got: inserted true want: false")
+		}
+		l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Items) != 1 || l.Items[0].ETag != "b" || l.Items[0].Payload["foo"] != "baz" {
+			t.Errorf("got: %v want: the replaced item", l.Items)
+		}
+	})
+	t.Run("when the item exists with another etag, then it should conflict", func(t *testing.T) {
+		item := &resource.Item{ID: "1", ETag: "c", Payload: map[string]interface{}{"id": "1", "foo": "qux"}}
+		if _, err := h.Upsert(ctx, item, &resource.Item{ID: "1", ETag: "a"}); err != resource.ErrConflict {
+			t.Errorf("got: %v want: %v", err, resource.ErrConflict)
+		}
+		if _, err := h.Upsert(ctx, item, &resource.Item{ID: "1", ETag: "p-1"}); err != resource.ErrConflict {
+			t.Errorf("got: %v want: %v", err, resource.ErrConflict)
+		}
+	})
+	t.Run("when the item has no etag and the original a provisional one, then it should be replaced", func(t *testing.T) {
+		if err := s.DB("").C("test").Insert(map[string]interface{}{"_id": "2", "foo": "bar"}); err != nil {
+			t.Fatal(err)
+		}
+		item := &resource.Item{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "foo": "baz"}}
+		inserted, err := h.Upsert(ctx, item, &resource.Item{ID: "2", ETag: "p-2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted {
+			t.Error("got: inserted true want: false")
+		}
+	})
+}
+
+func TestUpdateWithMerge(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{MergeRetries: 1000})
+	ctx := context.Background()
+	if err := h.Insert(ctx, []*resource.Item{{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "n": 0}}}); err != nil {
+		t.Fatal(err)
+	}
+	increment := func(current *resource.Item) (*resource.Item, error) {
+		p := make(map[string]interface{}, len(current.Payload))
+		for k, v := range current.Payload {
+			p[k] = v
+		}
+		p["n"] = p["n"].(int) + 1
+		return &resource.Item{ID: current.ID, Payload: p}, nil
+	}
+
+	const workers, updates = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*updates)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				if err := h.UpdateWithMerge(ctx, "1", increment); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("UpdateWithMerge: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["n"] != workers*updates {
+		t.Errorf("got: n = %v want: %d, updates were lost", doc["n"], workers*updates)
+	}
+
+	if err := h.UpdateWithMerge(ctx, "2", increment); err != resource.ErrNotFound {
+		t.Errorf("got: %v want: %v", err, resource.ErrNotFound)
+	}
+	mergeErr := errors.New("merge failed")
+	if err := h.UpdateWithMerge(ctx, "1", func(*resource.Item) (*resource.Item, error) { return nil, mergeErr }); err != mergeErr {
+		t.Errorf("got: %v want: %v", err, mergeErr)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "status": "pending", "owner": "x"}}
+	if err := h.Insert(context.Background(), []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := h.CompareAndSwap(context.Background(), "1", map[string]interface{}{"status": "pending", "owner": "y"}, map[string]interface{}{"status": "active"})
+	if err != nil || ok {
+		t.Fatalf("owner mismatch: got: %v, %v want: false, <nil>", ok, err)
+	}
+
+	const n = 10
+	results := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			ok, err := h.CompareAndSwap(context.Background(), "1",
+				map[string]interface{}{"status": "pending", "owner": "x"},
+				map[string]interface{}{"status": "active"})
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}()
+	}
+	var swapped int
+	for i := 0; i < n; i++ {
+		if <-results {
+			swapped++
+		}
+	}
+	if swapped != 1 {
+		t.Errorf("got %d successful swaps, want 1", swapped)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 {
+		t.Fatalf("got %d items, want 1", len(l.Items))
+	}
+	got := l.Items[0]
+	if got.Payload["status"] != "active" {
+		t.Errorf("got status: %v want: active", got.Payload["status"])
+	}
+	if got.ETag == "a" || !got.Updated.After(item.Updated) {
+		t.Errorf("etag and update time not bumped: %v %v", got.ETag, got.Updated)
+	}
+	// The previous version can't be used for an update anymore.
+	if err := h.Update(context.Background(), item, item); err != resource.ErrConflict {
+		t.Errorf("got: %v want: %v", err, resource.ErrConflict)
+	}
+}
+
+func TestCompareAndSwapStoredValues(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{DateFields: []string{"at"}, BoolFields: []string{"public"}})
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "at": "2023-01-02T01:00:00Z", "public": true}}
+	if err := h.Insert(context.Background(), []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Conditions match the time and integer the values are stored as.
+	for _, tc := range []struct {
+		conditions map[string]interface{}
+		expect     bool
+	}{
+		{map[string]interface{}{"at": "2023-01-02T02:00:00+01:00", "public": false}, false},
+		{map[string]interface{}{"at": "2023-01-02T03:00:00Z", "public": true}, false},
+		{map[string]interface{}{"at": "2023-01-02T02:00:00+01:00", "public": true}, true},
+	} {
+		ok, err := h.CompareAndSwap(context.Background(), "1", tc.conditions, map[string]interface{}{"status": "active"})
+		if err != nil || ok != tc.expect {
+			t.Errorf("%v: got: %v, %v want: %v, <nil>", tc.conditions, ok, err, tc.expect)
+		}
+	}
+
+	if _, err := h.CompareAndSwap(context.Background(), "1", map[string]interface{}{"at": "yesterday"}, map[string]interface{}{"status": "active"}); err == nil {
+		t.Error("invalid date: got no error")
+	}
+}
+
+func TestFindCreatedBetween(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	t0 := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	var items []*resource.Item
+	for i := 0; i < 4; i++ {
+		id := bson.NewObjectIdWithTime(t0.Add(time.Duration(i) * time.Second))
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}})
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		from, to time.Time
+		want     []interface{}
+	}{
+		{t0.Add(time.Second), t0.Add(3 * time.Second), []interface{}{1, 2}},
+		// Ids only hold seconds: the item created at t0 is before t0+0.5s.
+		{t0.Add(500 * time.Millisecond), t0.Add(2500 * time.Millisecond), []interface{}{1, 2}},
+		{t0.Add(-time.Hour), t0.Add(time.Hour), []interface{}{0, 1, 2, 3}},
+		{t0.Add(4 * time.Second), t0.Add(time.Hour), nil},
+	}
+	for _, tc := range cases {
+		l, err := h.Find(context.Background(), &query.Query{
+			Predicate: query.Predicate{mongo.CreatedBetween(tc.from, tc.to)},
+			Sort:      query.Sort{{Name: "n"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.Payload["n"])
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("[%v, %v): got: %v want: %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateDuplicateKey(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	if err := s.DB("").C("test").EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "email": "a@example.com"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "email": "b@example.com"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	item := &resource.Item{ID: "2", ETag: "c", Payload: map[string]interface{}{"id": "2", "email": "a@example.com"}}
+	err := h.Update(context.Background(), item, items[1])
+	dup, ok := err.(*mongo.DuplicateKeyError)
+	if !ok {
+		t.Fatalf("got: %#v want: *mongo.DuplicateKeyError", err)
+	}
+	if dup.Index != "email_1" || !reflect.DeepEqual(dup.Fields, []string{"email"}) {
+		t.Errorf("got: %s %v want: email_1 [email]", dup.Index, dup.Fields)
+	}
+	if !errors.Is(err, resource.ErrConflict) {
+		t.Error("error does not match resource.ErrConflict")
+	}
+}
+
+func TestPartialUpdate(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	original := &resource.Item{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{
+		"id":    "1",
+		"title": "a",
+		"meta":  map[string]interface{}{"author": "x", "views": 1},
+	}}
+	if err := h.Insert(context.Background(), []*resource.Item{original}); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := h.PartialUpdate(context.Background(), original, map[string]interface{}{"meta.views": 2, "status": "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"id":     "1",
+		"title":  "a",
+		"status": "draft",
+		"meta":   map[string]interface{}{"author": "x", "views": 2},
+	}
+	if !reflect.DeepEqual(item.Payload, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", item.Payload, expect)
+	}
+	if item.ID != "1" || item.ETag == "" || item.ETag == "a" || !item.Updated.After(now) {
+		t.Errorf("id, etag or update time not set: %v %v %v", item.ID, item.ETag, item.Updated)
+	}
+
+	// The returned item is the stored one.
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || !reflect.DeepEqual(l.Items[0], item) {
+		t.Errorf("\ngot: %v\nwant: %v", l.Items, item)
+	}
+
+	if _, err := h.PartialUpdate(context.Background(), original, map[string]interface{}{"title": "b"}); err != resource.ErrConflict {
+		t.Errorf("stale etag: got: %v want: %v", err, resource.ErrConflict)
+	}
+	if _, err := h.PartialUpdate(context.Background(), &resource.Item{ID: "2", ETag: "a"}, map[string]interface{}{"title": "b"}); err != resource.ErrNotFound {
+		t.Errorf("missing item: got: %v want: %v", err, resource.ErrNotFound)
+	}
+	if _, err := h.PartialUpdate(context.Background(), item, map[string]interface{}{"_etag": "b"}); err == nil {
+		t.Error("expected an error when changing the etag")
+	}
+}
+
+func TestPartialUpdateChanged(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	original := &resource.Item{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{
+		"id":    "1",
+		"title": "a",
+		"body":  "long text",
+		"draft": true,
+		"meta":  map[string]interface{}{"author": "x", "views": 1, "tag": "t"},
+	}}
+	if err := h.Insert(context.Background(), []*resource.Item{original}); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := h.PartialUpdateChanged(context.Background(), original,
+		map[string]interface{}{"meta.views": 2, "title": "b"}, []string{"draft", "meta.tag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"id":    "1",
+		"title": "b",
+		"draft": nil,
+		"meta":  map[string]interface{}{"views": 2, "tag": nil},
+	}
+	if !reflect.DeepEqual(item.Payload, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", item.Payload, expect)
+	}
+	if item.ETag == "" || item.ETag == "a" || !item.Updated.After(now) {
+		t.Errorf("etag or update time not set: %v %v", item.ETag, item.Updated)
+	}
+
+	var doc map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := doc["draft"]; found {
+		t.Error("draft not removed")
+	}
+	if doc["body"] != "long text" || doc["_etag"] != item.ETag {
+		t.Errorf("unexpected stored document: %v", doc)
+	}
+
+	if _, err := h.PartialUpdateChanged(context.Background(), original, nil, []string{"body"}); err != resource.ErrConflict {
+		t.Errorf("stale etag: got: %v want: %v", err, resource.ErrConflict)
+	}
+	if _, err := h.PartialUpdateChanged(context.Background(), item, map[string]interface{}{"title": "c"}, []string{"title"}); err == nil {
+		t.Error("expected an error when changing and unsetting the same field")
+	}
+}
+
+func TestFindUnsortedArray(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	exp, err := h.UnsortedArray(context.Background(), "scores")
+	if err != nil {
+		t.Skip(err)
+	}
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "scores": []interface{}{1, 2, 3}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "scores": []interface{}{3, 1, 2}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "scores": []interface{}{}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "scores": []interface{}{5}}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "scores": []interface{}{1, 2.5, 2}}},
+		{ID: "6", Payload: map[string]interface{}{"id": "6"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.Predicate{exp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if want := []interface{}{"2", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+}
+
+func TestFindSizeMismatch(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "items": []interface{}{"a", "b"}, "quantities": []interface{}{1, 2}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "items": []interface{}{"a", "b"}, "quantities": []interface{}{1}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "items": []interface{}{"a"}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "items": []interface{}{}}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5"}},
+		{ID: "6", Payload: map[string]interface{}{"id": "6", "items": nil, "quantities": []interface{}{3}}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.Predicate{&mongo.SizeMismatch{Field: "items", Other: "quantities"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if want := []interface{}{"2", "3", "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+}
+
+func TestETag(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	ctx := context.Background()
+	items := []*resource.Item{{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	// Documents created outside of rest-layer have no etag.
+	if err := s.DB("").C("test").Insert(bson.M{"_id": "2", "foo": "baz"}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"1": "a", "2": "p-2"} {
+		etag, err := h.ETag(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != want {
+			t.Errorf("ETag(%s): got: %s want: %s", id, etag, want)
+		}
+	}
+	if _, err := h.ETag(ctx, "3"); err != resource.ErrNotFound {
+		t.Errorf("ETag(3): got error: %v want: %v", err, resource.ErrNotFound)
+	}
+}
+
+func TestFindNot(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "title": "draft: a", "price": 5}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "title": "b", "price": 15}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "title": "c"}},
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		exp  query.Expression
+		want []interface{}
+	}{
+		{"regex", &mongo.Not{Exp: &query.Regex{Field: "title", Value: regexp.MustCompile("^draft")}}, []interface{}{"2", "3"}},
+		{"greater than", &mongo.Not{Exp: &query.GreaterThan{Field: "price", Value: 10}}, []interface{}{"1", "3"}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := h.Find(ctx, &query.Query{Predicate: query.Predicate{tc.exp}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []interface{}
+			for _, item := range l.Items {
+				got = append(got, item.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindFieldRegex(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "text": "abc", "pattern": "^a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "text": "abc", "pattern": "^b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "text": "x-42", "pattern": "^x-[0-9]+$"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "text": 42, "pattern": "42"}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "text": "abc"}},
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	q := &query.Query{Predicate: query.Predicate{&mongo.FieldRegex{Field: "text", Pattern: "pattern"}}}
+	l, err := h.Find(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if want := []interface{}{"1", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+
+	// An invalid stored pattern makes the query fail.
+	invalid := &resource.Item{ID: "6", Payload: map[string]interface{}{"id": "6", "text": "abc", "pattern": "("}}
+	if err := h.Insert(ctx, []*resource.Item{invalid}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Find(ctx, q); err == nil {
+		t.Error("expected an error for an invalid stored pattern, got nil")
+	}
+}
+
+func TestFindInBatches(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	// Only sorts on scalar fields of the schema are merged.
+	sch := &schema.Schema{Fields: schema.Fields{
+		"id":   schema.IDField,
+		"rank": {Validator: &schema.Integer{}},
+		"tags": {Validator: &schema.Array{}},
+	}}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{InBatchSize: 3, Schema: sch})
+	ctx := context.Background()
+	var items []*resource.Item
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{
+			"id":   id,
+			"rank": i % 4,
+			"tags": []interface{}{"t" + strconv.Itoa(i), "t" + strconv.Itoa(i+1)},
+		}})
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	ids := func(l *resource.ItemList) []interface{} {
+		var ids []interface{}
+		for _, item := range l.Items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	in := &query.In{Field: "id", Values: []query.Value{"9", "1", "5", "2", "7", "0", "3", "8"}}
+	l, err := h.Find(ctx, &query.Query{
+		Predicate: query.Predicate{in},
+		Sort:      query.Sort{{Name: "rank", Reversed: true}, {Name: "id"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"3", "7", "2", "1", "5", "9", "0", "8"}; !reflect.DeepEqual(ids(l), want) || l.Total != 8 {
+		t.Errorf("got: %v total %d want: %v total 8", ids(l), l.Total, want)
+	}
+
+	l, err = h.Find(ctx, &query.Query{
+		Predicate: query.Predicate{in},
+		Sort:      query.Sort{{Name: "rank", Reversed: true}, {Name: "id"}},
+		Window:    &query.Window{Offset: 2, Limit: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"2", "1", "5"}; !reflect.DeepEqual(ids(l), want) {
+		t.Errorf("got: %v want: %v", ids(l), want)
+	}
+
+	// Items matching several batches are returned once.
+	tags := &query.In{Field: "tags", Values: []query.Value{"t1", "t2", "t3", "t4", "t5"}}
+	l, err = h.Find(ctx, &query.Query{Predicate: query.Predicate{tags}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"0", "1", "2", "3", "4", "5"}; !reflect.DeepEqual(ids(l), want) {
+		t.Errorf("got: %v want: %v", ids(l), want)
+	}
+
+	// Sorted fields missing from the projection are not returned.
+	l, err = h.FindWithProjection(ctx, &query.Query{
+		Predicate: query.Predicate{in},
+		Sort:      query.Sort{{Name: "rank"}},
+		Window:    &query.Window{Limit: 2},
+	}, mongo.Projection{Include: []string{"tags"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": "0", "tags": []interface{}{"t0", "t1"}}
+	if len(l.Items) != 2 || !reflect.DeepEqual(l.Items[0].Payload, want) || l.Items[1].ID != "8" {
+		t.Errorf("got: %v want: items 0 and 8 without rank", l.Items)
+	}
+
+	// Arrays are sorted by their lowest or highest element, so sorts on
+	// arrays are sent in a single query.
+	unsplit := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{InBatchSize: -1, Schema: sch})
+	for _, sort := range []string{"tags", "-tags,id"} {
+		q := &query.Query{Predicate: query.Predicate{in}, Sort: query.MustParseSort(sort), Window: &query.Window{Limit: 4}}
+		l, err := h.Find(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ul, err := unsplit.Find(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids(l), ids(ul)) {
+			t.Errorf("sort %s: got: %v want: %v", sort, ids(l), ids(ul))
+		}
+	}
+}
+
+func TestFindInBatchesMappedField(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	mapping := mongo.FieldMapping{Updated: "modifiedAt"}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{InBatchSize: 2, FieldMapping: mapping})
+	unsplit := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{InBatchSize: -1, FieldMapping: mapping})
+	ctx := context.Background()
+	var items []*resource.Item
+	var values []query.Value
+	for i := 0; i < 6; i++ {
+		id := strconv.Itoa(i)
+		updated := now.Add(time.Duration((i*7)%6) * time.Minute)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Updated: updated, Payload: map[string]interface{}{"id": id}})
+		values = append(values, id)
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	q := &query.Query{
+		Predicate: query.Predicate{&query.In{Field: "id", Values: values}},
+		Sort:      query.Sort{{Name: "modifiedAt", Reversed: true}},
+		Window:    &query.Window{Limit: 4},
+	}
+	l, err := h.Find(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul, err := unsplit.Find(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want []interface{}
+	for i := range l.Items {
+		got = append(got, l.Items[i].ID)
+	}
+	for i := range ul.Items {
+		want = append(want, ul.Items[i].ID)
+	}
+	if len(want) != 4 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+}
+
+func TestHandlerSessionOptions(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{
+		Safe:          &mgo.Safe{WMode: "majority", WTimeout: 5000},
+		ReadMode:      mgo.SecondaryPreferred,
+		SocketTimeout: 10 * time.Second,
+		SyncTimeout:   5 * time.Second,
+	})
+	items := []*resource.Item{{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	l, err := h.Find(ctx, &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].Payload["foo"] != "bar" {
+		t.Errorf("got: %v want: the inserted item", l.Items)
+	}
+	if s.Mode() != mgo.Strong {
+		t.Errorf("got: mode %v want: the mode of the given session to be left untouched", s.Mode())
+	}
+}
+
+func TestFieldTransforms(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	hash := func(v interface{}) (interface{}, error) {
+		return fmt.Sprintf("hash(%v)", v), nil
+	}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{
+		Transforms: map[string]mongo.FieldTransform{"password": {Write: hash, Read: mongo.Redact}},
+	})
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "a", "password": "secret"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "name": "b", "password": "other"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["password"] != "hash(secret)" {
+		t.Errorf("got: stored password %v want: hash(secret)", stored["password"])
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{password:"secret"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": "1", "name": "a"}
+	if len(l.Items) != 1 || !reflect.DeepEqual(l.Items[0].Payload, want) {
+		t.Errorf("got: %v want: %v", l.Items, want)
+	}
+
+	// Updating the item read without its redacted password keeps it.
+	original := l.Items[0]
+	updated := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "name": "c"}}
+	if err := h.Update(context.Background(), updated, original); err != nil {
+		t.Fatal(err)
+	}
+	stored = nil
+	if err := s.DB("").C("test").FindId("1").One(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["name"] != "c" || stored["password"] != "hash(secret)" {
+		t.Errorf("got: stored %v want: name c and password hash(secret)", stored)
+	}
+
+	// Giving the stored value back does not transform it again.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{
+		Transforms: map[string]mongo.FieldTransform{"password": {Write: hash}},
+	})
+	original = &resource.Item{ID: "2", ETag: "a"}
+	updated = &resource.Item{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "b", "password": "hash(other)"}}
+	if err := h.Update(context.Background(), updated, original); err != nil {
+		t.Fatal(err)
+	}
+	stored = nil
+	if err := s.DB("").C("test").FindId("2").One(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["password"] != "hash(other)" {
+		t.Errorf("got: stored password %v want: hash(other)", stored["password"])
+	}
+}
+
+func TestCompoundID(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{IDFields: []string{"tenant", "num"}})
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ETag: "a", Payload: map[string]interface{}{"tenant": "acme", "num": 42, "foo": "bar"}},
+		{ETag: "a", Payload: map[string]interface{}{"tenant": "acme", "num": 43, "foo": "baz"}},
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	if items[0].ID != `["acme",42]` || items[0].Payload["id"] != items[0].ID {
+		t.Errorf("got: id %v want: [\"acme\",42]", items[0].ID)
+	}
+
+	var stored map[string]interface{}
+	if err := s.DB("").C("test").Find(bson.M{"_id": bson.D{{Name: "tenant", Value: "acme"}, {Name: "num", Value: 42}}}).One(&stored); err != nil {
+		t.Fatalf("compound _id not found: %v", err)
+	}
+
+	l, err := h.Find(ctx, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "id", Value: `["acme",43]`}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != `["acme",43]` || l.Items[0].Payload["foo"] != "baz" {
+		t.Errorf("got: %v want: the item with id [\"acme\",43]", l.Items)
+	}
+
+	got, err := h.MultiGet(ctx, []interface{}{`["acme",43]`, `["acme",42]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != `["acme",43]` || got[1].ID != `["acme",42]` {
+		t.Errorf("got: %v want: both items in order", got)
+	}
+
+	update := &resource.Item{ID: items[0].ID, ETag: "b", Payload: map[string]interface{}{"tenant": "acme", "num": 42, "foo": "qux"}}
+	if err := h.Update(ctx, update, items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items stored without etag get a provisional one derived from the id.
+	if err := s.DB("").C("test").Insert(bson.M{"_id": bson.D{{Name: "tenant", Value: "acme"}, {Name: "num", Value: 44}}, "tenant": "acme", "num": 44}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = h.MultiGet(ctx, []interface{}{`["acme",44]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ETag != `p-["acme",44]` {
+		t.Fatalf("got: %v want: an item with etag p-[\"acme\",44]", got)
+	}
+	if err := h.Delete(ctx, got[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const base62Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// base62Codec stores base62 string ids as integers.
+type base62Codec struct{}
+
+func (base62Codec) Encode(id interface{}) (interface{}, error) {
+	s, ok := id.(string)
+	if !ok || s == "" {
+		return nil, fmt.Errorf("not a base62 string: %v", id)
+	}
+	var n int64
+	for _, r := range s {
+		d := strings.IndexRune(base62Digits, r)
+		if d < 0 {
+			return nil, fmt.Errorf("invalid base62 digit: %q", r)
+		}
+		n = n*62 + int64(d)
+	}
+	return n, nil
+}
+
+func (base62Codec) Decode(v interface{}) (interface{}, error) {
+	n, ok := v.(int64)
+	if !ok || n < 0 {
+		return nil, errors.New("not a base62 integer")
+	}
+	b := []byte{}
+	for {
+		b = append([]byte{base62Digits[n%62]}, b...)
+		if n /= 62; n == 0 {
+			return string(b), nil
+		}
+	}
+}
+
+func TestIDCodec(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{IDCodec: base62Codec{}})
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ID: "1z", ETag: "a", Payload: map[string]interface{}{"id": "1z", "foo": "bar"}},
+		{ID: "10", ETag: "a", Payload: map[string]interface{}{"id": "10", "foo": "baz"}},
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	var stored map[string]interface{}
+	if err := s.DB("").C("test").FindId(int64(123)).One(&stored); err != nil {
+		t.Fatalf("encoded _id not found: %v", err)
+	}
+
+	l, err := h.Find(ctx, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "id", Value: "10"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "10" || l.Items[0].Payload["foo"] != "baz" {
+		t.Errorf("got: %v want: the item with id 10", l.Items)
+	}
+
+	got, err := h.MultiGet(ctx, []interface{}{"10", "1z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != "10" || got[1].ID != "1z" {
+		t.Errorf("got: %v want: both items in order", got)
+	}
+
+	update := &resource.Item{ID: "1z", ETag: "b", Payload: map[string]interface{}{"id": "1z", "foo": "qux"}}
+	if err := h.Update(ctx, update, items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items stored without etag get a provisional one derived from the id.
+	if err := s.DB("").C("test").Insert(bson.M{"_id": int64(124), "foo": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = h.MultiGet(ctx, []interface{}{"20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ETag != "p-20" {
+		t.Fatalf("got: %v want: an item with etag p-20", got)
+	}
+	if err := h.Delete(ctx, got[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTimestamps(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ServerTimestamps: true})
+	ctx := context.Background()
+	past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	stored := func() (created, updated time.Time) {
+		var doc struct {
+			Created time.Time `bson:"_created"`
+			Updated time.Time `bson:"_updated"`
+		}
+		if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc.Created, doc.Updated
+	}
+
+	item := &resource.Item{ID: "1", ETag: "a", Updated: past, Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	if err := h.Insert(ctx, []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	created, updated := stored()
+	if !created.After(past) || !created.Equal(updated) {
+		t.Fatalf("got: created %v updated %v want: the insertion time for both", created, updated)
+	}
+	if !item.Updated.Equal(updated) {
+		t.Errorf("got: item updated %v want: %v", item.Updated, updated)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	update := &resource.Item{ID: "1", ETag: "b", Updated: past, Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	if err := h.Update(ctx, update, item); err != nil {
+		t.Fatal(err)
+	}
+	c, u := stored()
+	if !c.Equal(created) || !u.After(updated) {
+		t.Errorf("got: created %v updated %v want: created %v and a later update", c, u, created)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	upsert := &resource.Item{ID: "1", ETag: "c", Updated: past, Payload: map[string]interface{}{"id": "1", "foo": "qux"}}
+	if _, err := h.Upsert(ctx, upsert, update); err != nil {
+		t.Fatal(err)
+	}
+	c, u2 := stored()
+	if !c.Equal(created) || !u2.After(u) {
+		t.Errorf("got: created %v updated %v want: created %v and a later update", c, u2, created)
+	}
+
+	got, err := h.MultiGet(ctx, []interface{}{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": "1", "foo": "qux"}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Payload, want) {
+		t.Errorf("got: %v want: payload %v", got, want)
+	}
+}
+
+func TestInsertionOrder(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{InsertionOrder: true})
+	ctx := context.Background()
+	ids := []string{"c", "a", "d", "b"}
+	items := map[string]*resource.Item{}
+	for _, id := range ids {
+		item := &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{"id": id}}
+		if err := h.Insert(ctx, []*resource.Item{item}); err != nil {
+			t.Fatal(err)
+		}
+		items[id] = item
+	}
+	find := func() []interface{} {
+		l, err := h.Find(ctx, &query.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			if _, found := item.Payload["_seq"]; found {
+				t.Errorf("item %v: sequence number returned in payload", item.ID)
+			}
+			got = append(got, item.ID)
+		}
+		return got
+	}
+	if got, want := find(), []interface{}{"c", "a", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+
+	// Replacing an item keeps its position.
+	update := &resource.Item{ID: "a", ETag: "b", Payload: map[string]interface{}{"id": "a", "foo": "bar"}}
+	if err := h.Update(ctx, update, items["a"]); err != nil {
+		t.Fatal(err)
+	}
+	upsert := &resource.Item{ID: "c", ETag: "b", Payload: map[string]interface{}{"id": "c", "foo": "bar"}}
+	if _, err := h.Upsert(ctx, upsert, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := find(), []interface{}{"c", "a", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after replace got: %v want: %v", got, want)
+	}
+
+	// An explicit sort still applies.
+	l, err := h.Find(ctx, &query.Query{Sort: query.Sort{{Name: "id"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if want := []interface{}{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sorted by id got: %v want: %v", got, want)
+	}
+}
+
+func TestEstimatedCount(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	exact := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	estimated := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{EstimatedCount: true})
+	var items []*resource.Item
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{"id": id, "even": i%2 == 0}})
+	}
+	if err := exact.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    *query.Query
+		want int
+	}{
+		{"no filter", &query.Query{}, 10},
+		{"filter", &query.Query{Predicate: query.Predicate{&query.Equal{Field: "even", Value: true}}}, 5},
+	} {
+		n, err := exact.Count(ctx, tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := estimated.Count(ctx, tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.want || e != tc.want {
+			t.Errorf("%s: got: exact %d estimated %d want: %d", tc.name, n, e, tc.want)
+		}
+	}
+
+	// The estimate of a missing collection is zero.
+	missing := mongo.NewHandlerWithOptions(s, "", "missing", mongo.Options{EstimatedCount: true})
+	if n, err := missing.Count(ctx, &query.Query{}); err != nil || n != 0 {
+		t.Errorf("missing collection: got: %d, %v want: 0, nil", n, err)
+	}
+}
+
+func TestLargeSorts(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Lower the memory limit of sorts (MongoDB 4.4+) so that a few items
+	// exceed it.
+	const param = "internalQueryMaxBlockingSortMemoryUsageBytes"
+	var prev bson.M
+	if err := s.Run(bson.D{{Name: "getParameter", Value: 1}, {Name: param, Value: 1}}, &prev); err != nil {
+		t.Skipf("can't read %s: %v", param, err)
+	}
+	if err := s.Run(bson.D{{Name: "setParameter", Value: 1}, {Name: param, Value: 16 * 1024}}, nil); err != nil {
+		t.Skipf("can't set %s: %v", param, err)
+	}
+	defer s.Run(bson.D{{Name: "setParameter", Value: 1}, {Name: param, Value: prev[param]}}, nil)
+
+	var items []*resource.Item
+	for i := 0; i < 200; i++ {
+		id := strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{
+			"id":   id,
+			"rank": (i * 7) % 200,
+			"pad":  strings.Repeat("x", 512),
+		}})
+	}
+	if err := mongo.NewHandler(s, "", "test").Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	q := &query.Query{Sort: query.MustParseSort("rank"), Window: &query.Window{Limit: -1}}
+
+	if _, err := mongo.NewHandler(s, "", "test").Find(ctx, q); err == nil {
+		t.Error("FailLargeSorts: expected an error, got nil")
+	}
+
+	strict := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{LargeSorts: mongo.StrictLargeSorts})
+	_, err := strict.Find(ctx, q)
+	var serr *mongo.SortMemoryError
+	if !errors.As(err, &serr) {
+		t.Fatalf("StrictLargeSorts: got: %v want a *SortMemoryError", err)
+	}
+	if want := []string{"rank"}; !reflect.DeepEqual(serr.Sort, want) {
+		t.Errorf("StrictLargeSorts: got sort: %v want: %v", serr.Sort, want)
+	}
+
+	disk := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{LargeSorts: mongo.DiskLargeSorts})
+	l, err := disk.Find(ctx, q)
+	if err != nil {
+		t.Fatalf("DiskLargeSorts: %v", err)
+	}
+	if len(l.Items) != len(items) {
+		t.Fatalf("DiskLargeSorts: got %d items want: %d", len(l.Items), len(items))
+	}
+	for i, item := range l.Items {
+		if rank := item.Payload["rank"]; rank != i {
+			t.Fatalf("DiskLargeSorts: item #%d has rank %v", i, rank)
+		}
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	var items []*resource.Item
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("%02d", i)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{"id": id}})
+	}
+	if err := mongo.NewHandler(s, "", "test").Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{MaxResults: 10})
+	cases := []struct {
+		name   string
+		window *query.Window
+		first  string
+		count  int
+		limit  int
+	}{
+		{"no window", nil, "00", 10, 10},
+		{"no limit", &query.Window{Offset: 5, Limit: -1}, "05", 10, 10},
+		{"explicit limit", &query.Window{Limit: 30}, "00", 30, 30},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := h.Find(ctx, &query.Query{Window: tc.window})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(l.Items) != tc.count || l.Limit != tc.limit {
+				t.Fatalf("got: %d items, limit %d want: %d items, limit %d", len(l.Items), l.Limit, tc.count, tc.limit)
+			}
+			if l.Items[0].ID != tc.first {
+				t.Errorf("got first item: %v want: %v", l.Items[0].ID, tc.first)
+			}
+		})
+	}
+
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{MaxResults: 10, FailOnMaxResults: true})
+	if _, err := h.Find(ctx, &query.Query{}); err != mongo.ErrTooManyResults {
+		t.Errorf("fail: got: %v want: %v", err, mongo.ErrTooManyResults)
+	}
+	l, err := h.Find(ctx, &query.Query{Window: &query.Window{Offset: 45, Limit: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 5 || l.Limit != -1 || l.Total != 50 {
+		t.Errorf("fail under max: got: %d items, limit %d, total %d want: 5 items, limit -1, total 50", len(l.Items), l.Limit, l.Total)
+	}
+}
+
+func TestUpdateWithInfo(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := &resource.Item{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	if err := h.Insert(ctx, []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	update := &resource.Item{ID: "1", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	info, err := h.UpdateWithInfo(ctx, update, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Matched != 1 || info.Updated != 1 {
+		t.Errorf("change: got: %+v want: 1 matched and 1 updated", info)
+	}
+
+	// Writing the same document again matches without modifying it.
+	same := &resource.Item{ID: "1", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	info, err = h.UpdateWithInfo(ctx, same, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Matched != 1 || info.Updated != 0 {
+		t.Errorf("identical overwrite: got: %+v want: 1 matched and 0 updated", info)
+	}
+
+	if _, err := h.UpdateWithInfo(ctx, same, item); err != resource.ErrConflict {
+		t.Errorf("stale etag: got: %v want: %v", err, resource.ErrConflict)
+	}
+	missing := &resource.Item{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2"}}
+	if _, err := h.UpdateWithInfo(ctx, missing, missing); err != resource.ErrNotFound {
+		t.Errorf("missing item: got: %v want: %v", err, resource.ErrNotFound)
+	}
+}
+
+func TestTrackAccess(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{TrackAccess: true})
+	ctx := context.Background()
+	c := s.DB("").C("test")
+	past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	lastAccess := func() time.Time {
+		var doc struct {
+			LastAccess time.Time `bson:"_lastAccess"`
+		}
+		if err := c.FindId("1").One(&doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc.LastAccess
+	}
+
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	if err := h.Insert(ctx, []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	if !lastAccess().After(past) {
+		t.Fatalf("got: last access %v want: the insertion time", lastAccess())
+	}
+
+	// Lists are not recorded.
+	if err := c.UpdateId("1", bson.M{"$set": bson.M{"_lastAccess": past}}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(ctx, &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 {
+		t.Fatalf("got: %d items want: 1", len(l.Items))
+	}
+	if got := lastAccess(); !got.Equal(past) {
+		t.Errorf("after Find got: last access %v want: %v", got, past)
+	}
+
+	got, err := h.MultiGet(ctx, []interface{}{"1", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"id": "1", "foo": "bar"}; len(got) != 1 || !reflect.DeepEqual(got[0].Payload, want) {
+		t.Errorf("got: %v want: payload %v", got, want)
+	}
+	if got := lastAccess(); !got.After(past) {
+		t.Errorf("after MultiGet got: last access %v want: now", got)
+	}
+
+	// Recording the access leaves the etag untouched.
+	update := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	if err := h.Update(ctx, update, item); err != nil {
+		t.Errorf("update after MultiGet: %v", err)
+	}
+
+	// Accesses are recorded in batches like items are read.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{TrackAccess: true, InBatchSize: 1})
+	if err := h.Insert(ctx, []*resource.Item{{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UpdateAll(nil, bson.M{"$set": bson.M{"_lastAccess": past}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.MultiGet(ctx, []interface{}{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Find(bson.M{"_lastAccess": bson.M{"$gt": past}}).Count(); err != nil || n != 2 {
+		t.Errorf("after MultiGet in batches got: %d, %v items accessed want: 2", n, err)
+	}
+}
+
+func TestFieldMapping(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{
+		FieldMapping: mongo.FieldMapping{ETag: "version", Updated: "modifiedAt"},
+	})
+	ctx := context.Background()
+	item := &resource.Item{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	if err := h.Insert(ctx, []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	c := s.DB("").C("test")
+	var doc map[string]interface{}
+	if err := c.FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"_id": "1", "version": "a", "modifiedAt": now, "foo": "bar"}; !reflect.DeepEqual(doc, want) {
+		t.Errorf("got: %v want: %v", doc, want)
+	}
+
+	l, err := h.Find(ctx, &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || !reflect.DeepEqual(l.Items[0], item) {
+		t.Errorf("got: %v want: %v", l.Items, item)
+	}
+
+	update := &resource.Item{ID: "1", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	if err := h.Update(ctx, update, &resource.Item{ID: "1", ETag: "x"}); err != resource.ErrConflict {
+		t.Errorf("got: %v want: %v", err, resource.ErrConflict)
+	}
+	if err := h.Update(ctx, update, item); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := h.PartialUpdate(ctx, update, map[string]interface{}{"foo": "qux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = nil
+	if err := c.FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["version"] != changed.ETag || doc["_etag"] != nil || doc["_updated"] != nil {
+		t.Errorf("got: %v want: version %s and no default meta fields", doc, changed.ETag)
+	}
+	if _, err := h.PartialUpdate(ctx, changed, map[string]interface{}{"version": "c"}); err == nil {
+		t.Error("expected an error when changing the mapped etag field, got nil")
+	}
+	if err := h.Delete(ctx, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items stored without etag get a provisional one.
+	if err := c.Insert(map[string]interface{}{"_id": "2", "foo": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	items, err := h.MultiGet(ctx, []interface{}{"2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ETag != "p-2" {
+		t.Fatalf("got: %v want: an item with etag p-2", items)
+	}
+	if err := h.Delete(ctx, items[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindAlwaysCountTotal(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	items := make([]*resource.Item, 5)
+	for i := range items {
+		id := strconv.Itoa(i + 1)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "odd": i%2 == 0}}
+	}
+	if err := mongo.NewHandler(s, "", "test").Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		predicate string
+		window    query.Window
+		count     int
+		total     int
+	}{
+		{"first page", "", query.Window{Limit: 2}, 2, 5},
+		{"middle page", "", query.Window{Offset: 2, Limit: 2}, 2, 5},
+		{"last page", "", query.Window{Offset: 4, Limit: 2}, 1, 5},
+		{"out of bounds", "", query.Window{Offset: 10, Limit: 2}, 0, 5},
+		{"filtered", "{odd:true}", query.Window{Limit: 2}, 2, 3},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			q := &query.Query{Predicate: query.MustParsePredicate(tc.predicate), Window: &tc.window}
+			for _, always := range []bool{false, true} {
+				h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{AlwaysCountTotal: always})
+				l, err := h.Find(context.Background(), q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				total := tc.total
+				if !always && (tc.count == tc.window.Limit || tc.count == 0) {
+					// Total can't be deduced without counting.
+					total = -1
+				}
+				if len(l.Items) != tc.count || l.Total != total {
+					t.Errorf("AlwaysCountTotal %v: got: %d items, total %d want: %d, %d", always, len(l.Items), l.Total, tc.count, total)
+				}
+			}
+		})
+	}
+}
+
+// proxy forwards connections to the local MongoDB server until stopped.
+type proxy struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+	hold  chan struct{}
+}
+
+func newProxy(t *testing.T) *proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", "127.0.0.1:27017")
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, server)
+			p.mu.Unlock()
+			go io.Copy(server, conn)
+			go p.forward(conn, server)
+		}
+	}()
+	return p
+}
+
+// forward copies the replies of server to conn, holding them while the proxy
+// is paused.
+func (p *proxy) forward(conn, server net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := server.Read(buf)
+		p.mu.Lock()
+		hold := p.hold
+		p.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		if n > 0 {
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pause stops forwarding the replies of the server until the proxy is
+// stopped, leaving the clients waiting on socket reads.
+func (p *proxy) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hold == nil {
+		p.hold = make(chan struct{})
+	}
+}
+
+// stop closes the listener and all the forwarded connections.
+func (p *proxy) stop() {
+	p.ln.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hold != nil {
+		close(p.hold)
+		p.hold = nil
+	}
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func TestConnectionFailure(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	p := newProxy(t)
+	defer p.stop()
+	ps, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:    []string{p.ln.Addr().String()},
+		Direct:   true,
+		FailFast: true,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	h := mongo.NewHandlerWithOptions(ps, s.DB("").Name, "test", mongo.Options{SyncTimeout: time.Second})
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1"}}
+	if err := h.Insert(context.Background(), []*resource.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.stop()
+	retryable := func(op string, err error) {
+		t.Helper()
+		if !errors.Is(err, mongo.ErrTemporary) && !errors.Is(err, mongo.ErrUnavailable) {
+			t.Errorf("%s: got: %v want an error matching ErrTemporary or ErrUnavailable", op, err)
+		} else if errors.Unwrap(err) == nil {
+			t.Errorf("%s: %v does not wrap the mgo error", op, err)
+		}
+	}
+	_, err = h.Find(context.Background(), &query.Query{})
+	retryable("find", err)
+	_, err = h.Count(context.Background(), &query.Query{})
+	retryable("count", err)
+	retryable("insert", h.Insert(context.Background(), []*resource.Item{{ID: "2", Payload: map[string]interface{}{"id": "2"}}}))
+	retryable("update", h.Update(context.Background(), &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1"}}, item))
+	retryable("delete", h.Delete(context.Background(), item))
+	_, err = h.Clear(context.Background(), &query.Query{})
+	retryable("clear", err)
+	_, err = h.MultiGet(context.Background(), []interface{}{"1"})
+	retryable("multi get", err)
+	_, err = h.Upsert(context.Background(), &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1"}}, item)
+	retryable("upsert", err)
+	_, _, err = h.FindOrCreate(context.Background(), &query.Query{}, item)
+	retryable("find or create", err)
+	_, err = h.CompareAndSwap(context.Background(), "1", nil, map[string]interface{}{"foo": "bar"})
+	retryable("compare and swap", err)
+	_, err = h.PartialUpdate(context.Background(), item, map[string]interface{}{"foo": "bar"})
+	retryable("partial update", err)
+	_, err = h.ClearWithProgress(context.Background(), &query.Query{}, 10, func(int) {})
+	retryable("clear with progress", err)
+	_, err = h.ClearDryRun(context.Background(), &query.Query{})
+	retryable("clear dry run", err)
+	bh := mongo.NewHandlerWithOptions(ps, s.DB("").Name, "test", mongo.Options{SyncTimeout: time.Second, BulkInsertSize: 1})
+	retryable("bulk insert", bh.Insert(context.Background(), []*resource.Item{
+		{ID: "2", Payload: map[string]interface{}{"id": "2"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3"}},
+	}))
+	_, err = h.BulkApply(context.Background(),
+		[]*resource.Item{{ID: "2", Payload: map[string]interface{}{"id": "2"}}},
+		[]*resource.Item{{ID: "1", Payload: map[string]interface{}{"id": "1"}}},
+		[]*resource.Item{item})
+	retryable("bulk apply", err)
+
+	// Data errors are not retryable.
+	if err := mongo.NewHandler(s, "", "test").Delete(context.Background(), &resource.Item{ID: "3"}); err != resource.ErrNotFound {
+		t.Errorf("got: %v want: %v", err, resource.ErrNotFound)
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	v, err := h.ServerVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\d+\.\d+\.\d+`).MatchString(v) {
+		t.Errorf("got: %q want: a semver string", v)
+	}
+}
+
+func TestDecimalFields(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{DecimalFields: []string{"ref", "meta.ref"}})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{
+			"id":   "1",
+			"ref":  json.Number("12345678901234567"),
+			"meta": map[string]interface{}{"ref": int64(98765432109876543)},
+		}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["ref"].(bson.Decimal128); !ok {
+		t.Errorf("got stored type: %T want: bson.Decimal128", doc["ref"])
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 {
+		t.Fatalf("got %d items, want 1", len(l.Items))
+	}
+	p := l.Items[0].Payload
+	if p["ref"] != int64(12345678901234567) {
+		t.Errorf("got: %#v want: int64(12345678901234567)", p["ref"])
+	}
+	if ref := p["meta"].(map[string]interface{})["ref"]; ref != int64(98765432109876543) {
+		t.Errorf("got: %#v want: int64(98765432109876543)", ref)
+	}
+}
+
+func TestInsertGeneratedID(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+		{Payload: map[string]interface{}{"foo": "baz"}},
+		{ID: "", Payload: map[string]interface{}{"id": "", "foo": "qux"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	if items[0].ID != "1" {
+		t.Errorf("got: %v want: 1", items[0].ID)
+	}
+	for _, item := range items[1:] {
+		id, ok := item.ID.(bson.ObjectId)
+		if !ok || !id.Valid() {
+			t.Fatalf("got id: %#v want: an ObjectId", item.ID)
+		}
+		if item.Payload["id"] != id {
+			t.Errorf("got payload id: %#v want: %#v", item.Payload["id"], id)
+		}
+		var doc map[string]interface{}
+		if err := s.DB("").C("test").FindId(id).One(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc["foo"] != item.Payload["foo"] {
+			t.Errorf("got: %v want: %v", doc["foo"], item.Payload["foo"])
+		}
+	}
+	if items[1].ID == items[2].ID {
+		t.Error("generated ids are not unique")
+	}
+}
+
+func TestInsertRejectEmptyID(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{EmptyIDs: mongo.RejectEmptyIDs})
+	for _, id := range []interface{}{nil, "", bson.ObjectId("")} {
+		items := []*resource.Item{
+			{ID: "1", Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+			{ID: id, Payload: map[string]interface{}{"id": id, "foo": "baz"}},
+		}
+		err := h.Insert(context.Background(), items)
+		if !errors.Is(err, mongo.ErrEmptyID) {
+			t.Errorf("id %#v: got: %v want: %v", id, err, mongo.ErrEmptyID)
+		}
+		if err == nil || err.Error() != "item #1: mongo: item id must not be empty" {
+			t.Errorf("id %#v: got: %v want: a message naming the item", id, err)
+		}
+	}
+	// No item is inserted when one of them is rejected.
+	assertCollectionIDs(t, s.DB("").C("test"), nil)
+}
+
+func TestNonFinite(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	item := func() *resource.Item {
+		return &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "score": math.NaN(), "n": 1}}
+	}
+
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{NonFinite: mongo.RejectNonFinite})
+	err := h.Insert(context.Background(), []*resource.Item{item()})
+	if err == nil || err.Error() != "score: non-finite number NaN" {
+		t.Errorf("got error: %v want: score: non-finite number NaN", err)
+	}
+	if n, _ := s.DB("").C("test").Count(); n != 0 {
+		t.Errorf("got %d stored items, want 0", n)
+	}
+
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{NonFinite: mongo.NullNonFinite})
+	if err := h.Insert(context.Background(), []*resource.Item{item()}); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if v, found := doc["score"]; !found || v != nil {
+		t.Errorf("got stored score: %#v want: nil", v)
+	}
+}
+
+func TestFindOrCreate(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	if err := s.DB("").C("test").EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	q := &query.Query{Predicate: query.MustParsePredicate(`{key:"k"}`)}
+
+	const n = 10
+	type result struct {
+		item    *resource.Item
+		created bool
+	}
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		go func() {
+			item, created, err := h.FindOrCreate(context.Background(), q, &resource.Item{
+				ID: id, ETag: "e" + id, Updated: now, Payload: map[string]interface{}{"id": id, "key": "k"},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result{item, created}
+		}()
+	}
+	var created []interface{}
+	ids := map[interface{}]bool{}
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.item == nil {
+			continue
+		}
+		if r.created {
+			created = append(created, r.item.ID)
+		}
+		ids[r.item.ID] = true
+	}
+	if len(created) != 1 {
+		t.Fatalf("got %d creations (%v), want 1", len(created), created)
+	}
+	if len(ids) != 1 || !ids[created[0]] {
+		t.Errorf("got items: %v want: only %v", ids, created[0])
+	}
+
+	item, ok, err := h.FindOrCreate(context.Background(), q, &resource.Item{ID: "x", Payload: map[string]interface{}{"id": "x", "key": "k"}})
+	if err != nil || ok || item.ID != created[0] || item.Payload["key"] != "k" {
+		t.Errorf("got: %v, %v, %v want: existing item %v", item, ok, err, created[0])
+	}
+	assertCollectionIDs(t, s.DB("").C("test"), []string{created[0].(string)})
+
+	// Items without id get a new ObjectId, like with Insert.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ServerTimestamps: true})
+	for _, key := range []string{"a", "b"} {
+		item := &resource.Item{Payload: map[string]interface{}{"key": key}}
+		q := &query.Query{Predicate: query.MustParsePredicate(`{key:"` + key + `"}`)}
+		got, ok, err := h.FindOrCreate(context.Background(), q, item)
+		if err != nil || !ok {
+			t.Fatalf("got: %v, %v want: a created item", ok, err)
+		}
+		id, isOID := item.ID.(bson.ObjectId)
+		if !isOID || got.ID != id || item.Payload["id"] != id {
+			t.Errorf("got id: %#v, returned %#v want: a generated ObjectId", item.ID, got.ID)
+		}
+		var doc bson.M
+		if err := s.DB("").C("test").FindId(id).One(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := doc["_created"]; !found {
+			t.Errorf("got: %v want: a _created field", doc)
+		}
+	}
+}
+
+func TestFindRange(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	var items []*resource.Item
+	for _, age := range []int{10, 18, 30, 64, 65, 80} {
+		id := strconv.Itoa(age)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "age": age}})
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{
+			&query.GreaterOrEqual{Field: "age", Value: 18},
+			&query.LowerThan{Field: "age", Value: 65},
+		},
+		Sort: query.Sort{{Name: "age"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{"18", "30", "64"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
+
+func TestFlattenSeparator(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{FlattenSeparator: "__"})
+	payload := func(id string, n int) map[string]interface{} {
+		return map[string]interface{}{
+			"id": id,
+			"a": map[string]interface{}{
+				"b":    n,
+				"list": []interface{}{map[string]interface{}{"c": n}},
+			},
+		}
+	}
+	items := []*resource.Item{
+		{ID: "1", ETag: "e1", Updated: now, Payload: payload("1", 1)},
+		{ID: "2", ETag: "e2", Updated: now, Payload: payload("2", 2)},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := s.DB("").C("test").FindId("1").One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := doc["a"]; found || doc["a__b"] != 1 {
+		t.Errorf("payload not flattened: %v", doc)
+	}
+	if list, ok := doc["a__list"].([]interface{}); !ok || len(list) != 1 {
+		t.Errorf("array not stored as is: %v", doc["a__list"])
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{"a.b":{$gte:2}}`),
+		Sort:      query.Sort{{Name: "a.b", Reversed: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []*resource.Item{{ID: "2", ETag: "e2", Updated: now, Payload: payload("2", 2)}}
+	if !reflect.DeepEqual(l.Items, expect) {
+		t.Errorf("\ngot: %v\nwant: %v", l.Items, expect)
+	}
+}
+
+func TestHandlerConversion(t *testing.T) {
+	errNoCollection := errors.New("no collection")
+	h := mongo.Handler(func(ctx context.Context) (*mgo.Collection, error) {
+		return nil, errNoCollection
+	})
+	var _ resource.Storer = h
+	if _, err := h.Find(context.Background(), &query.Query{}); !errors.Is(err, errNoCollection) {
+		t.Errorf("Find: got error: %v want: %v", err, errNoCollection)
+	}
+	if _, err := h.Count(context.Background(), &query.Query{}); !errors.Is(err, errNoCollection) {
+		t.Errorf("Count: got error: %v want: %v", err, errNoCollection)
+	}
+}
+
+func TestHandlerClose(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	// The replies of the server are held by the proxy, so the Find is surely
+	// waiting on a socket read when the handler is closed.
+	p := newProxy(t)
+	defer p.stop()
+	ps, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:   []string{p.ln.Addr().String()},
+		Direct:  true,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	h := mongo.NewHandlerWithOptions(ps, s.DB("").Name, "test", mongo.Options{})
+	items := []*resource.Item{{ID: "1", Payload: map[string]interface{}{"id": "1"}}}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	p.pause()
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.Find(context.Background(), &query.Query{})
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Find returned before Close: %v", err)
+	default:
+	}
+	// Closing a copy of the handler closes them all.
+	h2 := h
+	h2.Close()
+	h2.Close()
+	// The sockets of the Find are closed with the last copy of the session.
+	ps.Close()
+	select {
+	case err := <-done:
+		if err != mongo.ErrHandlerClosed {
+			t.Errorf("got: %v want: %v", err, mongo.ErrHandlerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Find did not return after Close")
+	}
+
+	if _, err := h.Find(context.Background(), &query.Query{}); err != mongo.ErrHandlerClosed {
+		t.Errorf("got: %v want: %v", err, mongo.ErrHandlerClosed)
+	}
+}
+
+func TestFindElemMatchCount(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	comments := func(users ...string) []interface{} {
+		c := []interface{}{}
+		for _, u := range users {
+			c = append(c, map[string]interface{}{"user": u})
+		}
+		return c
+	}
+	items := []*resource.Item{
+		{ID: "0", Payload: map[string]interface{}{"id": "0"}},
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "comments": comments("x", "y")}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "comments": comments("x", "y", "x")}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "comments": comments("x", "x", "x")}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "comments": comments("y", "y", "y")}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	for min, expect := range map[int][]interface{}{
+		0: {"0", "1", "2", "3", "4"},
+		1: {"1", "2", "3"},
+		2: {"2", "3"},
+		3: {"3"},
+		4: nil,
+	} {
+		l, err := h.Find(context.Background(), &query.Query{
+			Predicate: query.Predicate{&mongo.ElemMatchCount{
+				Field: "comments",
+				Exps:  []query.Expression{&query.Equal{Field: "user", Value: "x"}},
+				Min:   min,
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.ID)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("min %d: got: %v want: %v", min, got, expect)
+		}
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1"}},
+		{ID: "2", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "2"}},
+	}
+	if err := mongo.NewHandler(s, "", "test").Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	ids := []interface{}{"2", "x", "1", "2", "y", "x"}
+
+	t.Run("omit", func(t *testing.T) {
+		h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+		got, err := h.MultiGet(context.Background(), ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := []*resource.Item{items[1], items[0], items[1]}; !reflect.DeepEqual(got, expect) {
+			t.Errorf("\ngot: %v\nwant: %v", got, expect)
+		}
+	})
+	t.Run("nil", func(t *testing.T) {
+		h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{MissingIDs: mongo.NilMissing})
+		got, err := h.MultiGet(context.Background(), ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := []*resource.Item{items[1], nil, items[0], items[1], nil, nil}; !reflect.DeepEqual(got, expect) {
+			t.Errorf("\ngot: %v\nwant: %v", got, expect)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{MissingIDs: mongo.ErrorMissing})
+		_, err := h.MultiGet(context.Background(), ids)
+		merr, ok := err.(*mongo.MissingIDsError)
+		if !ok {
+			t.Fatalf("got: %#v want: *mongo.MissingIDsError", err)
+		}
+		if expect := []interface{}{"x", "y"}; !reflect.DeepEqual(merr.IDs, expect) {
+			t.Errorf("got: %v want: %v", merr.IDs, expect)
+		}
+		if !errors.Is(err, resource.ErrNotFound) {
+			t.Error("error does not match resource.ErrNotFound")
+		}
+		got, err := h.MultiGet(context.Background(), []interface{}{"1", "1"})
+		if err != nil || len(got) != 2 {
+			t.Errorf("got: %v, %v want: 2 items", got, err)
+		}
+	})
+}
+
+func TestMultiGetBatches(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	const n = 2500
+	items := make([]*resource.Item, n)
+	for i := range items {
+		id := strconv.Itoa(i)
+		items[i] = &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{"id": id}}
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	// More ids than the default batch size, in reverse order, with a missing
+	// one and repeated ones spanning several batches.
+	var ids []interface{}
+	for i := n - 1; i >= 0; i-- {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	ids = append(ids, "missing", "0", strconv.Itoa(n-1))
+	got, err := h.MultiGet(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n+2 {
+		t.Fatalf("got: %d items want: %d", len(got), n+2)
+	}
+	for i, item := range got[:n] {
+		if want := strconv.Itoa(n - 1 - i); item.ID != want {
+			t.Fatalf("item #%d: got: id %v want: %v", i, item.ID, want)
+		}
+	}
+	if got[n].ID != "0" || got[n+1].ID != strconv.Itoa(n-1) {
+		t.Errorf("got: %v, %v want: the repeated items", got[n], got[n+1])
+	}
+}
+
+func TestFindNumberRegex(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "phone": 5551234}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "phone": int64(4155551234)}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "phone": float64(5559876)}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{&mongo.NumberRegex{Field: "phone", Value: regexp.MustCompile("^555")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{"1", "3"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
+
+func TestFindDateDiff(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{DateFields: []string{"createdAt", "resolvedAt"}})
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	ticket := func(id string, resolvedAfter time.Duration) *resource.Item {
+		p := map[string]interface{}{"id": id, "createdAt": "2023-01-01T00:00:00Z"}
+		if resolvedAfter > 0 {
+			p["resolvedAt"] = created.Add(resolvedAfter)
+		}
+		return &resource.Item{ID: id, Payload: p}
+	}
+	items := []*resource.Item{
+		ticket("1", 2*time.Hour),
+		ticket("2", 30*time.Hour),
+		ticket("3", 24*time.Hour),
+		ticket("4", 0),
+		ticket("5", 72*time.Hour),
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{&mongo.DateDiff{From: "createdAt", To: "resolvedAt", Min: 24 * time.Hour}},
+		Sort:      query.MustParseSort("id"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{"2", "5"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tags": []interface{}{"a", "b", "c"}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tags": []interface{}{"b", "a"}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tags": []interface{}{"a"}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "tags": "a"}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	ids := func(values ...query.Value) []interface{} {
+		l, err := h.Find(context.Background(), &query.Query{
+			Predicate: query.Predicate{&mongo.All{Field: "tags", Values: values}},
+			Sort:      query.MustParseSort("id"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, item := range l.Items {
+			got = append(got, item.ID)
+		}
+		return got
+	}
+	if got, want := ids("a", "b"), []interface{}{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+	if got, want := ids("a"), []interface{}{"1", "2", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+}
+
+func TestFindDateBetween(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{DateFields: []string{"createdAt"}})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "createdAt": "2022-12-31T23:59:59Z"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "createdAt": "2023-01-01T00:00:00Z"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "createdAt": "2023-01-15T12:00:00Z"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "createdAt": "2023-01-31T23:59:59Z"}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "createdAt": "2023-02-01T00:00:00Z"}},
+		{ID: "6", Payload: map[string]interface{}{"id": "6"}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{
+			&mongo.DateBetween{
+				Field: "createdAt",
+				Start: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2023, 1, 31, 23, 59, 59, 0, time.UTC),
+			},
+			&query.NotEqual{Field: "id", Value: "3"},
+		},
+		Sort: query.MustParseSort("id"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if expect := []interface{}{"2", "4"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got: %v want: %v", got, expect)
+	}
+}
+
+func TestFindUpdatedAfter(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandler(s, "", "test")
+	updated := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	items := []*resource.Item{
+		{ID: "1", Updated: updated, Payload: map[string]interface{}{"id": "1", "lastCheck": updated.Add(-2 * time.Hour)}},
+		{ID: "2", Updated: updated, Payload: map[string]interface{}{"id": "2", "lastCheck": updated.Add(-30 * time.Minute)}},
+		{ID: "3", Updated: updated, Payload: map[string]interface{}{"id": "3", "lastCheck": updated.Add(time.Hour)}},
+		{ID: "4", Updated: updated, Payload: map[string]interface{}{"id": "4"}},
+		{ID: "5", Updated: updated, Payload: map[string]interface{}{"id": "5", "lastCheck": updated.Add(-time.Hour)}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.Find(context.Background(), &query.Query{
+		Predicate: query.Predicate{mongo.UpdatedAfter("lastCheck", time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, item := range l.Items {
+		got = append(got, item.ID)
+	}
+	if want := []interface{}{"1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v want: %v", got, want)
+	}
+}
+
+func TestFindCollScan(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	if err := s.DB("").C("test").EnsureIndex(mgo.Index{Key: []string{"name"}}); err != nil {
+		t.Fatal(err)
+	}
+	var scans []string
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{
+		OnCollScan: func(q *query.Query) { scans = append(scans, q.Predicate.String()) },
+	})
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a", "age": 1}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b", "age": 2}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items are sorted by name so the name index is the only sensible plan
+	// for a query on name.
+	sort := query.MustParseSort("name")
+	for _, p := range []string{`{name:"a"}`, `{age:1}`} {
+		l, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(p), Sort: sort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Items) != 1 {
+			t.Errorf("%s: got %d items, want 1", p, len(l.Items))
+		}
+	}
+	if expect := []string{query.MustParsePredicate(`{age:1}`).String()}; !reflect.DeepEqual(scans, expect) {
+		t.Errorf("got scans: %v want: %v", scans, expect)
+	}
+
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{FailOnCollScan: true})
+	if _, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{age:1}`), Sort: sort}); err != mongo.ErrCollScan {
+		t.Errorf("got: %v want: %v", err, mongo.ErrCollScan)
+	}
+	if _, err := h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{name:"a"}`), Sort: sort}); err != nil {
+		t.Errorf("unexpected error on indexed query: %v", err)
+	}
+}
+
+func TestClearWithProgress(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	var items []*resource.Item
+	for i := 0; i < 25; i++ {
+		id := fmt.Sprintf("%02d", i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i % 5}})
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []int
+	n, err := h.ClearWithProgress(context.Background(), &query.Query{
+		Predicate: query.MustParsePredicate(`{n:{$gt:0}}`),
+	}, 6, func(deleted int) {
+		calls = append(calls, deleted)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Errorf("got: %d want: 20", n)
+	}
+	if expect := []int{6, 12, 18, 20}; !reflect.DeepEqual(calls, expect) {
+		t.Errorf("got progress: %v want: %v", calls, expect)
+	}
+	assertCollectionIDs(t, s.DB("").C("test"), []string{"00", "05", "10", "15", "20"})
+
+	// Windows are removed in batches as well.
+	calls = nil
+	n, err = h.ClearWithProgress(context.Background(), &query.Query{
+		Window: &query.Window{Offset: 1, Limit: 3},
+	}, 2, func(deleted int) {
+		calls = append(calls, deleted)
+	})
+	if err != nil || n != 3 {
+		t.Errorf("got: %d, %v want: 3, nil", n, err)
+	}
+	if expect := []int{2, 3}; !reflect.DeepEqual(calls, expect) {
+		t.Errorf("got progress: %v want: %v", calls, expect)
+	}
+	assertCollectionIDs(t, s.DB("").C("test"), []string{"00", "20"})
+
+	// Cancelling stops after the current batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err = h.ClearWithProgress(ctx, &query.Query{}, 2, func(int) { cancel() })
+	if err != context.Canceled || n != 2 {
+		t.Errorf("got: %d, %v want: 2, %v", n, err, context.Canceled)
+	}
+}
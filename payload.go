@@ -0,0 +1,313 @@
+package mongo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// getPath returns the value of the field at the dotted path in p.
+func getPath(p map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		sub, ok := p[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		p = sub
+	}
+	v, found := p[keys[len(keys)-1]]
+	return v, found
+}
+
+// setPath sets the value of the field at the dotted path in p. Parent maps are
+// copied so the maps p was built from are left untouched, and created if
+// missing.
+func setPath(p map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		sub, _ := p[k].(map[string]interface{})
+		cp := make(map[string]interface{}, len(sub))
+		for sk, sv := range sub {
+			cp[sk] = sv
+		}
+		p[k] = cp
+		p = cp
+	}
+	p[keys[len(keys)-1]] = v
+}
+
+// deletePath removes the field at the dotted path in p, if any.
+func deletePath(p map[string]interface{}, path string) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		sub, ok := p[k].(map[string]interface{})
+		if !ok {
+			return
+		}
+		p = sub
+	}
+	delete(p, keys[len(keys)-1])
+}
+
+// coerceDate converts the ISO 8601 string stored at path in p into a time.Time.
+func coerceDate(p map[string]interface{}, path string) error {
+	v, found := getPath(p, path)
+	if !found || v == nil {
+		return nil
+	}
+	t, err := parseTime(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if _, ok := v.(string); ok {
+		setPath(p, path, t)
+	}
+	return nil
+}
+
+// coerceBool converts the boolean stored at path in p into a 0 or 1 integer.
+func coerceBool(p map[string]interface{}, path string) {
+	v, _ := getPath(p, path)
+	if b, ok := v.(bool); ok {
+		setPath(p, path, boolInt(b))
+	}
+}
+
+// decodeBool converts back the integer stored at path in p by coerceBool into
+// a boolean.
+func decodeBool(p map[string]interface{}, path string) {
+	v, _ := getPath(p, path)
+	switch t := v.(type) {
+	case int:
+		setPath(p, path, t != 0)
+	case int64:
+		setPath(p, path, t != 0)
+	case float64:
+		setPath(p, path, t != 0)
+	}
+}
+
+// boolInt returns 1 if b is true, or 0 otherwise.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// replaceNonFinite replaces the NaN and infinite float values found in p, at
+// any depth, by nil, or returns an error naming the first one found if reject
+// is true. Sub-documents and arrays are copied so the ones p was built from are
+// left untouched.
+func replaceNonFinite(p map[string]interface{}, reject bool) error {
+	for k, v := range p {
+		nv, changed, err := nonFinite(k, v, reject)
+		if err != nil {
+			return err
+		}
+		if changed {
+			p[k] = nv
+		}
+	}
+	return nil
+}
+
+// nonFinite returns v with its non-finite float values replaced by nil, and
+// whether any has been replaced.
+func nonFinite(path string, v interface{}, reject bool) (interface{}, bool, error) {
+	var f float64
+	switch t := v.(type) {
+	case float64:
+		f = t
+	case float32:
+		f = float64(t)
+	case map[string]interface{}:
+		var cp map[string]interface{}
+		for k, sv := range t {
+			nv, changed, err := nonFinite(path+"."+k, sv, reject)
+			if err != nil {
+				return nil, false, err
+			}
+			if changed {
+				if cp == nil {
+					cp = make(map[string]interface{}, len(t))
+					for ck, cv := range t {
+						cp[ck] = cv
+					}
+				}
+				cp[k] = nv
+			}
+		}
+		if cp == nil {
+			return v, false, nil
+		}
+		return cp, true, nil
+	case []interface{}:
+		var cp []interface{}
+		for i, sv := range t {
+			nv, changed, err := nonFinite(fmt.Sprintf("%s.%d", path, i), sv, reject)
+			if err != nil {
+				return nil, false, err
+			}
+			if changed {
+				if cp == nil {
+					cp = append([]interface{}{}, t...)
+				}
+				cp[i] = nv
+			}
+		}
+		if cp == nil {
+			return v, false, nil
+		}
+		return cp, true, nil
+	case []float64:
+		for _, sf := range t {
+			if math.IsNaN(sf) || math.IsInf(sf, 0) {
+				// Use a []interface{} so the values can be replaced by nil
+				a := make([]interface{}, len(t))
+				for i, sf := range t {
+					a[i] = sf
+				}
+				return nonFinite(path, a, reject)
+			}
+		}
+		return v, false, nil
+	default:
+		return v, false, nil
+	}
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return v, false, nil
+	}
+	if reject {
+		return nil, false, fmt.Errorf("%s: non-finite number %v", path, f)
+	}
+	return nil, true, nil
+}
+
+// checkDepth returns an error naming the first value found in p nested deeper
+// than max levels. Top-level fields are at depth 1, and each sub-document or
+// array adds a level, so elements of arrays of sub-documents count twice.
+// Keys given as dotted paths, like in PartialUpdate changes, are at the depth
+// of their last segment.
+func checkDepth(p map[string]interface{}, max int) error {
+	for k, v := range p {
+		if err := valueDepth(k, v, strings.Count(k, ".")+1, max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueDepth checks the depth of v, found at path and depth.
+func valueDepth(path string, v interface{}, depth, max int) error {
+	if depth > max {
+		return fmt.Errorf("%s: payload exceeds the maximum depth of %d", path, max)
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, sv := range t {
+			if err := valueDepth(path+"."+k, sv, depth+1, max); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, sv := range t {
+			if err := valueDepth(fmt.Sprintf("%s.%d", path, i), sv, depth+1, max); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// coerceDecimal converts the number stored at path in p into a
+// bson.Decimal128.
+func coerceDecimal(p map[string]interface{}, path string) error {
+	v, found := getPath(p, path)
+	if !found || v == nil {
+		return nil
+	}
+	var s string
+	switch t := v.(type) {
+	case bson.Decimal128:
+		return nil
+	case json.Number:
+		s = t.String()
+	case string:
+		s = t
+	case float64:
+		s = strconv.FormatFloat(t, 'g', -1, 64)
+	case float32:
+		s = strconv.FormatFloat(float64(t), 'g', -1, 32)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s = fmt.Sprint(t)
+	default:
+		return fmt.Errorf("%s: not a number: %v", path, v)
+	}
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		return fmt.Errorf("%s: not a number: %q", path, s)
+	}
+	setPath(p, path, d)
+	return nil
+}
+
+// decodeDecimal converts the bson.Decimal128 stored at path in p back into an
+// int64 if it holds an integer, or a json.Number otherwise.
+func decodeDecimal(p map[string]interface{}, path string) {
+	v, _ := getPath(p, path)
+	d, ok := v.(bson.Decimal128)
+	if !ok {
+		return
+	}
+	s := d.String()
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		setPath(p, path, n)
+		return
+	}
+	setPath(p, path, json.Number(s))
+}
+
+// flatten returns a copy of p in which nested objects are replaced by keys
+// joining the path of their fields with sep. Arrays, including arrays of
+// objects, and empty objects are kept as is.
+func flatten(p map[string]interface{}, sep string) map[string]interface{} {
+	r := make(map[string]interface{}, len(p))
+	flattenInto(r, "", p, sep)
+	return r
+}
+
+func flattenInto(r map[string]interface{}, prefix string, p map[string]interface{}, sep string) {
+	for k, v := range p {
+		if sub, ok := v.(map[string]interface{}); ok && len(sub) > 0 {
+			flattenInto(r, prefix+k+sep, sub, sep)
+			continue
+		}
+		r[prefix+k] = v
+	}
+}
+
+// unflatten reverses flatten, rebuilding nested objects from the keys of p
+// joined with sep.
+func unflatten(p map[string]interface{}, sep string) map[string]interface{} {
+	r := make(map[string]interface{}, len(p))
+	for k, v := range p {
+		keys := strings.Split(k, sep)
+		cur := r
+		for _, sk := range keys[:len(keys)-1] {
+			sub, ok := cur[sk].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				cur[sk] = sub
+			}
+			cur = sub
+		}
+		cur[keys[len(keys)-1]] = v
+	}
+	return r
+}
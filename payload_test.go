@@ -0,0 +1,196 @@
+package mongo
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCoerceDate(t *testing.T) {
+	orig := map[string]interface{}{
+		"at":   "2023-01-01T10:00:00+02:00",
+		"meta": map[string]interface{}{"at": "2023-01-02"},
+		"none": nil,
+	}
+	p := map[string]interface{}{}
+	for k, v := range orig {
+		p[k] = v
+	}
+	for _, f := range []string{"at", "meta.at", "none", "missing"} {
+		if err := coerceDate(p, f); err != nil {
+			t.Fatalf("coerceDate(%s) error: %v", f, err)
+		}
+	}
+	expect := map[string]interface{}{
+		"at":   time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC),
+		"meta": map[string]interface{}{"at": time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		"none": nil,
+	}
+	// Normalize the location of the parsed time for comparison.
+	p["at"] = p["at"].(time.Time).UTC()
+	if !reflect.DeepEqual(p, expect) {
+		t.Errorf("got: %v want: %v", p, expect)
+	}
+	if _, ok := orig["meta"].(map[string]interface{})["at"].(string); !ok {
+		t.Error("coerceDate modified the original sub-document")
+	}
+	if err := coerceDate(map[string]interface{}{"at": "tomorrow"}, "at"); err == nil {
+		t.Error("expected an error for an invalid date, got nil")
+	}
+}
+
+func TestDecimalRoundTrip(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want interface{}
+	}{
+		{json.Number("12345678901234567"), int64(12345678901234567)},
+		{int64(-12345678901234567), int64(-12345678901234567)},
+		{"12345678901234567", int64(12345678901234567)},
+		{1.5, json.Number("1.5")},
+		{json.Number("123456789012345678901234567890"), json.Number("123456789012345678901234567890")},
+	}
+	for _, tc := range cases {
+		p := map[string]interface{}{"n": tc.in}
+		if err := coerceDecimal(p, "n"); err != nil {
+			t.Fatalf("coerceDecimal(%v) error: %v", tc.in, err)
+		}
+		if _, ok := p["n"].(bson.Decimal128); !ok {
+			t.Errorf("coerceDecimal(%v): got: %T want: bson.Decimal128", tc.in, p["n"])
+		}
+		decodeDecimal(p, "n")
+		if !reflect.DeepEqual(p["n"], tc.want) {
+			t.Errorf("round trip of %#v: got: %#v want: %#v", tc.in, p["n"], tc.want)
+		}
+	}
+	if err := coerceDecimal(map[string]interface{}{"n": "abc"}, "n"); err == nil {
+		t.Error("expected an error for an invalid number, got nil")
+	}
+}
+
+func TestBoolRoundTrip(t *testing.T) {
+	for _, b := range []bool{true, false} {
+		p := map[string]interface{}{"meta": map[string]interface{}{"public": b}}
+		coerceBool(p, "meta.public")
+		if got, want := p["meta"].(map[string]interface{})["public"], boolInt(b); got != want {
+			t.Errorf("coerceBool(%v): got: %#v want: %#v", b, got, want)
+		}
+		decodeBool(p, "meta.public")
+		if got := p["meta"].(map[string]interface{})["public"]; got != b {
+			t.Errorf("round trip of %v: got: %#v", b, got)
+		}
+	}
+	p := map[string]interface{}{"public": "yes"}
+	coerceBool(p, "public")
+	decodeBool(p, "public")
+	if p["public"] != "yes" {
+		t.Errorf("non boolean value changed: got: %#v", p["public"])
+	}
+}
+
+func TestReplaceNonFinite(t *testing.T) {
+	orig := map[string]interface{}{
+		"a":    math.NaN(),
+		"ok":   1.5,
+		"meta": map[string]interface{}{"b": math.Inf(1), "c": "x"},
+		"list": []interface{}{1, math.Inf(-1)},
+		"vec":  []float64{1, math.NaN()},
+	}
+	p := map[string]interface{}{}
+	for k, v := range orig {
+		p[k] = v
+	}
+	if err := replaceNonFinite(p, false); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{
+		"a":    nil,
+		"ok":   1.5,
+		"meta": map[string]interface{}{"b": nil, "c": "x"},
+		"list": []interface{}{1, nil},
+		"vec":  []interface{}{1.0, nil},
+	}
+	if !reflect.DeepEqual(p, expect) {
+		t.Errorf("got: %v want: %v", p, expect)
+	}
+	if orig["meta"].(map[string]interface{})["b"] == nil || orig["list"].([]interface{})[1] == nil {
+		t.Error("replaceNonFinite modified the original values")
+	}
+
+	err := replaceNonFinite(map[string]interface{}{"meta": map[string]interface{}{"b": math.Inf(1)}}, true)
+	if err == nil || err.Error() != "meta.b: non-finite number +Inf" {
+		t.Errorf("got error: %v want: meta.b: non-finite number +Inf", err)
+	}
+	if err := replaceNonFinite(map[string]interface{}{"ok": 1.5}, true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	m := OptionsHandler{opts: Options{MaxDepth: 3}}
+	cases := []struct {
+		name    string
+		payload map[string]interface{}
+		err     string
+	}{
+		{"flat", map[string]interface{}{"a": 1}, ""},
+		{"sub-documents", map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}}}, ""},
+		{"too deep", map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{"d": 1}}}}, "a.b.c.d: payload exceeds the maximum depth of 3"},
+		{"array of values", map[string]interface{}{"a": []interface{}{[]interface{}{1}}}, ""},
+		{"array of documents", map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": 1}}}, ""},
+		{"array of deep documents", map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": []interface{}{1}}}}, "a.0.b.0: payload exceeds the maximum depth of 3"},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := m.newMongoItem(&resource.Item{ID: "1", Payload: tc.payload})
+			if tc.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("got error: %v want: %s", err, tc.err)
+			}
+		})
+	}
+
+	_, err := m.changesDoc(map[string]interface{}{"a.b": map[string]interface{}{"c": 1}})
+	if err != nil {
+		t.Errorf("changes: unexpected error: %v", err)
+	}
+	_, err = m.changesDoc(map[string]interface{}{"a.b": map[string]interface{}{"c": map[string]interface{}{"d": 1}}})
+	if want := "a.b.c.d: payload exceeds the maximum depth of 3"; err == nil || err.Error() != want {
+		t.Errorf("changes: got error: %v want: %s", err, want)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	p := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": 1,
+			"c": map[string]interface{}{"d": "x"},
+			"e": []interface{}{map[string]interface{}{"f": 1}, 2},
+		},
+		"g":     map[string]interface{}{},
+		"h":     nil,
+		"array": []interface{}{"a", "b"},
+	}
+	flat := flatten(p, "__")
+	expect := map[string]interface{}{
+		"a__b":    1,
+		"a__c__d": "x",
+		"a__e":    []interface{}{map[string]interface{}{"f": 1}, 2},
+		"g":       map[string]interface{}{},
+		"h":       nil,
+		"array":   []interface{}{"a", "b"},
+	}
+	if !reflect.DeepEqual(flat, expect) {
+		t.Errorf("flatten:\ngot:  %v\nwant: %v", flat, expect)
+	}
+	if got := unflatten(flat, "__"); !reflect.DeepEqual(got, p) {
+		t.Errorf("unflatten:\ngot:  %v\nwant: %v", got, p)
+	}
+}
@@ -0,0 +1,103 @@
+package mongo
+
+import (
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// defaultPoolTimeout is the socket and sync timeout of pooled sessions when
+// neither the options nor the context define one, as for sessions created by
+// mgo.Dial.
+const defaultPoolTimeout = time.Minute
+
+// sessionPool holds long-lived copies of the session of a handler, checked
+// out by its operations instead of copying the session each time, which
+// saves allocations. Sessions are refreshed when returned, so each operation
+// acquires a socket from the mgo pool as with a fresh copy.
+type sessionPool struct {
+	size int
+
+	mu     sync.Mutex
+	idle   []*mgo.Session
+	owned  map[*mgo.Session]bool
+	closed bool
+}
+
+func newSessionPool(size int) *sessionPool {
+	if size <= 0 {
+		return nil
+	}
+	return &sessionPool{
+		size:  size,
+		idle:  make([]*mgo.Session, 0, size),
+		owned: make(map[*mgo.Session]bool, size),
+	}
+}
+
+// get checks out an idle session, or a new copy of base in mode (unless
+// mgo.Eventual) if all the sessions of the pool are in use and the pool is
+// not full. It returns nil if the pool is nil, full or closed, in which case
+// the caller should copy base itself.
+func (p *sessionPool) get(base *mgo.Session, mode mgo.Mode) *mgo.Session {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	if n := len(p.idle); n > 0 {
+		s := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return s
+	}
+	if len(p.owned) == p.size {
+		return nil
+	}
+	s := base.Copy()
+	if mode != mgo.Eventual {
+		s.SetMode(mode, true)
+	}
+	p.owned[s] = true
+	return s
+}
+
+// put returns s to the pool if it was checked out from it, and tells if it
+// did. Sessions returned to a closed pool are closed.
+func (p *sessionPool) put(s *mgo.Session) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.owned[s] {
+		return false
+	}
+	if p.closed {
+		delete(p.owned, s)
+		s.Close()
+		return true
+	}
+	// Release the socket, which may have been broken by a network failure.
+	s.Refresh()
+	p.idle = append(p.idle, s)
+	return true
+}
+
+// close closes the idle sessions of the pool, and the others once returned.
+func (p *sessionPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, s := range p.idle {
+		delete(p.owned, s)
+		s.Close()
+	}
+	p.idle = nil
+}
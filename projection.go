@@ -0,0 +1,216 @@
+package mongo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Projection describes the fields MongoDB should return for matching
+// documents. Include and Exclude list the payload fields to respectively keep
+// or drop, and Slice limits the number of array elements returned for some
+// fields. Size maps computed fields to the array field they hold the length
+// of; the array itself is not returned unless explicitly included.
+//
+// MongoDB does not allow inclusion and exclusion to be mixed in the same
+// projection, but a $slice or $size may be combined with either of them. An
+// empty Projection returns documents in their entirety.
+type Projection struct {
+	Include []string
+	Exclude []string
+	Slice   map[string]Slice
+	Size    map[string]string
+}
+
+// Slice defines a $slice projection on an array field. When Skip is zero, the
+// first Limit elements are returned, or the last -Limit elements if Limit is
+// negative. When Skip is set, Limit elements are returned after skipping Skip
+// elements (a negative Skip counts from the end of the array).
+type Slice struct {
+	Skip  int
+	Limit int
+}
+
+// value returns the $slice argument for s.
+func (s Slice) value() interface{} {
+	if s.Skip == 0 {
+		return s.Limit
+	}
+	return []int{s.Skip, s.Limit}
+}
+
+// getSelect transforms a Projection into a Mongo select document. The meta
+// fields needed to rebuild a resource.Item are always part of the result.
+func getSelect(p Projection) (bson.M, error) {
+	if len(p.Include) > 0 && len(p.Exclude) > 0 {
+		return nil, fmt.Errorf("invalid projection: cannot mix field inclusion (%s) and exclusion (%s)",
+			strings.Join(p.Include, ","), strings.Join(p.Exclude, ","))
+	}
+	sel := bson.M{}
+	fields := make([]string, 0, len(p.Include)+len(p.Exclude)+len(p.Slice))
+	add := func(f string, v interface{}) error {
+		if f == "id" {
+			return fmt.Errorf("invalid projection: %s: id is always returned", f)
+		}
+		if _, found := sel[f]; found {
+			return fmt.Errorf("invalid projection: %s: field is projected more than once", f)
+		}
+		sel[f] = v
+		fields = append(fields, f)
+		return nil
+	}
+	for _, f := range p.Include {
+		if err := add(f, 1); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range p.Exclude {
+		if err := add(f, 0); err != nil {
+			return nil, err
+		}
+	}
+	for f, s := range p.Slice {
+		if s.Skip != 0 && s.Limit <= 0 {
+			return nil, fmt.Errorf("invalid projection: %s: $slice limit must be positive when skip is set", f)
+		}
+		if err := add(f, bson.M{"$slice": s.value()}); err != nil {
+			return nil, err
+		}
+	}
+	for f, array := range p.Size {
+		if array == "" {
+			return nil, fmt.Errorf("invalid projection: %s: $size requires an array field", f)
+		}
+		if err := add(f, bson.M{"$size": bson.M{"$ifNull": []interface{}{"$" + array, []interface{}{}}}}); err != nil {
+			return nil, err
+		}
+	}
+	// MongoDB rejects projections where a field and one of its sub-fields are
+	// both projected.
+	sort.Strings(fields)
+	for i := 1; i < len(fields); i++ {
+		if strings.HasPrefix(fields[i], fields[i-1]+".") {
+			return nil, fmt.Errorf("invalid projection: %s: path collides with %s", fields[i], fields[i-1])
+		}
+	}
+	if len(p.Include) > 0 {
+		sel["_etag"] = 1
+		sel["_updated"] = 1
+	}
+	return sel, nil
+}
+
+// getProjectStages transforms a Projection into aggregation stages. It is
+// needed when the projection holds fields computed by $size, which can't be
+// expressed in a find projection.
+func getProjectStages(p Projection) ([]bson.M, error) {
+	sel, err := getSelect(p)
+	if err != nil {
+		return nil, err
+	}
+	computed := bson.M{}
+	for f, s := range p.Slice {
+		// The aggregation $slice operator takes the array as first argument.
+		if s.Skip == 0 {
+			computed[f] = bson.M{"$slice": []interface{}{"$" + f, s.Limit}}
+		} else {
+			computed[f] = bson.M{"$slice": []interface{}{"$" + f, s.Skip, s.Limit}}
+		}
+	}
+	for f := range p.Size {
+		computed[f] = sel[f]
+	}
+	inclusion := len(p.Include) > 0
+	for f := range computed {
+		if inclusion {
+			sel[f] = 1
+		} else {
+			delete(sel, f)
+		}
+	}
+	if !inclusion {
+		for _, array := range p.Size {
+			if _, found := computed[array]; !found {
+				sel[array] = 0
+			}
+		}
+	}
+	stages := []bson.M{{"$addFields": computed}}
+	if len(sel) > 0 {
+		stages = append(stages, bson.M{"$project": sel})
+	}
+	return stages, nil
+}
+
+// pushdownProjection transforms a rest-layer projection into a Projection
+// including the stored fields it needs. Children of objects known by fg are
+// mapped to dotted paths; other fields with children, e.g. references, are
+// included as a whole, as the children may belong to another resource.
+// Aliases and params are applied by rest-layer on the returned payload. An
+// empty Projection is returned when all fields are needed.
+func pushdownProjection(p query.Projection, fg schema.FieldGetter) Projection {
+	fields := projectionPaths(p, "", fg)
+	if len(fields) == 0 {
+		return Projection{}
+	}
+	// Keep only the outermost of the paths colliding with each other, which
+	// also removes fields projected more than once under different aliases.
+	sort.Strings(fields)
+	include := fields[:1]
+	for _, f := range fields[1:] {
+		last := include[len(include)-1]
+		if f != last && !strings.HasPrefix(f, last+".") {
+			include = append(include, f)
+		}
+	}
+	return Projection{Include: include}
+}
+
+// projectionPaths returns the paths of the fields of p prefixed by prefix, or
+// nil if p selects all the fields.
+func projectionPaths(p query.Projection, prefix string, fg schema.FieldGetter) []string {
+	paths := make([]string, 0, len(p))
+	for _, pf := range p {
+		if pf.Name == "*" {
+			return nil
+		}
+		path := prefix + pf.Name
+		if pf.Name == "id" && prefix == "" {
+			// _id is always returned.
+			continue
+		}
+		if len(pf.Children) == 0 || !isObjectField(fg, path) {
+			paths = append(paths, path)
+			continue
+		}
+		children := projectionPaths(pf.Children, path+".", fg)
+		if len(children) == 0 {
+			paths = append(paths, path)
+			continue
+		}
+		paths = append(paths, children...)
+	}
+	return paths
+}
+
+// isObjectField tells if the field at path holds a sub-document whose fields
+// may be projected individually. Without fg, the field may be a reference,
+// whose children are fields of another resource, so none is assumed to.
+func isObjectField(fg schema.FieldGetter, path string) bool {
+	if fg == nil {
+		return false
+	}
+	f := fg.GetField(path)
+	if f == nil {
+		return false
+	}
+	if f.Schema != nil {
+		return true
+	}
+	_, ok := f.Validator.(*schema.Object)
+	return ok
+}
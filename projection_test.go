@@ -0,0 +1,216 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGetSelect(t *testing.T) {
+	cases := []struct {
+		name       string
+		projection Projection
+		want       bson.M
+	}{
+		{
+			name:       "empty",
+			projection: Projection{},
+			want:       bson.M{},
+		},
+		{
+			name:       "inclusion",
+			projection: Projection{Include: []string{"title", "meta.author"}},
+			want:       bson.M{"title": 1, "meta.author": 1, "_etag": 1, "_updated": 1},
+		},
+		{
+			name: "slice with exclusion",
+			projection: Projection{
+				Exclude: []string{"raw"},
+				Slice:   map[string]Slice{"comments": {Limit: 3}},
+			},
+			want: bson.M{"raw": 0, "comments": bson.M{"$slice": 3}},
+		},
+		{
+			name: "slice with inclusion",
+			projection: Projection{
+				Include: []string{"title"},
+				Slice:   map[string]Slice{"comments": {Skip: -5, Limit: 2}},
+			},
+			want: bson.M{"title": 1, "comments": bson.M{"$slice": []int{-5, 2}}, "_etag": 1, "_updated": 1},
+		},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getSelect(tc.projection)
+			if err != nil {
+				t.Fatalf("getSelect error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("getSelect:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetSelectInvalid(t *testing.T) {
+	cases := []struct {
+		name       string
+		projection Projection
+		want       string
+	}{
+		{
+			name: "inclusion with exclusion",
+			projection: Projection{
+				Include: []string{"title"},
+				Exclude: []string{"raw"},
+				Slice:   map[string]Slice{"comments": {Limit: 3}},
+			},
+			want: "invalid projection: cannot mix field inclusion (title) and exclusion (raw)",
+		},
+		{
+			name: "sliced and excluded",
+			projection: Projection{
+				Exclude: []string{"comments"},
+				Slice:   map[string]Slice{"comments": {Limit: 3}},
+			},
+			want: "invalid projection: comments: field is projected more than once",
+		},
+		{
+			name:       "path collision",
+			projection: Projection{Exclude: []string{"meta", "meta.raw"}},
+			want:       "invalid projection: meta.raw: path collides with meta",
+		},
+		{
+			name:       "id exclusion",
+			projection: Projection{Exclude: []string{"id"}},
+			want:       "invalid projection: id: id is always returned",
+		},
+		{
+			name:       "size without array",
+			projection: Projection{Size: map[string]string{"count": ""}},
+			want:       "invalid projection: count: $size requires an array field",
+		},
+		{
+			name: "size overriding excluded field",
+			projection: Projection{
+				Exclude: []string{"count"},
+				Size:    map[string]string{"count": "comments"},
+			},
+			want: "invalid projection: count: field is projected more than once",
+		},
+		{
+			name:       "skip without limit",
+			projection: Projection{Slice: map[string]Slice{"comments": {Skip: 2}}},
+			want:       "invalid projection: comments: $slice limit must be positive when skip is set",
+		},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getSelect(tc.projection)
+			if err == nil {
+				t.Fatal("getSelect: expected error, got nil")
+			}
+			if err.Error() != tc.want {
+				t.Errorf("getSelect error:\ngot:  %s\nwant: %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetProjectStages(t *testing.T) {
+	size := bson.M{"$size": bson.M{"$ifNull": []interface{}{"$comments", []interface{}{}}}}
+	cases := []struct {
+		name       string
+		projection Projection
+		want       []bson.M
+	}{
+		{
+			name:       "size only",
+			projection: Projection{Size: map[string]string{"count": "comments"}},
+			want: []bson.M{
+				{"$addFields": bson.M{"count": size}},
+				{"$project": bson.M{"comments": 0}},
+			},
+		},
+		{
+			name: "size with inclusion and slice",
+			projection: Projection{
+				Include: []string{"title"},
+				Slice:   map[string]Slice{"tags": {Skip: 1, Limit: 2}},
+				Size:    map[string]string{"count": "comments"},
+			},
+			want: []bson.M{
+				{"$addFields": bson.M{
+					"count": size,
+					"tags":  bson.M{"$slice": []interface{}{"$tags", 1, 2}},
+				}},
+				{"$project": bson.M{"title": 1, "tags": 1, "count": 1, "_etag": 1, "_updated": 1}},
+			},
+		},
+		{
+			name: "size replacing sliced array",
+			projection: Projection{
+				Exclude: []string{"raw"},
+				Slice:   map[string]Slice{"comments": {Limit: 3}},
+				Size:    map[string]string{"count": "comments"},
+			},
+			want: []bson.M{
+				{"$addFields": bson.M{
+					"count":    size,
+					"comments": bson.M{"$slice": []interface{}{"$comments", 3}},
+				}},
+				{"$project": bson.M{"raw": 0}},
+			},
+		},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getProjectStages(tc.projection)
+			if err != nil {
+				t.Fatalf("getProjectStages error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("getProjectStages:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPushdownProjection(t *testing.T) {
+	s := schema.Schema{Fields: schema.Fields{
+		"name": {},
+		"meta": {Schema: &schema.Schema{Fields: schema.Fields{"title": {}, "raw": {}}}},
+		"user": {Validator: &schema.Reference{Path: "users"}},
+	}}
+	cases := []struct {
+		name       string
+		projection string
+		fg         schema.FieldGetter
+		want       []string
+	}{
+		{"fields", "id,name", nil, []string{"name"}},
+		{"only id", "id", nil, nil},
+		{"wildcard", "name,*", nil, nil},
+		{"children", "name,meta{title,raw}", s, []string{"meta.raw", "meta.title", "name"}},
+		{"children without schema", "name,meta{title,raw}", nil, []string{"meta", "name"}},
+		{"child wildcard", "meta{*}", s, []string{"meta"}},
+		{"aliases", "a:name,b:name,meta,t:meta{title}", s, []string{"meta", "name"}},
+		{"reference", "user{name},meta{title}", s, []string{"meta.title", "user"}},
+		{"reference without schema", "user{name}", nil, []string{"user"}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got := pushdownProjection(query.MustParseProjection(tc.projection), tc.fg)
+			if !reflect.DeepEqual(got.Include, tc.want) {
+				t.Errorf("pushdownProjection(%q): got: %v want: %v", tc.projection, got.Include, tc.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,18 @@
 package mongo
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
 	"github.com/rs/rest-layer/schema/query"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -17,15 +28,718 @@ func getField(f string) string {
 	return f
 }
 
+// TranslateQuery returns the MongoDB query and sort a handler with default
+// options sends for q, without querying the database. It is meant for
+// debugging and tooling; see OptionsHandler.TranslateQuery to take the options
+// of a handler into account.
+func TranslateQuery(q *query.Query) (bson.M, []string, error) {
+	return OptionsHandler{}.TranslateQuery(q)
+}
+
+// TranslateQuery returns the MongoDB query and sort m sends for q, without
+// querying the database.
+func (m OptionsHandler) TranslateQuery(q *query.Query) (bson.M, []string, error) {
+	b, err := m.getQuery(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, m.getSort(q), nil
+}
+
 // getQuery transform a query into a Mongo query.
-func getQuery(q *query.Query) (bson.M, error) {
-	return translatePredicate(q.Predicate)
+func (m OptionsHandler) getQuery(q *query.Query) (bson.M, error) {
+	p := q.Predicate
+	if m.opts.Schema != nil {
+		if err := validateFields(p, m.opts.Schema, m.opts.CreatedField); err != nil {
+			return nil, err
+		}
+	}
+	p, err := m.storedValues(p)
+	if err != nil {
+		return nil, err
+	}
+	if m.opts.CreatedField != "" {
+		var err error
+		if p, err = translateCreated(p, m.opts.CreatedField); err != nil {
+			return nil, err
+		}
+	}
+	if f := m.updatedField(); f != updatedField {
+		p = mapUpdated(p, f)
+	}
+	if m.opts.FlattenSeparator != "" {
+		p = mapExprFields(p, m.flatField)
+	}
+	b, err := translatePredicate(p)
+	if err != nil || m.opts.FlattenSeparator == "" {
+		return b, err
+	}
+	return renameQueryFields(b, m.flatField), nil
+}
+
+// storedValues returns a copy of p in which the values are converted to the
+// way they are stored: DateFields, BoolFields, Transforms and custom ids.
+func (m OptionsHandler) storedValues(p query.Predicate) (query.Predicate, error) {
+	var err error
+	if len(m.opts.DateFields) > 0 {
+		if p, err = mapValues(p, m.dateValue); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.opts.BoolFields) > 0 {
+		if p, err = mapValues(p, m.boolValue); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.opts.Transforms) > 0 {
+		if p, err = mapValues(p, m.transformValue); err != nil {
+			return nil, err
+		}
+	}
+	if m.customIDs() {
+		if p, err = mapValues(p, m.idValue); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// flatField returns the name under which the field at the dotted path f is
+// stored.
+func (m OptionsHandler) flatField(f string) string {
+	if m.opts.FlattenSeparator == "" {
+		return f
+	}
+	return strings.Replace(f, ".", m.opts.FlattenSeparator, -1)
+}
+
+// flatDoc returns a copy of the document d, whose keys are dotted paths, with
+// keys and values flattened the way payloads are stored.
+func (m OptionsHandler) flatDoc(d map[string]interface{}) bson.M {
+	if m.opts.FlattenSeparator == "" {
+		return d
+	}
+	r := bson.M{}
+	for f, v := range d {
+		r[m.flatField(f)] = v
+	}
+	return flatten(r, m.opts.FlattenSeparator)
+}
+
+// flatProjection returns a copy of p with fields named the way they are
+// stored.
+func (m OptionsHandler) flatProjection(p Projection) Projection {
+	r := Projection{}
+	for _, f := range p.Include {
+		r.Include = append(r.Include, m.flatField(f))
+	}
+	for _, f := range p.Exclude {
+		r.Exclude = append(r.Exclude, m.flatField(f))
+	}
+	if p.Slice != nil {
+		r.Slice = make(map[string]Slice, len(p.Slice))
+		for f, s := range p.Slice {
+			r.Slice[m.flatField(f)] = s
+		}
+	}
+	if p.Size != nil {
+		r.Size = make(map[string]string, len(p.Size))
+		for f, array := range p.Size {
+			r.Size[m.flatField(f)] = m.flatField(array)
+		}
+	}
+	return r
+}
+
+// renameQueryFields returns a copy of the query document b with the fields it
+// compares renamed by fn, including in $and, $or and $nor clauses. Fields of
+// operator documents, e.g. $elemMatch sub-fields, are left untouched.
+func renameQueryFields(b bson.M, fn func(string) string) bson.M {
+	r := make(bson.M, len(b))
+	for k, v := range b {
+		switch {
+		case k == "$and" || k == "$or" || k == "$nor":
+			l, _ := v.([]bson.M)
+			rl := make([]bson.M, len(l))
+			for i, sb := range l {
+				rl[i] = renameQueryFields(sb, fn)
+			}
+			r[k] = rl
+		case strings.HasPrefix(k, "$"):
+			r[k] = v
+		default:
+			r[fn(k)] = v
+		}
+	}
+	return r
+}
+
+// dateValue converts query values compared with one of the DateFields into
+// time.Time.
+func (m OptionsHandler) dateValue(field string, v query.Value) (query.Value, error) {
+	if _, ok := v.(string); !ok || !inStrings(field, m.opts.DateFields) {
+		return v, nil
+	}
+	t, err := parseTime(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", field, err)
+	}
+	return t, nil
+}
+
+// boolValue converts boolean query values compared with one of the BoolFields
+// into the 0 or 1 integer they are stored as.
+func (m OptionsHandler) boolValue(field string, v query.Value) (query.Value, error) {
+	if b, ok := v.(bool); ok && inStrings(field, m.opts.BoolFields) {
+		return boolInt(b), nil
+	}
+	return v, nil
+}
+
+// mapValues returns a copy of p in which the values compared with fields are
+// replaced by the result of fn. Values in $elemMatch sub-expressions are left
+// untouched as their fields are relative to array elements.
+func mapValues(p query.Predicate, fn func(field string, v query.Value) (query.Value, error)) (query.Predicate, error) {
+	r := make(query.Predicate, 0, len(p))
+	for _, exp := range p {
+		exp, err := mapExpValues(exp, fn)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, exp)
+	}
+	return r, nil
+}
+
+func mapExpValues(exp query.Expression, fn func(field string, v query.Value) (query.Value, error)) (query.Expression, error) {
+	var err error
+	switch t := exp.(type) {
+	case *query.And:
+		and := make(query.And, len(*t))
+		for i, subExp := range *t {
+			if and[i], err = mapExpValues(subExp, fn); err != nil {
+				return nil, err
+			}
+		}
+		return &and, nil
+	case *query.Or:
+		or := make(query.Or, len(*t))
+		for i, subExp := range *t {
+			if or[i], err = mapExpValues(subExp, fn); err != nil {
+				return nil, err
+			}
+		}
+		return &or, nil
+	case query.Predicate, *query.Predicate:
+		return mapValues(expToPredicate(t), fn)
+	case *query.In:
+		values := make([]query.Value, len(t.Values))
+		for i, v := range t.Values {
+			if values[i], err = fn(t.Field, v); err != nil {
+				return nil, err
+			}
+		}
+		return &query.In{Field: t.Field, Values: values}, nil
+	case *query.NotIn:
+		values := make([]query.Value, len(t.Values))
+		for i, v := range t.Values {
+			if values[i], err = fn(t.Field, v); err != nil {
+				return nil, err
+			}
+		}
+		return &query.NotIn{Field: t.Field, Values: values}, nil
+	case *All:
+		values := make([]query.Value, len(t.Values))
+		for i, v := range t.Values {
+			if values[i], err = fn(t.Field, v); err != nil {
+				return nil, err
+			}
+		}
+		return &All{Field: t.Field, Values: values}, nil
+	case *Not:
+		sub, err := mapExpValues(t.Exp, fn)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Exp: sub}, nil
+	case *query.Equal:
+		v, err := fn(t.Field, t.Value)
+		return &query.Equal{Field: t.Field, Value: v}, err
+	case *query.NotEqual:
+		v, err := fn(t.Field, t.Value)
+		return &query.NotEqual{Field: t.Field, Value: v}, err
+	case *query.GreaterThan:
+		v, err := fn(t.Field, t.Value)
+		return &query.GreaterThan{Field: t.Field, Value: v}, err
+	case *query.GreaterOrEqual:
+		v, err := fn(t.Field, t.Value)
+		return &query.GreaterOrEqual{Field: t.Field, Value: v}, err
+	case *query.LowerThan:
+		v, err := fn(t.Field, t.Value)
+		return &query.LowerThan{Field: t.Field, Value: v}, err
+	case *query.LowerOrEqual:
+		v, err := fn(t.Field, t.Value)
+		return &query.LowerOrEqual{Field: t.Field, Value: v}, err
+	}
+	return exp, nil
+}
+
+// mapUpdated returns a copy of p in which the DateDiff expressions on the
+// update time of items, like those of UpdatedAfter, refer to the field f
+// storing it instead.
+func mapUpdated(p query.Predicate, f string) query.Predicate {
+	r := make(query.Predicate, 0, len(p))
+	for _, exp := range p {
+		r = append(r, mapExpUpdated(exp, f))
+	}
+	return r
+}
+
+func mapExpUpdated(exp query.Expression, f string) query.Expression {
+	switch t := exp.(type) {
+	case *query.And:
+		and := make(query.And, len(*t))
+		for i, subExp := range *t {
+			and[i] = mapExpUpdated(subExp, f)
+		}
+		return &and
+	case *query.Or:
+		or := make(query.Or, len(*t))
+		for i, subExp := range *t {
+			or[i] = mapExpUpdated(subExp, f)
+		}
+		return &or
+	case query.Predicate, *query.Predicate:
+		return mapUpdated(expToPredicate(t), f)
+	case *Not:
+		return &Not{Exp: mapExpUpdated(t.Exp, f)}
+	case *DateDiff:
+		d := *t
+		if d.From == updatedField {
+			d.From = f
+		}
+		if d.To == updatedField {
+			d.To = f
+		}
+		return &d
+	}
+	return exp
+}
+
+// mapExprFields returns a copy of p in which the fields of the expressions
+// translated into a $expr, which renameQueryFields leaves untouched, are
+// renamed by fn.
+func mapExprFields(p query.Predicate, fn func(string) string) query.Predicate {
+	r := make(query.Predicate, 0, len(p))
+	for _, exp := range p {
+		r = append(r, mapExpExprFields(exp, fn))
+	}
+	return r
+}
+
+func mapExpExprFields(exp query.Expression, fn func(string) string) query.Expression {
+	switch t := exp.(type) {
+	case *query.And:
+		and := make(query.And, len(*t))
+		for i, subExp := range *t {
+			and[i] = mapExpExprFields(subExp, fn)
+		}
+		return &and
+	case *query.Or:
+		or := make(query.Or, len(*t))
+		for i, subExp := range *t {
+			or[i] = mapExpExprFields(subExp, fn)
+		}
+		return &or
+	case query.Predicate, *query.Predicate:
+		return mapExprFields(expToPredicate(t), fn)
+	case *Not:
+		return &Not{Exp: mapExpExprFields(t.Exp, fn)}
+	case *SizeMismatch:
+		e := *t
+		e.Field, e.Other = fn(t.Field), fn(t.Other)
+		return &e
+	case *NumberRegex:
+		e := *t
+		e.Field = fn(t.Field)
+		return &e
+	case *DateDiff:
+		e := *t
+		e.From, e.To = fn(t.From), fn(t.To)
+		return &e
+	case *FieldRegex:
+		e := *t
+		e.Field, e.Pattern = fn(t.Field), fn(t.Pattern)
+		return &e
+	case *ElemMatchCount:
+		// Arrays are stored as is, so the fields of their elements are kept.
+		e := *t
+		e.Field = fn(t.Field)
+		return &e
+	case *Unsorted:
+		e := *t
+		e.Field = fn(t.Field)
+		return &e
+	}
+	return exp
+}
+
+// validateFields ensures all fields referenced by p are defined by fg. Fields
+// listed in virtual are always accepted.
+func validateFields(p query.Predicate, fg schema.FieldGetter, virtual ...string) error {
+	for _, exp := range p {
+		switch t := exp.(type) {
+		case *query.And:
+			for _, subExp := range *t {
+				if err := validateFields(expToPredicate(subExp), fg, virtual...); err != nil {
+					return err
+				}
+			}
+			continue
+		case *query.Or:
+			for _, subExp := range *t {
+				if err := validateFields(expToPredicate(subExp), fg, virtual...); err != nil {
+					return err
+				}
+			}
+			continue
+		case query.Predicate, *query.Predicate:
+			if err := validateFields(expToPredicate(t), fg, virtual...); err != nil {
+				return err
+			}
+			continue
+		case *Not:
+			if err := validateFields(expToPredicate(t.Exp), fg, virtual...); err != nil {
+				return err
+			}
+			continue
+		case *DateDiff:
+			for _, field := range []string{t.From, t.To} {
+				if field != updatedField && !inStrings(field, virtual) && fg.GetField(field) == nil {
+					return fmt.Errorf("%s: unknown query field", field)
+				}
+			}
+			continue
+		case *FieldRegex:
+			for _, field := range []string{t.Field, t.Pattern} {
+				if !inStrings(field, virtual) && fg.GetField(field) == nil {
+					return fmt.Errorf("%s: unknown query field", field)
+				}
+			}
+			continue
+		case *SizeMismatch:
+			for _, field := range []string{t.Field, t.Other} {
+				if !inStrings(field, virtual) && fg.GetField(field) == nil {
+					return fmt.Errorf("%s: unknown query field", field)
+				}
+			}
+			continue
+		}
+		field, ok := expField(exp)
+		if !ok || inStrings(field, virtual) {
+			continue
+		}
+		f := fg.GetField(field)
+		if f == nil {
+			return fmt.Errorf("%s: unknown query field", field)
+		}
+		if t, ok := exp.(*query.ElemMatch); ok {
+			// Sub-fields can only be checked when array values are objects.
+			if arr, ok := f.Validator.(*schema.Array); ok {
+				if obj, ok := arr.Values.Validator.(*schema.Object); ok && obj.Schema != nil {
+					if err := validateFields(t.Exps, obj.Schema); err != nil {
+						return fmt.Errorf("%s.%v", field, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// inStrings returns true if s is a non empty string present in list.
+func inStrings(s string, list []string) bool {
+	for _, v := range list {
+		if v != "" && v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatedBetween returns an expression matching the items whose ObjectId id
+// has been created in the [from, to) time range. It is translated into an _id
+// range so the primary key index is used instead of scanning the collection.
+//
+// ObjectId only store timestamps with a second precision, so the range applies
+// to the creation time truncated to the second: an id created at 12:00:00.800
+// is out of a range starting at 12:00:00.500.
+func CreatedBetween(from, to time.Time) query.Expression {
+	and := query.And{}
+	for _, exp := range []query.Expression{
+		&query.GreaterOrEqual{Value: from},
+		&query.LowerThan{Value: to},
+	} {
+		// Errors are only returned for values which are not times.
+		b, _ := createdBounds(exp, "")
+		and = append(and, b...)
+	}
+	return &and
+}
+
+// translateCreated replaces the comparisons on the virtual field f, holding the
+// creation time of ObjectId ids, by comparisons on the id. As ObjectId only
+// store timestamps with a second precision, bounds are rounded so that the
+// comparisons behave as if they were performed on the truncated creation time.
+func translateCreated(p query.Predicate, f string) (query.Predicate, error) {
+	others := query.Predicate{}
+	bounds := []query.Expression{}
+	for _, exp := range p {
+		b, err := createdBounds(exp, f)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			bounds = append(bounds, b...)
+			continue
+		}
+		if exp, err = translateCreatedExp(exp, f); err != nil {
+			return nil, err
+		}
+		others = append(others, exp)
+	}
+	if len(bounds) == 0 {
+		return others, nil
+	}
+	// Wrap bounds in a $and as several of them may apply to the _id field.
+	and := query.And{}
+	if len(others) > 0 {
+		and = append(and, others)
+	}
+	and = append(and, bounds...)
+	return query.Predicate{&and}, nil
+}
+
+// translateCreatedExp applies translateCreated to the sub-expressions of exp.
+func translateCreatedExp(exp query.Expression, f string) (query.Expression, error) {
+	var exps []query.Expression
+	switch t := exp.(type) {
+	case *query.And:
+		exps = *t
+	case *query.Or:
+		exps = *t
+	case query.Predicate, *query.Predicate:
+		return translateCreated(expToPredicate(t), f)
+	case *Not:
+		sub, err := translateCreatedExp(t.Exp, f)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Exp: sub}, nil
+	default:
+		return exp, nil
+	}
+	s := make([]query.Expression, 0, len(exps))
+	for _, subExp := range exps {
+		b, err := createdBounds(subExp, f)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(b) == 1:
+			s = append(s, b[0])
+		case len(b) > 1:
+			and := query.And(b)
+			s = append(s, &and)
+		default:
+			if subExp, err = translateCreatedExp(subExp, f); err != nil {
+				return nil, err
+			}
+			s = append(s, subExp)
+		}
+	}
+	if _, ok := exp.(*query.Or); ok {
+		or := query.Or(s)
+		return &or, nil
+	}
+	and := query.And(s)
+	return &and, nil
+}
+
+// createdBounds returns the _id comparisons equivalent to exp if exp is a
+// comparison on the virtual created field f, or its negation, or nil
+// otherwise.
+func createdBounds(exp query.Expression, f string) ([]query.Expression, error) {
+	var field string
+	var value query.Value
+	switch t := exp.(type) {
+	case *query.Equal:
+		field, value = t.Field, t.Value
+	case *query.GreaterThan:
+		field, value = t.Field, t.Value
+	case *query.GreaterOrEqual:
+		field, value = t.Field, t.Value
+	case *query.LowerThan:
+		field, value = t.Field, t.Value
+	case *query.LowerOrEqual:
+		field, value = t.Field, t.Value
+	case *Not:
+		return negatedCreatedBounds(t.Exp, f)
+	default:
+		if field, ok := expField(exp); ok && field == f {
+			return nil, resource.ErrNotImplemented
+		}
+		return nil, nil
+	}
+	if field != f {
+		return nil, nil
+	}
+	tm, err := parseTime(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	// The smallest id created during the second following tm.
+	next := bson.NewObjectIdWithTime(time.Unix(tm.Unix()+1, 0))
+	// The smallest id created at or after tm.
+	ceil := next
+	if tm.Nanosecond() == 0 {
+		ceil = bson.NewObjectIdWithTime(time.Unix(tm.Unix(), 0))
+	}
+	switch exp.(type) {
+	case *query.Equal:
+		return []query.Expression{
+			&query.GreaterOrEqual{Field: "id", Value: ceil},
+			&query.LowerThan{Field: "id", Value: next},
+		}, nil
+	case *query.GreaterThan:
+		return []query.Expression{&query.GreaterOrEqual{Field: "id", Value: next}}, nil
+	case *query.GreaterOrEqual:
+		return []query.Expression{&query.GreaterOrEqual{Field: "id", Value: ceil}}, nil
+	case *query.LowerThan:
+		return []query.Expression{&query.LowerThan{Field: "id", Value: ceil}}, nil
+	default: // *query.LowerOrEqual
+		return []query.Expression{&query.LowerThan{Field: "id", Value: next}}, nil
+	}
+}
+
+// negatedCreatedBounds returns the _id comparisons equivalent to the negation
+// of exp if exp is a comparison on the virtual created field f, or nil
+// otherwise. As all documents have an id, the negation can't match documents
+// missing the field like other $not conditions do.
+func negatedCreatedBounds(exp query.Expression, f string) ([]query.Expression, error) {
+	b, err := createdBounds(exp, f)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	neg := make([]query.Expression, len(b))
+	for i, bound := range b {
+		switch t := bound.(type) {
+		case *query.GreaterOrEqual:
+			neg[i] = &query.LowerThan{Field: t.Field, Value: t.Value}
+		case *query.LowerThan:
+			neg[i] = &query.GreaterOrEqual{Field: t.Field, Value: t.Value}
+		}
+	}
+	if len(neg) == 1 {
+		return neg, nil
+	}
+	// Not matching all the bounds means being out of one of them.
+	or := query.Or(neg)
+	return []query.Expression{&or}, nil
+}
+
+// expField returns the field targeted by a single field expression.
+func expField(exp query.Expression) (string, bool) {
+	switch t := exp.(type) {
+	case *query.In:
+		return t.Field, true
+	case *query.NotIn:
+		return t.Field, true
+	case *query.Exist:
+		return t.Field, true
+	case *query.NotExist:
+		return t.Field, true
+	case *query.Equal:
+		return t.Field, true
+	case *query.NotEqual:
+		return t.Field, true
+	case *query.GreaterThan:
+		return t.Field, true
+	case *query.GreaterOrEqual:
+		return t.Field, true
+	case *query.LowerThan:
+		return t.Field, true
+	case *query.LowerOrEqual:
+		return t.Field, true
+	case *query.Regex:
+		return t.Field, true
+	case *query.ElemMatch:
+		return t.Field, true
+	case *Prefix:
+		return t.Field, true
+	case *ElemMatchCount:
+		return t.Field, true
+	case *AllElemMatch:
+		return t.Field, true
+	case *NumberRegex:
+		return t.Field, true
+	case *Mod:
+		return t.Field, true
+	case *All:
+		return t.Field, true
+	case *DateBetween:
+		return t.Field, true
+	case *Near:
+		return t.Field, true
+	case *NearSphere:
+		return t.Field, true
+	case *GeoWithin:
+		return t.Field, true
+	case *Unsorted:
+		return t.Field, true
+	}
+	return "", false
+}
+
+// parseTime converts a query value into a time.Time. Strings are accepted in
+// RFC 3339 or YYYY-MM-DD formats.
+func parseTime(v query.Value) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if tm, err := time.Parse(layout, t); err == nil {
+				return tm, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time value: %v", v)
+}
+
+// getSort returns the sort of q using the stored field names, or the insertion
+// order when q has no sort and InsertionOrder is set.
+func (m OptionsHandler) getSort(q *query.Query) []string {
+	if m.opts.InsertionOrder && len(q.Sort) == 0 && !hasNear(q.Predicate) {
+		return []string{seqField, "_id"}
+	}
+	s := getSort(q)
+	if m.opts.FlattenSeparator != "" {
+		for i, f := range s {
+			s[i] = m.flatField(f)
+		}
+	}
+	return s
 }
 
 // getSort transform a resource.Lookup into a Mongo sort list.
 // If the sort list is empty, fallback to _id.
 func getSort(q *query.Query) []string {
 	if len(q.Sort) == 0 {
+		if hasNear(q.Predicate) {
+			// Keep the nearest-first order of $near.
+			return nil
+		}
 		return []string{"_id"}
 	}
 	s := make([]string, len(q.Sort))
@@ -39,6 +753,22 @@ func getSort(q *query.Query) []string {
 	return s
 }
 
+// hasNear returns true if p holds a Near or NearSphere expression at its root
+// or in an And.
+func hasNear(p query.Predicate) bool {
+	for _, exp := range p {
+		switch t := exp.(type) {
+		case *Near, *NearSphere:
+			return true
+		case *query.And:
+			if hasNear(query.Predicate(*t)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func applyWindow(mq *mgo.Query, w query.Window) *mgo.Query {
 	if w.Offset > 0 {
 		mq = mq.Skip(w.Offset)
@@ -49,13 +779,58 @@ func applyWindow(mq *mgo.Query, w query.Window) *mgo.Query {
 	return mq
 }
 
-func selectIDs(c *mgo.Collection, mq *mgo.Query) ([]interface{}, error) {
+// sortDoc returns the sort document of the mgo sort list srt.
+func sortDoc(srt []string) bson.D {
+	sort := make(bson.D, len(srt))
+	for i, f := range srt {
+		if strings.HasPrefix(f, "-") {
+			sort[i] = bson.DocElem{Name: f[1:], Value: -1}
+		} else {
+			sort[i] = bson.DocElem{Name: f, Value: 1}
+		}
+	}
+	return sort
+}
+
+// findPipeline returns the aggregation pipeline equivalent to a find of qry
+// sorted by srt and windowed by w, followed by stages.
+func findPipeline(qry bson.M, srt []string, w *query.Window, stages []bson.M) []bson.M {
+	pipeline := []bson.M{{"$match": qry}, {"$sort": sortDoc(srt)}}
+	if w != nil {
+		if w.Offset > 0 {
+			pipeline = append(pipeline, bson.M{"$skip": w.Offset})
+		}
+		if w.Limit > -1 {
+			pipeline = append(pipeline, bson.M{"$limit": w.Limit})
+		}
+	}
+	return append(pipeline, stages...)
+}
+
+// selectIDs returns the ids of the items read by mq, or the context error if
+// ctx is done before all of them are read.
+func selectIDs(ctx context.Context, mq *mgo.Query) ([]interface{}, error) {
+	return readIDs(ctx, mq.Select(bson.M{"_id": 1}).Iter())
+}
+
+// idIter is the part of *mgo.Iter used by readIDs.
+type idIter interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// readIDs returns the ids read with it, stopping with the context error as
+// soon as ctx is done.
+func readIDs(ctx context.Context, it idIter) ([]interface{}, error) {
 	var ids []interface{}
 	tmp := struct {
 		ID interface{} `bson:"_id"`
 	}{}
-	it := mq.Select(bson.M{"_id": 1}).Iter()
 	for it.Next(&tmp) {
+		if err := ctx.Err(); err != nil {
+			it.Close()
+			return nil, err
+		}
 		ids = append(ids, tmp.ID)
 	}
 	if err := it.Close(); err != nil {
@@ -78,7 +853,7 @@ func translatePredicate(q query.Predicate) (bson.M, error) {
 				}
 				s = append(s, sb)
 			}
-			b["$and"] = s
+			mergeCondition(b, "$and", s)
 		case *query.Or:
 			s := []bson.M{}
 			for _, subExp := range *t {
@@ -87,55 +862,497 @@ func translatePredicate(q query.Predicate) (bson.M, error) {
 				if err != nil {
 					return nil, err
 				}
+				if textCount(sb) > 0 {
+					return nil, errors.New("$text: not allowed in $or")
+				}
+				if nearCount(sb) > 0 {
+					return nil, errors.New("$near: not allowed in $or")
+				}
+				// The conditions of a sub-query are given as an $and clause,
+				// so merge those bearing on the same field.
+				if and, ok := sb["$and"].([]bson.M); ok && len(sb) == 1 {
+					if and = mergeAnd(and); len(and) == 1 {
+						sb = and[0]
+					}
+				}
 				s = append(s, sb)
 			}
-			b["$or"] = s
+			mergeCondition(b, "$or", s)
 		case *query.ElemMatch:
-			s := bson.M{}
-			for _, subExp := range t.Exps {
-				p := expToPredicate(subExp)
-				sb, err := translatePredicate(p)
+			s, err := translateElemMatch(t.Exps)
+			if err != nil {
+				return nil, err
+			}
+			mergeCondition(b, getField(t.Field), bson.M{"$elemMatch": s})
+		case *AllElemMatch:
+			all := make([]bson.M, len(t.Exps))
+			for i, exps := range t.Exps {
+				s, err := translateElemMatch(exps)
 				if err != nil {
 					return nil, err
 				}
-				for k, v := range sb {
-					s[k] = v
-				}
+				all[i] = bson.M{"$elemMatch": s}
 			}
-			b[getField(t.Field)] = bson.M{"$elemMatch": s}
+			mergeCondition(b, getField(t.Field), bson.M{"$all": all})
 		case *query.In:
-			b[getField(t.Field)] = bson.M{"$in": t.Values}
+			mergeCondition(b, getField(t.Field), bson.M{"$in": numberValues(t.Values)})
+		case *All:
+			mergeCondition(b, getField(t.Field), bson.M{"$all": numberValues(t.Values)})
 		case *query.NotIn:
-			b[getField(t.Field)] = bson.M{"$nin": t.Values}
+			mergeCondition(b, getField(t.Field), bson.M{"$nin": numberValues(t.Values)})
 		case *query.Exist:
-			b[getField(t.Field)] = bson.M{"$exists": true}
+			mergeCondition(b, getField(t.Field), bson.M{"$exists": true})
 		case *query.NotExist:
-			b[getField(t.Field)] = bson.M{"$exists": false}
+			mergeCondition(b, getField(t.Field), bson.M{"$exists": false})
 		case *query.Equal:
-			b[getField(t.Field)] = t.Value
+			mergeCondition(b, getField(t.Field), t.Value)
 		case *query.NotEqual:
-			b[getField(t.Field)] = bson.M{"$ne": t.Value}
+			mergeCondition(b, getField(t.Field), bson.M{"$ne": t.Value})
 		case *query.GreaterThan:
-			b[getField(t.Field)] = bson.M{"$gt": t.Value}
+			mergeCondition(b, getField(t.Field), bson.M{"$gt": t.Value})
 		case *query.GreaterOrEqual:
-			b[getField(t.Field)] = bson.M{"$gte": t.Value}
+			mergeCondition(b, getField(t.Field), bson.M{"$gte": t.Value})
 		case *query.LowerThan:
-			b[getField(t.Field)] = bson.M{"$lt": t.Value}
+			mergeCondition(b, getField(t.Field), bson.M{"$lt": t.Value})
 		case *query.LowerOrEqual:
-			b[getField(t.Field)] = bson.M{"$lte": t.Value}
+			mergeCondition(b, getField(t.Field), bson.M{"$lte": t.Value})
 		case *query.Regex:
+			pattern, options := regexOptions(t.Value.String())
 			if t.Negated {
-				b[getField(t.Field)] = bson.M{"$not": bson.RegEx{Pattern: t.Value.String()}}
+				mergeCondition(b, getField(t.Field), bson.M{"$not": bson.RegEx{Pattern: pattern, Options: options}})
+			} else if options != "" {
+				mergeCondition(b, getField(t.Field), bson.M{"$regex": pattern, "$options": options})
 			} else {
-				b[getField(t.Field)] = bson.M{"$regex": t.Value.String()}
+				mergeCondition(b, getField(t.Field), bson.M{"$regex": pattern})
+			}
+		case *Not:
+			sb, err := translatePredicate(expToPredicate(t.Exp))
+			if err != nil {
+				return nil, err
+			}
+			if and, ok := sb["$and"].([]bson.M); ok && len(sb) == 1 {
+				if and = mergeAnd(and); len(and) == 1 {
+					sb = and[0]
+				}
+			}
+			field, cond, ok := negatedCondition(sb)
+			if !ok {
+				return nil, resource.ErrNotImplemented
 			}
+			mergeCondition(b, field, bson.M{"$not": cond})
+		case *Prefix:
+			mergeCondition(b, getField(t.Field), bson.M{"$regex": t.pattern()})
+		case *NumberRegex:
+			mergeCondition(b, "$expr", bson.M{"$regexMatch": bson.M{
+				"input": bson.M{"$toString": "$" + getField(t.Field)},
+				"regex": t.Value.String(),
+			}})
+		case *Mod:
+			mergeCondition(b, getField(t.Field), bson.M{"$mod": []interface{}{t.Divisor, t.Remainder}})
+		case *DateBetween:
+			mergeCondition(b, getField(t.Field), bson.M{"$gte": t.Start, "$lte": t.End})
+		case *Near:
+			mergeCondition(b, getField(t.Field), bson.M{"$near": t.doc()})
+		case *NearSphere:
+			mergeCondition(b, getField(t.Field), bson.M{"$nearSphere": Near(*t).doc()})
+		case *GeoWithin:
+			mergeCondition(b, getField(t.Field), bson.M{"$geoWithin": t.doc()})
+		case *FieldCount:
+			mergeCondition(b, "$expr", bson.M{"$gt": []interface{}{
+				bson.M{"$size": bson.M{"$filter": bson.M{
+					"input": bson.M{"$objectToArray": "$$ROOT"},
+					"as":    "f",
+					"cond":  bson.M{"$not": []interface{}{bson.M{"$in": []interface{}{"$$f.k", t.metaFields()}}}},
+				}}},
+				t.Min,
+			}})
+		case *Text:
+			mergeCondition(b, "$text", t.doc())
+		case *Unsorted:
+			// $sortArray fails on values which are not arrays.
+			f := "$" + getField(t.Field)
+			mergeCondition(b, "$expr", bson.M{"$cond": []interface{}{
+				bson.M{"$isArray": f},
+				bson.M{"$ne": []interface{}{f, bson.M{"$sortArray": bson.M{"input": f, "sortBy": 1}}}},
+				false,
+			}})
+		case *SizeMismatch:
+			mergeCondition(b, "$expr", bson.M{"$ne": []interface{}{
+				exprSize("$" + getField(t.Field)),
+				exprSize("$" + getField(t.Other)),
+			}})
+		case *FieldRegex:
+			// $regexMatch fails on values which are not strings.
+			f, p := "$"+getField(t.Field), "$"+getField(t.Pattern)
+			mergeCondition(b, "$expr", bson.M{"$cond": []interface{}{
+				bson.M{"$and": []interface{}{
+					bson.M{"$eq": []interface{}{bson.M{"$type": f}, "string"}},
+					bson.M{"$eq": []interface{}{bson.M{"$type": p}, "string"}},
+				}},
+				bson.M{"$regexMatch": bson.M{"input": f, "regex": p}},
+				false,
+			}})
+		case *DateDiff:
+			mergeCondition(b, "$expr", bson.M{"$gt": []interface{}{
+				bson.M{"$subtract": []interface{}{"$" + getField(t.To), "$" + getField(t.From)}},
+				t.Min.Milliseconds(),
+			}})
+		case *ElemMatchCount:
+			cond, err := translateExprCondition(query.Predicate(t.Exps), "$$e.")
+			if err != nil {
+				return nil, err
+			}
+			mergeCondition(b, "$expr", bson.M{"$gte": []interface{}{
+				bson.M{"$size": bson.M{"$filter": bson.M{
+					"input": bson.M{"$ifNull": []interface{}{"$" + getField(t.Field), []interface{}{}}},
+					"as":    "e",
+					"cond":  cond,
+				}}},
+				t.Min,
+			}})
 		default:
 			return nil, resource.ErrNotImplemented
 		}
 	}
+	if textCount(b) > 1 {
+		return nil, errors.New("$text: only one text search is allowed")
+	}
+	if nearCount(b) > 1 {
+		return nil, errors.New("$near: only one proximity search is allowed")
+	}
 	return b, nil
 }
 
+// translateElemMatch translates the sub-expressions of an $elemMatch.
+func translateElemMatch(exps []query.Expression) (bson.M, error) {
+	s := bson.M{}
+	for _, subExp := range exps {
+		p := expToPredicate(subExp)
+		sb, err := translatePredicate(p)
+		if err != nil {
+			return nil, err
+		}
+		if textCount(sb) > 0 {
+			return nil, errors.New("$text: not allowed in $elemMatch")
+		}
+		if nearCount(sb) > 0 {
+			return nil, errors.New("$near: not allowed in $elemMatch")
+		}
+		for k, v := range sb {
+			mergeCondition(s, k, v)
+		}
+	}
+	return s, nil
+}
+
+// translateExprCondition translates p into an aggregation expression, e.g.
+// for the cond of a $filter, with fields prefixed by prefix (i.e.: "$$e.").
+func translateExprCondition(p query.Predicate, prefix string) (interface{}, error) {
+	conds := make([]interface{}, 0, len(p))
+	for _, exp := range p {
+		var cond interface{}
+		switch t := exp.(type) {
+		case *query.And:
+			s, err := translateExprConditions(*t, prefix)
+			if err != nil {
+				return nil, err
+			}
+			cond = bson.M{"$and": s}
+		case *query.Or:
+			s, err := translateExprConditions(*t, prefix)
+			if err != nil {
+				return nil, err
+			}
+			cond = bson.M{"$or": s}
+		case query.Predicate, *query.Predicate:
+			sc, err := translateExprCondition(expToPredicate(t), prefix)
+			if err != nil {
+				return nil, err
+			}
+			cond = sc
+		case *query.In:
+			cond = bson.M{"$in": []interface{}{prefix + t.Field, numberValues(t.Values)}}
+		case *query.NotIn:
+			cond = bson.M{"$not": []interface{}{bson.M{"$in": []interface{}{prefix + t.Field, numberValues(t.Values)}}}}
+		case *query.Exist:
+			cond = bson.M{"$ne": []interface{}{bson.M{"$type": prefix + t.Field}, "missing"}}
+		case *query.NotExist:
+			cond = bson.M{"$eq": []interface{}{bson.M{"$type": prefix + t.Field}, "missing"}}
+		case *query.Equal:
+			cond = bson.M{"$eq": []interface{}{prefix + t.Field, t.Value}}
+		case *query.NotEqual:
+			cond = bson.M{"$ne": []interface{}{prefix + t.Field, t.Value}}
+		case *query.GreaterThan:
+			cond = bson.M{"$gt": []interface{}{prefix + t.Field, t.Value}}
+		case *query.GreaterOrEqual:
+			cond = bson.M{"$gte": []interface{}{prefix + t.Field, t.Value}}
+		case *query.LowerThan:
+			cond = bson.M{"$lt": []interface{}{prefix + t.Field, t.Value}}
+		case *query.LowerOrEqual:
+			cond = bson.M{"$lte": []interface{}{prefix + t.Field, t.Value}}
+		default:
+			return nil, resource.ErrNotImplemented
+		}
+		conds = append(conds, cond)
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return bson.M{"$and": conds}, nil
+}
+
+// translateExprConditions applies translateExprCondition to each of exps.
+func translateExprConditions(exps []query.Expression, prefix string) ([]interface{}, error) {
+	s := make([]interface{}, 0, len(exps))
+	for _, exp := range exps {
+		cond, err := translateExprCondition(expToPredicate(exp), prefix)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, cond)
+	}
+	return s, nil
+}
+
+var regexFlagsRe = regexp.MustCompile(`^\(\?([ims]+)\)`)
+
+// regexOptions extracts the leading case-insensitive (i), multi-line (m) and
+// dot-all (s) inline flags of a Go regular expression, which MongoDB only
+// accepts as $options. Other flags and flag groups are left in the pattern.
+func regexOptions(pattern string) (string, string) {
+	m := regexFlagsRe.FindStringSubmatch(pattern)
+	if m == nil {
+		return pattern, ""
+	}
+	options := ""
+	for _, f := range "ims" {
+		if strings.ContainsRune(m[1], f) {
+			options += string(f)
+		}
+	}
+	return pattern[len(m[0]):], options
+}
+
+// exprSize returns the aggregation expression of the size of the array f, zero
+// if f is not an array ($size fails on other values).
+func exprSize(f string) bson.M {
+	return bson.M{"$cond": []interface{}{bson.M{"$isArray": f}, bson.M{"$size": f}, 0}}
+}
+
+// mergeCondition adds the condition v on field to the query document b. When b
+// already holds a condition on field, both are merged into a single operator
+// document, e.g. {f:{$gt:1}} and {f:{$lt:5}} gives {f:{$gt:1,$lt:5}}, instead
+// of the last one overwriting the first. Conditions that can't be merged are
+// combined using $and.
+func mergeCondition(b bson.M, field string, v interface{}) {
+	cur, found := b[field]
+	if !found {
+		b[field] = v
+		return
+	}
+	if field == "$and" {
+		b["$and"] = append(cur.([]bson.M), v.([]bson.M)...)
+		return
+	}
+	if strings.HasPrefix(field, "$") {
+		addAnd(b, bson.M{field: v})
+		return
+	}
+	curOps, ok := operatorDoc(cur)
+	if !ok {
+		curOps = bson.M{"$eq": cur}
+	}
+	ops, ok := operatorDoc(v)
+	if !ok {
+		ops = bson.M{"$eq": v}
+	}
+	for op, x := range ops {
+		if y, found := curOps[op]; found && !reflect.DeepEqual(x, y) {
+			addAnd(b, bson.M{field: v})
+			return
+		}
+	}
+	merged := make(bson.M, len(curOps)+len(ops))
+	for op, x := range curOps {
+		merged[op] = x
+	}
+	for op, x := range ops {
+		merged[op] = x
+	}
+	if eq, found := merged["$eq"]; found && len(merged) == 1 {
+		b[field] = eq
+		return
+	}
+	b[field] = merged
+}
+
+// textCount returns the number of $text searches held by the query document
+// b, at its root or in its $and clause.
+func textCount(b bson.M) int {
+	n := 0
+	if _, found := b["$text"]; found {
+		n++
+	}
+	and, _ := b["$and"].([]bson.M)
+	for _, sb := range and {
+		n += textCount(sb)
+	}
+	return n
+}
+
+// nearCount returns the number of $near or $nearSphere conditions held by the
+// query document b, at its root or in its $and clause.
+func nearCount(b bson.M) int {
+	n := 0
+	for f, v := range b {
+		if f == "$and" {
+			and, _ := v.([]bson.M)
+			for _, sb := range and {
+				n += nearCount(sb)
+			}
+			continue
+		}
+		if cond, ok := v.(bson.M); ok {
+			if _, found := cond["$near"]; found {
+				n++
+			}
+			if _, found := cond["$nearSphere"]; found {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// mergeAnd merges the conditions of the $and clause s bearing on the same
+// field, e.g. [{f:{$exists:true}},{f:{$ne:null}}] gives
+// [{f:{$exists:true,$ne:null}}]. Conditions that can't be merged are kept
+// apart.
+func mergeAnd(s []bson.M) []bson.M {
+	r := make([]bson.M, 0, len(s))
+next:
+	for _, sb := range s {
+		if len(sb) == 1 {
+			for f, v := range sb {
+				if strings.HasPrefix(f, "$") {
+					break
+				}
+				for _, rb := range r {
+					cur, found := rb[f]
+					if !found || len(rb) != 1 {
+						continue
+					}
+					m := bson.M{f: cur}
+					if mergeCondition(m, f, v); len(m) == 1 {
+						rb[f] = m[f]
+						continue next
+					}
+				}
+			}
+		}
+		r = append(r, sb)
+	}
+	return r
+}
+
+// addAnd appends the query document sb to the $and clause of b.
+func addAnd(b bson.M, sb bson.M) {
+	and, _ := b["$and"].([]bson.M)
+	b["$and"] = append(and, sb)
+}
+
+// negatedCondition returns the field and the operators of the query document
+// b to wrap in a $not, and false if b can't be negated this way: $not only
+// applies to the operators of a single field, and can't hold $not, $regex or
+// geospatial operators. A $regex is given as a regular expression instead.
+func negatedCondition(b bson.M) (string, interface{}, bool) {
+	if len(b) != 1 {
+		return "", nil, false
+	}
+	for field, v := range b {
+		ops, ok := operatorDoc(v)
+		if !ok || strings.HasPrefix(field, "$") {
+			return "", nil, false
+		}
+		if pattern, ok := ops["$regex"].(string); ok {
+			options, _ := ops["$options"].(string)
+			if len(ops) > 1 && (len(ops) > 2 || options == "") {
+				return "", nil, false
+			}
+			return field, bson.RegEx{Pattern: pattern, Options: options}, true
+		}
+		for _, op := range []string{"$not", "$regex", "$options", "$near", "$nearSphere"} {
+			if _, found := ops[op]; found {
+				return "", nil, false
+			}
+		}
+		return field, ops, true
+	}
+	return "", nil, false
+}
+
+// operatorDoc returns v as an operator document (i.e.: {$gt:1,$lt:5}) if it is
+// one.
+func operatorDoc(v interface{}) (bson.M, bool) {
+	m, ok := v.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// numberValues returns values with integers too large for an int32 converted
+// into int64, so they match the NumberLong values stored by MongoDB. Other
+// values are left untouched. json.Number values keep all their digits, while
+// float64 values, e.g. the numbers of a parsed predicate, only hold integers
+// exactly up to 2^53: larger ones are converted from their rounded value.
+func numberValues(values []query.Value) []query.Value {
+	var r []query.Value
+	for i, v := range values {
+		n, ok := numberValue(v)
+		if !ok {
+			if r != nil {
+				r[i] = v
+			}
+			continue
+		}
+		if r == nil {
+			r = make([]query.Value, len(values))
+			copy(r, values[:i])
+		}
+		r[i] = n
+	}
+	if r == nil {
+		return values
+	}
+	return r
+}
+
+// numberValue returns the converted value of v and true if v needs to be
+// converted by numberValues.
+func numberValue(v query.Value) (query.Value, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n, true
+		}
+		f, _ := t.Float64()
+		return f, true
+	case float64:
+		// Integral float64 outside of the int32 range but still in the
+		// int64 range.
+		if t == math.Trunc(t) && (t > math.MaxInt32 || t < math.MinInt32) && t >= -(1<<63) && t < 1<<63 {
+			return int64(t), true
+		}
+	}
+	return nil, false
+}
+
 func expToPredicate(exp query.Expression) query.Predicate {
 	switch t := exp.(type) {
 	case query.Predicate:
@@ -1,9 +1,12 @@
 package mongo
 
 import (
+	"encoding/json"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rs/rest-layer/resource"
 	"github.com/rs/rest-layer/schema"
@@ -42,12 +45,35 @@ func TestTranslatePredicateString(t *testing.T) {
 		{`{f:{$lte:1}}`, bson.M{"f": bson.M{"$lte": float64(1)}}},
 		{`{f:{$in:["foo","bar"]}}`, bson.M{"f": bson.M{"$in": []interface{}{"foo", "bar"}}}},
 		{`{f:{$nin:["foo","bar"]}}`, bson.M{"f": bson.M{"$nin": []interface{}{"foo", "bar"}}}},
+		{`{f:{$in:[12345678901,"foo",1]}}`, bson.M{"f": bson.M{"$in": []interface{}{int64(12345678901), "foo", float64(1)}}}},
+		{`{f:{$nin:[1,-12345678901]}}`, bson.M{"f": bson.M{"$nin": []interface{}{float64(1), int64(-12345678901)}}}},
+		{`{age:{$gte:18},age:{$lt:65}}`, bson.M{"age": bson.M{"$gte": float64(18), "$lt": float64(65)}}},
+		{`{f:"foo",f:{$exists:true}}`, bson.M{"f": bson.M{"$eq": "foo", "$exists": true}}},
+		{`{f:{$exists:true},f:{$ne:null}}`, bson.M{"f": bson.M{"$exists": true, "$ne": nil}}},
+		{`{f:{$exists:true},f:"foo"}`, bson.M{"f": bson.M{"$exists": true, "$eq": "foo"}}},
+		{`{f:{$exists:true},f:{$in:["foo","bar"]}}`, bson.M{"f": bson.M{"$exists": true, "$in": []interface{}{"foo", "bar"}}}},
+		{`{f:{$exists:true},f:{$exists:true}}`, bson.M{"f": bson.M{"$exists": true}}},
+		{`{$or:[{f:{$exists:true},f:{$ne:null}},{g:"foo"}]}`, bson.M{"$or": []bson.M{{"f": bson.M{"$exists": true, "$ne": nil}}, {"g": "foo"}}}},
+		{`{$or:[{f:"foo",f:"bar"},{g:"foo"}]}`, bson.M{"$or": []bson.M{{"$and": []bson.M{{"f": "foo"}, {"f": "bar"}}}, {"g": "foo"}}}},
+		{`{f:{$elemMatch:{a:{$exists:true},a:{$ne:null}}}}`, bson.M{"f": bson.M{"$elemMatch": bson.M{"a": bson.M{"$exists": true, "$ne": nil}}}}},
+		{`{f:{$gt:1},f:{$gt:2}}`, bson.M{"f": bson.M{"$gt": float64(1)}, "$and": []bson.M{{"f": bson.M{"$gt": float64(2)}}}}},
+		{`{$or:[{f:"a"},{f:"b"}],$or:[{g:"a"},{g:"b"}]}`, bson.M{
+			"$or":  []bson.M{{"f": "a"}, {"f": "b"}},
+			"$and": []bson.M{{"$or": []bson.M{{"g": "a"}, {"g": "b"}}}},
+		}},
 		{`{f:{$regex:"fo[o]{1}.+is.+some"}}`, bson.M{"f": bson.M{"$regex": "fo[o]{1}.+is.+some"}}},
 		{`{f:{$not:"fo[o]{1}.+is.+some"}}`, bson.M{"f": bson.M{"$not": bson.RegEx{Pattern: "fo[o]{1}.+is.+some"}}}},
+		{`{f:{$regex:"(?i)^foo"}}`, bson.M{"f": bson.M{"$regex": "^foo", "$options": "i"}}},
+		{`{f:{$regex:"(?sm)^foo.bar$"}}`, bson.M{"f": bson.M{"$regex": "^foo.bar$", "$options": "ms"}}},
+		{`{f:{$regex:"(?U)foo+"}}`, bson.M{"f": bson.M{"$regex": "(?U)foo+"}}},
+		{`{f:{$regex:"foo(?i:bar)"}}`, bson.M{"f": bson.M{"$regex": "foo(?i:bar)"}}},
+		{`{f:{$not:"(?i)foo"}}`, bson.M{"f": bson.M{"$not": bson.RegEx{Pattern: "foo", Options: "i"}}}},
 		{`{$and:[{f:"foo"},{f:"bar"}]}`, bson.M{"$and": []bson.M{{"f": "foo"}, {"f": "bar"}}}},
 		{`{$or:[{f:"foo"},{f:"bar"}]}`, bson.M{"$or": []bson.M{{"f": "foo"}, {"f": "bar"}}}},
 		{`{$or:[{f:"foo"},{f:"bar",g:"baz"}]}`, bson.M{"$or": []bson.M{{"f": "foo"}, {"$and": []bson.M{{"f": "bar"}, {"g": "baz"}}}}}},
 		{`{f:{$elemMatch:{a:"foo",b:"bar"}}}`, bson.M{"f": bson.M{"$elemMatch": bson.M{"a": "foo", "b": "bar"}}}},
+		{`{f:{$elemMatch:{a:"foo",b:{$gt:1}}}}`, bson.M{"f": bson.M{"$elemMatch": bson.M{"a": "foo", "b": bson.M{"$gt": float64(1)}}}}},
+		{`{f:{$elemMatch:{a:"foo",b:{$gt:1},b:{$lt:5}}}}`, bson.M{"f": bson.M{"$elemMatch": bson.M{"a": "foo", "b": bson.M{"$gt": float64(1), "$lt": float64(5)}}}}},
 	}
 	for i := range cases {
 		tc := cases[i]
@@ -108,6 +134,300 @@ func TestTranslatePredicate(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "prefix",
+			predicate: query.Predicate{
+				&Prefix{Field: "f", Value: "a.b*(c)?[d]^$|"},
+			},
+			want: bson.M{
+				"f": bson.M{"$regex": `^a\.b\*\(c\)\?\[d\]\^\$\|`},
+			},
+		},
+		{
+			name: "all elem match",
+			predicate: query.Predicate{
+				&AllElemMatch{Field: "items", Exps: [][]query.Expression{
+					{&query.Equal{Field: "a", Value: 1}},
+					{&query.Equal{Field: "b", Value: 2}, &query.GreaterThan{Field: "c", Value: 0}},
+				}},
+			},
+			want: bson.M{
+				"items": bson.M{"$all": []bson.M{
+					{"$elemMatch": bson.M{"a": 1}},
+					{"$elemMatch": bson.M{"b": 2, "c": bson.M{"$gt": 0}}},
+				}},
+			},
+		},
+		{
+			name: "field count",
+			predicate: query.Predicate{
+				&FieldCount{Min: 3},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$gt": []interface{}{
+					bson.M{"$size": bson.M{"$filter": bson.M{
+						"input": bson.M{"$objectToArray": "$$ROOT"},
+						"as":    "f",
+						"cond":  bson.M{"$not": []interface{}{bson.M{"$in": []interface{}{"$$f.k", []string{"_id", "_etag", "_updated", "_created", "_seq", "_lastAccess", "_expireAt"}}}}},
+					}}},
+					3,
+				}},
+			},
+		},
+		{
+			name: "number regex",
+			predicate: query.Predicate{
+				&NumberRegex{Field: "phone", Value: regexp.MustCompile("^555")},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$regexMatch": bson.M{
+					"input": bson.M{"$toString": "$phone"},
+					"regex": "^555",
+				}},
+			},
+		},
+		{
+			name: "all",
+			predicate: query.Predicate{
+				&All{Field: "tags", Values: []query.Value{"a", json.Number("2")}},
+				&query.NotIn{Field: "tags", Values: []query.Value{"c"}},
+			},
+			want: bson.M{
+				"tags": bson.M{"$all": []query.Value{"a", int64(2)}, "$nin": []query.Value{"c"}},
+			},
+		},
+		{
+			name: "date between",
+			predicate: query.Predicate{
+				&DateBetween{
+					Field: "createdAt",
+					Start: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+					End:   time.Date(2023, 1, 31, 23, 59, 59, 0, time.UTC),
+				},
+				&query.NotEqual{Field: "createdAt", Value: nil},
+			},
+			want: bson.M{
+				"createdAt": bson.M{
+					"$gte": time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+					"$lte": time.Date(2023, 1, 31, 23, 59, 59, 0, time.UTC),
+					"$ne":  nil,
+				},
+			},
+		},
+		{
+			name: "modulo",
+			predicate: query.Predicate{
+				&Mod{Field: "shardKey", Divisor: 16, Remainder: 3},
+				&query.Equal{Field: "f", Value: "foo"},
+			},
+			want: bson.M{
+				"shardKey": bson.M{"$mod": []interface{}{int64(16), int64(3)}},
+				"f":        "foo",
+			},
+		},
+		{
+			name: "near",
+			predicate: query.Predicate{
+				&Near{Field: "loc", Point: []float64{2.35, 48.85}, MinDistance: 10, MaxDistance: 5000},
+				&query.Equal{Field: "f", Value: "foo"},
+			},
+			want: bson.M{
+				"loc": bson.M{"$near": bson.M{
+					"$geometry":    bson.M{"type": "Point", "coordinates": []float64{2.35, 48.85}},
+					"$minDistance": 10.0,
+					"$maxDistance": 5000.0,
+				}},
+				"f": "foo",
+			},
+		},
+		{
+			name: "not regex",
+			predicate: query.Predicate{
+				&Not{Exp: &query.Regex{Field: "title", Value: regexp.MustCompile("^draft")}},
+			},
+			want: bson.M{"title": bson.M{"$not": bson.RegEx{Pattern: "^draft"}}},
+		},
+		{
+			name: "not regex with options",
+			predicate: query.Predicate{
+				&Not{Exp: &query.Regex{Field: "title", Value: regexp.MustCompile("(?i)^draft")}},
+			},
+			want: bson.M{"title": bson.M{"$not": bson.RegEx{Pattern: "^draft", Options: "i"}}},
+		},
+		{
+			name: "not greater than",
+			predicate: query.Predicate{
+				&Not{Exp: &query.GreaterThan{Field: "price", Value: 10}},
+				&query.Equal{Field: "f", Value: "foo"},
+			},
+			want: bson.M{
+				"price": bson.M{"$not": bson.M{"$gt": 10}},
+				"f":     "foo",
+			},
+		},
+		{
+			name: "not range",
+			predicate: query.Predicate{
+				&Not{Exp: &query.And{
+					&query.GreaterOrEqual{Field: "price", Value: 10},
+					&query.LowerThan{Field: "price", Value: 20},
+				}},
+			},
+			want: bson.M{"price": bson.M{"$not": bson.M{"$gte": 10, "$lt": 20}}},
+		},
+		{
+			name: "near sphere",
+			predicate: query.Predicate{
+				&NearSphere{Field: "location", Point: []float64{2.35, 48.85}, MinDistance: 100, MaxDistance: 5000},
+			},
+			want: bson.M{
+				"location": bson.M{"$nearSphere": bson.M{
+					"$geometry":    bson.M{"type": "Point", "coordinates": []float64{2.35, 48.85}},
+					"$minDistance": 100.0,
+					"$maxDistance": 5000.0,
+				}},
+			},
+		},
+		{
+			name: "near sphere without distances",
+			predicate: query.Predicate{
+				&NearSphere{Field: "location", Point: []float64{2.35, 48.85}},
+			},
+			want: bson.M{
+				"location": bson.M{"$nearSphere": bson.M{
+					"$geometry": bson.M{"type": "Point", "coordinates": []float64{2.35, 48.85}},
+				}},
+			},
+		},
+		{
+			name: "geo within",
+			predicate: query.Predicate{
+				&GeoWithin{Field: "loc", Polygon: [][]float64{{0, 0}, {1, 0}, {1, 1}}},
+			},
+			want: bson.M{
+				"loc": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+					"type":        "Polygon",
+					"coordinates": [][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}},
+				}}},
+			},
+		},
+		{
+			name: "text search",
+			predicate: query.Predicate{
+				&Text{Search: "red shoes"},
+				&query.Equal{Field: "f", Value: "foo"},
+			},
+			want: bson.M{
+				"$text": bson.M{"$search": "red shoes"},
+				"f":     "foo",
+			},
+		},
+		{
+			name: "text search with options",
+			predicate: query.Predicate{
+				&Text{Search: "chaussures rouges", Language: "french", CaseSensitive: true},
+			},
+			want: bson.M{
+				"$text": bson.M{"$search": "chaussures rouges", "$language": "french", "$caseSensitive": true},
+			},
+		},
+		{
+			name: "date diff",
+			predicate: query.Predicate{
+				&DateDiff{From: "createdAt", To: "resolvedAt", Min: 24 * time.Hour},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$gt": []interface{}{
+					bson.M{"$subtract": []interface{}{"$resolvedAt", "$createdAt"}},
+					int64(86400000),
+				}},
+			},
+		},
+		{
+			name: "updated after",
+			predicate: query.Predicate{
+				UpdatedAfter("lastCheck", time.Minute),
+			},
+			want: bson.M{
+				"$expr": bson.M{"$gt": []interface{}{
+					bson.M{"$subtract": []interface{}{"$_updated", "$lastCheck"}},
+					int64(60000),
+				}},
+			},
+		},
+		{
+			name: "unsorted array",
+			predicate: query.Predicate{
+				&Unsorted{Field: "scores"},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$cond": []interface{}{
+					bson.M{"$isArray": "$scores"},
+					bson.M{"$ne": []interface{}{"$scores", bson.M{"$sortArray": bson.M{"input": "$scores", "sortBy": 1}}}},
+					false,
+				}},
+			},
+		},
+		{
+			name: "size mismatch",
+			predicate: query.Predicate{
+				&SizeMismatch{Field: "items", Other: "quantities"},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$ne": []interface{}{
+					bson.M{"$cond": []interface{}{bson.M{"$isArray": "$items"}, bson.M{"$size": "$items"}, 0}},
+					bson.M{"$cond": []interface{}{bson.M{"$isArray": "$quantities"}, bson.M{"$size": "$quantities"}, 0}},
+				}},
+			},
+		},
+		{
+			name: "field regex",
+			predicate: query.Predicate{
+				&FieldRegex{Field: "text", Pattern: "pattern"},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$cond": []interface{}{
+					bson.M{"$and": []interface{}{
+						bson.M{"$eq": []interface{}{bson.M{"$type": "$text"}, "string"}},
+						bson.M{"$eq": []interface{}{bson.M{"$type": "$pattern"}, "string"}},
+					}},
+					bson.M{"$regexMatch": bson.M{"input": "$text", "regex": "$pattern"}},
+					false,
+				}},
+			},
+		},
+		{
+			name: "elem match count",
+			predicate: query.Predicate{
+				&ElemMatchCount{
+					Field: "comments",
+					Exps: []query.Expression{
+						&query.Equal{Field: "user", Value: "x"},
+						&query.Or{
+							&query.GreaterOrEqual{Field: "votes", Value: 2},
+							&query.Exist{Field: "pinned"},
+						},
+					},
+					Min: 2,
+				},
+			},
+			want: bson.M{
+				"$expr": bson.M{"$gte": []interface{}{
+					bson.M{"$size": bson.M{"$filter": bson.M{
+						"input": bson.M{"$ifNull": []interface{}{"$comments", []interface{}{}}},
+						"as":    "e",
+						"cond": bson.M{"$and": []interface{}{
+							bson.M{"$eq": []interface{}{"$$e.user", "x"}},
+							bson.M{"$or": []interface{}{
+								bson.M{"$gte": []interface{}{"$$e.votes", 2}},
+								bson.M{"$ne": []interface{}{bson.M{"$type": "$$e.pinned"}, "missing"}},
+							}},
+						}},
+					}}},
+					2,
+				}},
+			},
+		},
 		{
 			name: "or expressions",
 			predicate: query.Predicate{
@@ -178,12 +498,87 @@ func TestTranslatePredicateInvalid(t *testing.T) {
 	}
 }
 
+func TestTranslatePredicateInvalidNot(t *testing.T) {
+	cases := []struct {
+		name string
+		exp  query.Expression
+	}{
+		{"equal", &query.Equal{Field: "f", Value: "foo"}},
+		{"negated regex", &query.Regex{Field: "f", Value: regexp.MustCompile("foo"), Negated: true}},
+		{"not", &Not{Exp: &query.GreaterThan{Field: "f", Value: 1}}},
+		{"several fields", &query.And{&query.GreaterThan{Field: "f", Value: 1}, &query.LowerThan{Field: "g", Value: 1}}},
+		{"or", &query.Or{&query.GreaterThan{Field: "f", Value: 1}, &query.LowerThan{Field: "f", Value: 0}}},
+		{"expr", &SizeMismatch{Field: "f", Other: "g"}},
+		{"near", &Near{Field: "loc", Point: []float64{0, 0}}},
+		{"unsupported", UnsupportedExpression{}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := translatePredicate(query.Predicate{&Not{Exp: tc.exp}})
+			if err != resource.ErrNotImplemented {
+				t.Errorf("translatePredicate error: got: %v want: %v", err, resource.ErrNotImplemented)
+			}
+		})
+	}
+}
+
+func TestTranslatePredicateInvalidText(t *testing.T) {
+	text := &Text{Search: "shoes"}
+	cases := []struct {
+		name      string
+		predicate query.Predicate
+		want      string
+	}{
+		{"in or", query.Predicate{&query.Or{text, &query.Equal{Field: "f", Value: "foo"}}}, "$text: not allowed in $or"},
+		{"in elem match", query.Predicate{&query.ElemMatch{Field: "f", Exps: []query.Expression{text}}}, "$text: not allowed in $elemMatch"},
+		{"twice", query.Predicate{text, &query.And{text}}, "$text: only one text search is allowed"},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := translatePredicate(tc.predicate)
+			if err == nil || err.Error() != tc.want {
+				t.Errorf("translatePredicate error: got: %v want: %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslatePredicateInvalidNear(t *testing.T) {
+	near := &Near{Field: "loc", Point: []float64{2.35, 48.85}}
+	cases := []struct {
+		name      string
+		predicate query.Predicate
+		want      string
+	}{
+		{"in or", query.Predicate{&query.Or{near, &query.Equal{Field: "f", Value: "foo"}}}, "$near: not allowed in $or"},
+		{"in elem match", query.Predicate{&query.ElemMatch{Field: "f", Exps: []query.Expression{near}}}, "$near: not allowed in $elemMatch"},
+		{"twice", query.Predicate{near, &query.And{&Near{Field: "home", Point: []float64{0, 0}}}}, "$near: only one proximity search is allowed"},
+		{"with near sphere", query.Predicate{near, &NearSphere{Field: "loc", Point: []float64{0, 0}}}, "$near: only one proximity search is allowed"},
+		{"near sphere in or", query.Predicate{&query.Or{&NearSphere{Field: "loc", Point: []float64{0, 0}}, &query.Equal{Field: "f", Value: "foo"}}}, "$near: not allowed in $or"},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := translatePredicate(tc.predicate)
+			if err == nil || err.Error() != tc.want {
+				t.Errorf("translatePredicate error: got: %v want: %s", err, tc.want)
+			}
+		})
+	}
+}
+
 func TestGetSort(t *testing.T) {
 	var s []string
 	s = getSort(&query.Query{Sort: query.Sort{}})
 	if expect := []string{"_id"}; !reflect.DeepEqual(expect, s) {
 		t.Errorf("expected %v, got %v", expect, s)
 	}
+	s = getSort(&query.Query{Predicate: query.Predicate{&query.And{&Near{Field: "loc", Point: []float64{0, 0}}}}})
+	if s != nil {
+		t.Errorf("expected no sort for $near, got %v", s)
+	}
 	s = getSort(&query.Query{Sort: query.Sort{{Name: "id"}}})
 	if expect := []string{"_id"}; !reflect.DeepEqual(expect, s) {
 		t.Errorf("expected %v, got %v", expect, s)
@@ -201,3 +596,386 @@ func TestGetSort(t *testing.T) {
 		t.Errorf("expected %v, got %v", expect, s)
 	}
 }
+
+func TestGetSortInsertionOrder(t *testing.T) {
+	m := OptionsHandler{opts: Options{InsertionOrder: true}}
+	s := m.getSort(&query.Query{})
+	if expect := []string{"_seq", "_id"}; !reflect.DeepEqual(expect, s) {
+		t.Errorf("expected %v, got %v", expect, s)
+	}
+	s = m.getSort(&query.Query{Sort: query.Sort{{Name: "id"}}})
+	if expect := []string{"_id"}; !reflect.DeepEqual(expect, s) {
+		t.Errorf("expected %v, got %v", expect, s)
+	}
+	s = m.getSort(&query.Query{Predicate: query.Predicate{&Near{Field: "loc", Point: []float64{0, 0}}}})
+	if s != nil {
+		t.Errorf("expected no sort for $near, got %v", s)
+	}
+}
+
+func TestNextSeq(t *testing.T) {
+	prev := nextSeq()
+	for i := 0; i < 1000; i++ {
+		seq := nextSeq()
+		if seq <= prev {
+			t.Fatalf("nextSeq: got %d after %d", seq, prev)
+		}
+		prev = seq
+	}
+}
+
+func TestTranslateQuery(t *testing.T) {
+	queries := []*query.Query{
+		{},
+		{Predicate: query.MustParsePredicate(`{id:"1"}`)},
+		{Predicate: query.MustParsePredicate(`{$or:[{a:{$gt:1}},{b:{$exists:false}}]}`)},
+		{
+			Predicate: query.MustParsePredicate(`{a:{$in:[1,2]},c:{$regex:"^x"}}`),
+			Sort:      query.Sort{{Name: "a", Reversed: true}, {Name: "id"}},
+		},
+	}
+	for _, q := range queries {
+		b, s, err := TranslateQuery(q)
+		if err != nil {
+			t.Fatalf("TranslateQuery(%s): %v", q.Predicate, err)
+		}
+		wantB, err := OptionsHandler{}.getQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b, wantB) {
+			t.Errorf("TranslateQuery(%s) query:\ngot:  %#v\nwant: %#v", q.Predicate, b, wantB)
+		}
+		if wantS := getSort(q); !reflect.DeepEqual(s, wantS) {
+			t.Errorf("TranslateQuery(%s) sort: got: %v want: %v", q.Predicate, s, wantS)
+		}
+	}
+
+	h := OptionsHandler{opts: Options{FlattenSeparator: "__"}}
+	q := &query.Query{
+		Predicate: query.MustParsePredicate(`{"meta.a":1}`),
+		Sort:      query.Sort{{Name: "meta.b"}},
+	}
+	b, s, err := h.TranslateQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"meta__a": 1.0}); !reflect.DeepEqual(b, want) {
+		t.Errorf("OptionsHandler.TranslateQuery query: got: %#v want: %#v", b, want)
+	}
+	if want := []string{"meta__b"}; !reflect.DeepEqual(s, want) {
+		t.Errorf("OptionsHandler.TranslateQuery sort: got: %v want: %v", s, want)
+	}
+
+	if _, _, err := TranslateQuery(&query.Query{Predicate: query.Predicate{&Text{}, &Text{}}}); err == nil {
+		t.Error("TranslateQuery: expected error, got nil")
+	}
+}
+
+func TestGetQueryUpdatedMapping(t *testing.T) {
+	h := OptionsHandler{opts: Options{FieldMapping: FieldMapping{Updated: "modifiedAt"}}}
+	q := &query.Query{Predicate: query.Predicate{
+		&query.Or{UpdatedAfter("lastCheck", time.Minute), &query.Equal{Field: "a", Value: 1}},
+	}}
+	b, err := h.getQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$or": []bson.M{
+		{"$expr": bson.M{"$gt": []interface{}{
+			bson.M{"$subtract": []interface{}{"$modifiedAt", "$lastCheck"}},
+			int64(60000),
+		}}},
+		{"a": 1},
+	}}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("got: %#v\nwant: %#v", b, want)
+	}
+}
+
+func TestGetQueryFlattenExpr(t *testing.T) {
+	h := OptionsHandler{opts: Options{FlattenSeparator: "__"}}
+	cases := []struct {
+		name string
+		exp  query.Expression
+		want bson.M
+	}{
+		{"size mismatch", &query.Or{&SizeMismatch{Field: "a.b", Other: "a.c"}}, bson.M{"$or": []bson.M{
+			{"$expr": bson.M{"$ne": []interface{}{exprSize("$a__b"), exprSize("$a__c")}}},
+		}}},
+		{"number regex", &NumberRegex{Field: "contact.phone", Value: regexp.MustCompile("^555")}, bson.M{
+			"$expr": bson.M{"$regexMatch": bson.M{"input": bson.M{"$toString": "$contact__phone"}, "regex": "^555"}},
+		}},
+		{"date diff", &DateDiff{From: "meta.opened", To: "meta.resolved", Min: time.Second}, bson.M{
+			"$expr": bson.M{"$gt": []interface{}{
+				bson.M{"$subtract": []interface{}{"$meta__resolved", "$meta__opened"}},
+				int64(1000),
+			}},
+		}},
+		{"field regex", &FieldRegex{Field: "doc.text", Pattern: "rule.pattern"}, bson.M{
+			"$expr": bson.M{"$cond": []interface{}{
+				bson.M{"$and": []interface{}{
+					bson.M{"$eq": []interface{}{bson.M{"$type": "$doc__text"}, "string"}},
+					bson.M{"$eq": []interface{}{bson.M{"$type": "$rule__pattern"}, "string"}},
+				}},
+				bson.M{"$regexMatch": bson.M{"input": "$doc__text", "regex": "$rule__pattern"}},
+				false,
+			}},
+		}},
+		{"elem match count", &ElemMatchCount{
+			Field: "post.comments",
+			Exps:  []query.Expression{&query.Equal{Field: "user.name", Value: "x"}},
+			Min:   2,
+		}, bson.M{
+			"$expr": bson.M{"$gte": []interface{}{
+				bson.M{"$size": bson.M{"$filter": bson.M{
+					"input": bson.M{"$ifNull": []interface{}{"$post__comments", []interface{}{}}},
+					"as":    "e",
+					"cond":  bson.M{"$eq": []interface{}{"$$e.user.name", "x"}},
+				}}},
+				2,
+			}},
+		}},
+		{"unsorted", &Unsorted{Field: "stats.scores"}, bson.M{
+			"$expr": bson.M{"$cond": []interface{}{
+				bson.M{"$isArray": "$stats__scores"},
+				bson.M{"$ne": []interface{}{"$stats__scores", bson.M{"$sortArray": bson.M{"input": "$stats__scores", "sortBy": 1}}}},
+				false,
+			}},
+		}},
+		// FieldCount counts the stored top-level keys, it has no path to flatten.
+		{"field count", &FieldCount{Min: 1, meta: []string{"_id"}}, bson.M{
+			"$expr": bson.M{"$gt": []interface{}{
+				bson.M{"$size": bson.M{"$filter": bson.M{
+					"input": bson.M{"$objectToArray": "$$ROOT"},
+					"as":    "f",
+					"cond":  bson.M{"$not": []interface{}{bson.M{"$in": []interface{}{"$$f.k", []string{"_id"}}}}},
+				}}},
+				1,
+			}},
+		}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := h.getQuery(&query.Query{Predicate: query.Predicate{tc.exp}})
+			if err != nil {
+				t.Fatalf("getQuery error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("getQuery:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslateCreated(t *testing.T) {
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	dayID := bson.NewObjectIdWithTime(day)
+	nextID := bson.NewObjectIdWithTime(day.Add(time.Second))
+	cases := []struct {
+		predicate string
+		want      bson.M
+	}{
+		{`{created:{$gt:"2023-01-01"}}`, bson.M{"$and": []bson.M{{"_id": bson.M{"$gte": nextID}}}}},
+		{`{created:{$gte:"2023-01-01T00:00:00Z"}}`, bson.M{"$and": []bson.M{{"_id": bson.M{"$gte": dayID}}}}},
+		{`{created:{$gte:"2023-01-01T00:00:00.5Z"}}`, bson.M{"$and": []bson.M{{"_id": bson.M{"$gte": nextID}}}}},
+		{`{created:{$lt:"2023-01-01"}}`, bson.M{"$and": []bson.M{{"_id": bson.M{"$lt": dayID}}}}},
+		{`{created:{$lte:"2023-01-01"}}`, bson.M{"$and": []bson.M{{"_id": bson.M{"$lt": nextID}}}}},
+		{`{created:"2023-01-01",f:"foo"}`, bson.M{"$and": []bson.M{
+			{"f": "foo"},
+			{"_id": bson.M{"$gte": dayID}},
+			{"_id": bson.M{"$lt": nextID}},
+		}}},
+		{`{$or:[{created:{$gt:"2023-01-01"}},{f:"foo"}]}`, bson.M{"$or": []bson.M{
+			{"_id": bson.M{"$gte": nextID}},
+			{"f": "foo"},
+		}}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			p, err := translateCreated(query.MustParsePredicate(tc.predicate), "created")
+			if err != nil {
+				t.Fatalf("translateCreated error: %v", err)
+			}
+			got, err := translatePredicate(p)
+			if err != nil {
+				t.Fatalf("translatePredicate error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslateCreatedInvalid(t *testing.T) {
+	if _, err := translateCreated(query.MustParsePredicate(`{created:{$gt:"yesterday"}}`), "created"); err == nil {
+		t.Error("expected an error for an invalid time, got nil")
+	}
+	_, err := translateCreated(query.MustParsePredicate(`{created:{$exists:true}}`), "created")
+	if resource.ErrNotImplemented != err {
+		t.Errorf("expected ErrNotImplemented, got %v", err)
+	}
+}
+
+func TestTranslateCreatedNot(t *testing.T) {
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	dayID := bson.NewObjectIdWithTime(day)
+	nextID := bson.NewObjectIdWithTime(day.Add(time.Second))
+	h := OptionsHandler{opts: Options{CreatedField: "created"}}
+	cases := []struct {
+		name string
+		exp  query.Expression
+		want bson.M
+	}{
+		{"comparison", &Not{Exp: &query.GreaterThan{Field: "created", Value: "2023-01-01"}},
+			bson.M{"$and": []bson.M{{"_id": bson.M{"$lt": nextID}}}}},
+		{"equality", &Not{Exp: &query.Equal{Field: "created", Value: "2023-01-01"}},
+			bson.M{"$and": []bson.M{{"$or": []bson.M{
+				{"_id": bson.M{"$lt": dayID}},
+				{"_id": bson.M{"$gte": nextID}},
+			}}}}},
+		{"nested", &query.Or{
+			&Not{Exp: &query.LowerOrEqual{Field: "created", Value: "2023-01-01"}},
+			&query.Equal{Field: "f", Value: "foo"},
+		}, bson.M{"$or": []bson.M{
+			{"_id": bson.M{"$gte": nextID}},
+			{"f": "foo"},
+		}}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := h.getQuery(&query.Query{Predicate: query.Predicate{tc.exp}})
+			if err != nil {
+				t.Fatalf("getQuery error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("getQuery:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	s := schema.Schema{
+		Fields: schema.Fields{
+			"id":   {},
+			"name": {},
+			"meta": {Schema: &schema.Schema{Fields: schema.Fields{"title": {}}}},
+			"arr": {Validator: &schema.Array{Values: schema.Field{Validator: &schema.Object{
+				Schema: &schema.Schema{Fields: schema.Fields{"a": {}}},
+			}}}},
+		},
+	}
+	cases := []struct {
+		predicate string
+		err       string
+	}{
+		{`{id:"foo",name:"bar"}`, ""},
+		{`{"meta.title":"foo"}`, ""},
+		{`{$or:[{name:"foo"},{$and:[{id:"bar"}]}]}`, ""},
+		{`{arr:{$elemMatch:{a:"foo"}}}`, ""},
+		{`{created:{$gt:"2023-01-01"}}`, ""},
+		{`{nmae:"foo"}`, "nmae: unknown query field"},
+		{`{"meta.titel":"foo"}`, "meta.titel: unknown query field"},
+		{`{$or:[{name:"foo"},{$and:[{nmae:"bar"}]}]}`, "nmae: unknown query field"},
+		{`{arr:{$elemMatch:{b:"foo"}}}`, "arr.b: unknown query field"},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			err := validateFields(query.MustParsePredicate(tc.predicate), s, "created")
+			if tc.err == "" && err != nil {
+				t.Errorf("validateFields unexpected error: %v", err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("validateFields error:\ngot:  %v\nwant: %s", err, tc.err)
+			}
+		})
+	}
+
+	if err := validateFields(query.Predicate{UpdatedAfter("name", time.Hour)}, s); err != nil {
+		t.Errorf("validateFields unexpected error: %v", err)
+	}
+	if err := validateFields(query.Predicate{UpdatedAfter("nmae", time.Hour)}, s); err == nil || err.Error() != "nmae: unknown query field" {
+		t.Errorf("validateFields error:\ngot:  %v\nwant: nmae: unknown query field", err)
+	}
+}
+
+func TestMergeCondition(t *testing.T) {
+	cases := []struct {
+		name string
+		b    bson.M
+		f    string
+		v    interface{}
+		want bson.M
+	}{
+		{"new field", bson.M{"a": 1}, "b", 2, bson.M{"a": 1, "b": 2}},
+		{"operators", bson.M{"a": bson.M{"$gt": 1}}, "a", bson.M{"$lt": 5}, bson.M{"a": bson.M{"$gt": 1, "$lt": 5}}},
+		{"equality and operator", bson.M{"a": "x"}, "a", bson.M{"$exists": true}, bson.M{"a": bson.M{"$eq": "x", "$exists": true}}},
+		{"same equality", bson.M{"a": "x"}, "a", "x", bson.M{"a": "x"}},
+		{"conflicting equality", bson.M{"a": "x"}, "a", "y", bson.M{"a": "x", "$and": []bson.M{{"a": "y"}}}},
+		{"conflicting operators", bson.M{"a": bson.M{"$gt": 1}}, "a", bson.M{"$gt": 2, "$lt": 5},
+			bson.M{"a": bson.M{"$gt": 1}, "$and": []bson.M{{"a": bson.M{"$gt": 2, "$lt": 5}}}}},
+		{"and clauses", bson.M{"$and": []bson.M{{"a": 1}}}, "$and", []bson.M{{"b": 2}}, bson.M{"$and": []bson.M{{"a": 1}, {"b": 2}}}},
+		{"or clauses", bson.M{"$or": []bson.M{{"a": 1}}}, "$or", []bson.M{{"b": 2}},
+			bson.M{"$or": []bson.M{{"a": 1}}, "$and": []bson.M{{"$or": []bson.M{{"b": 2}}}}}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			mergeCondition(tc.b, tc.f, tc.v)
+			if !reflect.DeepEqual(tc.b, tc.want) {
+				t.Errorf("mergeCondition:\ngot:  %#v\nwant: %#v", tc.b, tc.want)
+			}
+		})
+	}
+}
+
+func TestNumberValues(t *testing.T) {
+	// 2^53+1 is rounded to 2^53 as a float64.
+	values := []query.Value{json.Number("9007199254740993"), json.Number("1.5"), float64(1e10), float64(9007199254740993), 1.5e10 + 0.5, "foo", []interface{}{1}}
+	want := []query.Value{int64(9007199254740993), float64(1.5), int64(1e10), int64(9007199254740992), 1.5e10 + 0.5, "foo", []interface{}{1}}
+	if got := numberValues(values); !reflect.DeepEqual(got, want) {
+		t.Errorf("numberValues:\ngot:  %#v\nwant: %#v", got, want)
+	}
+	if _, ok := values[0].(json.Number); !ok {
+		t.Error("numberValues modified its input")
+	}
+}
+
+func TestCreatedBetween(t *testing.T) {
+	from := time.Date(2023, 1, 2, 3, 4, 5, 500000000, time.UTC)
+	to := time.Date(2023, 1, 2, 4, 0, 0, 0, time.UTC)
+	got, err := translatePredicate(query.Predicate{CreatedBetween(from, to)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$and": []bson.M{
+		{"_id": bson.M{"$gte": bson.NewObjectIdWithTime(from.Truncate(time.Second).Add(time.Second))}},
+		{"_id": bson.M{"$lt": bson.NewObjectIdWithTime(to)}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestRenameQueryFields(t *testing.T) {
+	b := bson.M{
+		"a.b": 1,
+		"_id": "x",
+		"$or": []bson.M{{"c.d": bson.M{"$gt": 1}}, {"e": bson.M{"$elemMatch": bson.M{"f.g": 1}}}},
+	}
+	got := renameQueryFields(b, func(f string) string { return strings.Replace(f, ".", "__", -1) })
+	want := bson.M{
+		"a__b": 1,
+		"_id":  "x",
+		"$or":  []bson.M{{"c__d": bson.M{"$gt": 1}}, {"e": bson.M{"$elemMatch": bson.M{"f.g": 1}}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renameQueryFields:\ngot:  %#v\nwant: %#v", got, want)
+	}
+}
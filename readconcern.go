@@ -0,0 +1,123 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Read concern levels, see Options.ReadConcern.
+const (
+	ReadConcernLocal        = "local"
+	ReadConcernAvailable    = "available"
+	ReadConcernMajority     = "majority"
+	ReadConcernLinearizable = "linearizable"
+)
+
+// ErrEventualMode is returned by the reads run as commands, like Aggregate or
+// the reads of handlers with a ReadConcern, when the session is in
+// mgo.Eventual mode, in which mgo can't iterate over the cursor of a command.
+var ErrEventualMode = errors.New("mongo: command cursors can't be read in mgo.Eventual mode")
+
+// cursorResult is the result of a command returning a cursor.
+type cursorResult struct {
+	Cursor struct {
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		ID         int64      `bson:"id"`
+	} `bson:"cursor"`
+}
+
+// withReadConcern appends the read concern of the handler to the command cmd,
+// if any.
+func (m OptionsHandler) withReadConcern(cmd bson.D) bson.D {
+	if m.opts.ReadConcern == "" {
+		return cmd
+	}
+	return append(cmd, bson.DocElem{Name: "readConcern", Value: bson.M{"level": m.opts.ReadConcern}})
+}
+
+// maxTimeMS returns the maxTimeMS of a command bounded by the deadline of ctx,
+// if any.
+func maxTimeMS(ctx context.Context) (int64, bool) {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	ms := int64(time.Until(dl) / time.Millisecond)
+	if ms < 1 {
+		// 0 would disable the limit
+		ms = 1
+	}
+	return ms, true
+}
+
+// findCommand returns an iterator over the items of c matching qry, sorted by
+// srt, restricted to the fields selected by sel if not nil, and windowed by w.
+// The find command is run directly as mgo can't set its read concern.
+func (m OptionsHandler) findCommand(ctx context.Context, c *mgo.Collection, qry bson.M, srt []string, sel bson.M, w *query.Window) (*mgo.Iter, error) {
+	if c.Database.Session.Mode() == mgo.Eventual {
+		return nil, ErrEventualMode
+	}
+	cmd := bson.D{{Name: "find", Value: c.Name}, {Name: "filter", Value: qry}}
+	if len(srt) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "sort", Value: sortDoc(srt)})
+	}
+	if sel != nil {
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: sel})
+	}
+	if w != nil {
+		if w.Offset > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "skip", Value: w.Offset})
+		}
+		if w.Limit > -1 {
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: w.Limit})
+		}
+	}
+	if ms, ok := maxTimeMS(ctx); ok {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: ms})
+	}
+	var res cursorResult
+	err := c.Database.Run(m.withReadConcern(cmd), &res)
+	return c.NewIter(nil, res.Cursor.FirstBatch, res.Cursor.ID, err), nil
+}
+
+// aggregateCommand returns an iterator over the documents returned by the
+// aggregation pipeline run on c, allowed to use the disk with DiskLargeSorts.
+// The aggregate command is run directly as mgo can't set its read concern.
+func (m OptionsHandler) aggregateCommand(ctx context.Context, c *mgo.Collection, pipeline []bson.M) (*mgo.Iter, error) {
+	if c.Database.Session.Mode() == mgo.Eventual {
+		return nil, ErrEventualMode
+	}
+	cmd := bson.D{
+		{Name: "aggregate", Value: c.Name},
+		{Name: "pipeline", Value: pipeline},
+		{Name: "cursor", Value: bson.M{}},
+	}
+	if m.opts.LargeSorts == DiskLargeSorts {
+		cmd = append(cmd, bson.DocElem{Name: "allowDiskUse", Value: true})
+	}
+	if ms, ok := maxTimeMS(ctx); ok {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: ms})
+	}
+	var res cursorResult
+	err := c.Database.Run(m.withReadConcern(cmd), &res)
+	return c.NewIter(nil, res.Cursor.FirstBatch, res.Cursor.ID, err), nil
+}
+
+// countCommand returns the number of items of c matching qry. The count
+// command is run directly as mgo can't set its read concern.
+func (m OptionsHandler) countCommand(ctx context.Context, c *mgo.Collection, qry bson.M) (int, error) {
+	cmd := bson.D{{Name: "count", Value: c.Name}, {Name: "query", Value: qry}}
+	if ms, ok := maxTimeMS(ctx); ok {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: ms})
+	}
+	var res struct {
+		N int `bson:"n"`
+	}
+	err := c.Database.Run(m.withReadConcern(cmd), &res)
+	return res.N, err
+}
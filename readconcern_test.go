@@ -0,0 +1,92 @@
+package mongo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	mongo "github.com/rs/rest-layer-mongo"
+)
+
+func TestReadConcern(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ReadConcern: mongo.ReadConcernMajority})
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "foo": "baz"}},
+		{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3", "foo": "bar"}},
+	}
+	if err := h.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &query.Query{
+		Predicate: query.Predicate{&query.Equal{Field: "foo", Value: "bar"}},
+		Sort:      query.MustParseSort("-id"),
+		Window:    &query.Window{Limit: 1},
+	}
+	l, err := h.Find(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "3" {
+		t.Errorf("got: %v want: item 3", l.Items)
+	}
+	l, err = h.FindWithProjection(ctx, q, mongo.Projection{Size: map[string]string{"n": "tags"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "3" || l.Items[0].Payload["n"] != 0 {
+		t.Errorf("got: %v want: item 3 with n 0", l.Items)
+	}
+	if n, err := h.Count(ctx, q); err != nil || n != 2 {
+		t.Errorf("got count: %d, %v want: 2", n, err)
+	}
+	docs, err := h.Aggregate(ctx, []bson.M{{"$match": bson.M{"foo": "baz"}}})
+	if err != nil || len(docs) != 1 || docs[0]["_id"] != "2" {
+		t.Errorf("got docs: %v, %v want: item 2", docs, err)
+	}
+
+	// The server rejects unknown levels, which shows the read concern is sent.
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ReadConcern: "unknown"})
+	if _, err := h.Find(ctx, q); err == nil {
+		t.Error("Find: expected an error for an unknown read concern level, got nil")
+	}
+	if _, err := h.Count(ctx, q); err == nil {
+		t.Error("Count: expected an error for an unknown read concern level, got nil")
+	}
+	if _, _, err := h.ChangedSince(ctx, mongo.ChangeCursor{}, 0); err == nil {
+		t.Error("ChangedSince: expected an error for an unknown read concern level, got nil")
+	}
+	if _, err := h.Aggregate(ctx, []bson.M{{"$match": bson.M{}}}); err == nil {
+		t.Error("Aggregate: expected an error for an unknown read concern level, got nil")
+	}
+	// Finds split into batches or aggregated for their total also send it.
+	inq := &query.Query{Predicate: query.MustParsePredicate(`{id:{$in:["1","2","3"]}}`)}
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ReadConcern: "unknown", InBatchSize: 2})
+	if _, err := h.Find(ctx, inq); err == nil {
+		t.Error("Find in batches: expected an error for an unknown read concern level, got nil")
+	}
+	h = mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{ReadConcern: "unknown", ConsistentTotal: true})
+	if _, err := h.Find(ctx, q); err == nil {
+		t.Error("Find with total: expected an error for an unknown read concern level, got nil")
+	}
+
+	// Command cursors can't be read in eventual mode.
+	es := s.Copy()
+	defer es.Close()
+	es.SetMode(mgo.Eventual, true)
+	h = mongo.NewHandlerWithOptions(es, "", "test", mongo.Options{ReadConcern: mongo.ReadConcernMajority})
+	if _, err := h.Find(ctx, q); err != mongo.ErrEventualMode {
+		t.Errorf("Find: got: %v want: %v", err, mongo.ErrEventualMode)
+	}
+	if _, err := h.Aggregate(ctx, []bson.M{{"$match": bson.M{}}}); err != mongo.ErrEventualMode {
+		t.Errorf("Aggregate: got: %v want: %v", err, mongo.ErrEventualMode)
+	}
+}
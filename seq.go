@@ -0,0 +1,29 @@
+package mongo
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// seqField is the field holding the sequence number of items when the handler
+// is configured with InsertionOrder.
+const seqField = "_seq"
+
+// lastSeq is the last sequence number returned by nextSeq.
+var lastSeq int64
+
+// nextSeq returns a sequence number greater than all the previous ones of the
+// process, derived from the current time in nanoseconds so that numbers
+// generated by different processes roughly follow the order of insertion.
+func nextSeq() int64 {
+	for {
+		last := atomic.LoadInt64(&lastSeq)
+		seq := time.Now().UnixNano()
+		if seq <= last {
+			seq = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastSeq, last, seq) {
+			return seq
+		}
+	}
+}
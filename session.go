@@ -0,0 +1,41 @@
+package mongo
+
+import (
+	"context"
+	"net/http"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx in which s is pinned. All the operations
+// performed by handlers with this context then reuse s instead of a session
+// from the pool. With s in mgo.Strong mode, all these operations are sent to
+// the primary using the same connection, so reads see previous writes.
+//
+// The session must be connected to the same cluster as the handlers' sessions
+// and is not closed by the handlers.
+func WithSession(ctx context.Context, s *mgo.Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+func sessionFromContext(ctx context.Context) *mgo.Session {
+	s, _ := ctx.Value(sessionKey{}).(*mgo.Session)
+	return s
+}
+
+// Middleware returns an HTTP middleware pinning a copy of s in mgo.Strong
+// mode to the context of each request, so the operations of a request (e.g.
+// the creation of an item and the read of the created item) give consistent
+// results on replica sets. The copy is closed once the request is served.
+func Middleware(s *mgo.Session) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rs := s.Copy()
+			defer rs.Close()
+			rs.SetMode(mgo.Strong, true)
+			next.ServeHTTP(w, r.WithContext(WithSession(r.Context(), rs)))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package mongo_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestMiddleware(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+
+	var l *resource.ItemList
+	var err error
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := []*resource.Item{{ID: "1", Payload: map[string]interface{}{"id": "1"}}}
+		if err = h.Insert(r.Context(), items); err != nil {
+			return
+		}
+		l, err = h.Find(r.Context(), &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+	})
+	mongo.Middleware(s)(api).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Items) != 1 || l.Items[0].ID != "1" {
+		t.Errorf("got: %v want: [1]", l.Items)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{SessionPoolSize: 2})
+	defer h.Close()
+	if err := h.Insert(context.Background(), []*resource.Item{{ID: "1", Payload: map[string]interface{}{"id": "1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// More concurrent operations than pooled sessions.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := h.Count(context.Background(), &query.Query{})
+			if err != nil || n != 1 {
+				t.Errorf("got: %d, %v want: 1, nil", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Pooled sessions are reused after an operation interrupted by its
+	// deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	time.Sleep(2 * time.Millisecond)
+	if _, err := h.Find(ctx, &query.Query{}); err == nil {
+		t.Error("expected an error for an expired deadline, got nil")
+	}
+	for i := 0; i < 3; i++ {
+		if l, err := h.Find(context.Background(), &query.Query{}); err != nil || len(l.Items) != 1 {
+			t.Fatalf("got: %v, %v want: 1 item", l, err)
+		}
+	}
+
+	// Operations of a closed handler fail, even with pooled sessions.
+	h.Close()
+	if _, err := h.Count(context.Background(), &query.Query{}); err != mongo.ErrHandlerClosed {
+		t.Errorf("got: %v want: %v", err, mongo.ErrHandlerClosed)
+	}
+}
+
+func BenchmarkSessionPool(b *testing.B) {
+	s, cleanup := setupDBTest(b)
+	defer cleanup()
+	items := make([]*resource.Item, 10)
+	for i := range items {
+		id := strconv.Itoa(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id}}
+	}
+	if err := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{}).Insert(context.Background(), items); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{0, 8} {
+		b.Run("size="+strconv.Itoa(size), func(b *testing.B) {
+			h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{SessionPoolSize: size})
+			defer h.Close()
+			q := &query.Query{Window: &query.Window{Limit: 1}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := h.Find(context.Background(), q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// FindInSubquery returns the items matching q whose field holds the id of one
+// of the items of target matching sub, e.g. the posts whose user is an admin
+// when target manages the users. The window of sub, if any, selects the ids
+// in the order of sub.
+//
+// The ids are resolved in memory before querying the items of m, so sub
+// should not match millions of items. The resulting $in condition is split
+// into queries of at most InBatchSize ids like any other by Find. The ids
+// allowed by WithAllowedIDs in ctx restrict the items of m only, not those of
+// target.
+func (m OptionsHandler) FindInSubquery(ctx context.Context, q *query.Query, field string, target OptionsHandler, sub *query.Query) (*resource.ItemList, error) {
+	ids, err := target.subqueryIDs(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	jq := *q
+	jq.Predicate = append(query.Predicate{&query.In{Field: field, Values: ids}}, q.Predicate...)
+	return m.Find(ctx, &jq)
+}
+
+// subqueryIDs returns the ids of the items matching q, as returned to
+// clients.
+func (m OptionsHandler) subqueryIDs(ctx context.Context, q *query.Query) (_ []query.Value, err error) {
+	defer func() { err = classifyError(err) }()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	mq := c.Find(qry)
+	if q.Window != nil {
+		mq = m.windowQuery(c, qry, q)
+	}
+	ids, err := selectIDs(ctx, mq)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]query.Value, len(ids))
+	for i, id := range ids {
+		if m.customIDs() {
+			id = m.itemID(id)
+		}
+		values[i] = id
+	}
+	return values, nil
+}
@@ -0,0 +1,88 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestFindInSubquery(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	ctx := context.Background()
+	users := mongo.NewHandlerWithOptions(s, "", "users", mongo.Options{})
+	// Split the $in condition on user ids to exercise batching.
+	posts := mongo.NewHandlerWithOptions(s, "", "posts", mongo.Options{InBatchSize: 2})
+
+	var items []*resource.Item
+	for i := 0; i < 6; i++ {
+		id := "u" + strconv.Itoa(i)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{"id": id, "admin": i%2 == 0}})
+	}
+	if err := users.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	items = nil
+	for i := 0; i < 12; i++ {
+		id := "p" + strconv.Itoa(10+i)
+		items = append(items, &resource.Item{ID: id, ETag: "a", Payload: map[string]interface{}{
+			"id":        id,
+			"user":      "u" + strconv.Itoa(i%6),
+			"published": i < 6,
+		}})
+	}
+	if err := posts.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+
+	admins := &query.Query{Predicate: query.Predicate{&query.Equal{Field: "admin", Value: true}}}
+	ids := func(l *resource.ItemList) []interface{} {
+		var ids []interface{}
+		for _, item := range l.Items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+	cases := []struct {
+		name string
+		q    *query.Query
+		sub  *query.Query
+		want []interface{}
+	}{
+		{"admins", &query.Query{}, admins, []interface{}{"p10", "p12", "p14", "p16", "p18", "p20"}},
+		{"published", &query.Query{Predicate: query.Predicate{&query.Equal{Field: "published", Value: true}}}, admins, []interface{}{"p10", "p12", "p14"}},
+		{"sub window", &query.Query{Sort: query.MustParseSort("-id")}, &query.Query{
+			Predicate: admins.Predicate,
+			Sort:      query.MustParseSort("-id"),
+			Window:    &query.Window{Limit: 1},
+		}, []interface{}{"p20", "p14"}},
+		{"no match", &query.Query{}, &query.Query{Predicate: query.Predicate{&query.Equal{Field: "admin", Value: "x"}}}, nil},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := posts.FindInSubquery(ctx, tc.q, "user", users, tc.sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(l); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+
+	// Allowed ids restrict the posts, not the users.
+	actx := mongo.WithAllowedIDs(ctx, []interface{}{"p12", "p13"})
+	l, err := posts.FindInSubquery(actx, &query.Query{}, "user", users, admins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(l), []interface{}{"p12"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed ids: got: %v want: %v", got, want)
+	}
+}
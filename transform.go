@@ -0,0 +1,131 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// FieldTransform defines how the values of a payload field are transformed
+// when stored and read, e.g. to hash a password before storage and never
+// return it. Null values are never transformed.
+type FieldTransform struct {
+	// Write, when set, returns the value stored in place of v.
+	Write func(v interface{}) (interface{}, error)
+	// Read, when set, returns the value read in place of the stored value v,
+	// or false to remove the field from the payload (see Redact).
+	Read func(v interface{}) (interface{}, bool)
+}
+
+// Redact is a FieldTransform Read function removing the field from read
+// payloads.
+func Redact(v interface{}) (interface{}, bool) {
+	return nil, false
+}
+
+// writeTransforms replaces the values of the transformed fields of p by the
+// value to store. Fields may be nested or, like in PartialUpdate changes,
+// given as dotted keys.
+func (m OptionsHandler) writeTransforms(p map[string]interface{}) error {
+	for f, t := range m.opts.Transforms {
+		if t.Write == nil {
+			continue
+		}
+		v, dotted := p[f]
+		if !dotted {
+			v, _ = getPath(p, f)
+		}
+		if v == nil {
+			continue
+		}
+		v, err := t.Write(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+		if dotted {
+			p[f] = v
+		} else {
+			setPath(p, f, v)
+		}
+	}
+	return nil
+}
+
+// transformedValues returns the values of the transformed fields found in p,
+// before they are transformed.
+func (m OptionsHandler) transformedValues(p map[string]interface{}) map[string]interface{} {
+	if len(m.opts.Transforms) == 0 {
+		return nil
+	}
+	vs := map[string]interface{}{}
+	for f := range m.opts.Transforms {
+		if v, found := getPath(p, f); found {
+			vs[f] = v
+		}
+	}
+	return vs
+}
+
+// storedPath returns the path of the payload field f in stored documents,
+// which is a top-level key when documents are flattened.
+func (m OptionsHandler) storedPath(f string) string {
+	if sep := m.opts.FlattenSeparator; sep != "" {
+		return strings.Replace(f, ".", sep, -1)
+	}
+	return f
+}
+
+// storedValue returns the value at the path given by storedPath in the stored
+// document d.
+func (m OptionsHandler) storedValue(d map[string]interface{}, path string) (interface{}, bool) {
+	if m.opts.FlattenSeparator != "" {
+		v, found := d[path]
+		return v, found
+	}
+	return getPath(d, path)
+}
+
+// setStoredValue sets the value at the path given by storedPath in the stored
+// document d.
+func (m OptionsHandler) setStoredValue(d map[string]interface{}, path string, v interface{}) {
+	if m.opts.FlattenSeparator != "" {
+		d[path] = v
+		return
+	}
+	setPath(d, path, v)
+}
+
+// readTransforms replaces the stored values of the transformed fields of p by
+// the value to return, or removes them.
+func (m OptionsHandler) readTransforms(p map[string]interface{}) {
+	for f, t := range m.opts.Transforms {
+		if t.Read == nil {
+			continue
+		}
+		v, found := getPath(p, f)
+		if !found || v == nil {
+			continue
+		}
+		if v, ok := t.Read(v); ok {
+			setPath(p, f, v)
+		} else {
+			deletePath(p, f)
+		}
+	}
+}
+
+// transformValue converts query values compared with a transformed field into
+// the value stored for them, so filters on deterministic transformations,
+// like an unsalted hash, still match.
+func (m OptionsHandler) transformValue(field string, v query.Value) (query.Value, error) {
+	t, found := m.opts.Transforms[field]
+	if !found || t.Write == nil || v == nil {
+		return v, nil
+	}
+	v, err := t.Write(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", field, err)
+	}
+	return v, nil
+}
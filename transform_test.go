@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func hash(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:]), nil
+}
+
+func TestTransforms(t *testing.T) {
+	m := OptionsHandler{opts: Options{Transforms: map[string]FieldTransform{
+		"password":    {Write: hash, Read: Redact},
+		"meta.secret": {Write: hash, Read: func(v interface{}) (interface{}, bool) { return fmt.Sprintf("<%d chars>", len(v.(string))), true }},
+	}}}
+	h, _ := hash("pass")
+
+	p := map[string]interface{}{"name": "a", "password": "pass", "meta": map[string]interface{}{"secret": nil}}
+	if err := m.writeTransforms(p); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"name": "a", "password": h, "meta": map[string]interface{}{"secret": nil}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("writeTransforms:\ngot:  %#v\nwant: %#v", p, want)
+	}
+
+	changes := map[string]interface{}{"meta.secret": "pass"}
+	if err := m.writeTransforms(changes); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"meta.secret": h}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("writeTransforms:\ngot:  %#v\nwant: %#v", changes, want)
+	}
+
+	if err := m.writeTransforms(map[string]interface{}{"password": 1}); err == nil || err.Error() != "password: not a string" {
+		t.Errorf("writeTransforms: got: %v want: password: not a string", err)
+	}
+
+	p = map[string]interface{}{"name": "a", "password": h, "meta": map[string]interface{}{"secret": h}}
+	m.readTransforms(p)
+	want = map[string]interface{}{"name": "a", "meta": map[string]interface{}{"secret": "<64 chars>"}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("readTransforms:\ngot:  %#v\nwant: %#v", p, want)
+	}
+
+	b, err := m.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{name:"pass",password:"pass"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"name": "pass", "password": h}); !reflect.DeepEqual(b, want) {
+		t.Errorf("getQuery:\ngot:  %#v\nwant: %#v", b, want)
+	}
+}
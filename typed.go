@@ -0,0 +1,84 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// FindInto decodes the items matching q directly into result, which must be a
+// pointer to a slice of structs or of pointers to structs, bypassing the
+// payload map of resource.Item. Fields are mapped using bson struct tags, so
+// the id, etag and update time of the items can be retrieved with the "_id",
+// "_etag" and "_updated" tags, or the names set by the FieldMapping option.
+//
+// Values are decoded as stored: the Options converting the payload, such as
+// DateFields, DecimalFields or ExpireField, are not applied. FindInto is not
+// supported with a FlattenSeparator.
+func (m OptionsHandler) FindInto(ctx context.Context, q *query.Query, result interface{}) (err error) {
+	defer func() { err = classifyError(err) }()
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("find into: result must be a pointer to a slice")
+	}
+	et := rv.Elem().Type().Elem()
+	if et.Kind() != reflect.Struct && (et.Kind() != reflect.Ptr || et.Elem().Kind() != reflect.Struct) {
+		return errors.New("find into: result must be a slice of structs or struct pointers")
+	}
+	if m.opts.FlattenSeparator != "" {
+		return errors.New("find into: flattened storage is not supported")
+	}
+	slice := reflect.MakeSlice(rv.Elem().Type(), 0, 0)
+	if q.Window != nil && q.Window.Limit == 0 {
+		rv.Elem().Set(slice)
+		return nil
+	}
+
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return err
+	}
+	qry, _ = m.restrictQuery(ctx, qry)
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+
+	mq := c.Find(qry).Sort(m.getSort(q)...)
+	if q.Window != nil {
+		mq = applyWindow(mq, *q.Window)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		dur := time.Until(dl)
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	iter := mq.Iter()
+	for {
+		elem := reflect.New(et)
+		if et.Kind() == reflect.Ptr {
+			elem.Elem().Set(reflect.New(et.Elem()))
+		}
+		if !iter.Next(elem.Interface()) {
+			break
+		}
+		// Check if context is still ok and the handler not closed before to
+		// continue
+		if err = m.err(ctx); err != nil {
+			iter.Close()
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
@@ -0,0 +1,70 @@
+package mongo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mongo "github.com/rs/rest-layer-mongo"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+type typedItem struct {
+	ID      string    `bson:"_id"`
+	ETag    string    `bson:"_etag"`
+	Updated time.Time `bson:"_updated"`
+	Name    string    `bson:"name"`
+	Age     int       `bson:"age"`
+}
+
+func TestFindInto(t *testing.T) {
+	s, cleanup := setupDBTest(t)
+	defer cleanup()
+	h := mongo.NewHandlerWithOptions(s, "", "test", mongo.Options{})
+	now := time.Now().Truncate(time.Millisecond)
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "name": "foo", "age": 30}},
+		{ID: "2", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "2", "name": "bar", "age": 20}},
+		{ID: "3", ETag: "c", Updated: now, Payload: map[string]interface{}{"id": "3", "name": "baz", "age": 10}},
+	}
+	if err := h.Insert(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &query.Query{
+		Predicate: query.MustParsePredicate(`{age:{$gte:20}}`),
+		Sort:      query.MustParseSort("age"),
+	}
+	var got []typedItem
+	if err := h.FindInto(context.Background(), q, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got: %d items want: 2", len(got))
+	}
+	if got[0].ID != "2" || got[0].ETag != "b" || got[0].Name != "bar" || got[0].Age != 20 || !got[0].Updated.Equal(now) {
+		t.Errorf("got: %#v", got[0])
+	}
+	if got[1].ID != "1" || got[1].ETag != "a" || got[1].Name != "foo" || got[1].Age != 30 {
+		t.Errorf("got: %#v", got[1])
+	}
+
+	var ptrs []*typedItem
+	if err := h.FindInto(context.Background(), &query.Query{Window: &query.Window{Limit: 1}}, &ptrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 1 {
+		t.Errorf("got: %d items want: 1", len(ptrs))
+	}
+}
+
+func TestFindIntoInvalidResult(t *testing.T) {
+	h := mongo.NewHandlerWithOptions(nil, "", "test", mongo.Options{})
+	var items []typedItem
+	for _, result := range []interface{}{items, &[]string{}, typedItem{}} {
+		if err := h.FindInto(context.Background(), &query.Query{}, result); err == nil {
+			t.Errorf("FindInto(%T): expected error", result)
+		}
+	}
+}